@@ -1,18 +1,35 @@
 package blob
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"gophercon-2023-demo/identity"
 
 	cid "github.com/ipfs/go-cid"
 )
 
+var (
+	// ErrInvalidCID is returned if the requested content identifier is malformed.
+	ErrInvalidCID = errors.New("invalid cid")
+
+	// ErrBlobNotFound is returned if the PDS does not hold the requested blob.
+	ErrBlobNotFound = errors.New("blob not found")
+
+	// ErrPDSFailure is returned if the PDS failed to serve the blob for any other
+	// reason than it missing.
+	ErrPDSFailure = errors.New("pds failure")
+)
+
 type Blob struct {
 	Cid         cid.Cid    `json:"-"`
 	Size        int        `json:"size"`
@@ -27,73 +44,122 @@ type BlobSource struct {
 	Url string `json:"url"`
 }
 
-func RetrieveBlob(dir string, did string, cidStr string) (Blob, error) {
+const (
+	// defaultTimeout is the HTTP timeout of the default blob fetching client.
+	defaultTimeout = 30 * time.Second
+
+	// maxBlobBytes is the maximum size of a blob to accept from a PDS, protecting
+	// against malicious endpoints streaming garbage forever.
+	maxBlobBytes = 32 * 1024 * 1024
+)
+
+// Fetcher retrieves blobs from the PDS hosting a repository, caching them on the
+// local filesystem. The zero value is usable, but does not cache resolved DIDs;
+// use NewFetcher for sane defaults.
+type Fetcher struct {
+	Dir        string             // Directory to cache the blobs in
+	Resolver   *identity.Resolver // Resolver to find the PDS with (nil = uncached)
+	HTTPClient *http.Client       // Client to fetch the blobs with (nil = 30s timeout)
+}
+
+// NewFetcher creates a blob fetcher caching into the given directory, resolving
+// the repositories via a caching resolver.
+func NewFetcher(dir string) *Fetcher {
+	return &Fetcher{
+		Dir:        dir,
+		Resolver:   identity.NewResolver(),
+		HTTPClient: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// resolver returns the configured resolver, or an uncached default one if none
+// was set.
+func (f *Fetcher) resolver() *identity.Resolver {
+	if f.Resolver == nil {
+		return new(identity.Resolver)
+	}
+	return f.Resolver
+}
+
+// httpClient returns the configured HTTP client, or one with a default timeout
+// if none was set.
+func (f *Fetcher) httpClient() *http.Client {
+	if f.HTTPClient == nil {
+		return &http.Client{Timeout: defaultTimeout}
+	}
+	return f.HTTPClient
+}
+
+// RetrieveBlob retrieves a blob from a repository, identified by a handle or DID,
+// serving it from the local cache if it was already retrieved before. The blob
+// is verified against its content hash.
+func (f *Fetcher) RetrieveBlob(ctx context.Context, did string, cidStr string) (Blob, error) {
 	blob := Blob{}
 
 	c, err := cid.Decode(cidStr)
 	if err != nil {
-		return Blob{}, errors.New("invalid cid")
+		return Blob{}, fmt.Errorf("%w: %v", ErrInvalidCID, err)
 	}
 	blob.Cid = c
 	if blob.Cid.String() != cidStr {
-		return blob, errors.New("invalid cid, not equal")
+		return blob, fmt.Errorf("%w: not in canonical form", ErrInvalidCID)
 	}
 
-	if err := blob.FileLoad(dir); err == nil {
+	if err := blob.FileLoad(f.Dir); err == nil {
 		return blob, nil
 	}
 
 	// find repository location
-	// TODO: remove dependency on ATScan
-	resp, err := http.Get(fmt.Sprintf("https://api.atscan.net/%v", did))
-	if err != nil {
-		return blob, err
+	resolver := f.resolver()
+	if !strings.HasPrefix(did, "did:") {
+		ident, err := resolver.Lookup(ctx, did)
+		if err != nil {
+			return blob, err
+		}
+		did = ident.DID
 	}
-	defer resp.Body.Close()
-	ds, err := ioutil.ReadAll(resp.Body)
+	doc, err := resolver.ResolveDID(ctx, did)
 	if err != nil {
 		return blob, err
 	}
-	var dat map[string]interface{}
-	if err := json.Unmarshal(ds, &dat); err != nil {
-		return blob, err
-	}
-	pd, ok := dat["pds"].([]interface{})
-	if !ok || len(pd) == 0 {
-		return blob, errors.New("repository location not found")
-	}
-	pds, ok := pd[0].(string)
-	if !ok {
-		return blob, errors.New("invalid repository location")
-	}
-	// update did if differ from resolved (when using handle, for example)
-	if did != dat["did"].(string) {
-		did = dat["did"].(string)
+	pds := doc.PDSEndpoint()
+	if pds == "" {
+		return blob, identity.ErrNoPDS
 	}
 
 	// get from PDS
 	url := fmt.Sprintf("%v/xrpc/com.atproto.sync.getBlob?did=%v&cid=%v", pds, did, cidStr)
-	r, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return blob, err
 	}
-	defer r.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return blob, fmt.Errorf("PDS return code: %v", resp.StatusCode)
+	r, err := f.httpClient().Do(req)
+	if err != nil {
+		return blob, fmt.Errorf("%w: %v", ErrPDSFailure, err)
 	}
+	defer r.Body.Close()
 
-	body, _ := ioutil.ReadAll(r.Body)
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBlobBytes+1))
+	if err != nil {
+		return blob, fmt.Errorf("%w: %v", ErrPDSFailure, err)
+	}
+	if len(body) > maxBlobBytes {
+		return blob, fmt.Errorf("%w: blob larger than %d bytes", ErrPDSFailure, maxBlobBytes)
+	}
 	ct := r.Header.Get("Content-Type")
 
 	// check if its not error (in json)
+	var dat struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
 	if strings.Contains(ct, "application/json") {
-		var dat map[string]interface{}
-		if err := json.Unmarshal(body, &dat); err != nil {
+		if err := json.Unmarshal(body, &dat); err != nil && r.StatusCode == http.StatusOK {
 			return blob, err
 		}
-		if dat["error"].(string) != "" {
-			return blob, errors.New(dat["error"].(string))
-		}
+	}
+	if r.StatusCode != http.StatusOK || dat.Error != "" {
+		return blob, pdsError(r.StatusCode, dat.Error, dat.Message)
 	}
 
 	bsum, err := blob.Cid.Prefix().Sum(body)
@@ -114,11 +180,25 @@ func RetrieveBlob(dir string, did string, cidStr string) (Blob, error) {
 		Url: url,
 	}
 
-	blob.FileSave(dir)
+	blob.FileSave(f.Dir)
 
 	return blob, nil
 }
 
+// pdsError maps a failed getBlob response onto the error sentinels. Missing blobs
+// are reported as either a 404 or as a generic invalid request, so the error
+// name and message need to be checked too.
+func pdsError(status int, name string, message string) error {
+	if name == "" {
+		name = http.StatusText(status)
+	}
+	msg := strings.ToLower(message)
+	if status == http.StatusNotFound || name == "BlobNotFound" || strings.Contains(msg, "blob not found") {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, name)
+	}
+	return fmt.Errorf("%w: PDS return code: %v: %s", ErrPDSFailure, status, name)
+}
+
 func filePathBase(dir string) string {
 	return fmt.Sprintf("%v/blobs", dir)
 }
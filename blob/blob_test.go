@@ -0,0 +1,159 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gophercon-2023-demo/identity"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// testPDS is a fake personal data server, also acting as the did:plc directory
+// pointing to itself.
+type testPDS struct {
+	*httptest.Server
+
+	blobs map[string][]byte // Blobs served by content hash
+	huge  string            // Content hash to stream an oversized blob for
+	fetch atomic.Int32      // Number of getBlob requests served
+}
+
+// newTestPDS starts a fake PDS hosting the given blobs for did:plc:alice.
+func newTestPDS(t *testing.T, blobs map[string][]byte) *testPDS {
+	pds := &testPDS{blobs: blobs}
+	pds.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/com.atproto.sync.getBlob" {
+			if r.URL.Path != "/did:plc:alice" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(&identity.DIDDocument{
+				ID: "did:plc:alice",
+				Service: []*identity.Service{{
+					ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: pds.URL,
+				}},
+			})
+			return
+		}
+		pds.fetch.Add(1)
+
+		if r.URL.Query().Get("cid") == pds.huge {
+			io.CopyN(w, zeroReader{}, maxBlobBytes+1)
+			return
+		}
+		data, ok := pds.blobs[r.URL.Query().Get("cid")]
+		if !ok || r.URL.Query().Get("did") != "did:plc:alice" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"InvalidRequest","message":"Blob not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(data)
+	}))
+	t.Cleanup(pds.Close)
+
+	return pds
+}
+
+// fetcher creates a blob fetcher caching into a directory, resolving DIDs via
+// the fake PDS.
+func (pds *testPDS) fetcher(dir string) *Fetcher {
+	return &Fetcher{
+		Dir:      dir,
+		Resolver: &identity.Resolver{PLCDirectory: pds.URL},
+	}
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+// Read implements io.Reader.
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// makeTestCID hashes some data into a raw content identifier.
+func makeTestCID(t *testing.T, data []byte) string {
+	hash, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("failed to hash data: %v", err)
+	}
+	return cid.NewCidV1(cid.Raw, hash).String()
+}
+
+// Tests that blobs are retrieved from the PDS hosting the repository, verified
+// against their content hash and cached on disk.
+func TestRetrieveBlob(t *testing.T) {
+	var (
+		data  = []byte("hello world")
+		hash  = makeTestCID(t, data)
+		dir   = t.TempDir()
+		pds   = newTestPDS(t, map[string][]byte{hash: data})
+		bogus = makeTestCID(t, []byte("bogus"))
+		f     = pds.fetcher(dir)
+	)
+	blob, err := f.RetrieveBlob(context.Background(), "did:plc:alice", hash)
+	if err != nil {
+		t.Fatalf("failed to retrieve blob: %v", err)
+	}
+	if string(blob.Data) != string(data) || blob.Size != len(data) {
+		t.Errorf("blob data mismatch: have %q (%d), want %q (%d)", blob.Data, blob.Size, data, len(data))
+	}
+	if !strings.HasPrefix(blob.ContentType, "text/plain") {
+		t.Errorf("content type mismatch: have %v, want %v", blob.ContentType, "text/plain")
+	}
+	if blob.Source.Pds != pds.URL || blob.Source.Did != "did:plc:alice" {
+		t.Errorf("blob source mismatch: have %+v, want %s/%s", blob.Source, pds.URL, "did:plc:alice")
+	}
+	// Retrieving it again should be served from the disk cache
+	if blob, err = f.RetrieveBlob(context.Background(), "did:plc:alice", hash); err != nil {
+		t.Fatalf("failed to retrieve cached blob: %v", err)
+	}
+	if string(blob.Data) != string(data) {
+		t.Errorf("cached blob data mismatch: have %q, want %q", blob.Data, data)
+	}
+	if fetches := pds.fetch.Load(); fetches != 1 {
+		t.Errorf("pds fetch count mismatch: have %d, want %d", fetches, 1)
+	}
+	// Missing blobs and tampered content should be rejected
+	if _, err := f.RetrieveBlob(context.Background(), "did:plc:alice", makeTestCID(t, []byte("missing"))); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("missing blob error mismatch: have %v, want %v", err, ErrBlobNotFound)
+	}
+	pds.blobs[bogus] = data
+	if _, err := f.RetrieveBlob(context.Background(), "did:plc:alice", bogus); err == nil {
+		t.Errorf("tampered blob accepted")
+	}
+	if _, err := f.RetrieveBlob(context.Background(), "did:plc:alice", "not-a-cid"); !errors.Is(err, ErrInvalidCID) {
+		t.Errorf("invalid cid error mismatch: have %v, want %v", err, ErrInvalidCID)
+	}
+	pds.huge = makeTestCID(t, []byte("huge"))
+	if _, err := f.RetrieveBlob(context.Background(), "did:plc:alice", pds.huge); !errors.Is(err, ErrPDSFailure) {
+		t.Errorf("oversized blob error mismatch: have %v, want %v", err, ErrPDSFailure)
+	}
+	if _, err := f.RetrieveBlob(context.Background(), "did:plc:bob", makeTestCID(t, []byte("bob"))); !errors.Is(err, identity.ErrDIDNotFound) {
+		t.Errorf("unknown repository error mismatch: have %v, want %v", err, identity.ErrDIDNotFound)
+	}
+}
+
+// Tests that a zero value fetcher still bounds the time spent on a PDS.
+func TestFetcherDefaults(t *testing.T) {
+	if timeout := new(Fetcher).httpClient().Timeout; timeout != defaultTimeout {
+		t.Errorf("default timeout mismatch: have %v, want %v", timeout, defaultTimeout)
+	}
+	if new(Fetcher).resolver() == nil {
+		t.Errorf("default resolver missing")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	// maxImageBytes is the maximum number of bytes an image embedded in a post,
+	// or used as an avatar or banner might have before it's rejected by the server.
+	maxImageBytes = 1000000
+
+	// maxImageInputBytes is the maximum number of bytes the library will read
+	// from an image source before giving up. Images between the server limit
+	// and this are attempted to be shrunk.
+	maxImageInputBytes = 32 * 1024 * 1024
+)
+
+// Blob is a reference to a binary object uploaded into a user's repository, such
+// as an image. It can be embedded into posts or used as a profile picture.
+type Blob struct {
+	CID      string // Content hash of the blob
+	MimeType string // Content type of the blob
+	Size     int64  // Size of the blob in bytes
+
+	Width  int // Width of the image, zero if the blob is not an image
+	Height int // Height of the image, zero if the blob is not an image
+}
+
+// UploadBlob uploads an arbitrary binary object into the logged in user's
+// repository, returning a reference to it.
+//
+// Note, blobs that are not referenced by any record within a short time window
+// will be garbage collected by the server.
+func (c *Client) UploadBlob(ctx context.Context, data io.Reader, mimeType string) (*Blob, error) {
+	// Read the entire blob in so it may be retransmitted if needed
+	blob, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Blob *util.LexBlob `json:"blob"`
+	}
+	if err := c.client.Do(ctx, xrpc.Procedure, mimeType, "com.atproto.repo.uploadBlob", nil, bytes.NewReader(blob), &res); err != nil {
+		return nil, err
+	}
+	if res.Blob == nil {
+		return nil, errors.New("blob upload response missing blob reference")
+	}
+	return &Blob{
+		CID:      res.Blob.Ref.String(),
+		MimeType: res.Blob.MimeType,
+		Size:     res.Blob.Size,
+	}, nil
+}
+
+// UploadImage uploads a JPEG or PNG image into the logged in user's repository,
+// returning a reference to it. The image's EXIF and XMP metadata (including
+// location info) is stripped before upload.
+//
+// Note, if the image exceeds the maximum size accepted by the server, it will be
+// downscaled until it fits. You may use the UploadImageWithLimit to override the
+// limit and potentially disable the downscaling.
+func (c *Client) UploadImage(ctx context.Context, data io.Reader) (*Blob, error) {
+	return c.UploadImageWithLimit(ctx, data, maxImageBytes)
+}
+
+// UploadImageWithLimit uploads a JPEG or PNG image into the logged in user's
+// repository using a custom size limit (set to 0 to disable entirely), returning
+// a reference to it. The image's EXIF and XMP metadata (including location info)
+// is stripped before upload.
+func (c *Client) UploadImageWithLimit(ctx context.Context, data io.Reader, limit uint64) (*Blob, error) {
+	// Read the image with a cap on the max data size to avoid malicious content
+	raw, err := io.ReadAll(io.LimitReader(data, maxImageInputBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxImageInputBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrImageTooLarge, maxImageInputBytes)
+	}
+	// Ensure the image format is supported and drop any privacy sensitive data
+	config, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return nil, ErrImageFormat
+	}
+	if raw, err = stripMetadata(raw, format); err != nil {
+		return nil, err
+	}
+	width, height := config.Width, config.Height
+
+	// If the image is above the requested limit, attempt to shrink it
+	if limit != 0 && uint64(len(raw)) > limit {
+		img, _, err := image.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return nil, ErrImageFormat
+		}
+		if raw, img, err = shrinkImage(img, format, int(limit)); err != nil {
+			return nil, err
+		}
+		width, height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	return c.uploadImageData(ctx, raw, width, height)
+}
+
+// uploadImage encodes a decoded image and uploads it into the logged in user's
+// repository, shrinking it if it exceeds the server's size limit. JPEG is used
+// for the encoding, unless the image has transparency, in which case PNG.
+func (c *Client) uploadImage(ctx context.Context, img image.Image) (*Blob, error) {
+	format := "png"
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		format = "jpeg"
+	}
+	raw, img, err := shrinkImage(img, format, maxImageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return c.uploadImageData(ctx, raw, img.Bounds().Dx(), img.Bounds().Dy())
+}
+
+// uploadImageData uploads an already validated and encoded image, annotating
+// the returned blob reference with the image dimensions.
+func (c *Client) uploadImageData(ctx context.Context, raw []byte, width int, height int) (*Blob, error) {
+	blob, err := c.UploadBlob(ctx, bytes.NewReader(raw), http.DetectContentType(raw))
+	if err != nil {
+		return nil, err
+	}
+	blob.Width, blob.Height = width, height
+	return blob, nil
+}
+
+// record converts the blob reference into its atproto record form.
+func (b *Blob) record() any {
+	return map[string]any{
+		"$type":    "blob",
+		"ref":      map[string]string{"$link": b.CID},
+		"mimeType": b.MimeType,
+		"size":     b.Size,
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// Tests that arbitrary blobs can be uploaded and are referenced correctly.
+func TestUploadBlob(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+		data        = []byte("hello world")
+	)
+	blob, err := client.UploadBlob(ctx, bytes.NewReader(data), "text/plain")
+	if err != nil {
+		t.Fatalf("failed to upload blob: %v", err)
+	}
+	if blob.MimeType != "text/plain" {
+		t.Errorf("mime type mismatch: have %v, want %v", blob.MimeType, "text/plain")
+	}
+	if blob.Size != int64(len(data)) {
+		t.Errorf("size mismatch: have %d, want %d", blob.Size, len(data))
+	}
+	if blob.Width != 0 || blob.Height != 0 {
+		t.Errorf("dimensions mismatch: have %dx%d, want 0x0", blob.Width, blob.Height)
+	}
+	stored := srv.Blob(blob.CID)
+	if stored == nil {
+		t.Fatalf("blob %s not stored", blob.CID)
+	}
+	if !bytes.Equal(stored.Data, data) {
+		t.Errorf("stored blob mismatch: have %q, want %q", stored.Data, data)
+	}
+}
+
+// Tests that images are stripped of their metadata and shrunk if needed before
+// upload, and that the uploaded blobs are annotated with their dimensions.
+func TestUploadImage(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	clean, err := EncodeImage(makeTestImage(64, 48), "jpeg")
+	if err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	exif := "Exif\x00\x00GPS secrets"
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(exif)+2))
+	segment = append(segment, exif...)
+
+	dirty := append(append(append([]byte{}, clean[:2]...), segment...), clean[2:]...)
+	blob, err := client.UploadImage(ctx, bytes.NewReader(dirty))
+	if err != nil {
+		t.Fatalf("failed to upload image: %v", err)
+	}
+	if blob.MimeType != "image/jpeg" || blob.Width != 64 || blob.Height != 48 {
+		t.Errorf("blob mismatch: have %s %dx%d, want image/jpeg 64x48", blob.MimeType, blob.Width, blob.Height)
+	}
+	if stored := srv.Blob(blob.CID); stored == nil || !bytes.Equal(stored.Data, clean) {
+		t.Errorf("stored image not stripped of metadata")
+	}
+	// Upload an image that needs to be shrunk to fit into the limit
+	large, err := EncodeImage(makeTestImage(256, 256), "png")
+	if err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	limit := len(large) / 2
+
+	blob, err = client.UploadImageWithLimit(ctx, bytes.NewReader(large), uint64(limit))
+	if err != nil {
+		t.Fatalf("failed to upload large image: %v", err)
+	}
+	if blob.Size > int64(limit) {
+		t.Errorf("shrunk image too large: have %d bytes, want at most %d", blob.Size, limit)
+	}
+	stored := srv.Blob(blob.CID)
+	if stored == nil {
+		t.Fatalf("blob %s not stored", blob.CID)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(stored.Data))
+	if err != nil {
+		t.Fatalf("failed to decode stored image: %v", err)
+	}
+	if format != "png" || config.Width != blob.Width || config.Height != blob.Height {
+		t.Errorf("stored image mismatch: have %s %dx%d, want png %dx%d", format, config.Width, config.Height, blob.Width, blob.Height)
+	}
+	// Unsupported formats should be rejected
+	if _, err := client.UploadImage(ctx, bytes.NewReader([]byte("GIF89a"))); err != ErrImageFormat {
+		t.Errorf("invalid image error mismatch: have %v, want %v", err, ErrImageFormat)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"sync"
 	"time"
@@ -17,18 +18,6 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var (
-	// jwtAsyncRefreshThreshold is the remaining validity time of a JWT token
-	// below which to trigger a session refresh on a background thread (i.e.
-	// the client can still be actively used during).
-	jwtAsyncRefreshThreshold = 5 * time.Minute
-
-	// jwtSyncRefreshThreshold is the remaining validity time of a JWT token
-	// below which to trigger a session refresh on a foreground thread (i.e.
-	// the client blocks new API calls until the refresh finishes).
-	jwtSyncRefreshThreshold = 2 * time.Minute
-)
-
 var (
 	// ErrLoginUnauthorized is returned from a login attempt if the credentials
 	// are rejected by the server or the local client (master credentials).
@@ -42,11 +31,16 @@ var (
 	// ErrSessionExpired is returned from any API call if the underlying session
 	// has expired and a new login from scratch is required.
 	ErrSessionExpired = errors.New("session expired")
+
+	// ErrNotLoggedIn is returned from any API call requiring an authenticated
+	// user if the client was never logged in.
+	ErrNotLoggedIn = errors.New("not logged in")
 )
 
 // Client is an API client attached to (and authenticated to) a Bluesky PDS instance.
 type Client struct {
-	client *xrpc.Client // Underlying XRPC transport connected to the API
+	client    *xrpc.Client    // Underlying XRPC transport connected to the API
+	transport *retryTransport // HTTP transport pacing and retrying the API calls
 
 	jwtLock          sync.RWMutex                // Lock protecting the following JWT auth fields
 	jwtCurrentExpire time.Time                   // Expiration time for the current JWT token
@@ -54,29 +48,77 @@ type Client struct {
 	jwtAsyncRefresh  chan struct{}               // Channel tracking if an async refresher is running
 	jwtRefresherStop chan chan struct{}          // Notification channel to stop the JWT refresher
 	jwtRefreshHook   func(skip bool, async bool) // Testing hook to monitor when a refresh is triggered
+
+	jwtAsyncRefreshThreshold time.Duration // Remaining JWT validity below which to refresh in the background
+	jwtSyncRefreshThreshold  time.Duration // Remaining JWT validity below which to refresh blocking
+
+	logger *log.Logger // Logger to report background failures to
+
+	sessionStore SessionStore // Optional store to persist refreshed sessions into
+	sessionKey   string       // Key under which to persist the session in the store
 }
 
 // Dial connects to a remote Bluesky server and exchanges some basic information
 // to ensure the connectivity works.
-func Dial(ctx context.Context, server string) (*Client, error) {
-	return DialWithClient(ctx, server, new(http.Client))
+func Dial(ctx context.Context, server string, opts ...Option) (*Client, error) {
+	return DialWithClient(ctx, server, new(http.Client), opts...)
 }
 
 // DialWithClient connects to a remote Bluesky server using a user supplied HTTP
 // client and exchanges some basic information to ensure the connectivity works.
-func DialWithClient(ctx context.Context, server string, client *http.Client) (*Client, error) {
-	// Create the XRPC client from the supplied HTTP one
+//
+// Note, the HTTP client is copied and its transport wrapped to decode the error
+// responses of the server and to pace and retry the calls according to the
+// configured rate limiter and retry policy. The original is not modified.
+func DialWithClient(ctx context.Context, server string, client *http.Client, opts ...Option) (*Client, error) {
+	cfg := newConfig(opts)
+	if cfg.syncRefresh > cfg.asyncRefresh {
+		return nil, fmt.Errorf("sync refresh threshold %v above async threshold %v", cfg.syncRefresh, cfg.asyncRefresh)
+	}
+	// Create the XRPC client from the supplied HTTP one, wrapping the user's
+	// transport into the middlewares and the error and retry handlers
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	for i := len(cfg.middlewares) - 1; i >= 0; i-- {
+		base = cfg.middlewares[i](base)
+	}
+	transport := &retryTransport{
+		base:    &errorTransport{base: base},
+		policy:  cfg.retryPolicy,
+		limiter: cfg.rateLimiter,
+		logger:  cfg.logger,
+	}
+	hc := *client
+	hc.Transport = transport
+	if len(cfg.interceptors) > 0 {
+		hc.Transport = &interceptTransport{base: transport, interceptors: cfg.interceptors}
+	}
+	if cfg.timeout != 0 {
+		hc.Timeout = cfg.timeout
+	}
 	local := &xrpc.Client{
-		Client: client,
+		Client: &hc,
 		Host:   server,
 	}
+	if cfg.userAgent != "" {
+		local.UserAgent = &cfg.userAgent
+	}
+	if cfg.adminToken != "" {
+		local.AdminToken = &cfg.adminToken
+	}
 	// Do a sanity check with the server to ensure everything works. We don't
 	// really care about the response as long as we get a meaningful one.
 	if _, err := atproto.ServerDescribeServer(ctx, local); err != nil {
 		return nil, err
 	}
 	return &Client{
-		client: local,
+		client:                   local,
+		transport:                transport,
+		jwtAsyncRefreshThreshold: cfg.asyncRefresh,
+		jwtSyncRefreshThreshold:  cfg.syncRefresh,
+		logger:                   cfg.logger,
 	}, nil
 }
 
@@ -86,13 +128,31 @@ func DialWithClient(ctx context.Context, server string, client *http.Client) (*C
 // be detected and rejected. For your security, this library will refuse to use
 // your master credentials.
 func (c *Client) Login(ctx context.Context, handle string, appkey string) error {
+	if err := c.login(ctx, handle, appkey); err != nil {
+		return err
+	}
+	c.stopRefresher()
+
+	c.jwtRefresherStop = make(chan chan struct{})
+	go c.refresher()
+
+	return nil
+}
+
+// login authenticates to the Bluesky server with the given handle and appkey,
+// without starting the background refresher. It may be used to re-authenticate
+// a client that is already in use.
+func (c *Client) login(ctx context.Context, handle string, appkey string) error {
 	// Authenticate to the Bluesky server
 	sess, err := atproto.ServerCreateSession(ctx, c.client, &atproto.ServerCreateSession_Input{
 		Identifier: handle,
 		Password:   appkey,
 	})
 	if err != nil {
-		return fmt.Errorf("%w: %v", ErrLoginUnauthorized, err)
+		if errors.Is(err, ErrAuthRequired) {
+			return fmt.Errorf("%w: %w", ErrLoginUnauthorized, err)
+		}
+		return err
 	}
 	// Verify and reject master credentials, sorry, no bad security practices
 	token, _, err := jwt.NewParser().ParseUnverified(sess.AccessJwt, jwt.MapClaims{})
@@ -115,6 +175,9 @@ func (c *Client) Login(ctx context.Context, handle string, appkey string) error
 		return err
 	}
 	// Construct the authenticated client and the JWT expiration metadata
+	c.jwtLock.Lock()
+	defer c.jwtLock.Unlock()
+
 	c.client.Auth = &xrpc.AuthInfo{
 		AccessJwt:  sess.AccessJwt,
 		RefreshJwt: sess.RefreshJwt,
@@ -124,17 +187,21 @@ func (c *Client) Login(ctx context.Context, handle string, appkey string) error
 	c.jwtCurrentExpire = current.Time
 	c.jwtRefreshExpire = refresh.Time
 
-	c.jwtAsyncRefresh = make(chan struct{}, 1) // 1 async refresher allowed concurrently
-	c.jwtRefresherStop = make(chan chan struct{})
-	go c.refresher()
-
+	if c.jwtAsyncRefresh == nil {
+		c.jwtAsyncRefresh = make(chan struct{}, 1) // 1 async refresher allowed concurrently
+	}
 	return nil
 }
 
 // Close terminates the client, shutting down all pending tasks and background
 // operations.
 func (c *Client) Close() error {
-	// If the periodical JWT refresher is running, tear it down
+	c.stopRefresher()
+	return nil
+}
+
+// stopRefresher tears down the periodical JWT refresher, if it is running.
+func (c *Client) stopRefresher() {
 	if c.jwtRefresherStop != nil {
 		stopc := make(chan struct{})
 		c.jwtRefresherStop <- stopc
@@ -142,7 +209,6 @@ func (c *Client) Close() error {
 
 		c.jwtRefresherStop = nil
 	}
-	return nil
 }
 
 // refresher is an infinite loop that periodically checks the validity of the JWT
@@ -150,7 +216,9 @@ func (c *Client) Close() error {
 func (c *Client) refresher() {
 	for {
 		// Attempt to refresh the JWT token
-		c.maybeRefreshJWT()
+		if err := c.maybeRefreshJWT(); err != nil {
+			c.logf("Failed to refresh session: %v", err)
+		}
 
 		// Wait until some time passes or the client is closing down
 		select {
@@ -162,6 +230,15 @@ func (c *Client) refresher() {
 	}
 }
 
+// jwtFresh reports whether the JWT token is valid long enough to not need any
+// refresh yet, not even a background one.
+func (c *Client) jwtFresh() bool {
+	c.jwtLock.RLock()
+	defer c.jwtLock.RUnlock()
+
+	return time.Until(c.jwtCurrentExpire) > c.jwtAsyncRefreshThreshold
+}
+
 // maybeRefreshJWT checks the remainder validity time of the JWT token and does
 // a session refresh if it is necessary. Depending on the amount of time it is
 // still valid it might attempt a refresh on a background thread (permitting the
@@ -171,8 +248,8 @@ func (c *Client) maybeRefreshJWT() error {
 	c.jwtLock.RLock()
 	var (
 		now        = time.Now()
-		validAsync = c.jwtCurrentExpire.Sub(now) > jwtAsyncRefreshThreshold
-		validSync  = c.jwtCurrentExpire.Sub(now) > jwtSyncRefreshThreshold
+		validAsync = c.jwtCurrentExpire.Sub(now) > c.jwtAsyncRefreshThreshold
+		validSync  = c.jwtCurrentExpire.Sub(now) > c.jwtSyncRefreshThreshold
 	)
 	c.jwtLock.RUnlock()
 
@@ -186,7 +263,9 @@ func (c *Client) maybeRefreshJWT() error {
 		case c.jwtAsyncRefresh <- struct{}{}:
 			// We're the first to attempt a background refresh, do it
 			go func() {
-				c.refreshJWT(true)
+				if err := c.refreshJWT(true); err != nil {
+					c.logf("Failed to refresh session in the background: %v", err)
+				}
 				<-c.jwtAsyncRefresh
 			}()
 			return nil
@@ -212,7 +291,7 @@ func (c *Client) refreshJWT(async bool) error {
 	// Double-check the JWT token's validity to avoid multiple concurrent calls
 	// being blocked and each refreshing the token. Async refresh is guaranteed
 	// to be single threaded so no need to recheck the threshold with that.
-	if !async && time.Until(c.jwtCurrentExpire) > jwtAsyncRefreshThreshold {
+	if !async && time.Until(c.jwtCurrentExpire) > c.jwtAsyncRefreshThreshold {
 		// JWT token was already refreshed by someone else, ignore request
 		if c.jwtRefreshHook != nil {
 			c.jwtRefreshHook(true, async)
@@ -283,9 +362,23 @@ func (c *Client) refreshJWT(async bool) error {
 	c.jwtCurrentExpire = current.Time
 	c.jwtRefreshExpire = refresh.Time
 
+	// If the session is tracked in a store, persist the rotated tokens. This is a
+	// best effort operation, the live client remains usable even if it fails.
+	if c.sessionStore != nil {
+		if err := c.sessionStore.Save(context.Background(), c.sessionKey, c.session()); err != nil {
+			c.logf("Failed to persist refreshed session: %v", err)
+		}
+	}
 	return nil
 }
 
+// logf reports a background event or failure to the user's logger, if any.
+func (c *Client) logf(format string, args ...any) {
+	if c.logger != nil {
+		c.logger.Printf(format, args...)
+	}
+}
+
 // CustomCall is a wildcard method for executing atproto API calls that are not
 // (yet?) implemented by this library. The user needs to provide a callback that
 // will receive an XRPC client to do direct atproto calls through.
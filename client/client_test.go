@@ -7,79 +7,194 @@ package client
 import (
 	"context"
 	"errors"
-	"github.com/karalabe/go-bluesky"
-	"os"
+	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
+	"gophercon-2023-demo/client/clienttest"
+
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/xrpc"
 )
 
-// testCredentials contains credentials from the environment to use for Client
-// login tests.
+// testCredentials contains the credentials of the seeded test user to use for
+// Client login tests.
 type testCredentials struct {
 	handle string
 	passwd string
 	appkey string
 }
 
-// makeTestClient returns a Client and authentication credentials from env vars
-// that can be used to log in. The test will be skipped if the required variables
-// are not set.
-func makeTestClient(t *testing.T) (*main.main.Client, *testCredentials) {
+// makeTestServer starts a fake Bluesky server seeded with the accounts and the
+// social graph the tests expect.
+func makeTestServer(t *testing.T) *clienttest.Server {
+	t.Helper()
+
+	srv := clienttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	avatar, err := EncodeImage(makeTestImage(64, 64), "jpeg")
+	if err != nil {
+		t.Fatalf("failed to encode avatar: %v", err)
+	}
+	banner, err := EncodeImage(makeTestImage(192, 64), "jpeg")
+	if err != nil {
+		t.Fatalf("failed to encode banner: %v", err)
+	}
+	srv.AddAccount(&clienttest.Account{
+		Handle:       testHandleTester,
+		DID:          testDIDTester,
+		Password:     testPasswdTester,
+		AppPasswords: []string{testAppkeyTester},
+		Name:         "go-bluesky tester",
+		Bio:          "I'm a test account used to run the https://github.com/karalabe/go-bluesky test suite. If I do anything weird, please contact @karalabe.bsky.social to fix me.",
+		Posts:        2,
+	})
+	srv.AddAccount(&clienttest.Account{
+		Handle: "karalabe.bsky.social",
+		DID:    testDIDPeter,
+		Name:   "Péter Szilágyi",
+		Avatar: avatar,
+		Banner: banner,
+	})
+	srv.AddAccount(&clienttest.Account{
+		Handle: "why.bsky.team",
+		DID:    testDIDJeromy,
+		Name:   "Jeromy",
+		Avatar: avatar,
+	})
+	srv.AddFollow(testDIDTester, testDIDPeter)
+	srv.AddFollow(testDIDJeromy, testDIDPeter)
+	srv.AddFollow(testDIDPeter, testDIDJeromy)
+
+	// Seed a crowd of users, enough to span multiple pages of followers and
+	// followees for everyone
+	for i := 0; i < 250; i++ {
+		var (
+			handle = fmt.Sprintf("user%03d.test", i)
+			did    = fmt.Sprintf("did:plc:user%03d", i)
+		)
+		srv.AddAccount(&clienttest.Account{Handle: handle, DID: did})
+		if i < 40 {
+			srv.AddFollow(did, testDIDTester)
+		}
+		srv.AddFollow(did, testDIDPeter)
+		srv.AddFollow(testDIDJeromy, did)
+	}
+	return srv
+}
+
+// makeTestClient returns a Client connected to a fake server and the credentials
+// of the seeded test user that can be used to log in.
+func makeTestClient(t *testing.T) (*Client, *testCredentials) {
 	t.Helper()
 
-	var (
-		handle = getenvOrSkip(t, "GOBLUESKY_TEST_HANDLE")
-		passwd = getenvOrSkip(t, "GOBLUESKY_TEST_PASSWD")
-		appkey = getenvOrSkip(t, "GOBLUESKY_TEST_APPKEY")
-	)
-	client, err := Dial(context.Background(), ServerBskySocial)
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
 	if err != nil {
 		t.Fatalf("failed to dial: %v", err)
 	}
 	t.Cleanup(func() { client.Close() })
 
 	return client, &testCredentials{
-		handle: handle,
-		passwd: passwd,
-		appkey: appkey,
+		handle: testHandleTester,
+		passwd: testPasswdTester,
+		appkey: testAppkeyTester,
 	}
 }
 
-// makeTestClientWithLogin returns a Client which is logged in using credentials
-// from the environment. The test will be skipped if the required env vars are
-// not set.
-func makeTestClientWithLogin(t *testing.T) *main.main.Client {
+// makeTestClientWithLogin returns a Client connected to a fake server, which is
+// logged in as the seeded test user.
+func makeTestClientWithLogin(t *testing.T) *Client {
 	t.Helper()
 
-	client, creds := makeTestClient(t)
-	if err := client.Login(context.Background(), creds.handle, creds.appkey); err != nil {
-		t.Fatalf("failed to login to Bluesky server: %v", err)
-	}
+	client, _ := makeTestClientWithServer(t)
 	return client
 }
 
-// getenvOrSkip fetches the value of env or skips the test if env is not set.
-func getenvOrSkip(t *testing.T, env string) string {
+// makeTestClientWithServer returns a Client connected to a fake server, which is
+// logged in as the seeded test user, along with the server itself to inspect.
+func makeTestClientWithServer(t *testing.T) (*Client, *clienttest.Server) {
 	t.Helper()
 
-	val, ok := os.LookupEnv(env)
-	if !ok {
-		t.Skipf("skipping, environment variable %q is required to run the tests", env)
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
 	}
-	return val
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login to Bluesky server: %v", err)
+	}
+	return client, srv
+}
+
+// setJWTExpire overrides the expiration times of the JWT tokens of a client,
+// synchronizing with the background refresher.
+func setJWTExpire(c *Client, current time.Time, refresh time.Time) {
+	c.jwtLock.Lock()
+	defer c.jwtLock.Unlock()
+
+	c.jwtCurrentExpire = current
+	c.jwtRefreshExpire = refresh
+}
+
+// getJWTExpire retrieves the expiration time of the current JWT token of a
+// client, synchronizing with the background refresher.
+func getJWTExpire(c *Client) time.Time {
+	c.jwtLock.RLock()
+	defer c.jwtLock.RUnlock()
+
+	return c.jwtCurrentExpire
 }
 
 // Basic test to see if connecting to a Bluesky instance works.
 func TestDial(t *testing.T) {
-	ctx := context.Background()
-	client, err := Dial(ctx, ServerBskySocial)
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
 	if err != nil {
 		t.Fatalf("failed to dial bluesky server: %v", err)
 	}
 	defer client.Close()
+
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 1 {
+		t.Errorf("describe server calls mismatch: have %d, want %d", calls, 1)
+	}
+}
+
+// Tests that dialing retries transient server failures, but gives up on
+// permanent ones.
+func TestDialFailure(t *testing.T) {
+	srv := makeTestServer(t)
+	srv.InjectFault("com.atproto.server.describeServer", &clienttest.Fault{
+		Status: http.StatusServiceUnavailable,
+		Error:  "ServiceUnavailable",
+		Times:  1,
+	})
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to dial temporarily unavailable server: %v", err)
+	}
+	client.Close()
+
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 2 {
+		t.Errorf("call count mismatch: have %d, want %d", calls, 2)
+	}
+	srv.InjectFault("com.atproto.server.describeServer", &clienttest.Fault{
+		Status: http.StatusBadRequest,
+		Error:  "InvalidRequest",
+	})
+	if _, err := DialWithClient(context.Background(), srv.URL, srv.Client()); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("dial error mismatch: have %v, want %v", err, ErrInvalidRequest)
+	}
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 3 {
+		t.Errorf("call count mismatch: have %d, want %d", calls, 3)
+	}
 }
 
 // Tests that logging into a Bluesky server works and also that only app passwords
@@ -134,7 +249,7 @@ func TestJWTAsyncRefresh(t *testing.T) {
 		}
 		errc <- nil
 	}
-	client.jwtCurrentExpire = time.Now().Add(jwtAsyncRefreshThreshold - time.Second)
+	setJWTExpire(client, time.Now().Add(client.jwtAsyncRefreshThreshold-time.Second), time.Now().Add(time.Hour))
 	client.maybeRefreshJWT()
 
 	select {
@@ -147,7 +262,7 @@ func TestJWTAsyncRefresh(t *testing.T) {
 	}
 	// Wait a bit for background refresh (ush) and check that the JWT token was refreshed
 	time.Sleep(500 * time.Millisecond)
-	if time.Until(client.jwtCurrentExpire) < jwtAsyncRefreshThreshold {
+	if time.Until(getJWTExpire(client)) < client.jwtAsyncRefreshThreshold {
 		t.Fatalf("jwt token refresh failed")
 	}
 }
@@ -169,7 +284,7 @@ func TestJWTSyncRefresh(t *testing.T) {
 		}
 		errc <- nil
 	}
-	client.jwtCurrentExpire = time.Now().Add(jwtSyncRefreshThreshold - time.Second)
+	setJWTExpire(client, time.Now().Add(client.jwtSyncRefreshThreshold-time.Second), time.Now().Add(time.Hour))
 	client.maybeRefreshJWT()
 
 	select {
@@ -181,7 +296,7 @@ func TestJWTSyncRefresh(t *testing.T) {
 		t.Fatalf("jwt token refreshed didn't get called")
 	}
 	// Check immediately that the JWT token was refreshed
-	if time.Until(client.jwtCurrentExpire) < jwtAsyncRefreshThreshold {
+	if time.Until(getJWTExpire(client)) < client.jwtAsyncRefreshThreshold {
 		t.Fatalf("jwt token refresh failed")
 	}
 }
@@ -190,8 +305,7 @@ func TestJWTSyncRefresh(t *testing.T) {
 // out synchronously.
 func TestJWTExpiredRefresh(t *testing.T) {
 	client := makeTestClientWithLogin(t)
-	client.jwtCurrentExpire = time.Time{}
-	client.jwtRefreshExpire = time.Time{}
+	setJWTExpire(client, time.Time{}, time.Time{})
 
 	if err := client.maybeRefreshJWT(); !errors.Is(err, ErrSessionExpired) {
 		t.Fatalf("expired session error mismatch: have %v, want %v", err, ErrSessionExpired)
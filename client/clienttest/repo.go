@@ -0,0 +1,486 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clienttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// maxApplyWrites is the maximum number of writes applyWrites accepts.
+const maxApplyWrites = 200
+
+// Record is a record stored in the repository of a seeded account.
+//
+// Note, the repositories are independent of the seeded social graph: creating a
+// follow record does not show up in the follower listings and vice versa.
+type Record struct {
+	URI   string          // at:// URI of the record
+	CID   string          // Content hash of the record
+	Value json.RawMessage // Raw JSON value of the record
+
+	rkey string // Key of the record within its collection
+}
+
+// Records returns the records of a seeded account within a collection, ordered by
+// record key.
+func (s *Server) Records(did string, collection string) []*Record {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.listCollection(did, collection)
+}
+
+// PutRecord creates or overwrites a record in the repository of a seeded account,
+// bypassing authentication. It can be used to seed records, or to simulate edits
+// from other clients.
+func (s *Server) PutRecord(did string, collection string, rkey string, value any) *Record {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	blob, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return s.storeRecord(did, collection, rkey, blob)
+}
+
+// Blob is a binary object uploaded by a seeded account.
+type Blob struct {
+	MimeType string // Content type declared on upload
+	Data     []byte // Raw content of the blob
+}
+
+// Blob returns an uploaded blob by its content hash, or nil if it's unknown.
+func (s *Server) Blob(cid string) *Blob {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.blobs[cid]
+}
+
+// Muted reports whether a seeded account muted another user.
+func (s *Server) Muted(did string, subject string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.mutes[did][subject]
+}
+
+// listCollection returns the records of a collection, ordered by record key. The
+// lock is assumed held.
+func (s *Server) listCollection(did string, collection string) []*Record {
+	records := s.repos[did][collection]
+
+	rkeys := make([]string, 0, len(records))
+	for rkey := range records {
+		rkeys = append(rkeys, rkey)
+	}
+	sort.Strings(rkeys)
+
+	list := make([]*Record, 0, len(rkeys))
+	for _, rkey := range rkeys {
+		list = append(list, records[rkey])
+	}
+	return list
+}
+
+// storeRecord creates or overwrites a record. The lock is assumed held.
+func (s *Server) storeRecord(did string, collection string, rkey string, value json.RawMessage) *Record {
+	if s.repos[did] == nil {
+		s.repos[did] = make(map[string]map[string]*Record)
+	}
+	if s.repos[did][collection] == nil {
+		s.repos[did][collection] = make(map[string]*Record)
+	}
+	record := &Record{
+		URI:   fmt.Sprintf("at://%s/%s/%s", did, collection, rkey),
+		CID:   makeCID(cid.DagCBOR, value).String(),
+		Value: value,
+		rkey:  rkey,
+	}
+	s.repos[did][collection][rkey] = record
+	return record
+}
+
+// graphRecord finds the URI of a graph record within a collection pointing to a
+// subject, or returns an empty string if there is none. The lock is assumed held.
+func (s *Server) graphRecord(did string, collection string, subject string) string {
+	for _, record := range s.listCollection(did, collection) {
+		var value struct {
+			Subject string `json:"subject"`
+		}
+		if json.Unmarshal(record.Value, &value) == nil && value.Subject == subject {
+			return record.URI
+		}
+	}
+	return ""
+}
+
+// nextRecordKey generates a new, monotonically increasing record key. The lock
+// is assumed held.
+func (s *Server) nextRecordKey() string {
+	s.rkeys++
+	return fmt.Sprintf("3k%011d", s.rkeys)
+}
+
+// makeCID hashes some data into a content identifier.
+func makeCID(codec uint64, data []byte) cid.Cid {
+	hash, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(codec, hash)
+}
+
+// ownRepo resolves the repository of a write request, rejecting writes to any
+// repository other than the caller's own. The lock is assumed held.
+func (s *Server) ownRepo(repo string, session *jwt.RegisteredClaims) (string, error) {
+	account, err := s.lookup(repo)
+	if err != nil {
+		return "", err
+	}
+	if account.DID != session.Subject {
+		return "", &xrpcError{http.StatusBadRequest, "InvalidRequest", "Input/repo must be the authenticated user"}
+	}
+	return account.DID, nil
+}
+
+// checkRecord validates that a record value is a JSON object of the collection's
+// type.
+func checkRecord(collection string, value json.RawMessage) error {
+	var typed struct {
+		Type string `json:"$type"`
+	}
+	if err := json.Unmarshal(value, &typed); err != nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Input/record must be an object"}
+	}
+	if typed.Type != collection {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("Invalid $type: expected %s, got %s", collection, typed.Type)}
+	}
+	return nil
+}
+
+// decodeInput decodes the JSON body of a procedure call.
+func decodeInput(r *http.Request, input any) error {
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Malformed input: " + err.Error()}
+	}
+	return nil
+}
+
+// resolveHandle implements com.atproto.identity.resolveHandle.
+func (s *Server) resolveHandle(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account := s.accounts[r.URL.Query().Get("handle")]
+	if account == nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Unable to resolve handle"}
+	}
+	return writeJSON(w, map[string]string{"did": account.DID})
+}
+
+// getRecord implements com.atproto.repo.getRecord.
+func (s *Server) getRecord(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	query := r.URL.Query()
+	account, err := s.lookup(query.Get("repo"))
+	if err != nil {
+		return err
+	}
+	record := s.repos[account.DID][query.Get("collection")][query.Get("rkey")]
+	if record == nil {
+		return &xrpcError{http.StatusBadRequest, "RecordNotFound", fmt.Sprintf("Could not locate record: at://%s/%s/%s", account.DID, query.Get("collection"), query.Get("rkey"))}
+	}
+	return writeJSON(w, map[string]any{"uri": record.URI, "cid": record.CID, "value": record.Value})
+}
+
+// listRecords implements com.atproto.repo.listRecords. Records are listed in
+// ascending record key order, and the cursor is the last record key returned.
+func (s *Server) listRecords(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	query := r.URL.Query()
+	account, err := s.lookup(query.Get("repo"))
+	if err != nil {
+		return err
+	}
+	limit := 50
+	if param := query.Get("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > maxPageSize {
+			return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Error: limit must be between 1 and 100"}
+		}
+	}
+	var (
+		cursor  = query.Get("cursor")
+		records []*Record
+	)
+	for _, record := range s.listCollection(account.DID, query.Get("collection")) {
+		if record.rkey > cursor {
+			records = append(records, record)
+		}
+	}
+	res := struct {
+		Cursor  string           `json:"cursor,omitempty"`
+		Records []map[string]any `json:"records"`
+	}{Records: []map[string]any{}}
+
+	if len(records) > limit {
+		records = records[:limit]
+		res.Cursor = records[limit-1].rkey
+	}
+	for _, record := range records {
+		res.Records = append(res.Records, map[string]any{"uri": record.URI, "cid": record.CID, "value": record.Value})
+	}
+	return writeJSON(w, res)
+}
+
+// createRecord implements com.atproto.repo.createRecord.
+func (s *Server) createRecord(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	var input struct {
+		Repo       string          `json:"repo"`
+		Collection string          `json:"collection"`
+		Rkey       string          `json:"rkey"`
+		Record     json.RawMessage `json:"record"`
+	}
+	if err := decodeInput(r, &input); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	did, err := s.ownRepo(input.Repo, session)
+	if err != nil {
+		return err
+	}
+	if err := checkRecord(input.Collection, input.Record); err != nil {
+		return err
+	}
+	rkey := input.Rkey
+	if rkey == "" {
+		rkey = s.nextRecordKey()
+	} else if s.repos[did][input.Collection][rkey] != nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Record already exists"}
+	}
+	record := s.storeRecord(did, input.Collection, rkey, input.Record)
+	return writeJSON(w, map[string]string{"uri": record.URI, "cid": record.CID})
+}
+
+// putRecord implements com.atproto.repo.putRecord. If a swap CID is present, the
+// write is only accepted if it matches the current record's; a null swap CID only
+// accepts creating a new record.
+func (s *Server) putRecord(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	var input struct {
+		Repo       string          `json:"repo"`
+		Collection string          `json:"collection"`
+		Rkey       string          `json:"rkey"`
+		Record     json.RawMessage `json:"record"`
+		SwapRecord json.RawMessage `json:"swapRecord"`
+	}
+	if err := decodeInput(r, &input); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	did, err := s.ownRepo(input.Repo, session)
+	if err != nil {
+		return err
+	}
+	if input.Rkey == "" {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Input must have the property \"rkey\""}
+	}
+	if err := checkRecord(input.Collection, input.Record); err != nil {
+		return err
+	}
+	if input.SwapRecord != nil {
+		var swap *string
+		if err := json.Unmarshal(input.SwapRecord, &swap); err != nil {
+			return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Input/swapRecord must be a cid"}
+		}
+		current := s.repos[did][input.Collection][input.Rkey]
+		switch {
+		case swap == nil && current != nil:
+			return &xrpcError{http.StatusBadRequest, "InvalidSwap", "Record was at " + current.CID}
+		case swap != nil && current == nil:
+			return &xrpcError{http.StatusBadRequest, "InvalidSwap", "Record was at null"}
+		case swap != nil && current.CID != *swap:
+			return &xrpcError{http.StatusBadRequest, "InvalidSwap", "Record was at " + current.CID}
+		}
+	}
+	record := s.storeRecord(did, input.Collection, input.Rkey, input.Record)
+	return writeJSON(w, map[string]string{"uri": record.URI, "cid": record.CID})
+}
+
+// deleteRecord implements com.atproto.repo.deleteRecord. Deleting a missing
+// record is a no-op, same as on the live server.
+func (s *Server) deleteRecord(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	var input struct {
+		Repo       string `json:"repo"`
+		Collection string `json:"collection"`
+		Rkey       string `json:"rkey"`
+	}
+	if err := decodeInput(r, &input); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	did, err := s.ownRepo(input.Repo, session)
+	if err != nil {
+		return err
+	}
+	delete(s.repos[did][input.Collection], input.Rkey)
+	return writeJSON(w, struct{}{})
+}
+
+// applyWrites implements com.atproto.repo.applyWrites. The writes are validated
+// in full before any of them is applied, so a batch either lands completely or
+// not at all.
+func (s *Server) applyWrites(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	var input struct {
+		Repo   string `json:"repo"`
+		Writes []struct {
+			Type       string          `json:"$type"`
+			Collection string          `json:"collection"`
+			Rkey       string          `json:"rkey"`
+			Value      json.RawMessage `json:"value"`
+		} `json:"writes"`
+	}
+	if err := decodeInput(r, &input); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	did, err := s.ownRepo(input.Repo, session)
+	if err != nil {
+		return err
+	}
+	if len(input.Writes) > maxApplyWrites {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("Too many writes. Max: %d", maxApplyWrites)}
+	}
+	// Validate all the writes against the repository as it would be after the
+	// preceding ones, tracking the touched keys
+	exists := func(collection string, rkey string) bool {
+		return s.repos[did][collection][rkey] != nil
+	}
+	touched := make(map[string]bool)
+	for i, write := range input.Writes {
+		key := write.Collection + "/" + write.Rkey
+		switch write.Type {
+		case "com.atproto.repo.applyWrites#create":
+			if err := checkRecord(write.Collection, write.Value); err != nil {
+				return err
+			}
+			if write.Rkey == "" {
+				input.Writes[i].Rkey = s.nextRecordKey()
+				continue
+			}
+			if existing, ok := touched[key]; (ok && existing) || (!ok && exists(write.Collection, write.Rkey)) {
+				return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Record already exists: " + key}
+			}
+			touched[key] = true
+
+		case "com.atproto.repo.applyWrites#update":
+			if err := checkRecord(write.Collection, write.Value); err != nil {
+				return err
+			}
+			touched[key] = true
+
+		case "com.atproto.repo.applyWrites#delete":
+			if existing, ok := touched[key]; (ok && !existing) || (!ok && !exists(write.Collection, write.Rkey)) {
+				return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Could not find record: " + key}
+			}
+			touched[key] = false
+
+		default:
+			return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Unknown write type: " + write.Type}
+		}
+	}
+	// All writes are valid, apply them
+	for _, write := range input.Writes {
+		if write.Type == "com.atproto.repo.applyWrites#delete" {
+			delete(s.repos[did][write.Collection], write.Rkey)
+			continue
+		}
+		s.storeRecord(did, write.Collection, write.Rkey, write.Value)
+	}
+	return writeJSON(w, struct{}{})
+}
+
+// uploadBlob implements com.atproto.repo.uploadBlob.
+func (s *Server) uploadBlob(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Failed to read blob: " + err.Error()}
+	}
+	mimeType := r.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	ref := makeCID(cid.Raw, data).String()
+
+	s.lock.Lock()
+	s.blobs[ref] = &Blob{MimeType: mimeType, Data: data}
+	s.lock.Unlock()
+
+	return writeJSON(w, map[string]any{
+		"blob": map[string]any{
+			"$type":    "blob",
+			"ref":      map[string]string{"$link": ref},
+			"mimeType": mimeType,
+			"size":     len(data),
+		},
+	})
+}
+
+// muteActor implements app.bsky.graph.muteActor.
+func (s *Server) muteActor(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	return s.setMute(w, r, session, true)
+}
+
+// unmuteActor implements app.bsky.graph.unmuteActor.
+func (s *Server) unmuteActor(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	return s.setMute(w, r, session, false)
+}
+
+// setMute mutes or unmutes a user on behalf of the caller.
+func (s *Server) setMute(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims, muted bool) error {
+	var input struct {
+		Actor string `json:"actor"`
+	}
+	if err := decodeInput(r, &input); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, err := s.lookup(input.Actor)
+	if err != nil {
+		return err
+	}
+	if s.mutes[session.Subject] == nil {
+		s.mutes[session.Subject] = make(map[string]bool)
+	}
+	if muted {
+		s.mutes[session.Subject][account.DID] = true
+	} else {
+		delete(s.mutes[session.Subject], account.DID)
+	}
+	return writeJSON(w, struct{}{})
+}
@@ -0,0 +1,690 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package clienttest implements an in-process fake of a Bluesky PDS, serving a
+// subset of the XRPC API from seeded fixtures, so that clients can be tested
+// without network access or real accounts.
+package clienttest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// ScopeAccess is the JWT scope of sessions created with a master password.
+	ScopeAccess = "com.atproto.access"
+
+	// ScopeAppPass is the JWT scope of sessions created with an app password.
+	ScopeAppPass = "com.atproto.appPass"
+
+	// ScopeRefresh is the JWT scope of refresh tokens.
+	ScopeRefresh = "com.atproto.refresh"
+
+	// defaultAccessTTL is the lifetime of access tokens, same as the live server.
+	defaultAccessTTL = 2 * time.Hour
+
+	// defaultRefreshTTL is the lifetime of refresh tokens, same as the live server.
+	defaultRefreshTTL = 60 * 24 * time.Hour
+
+	// maxPageSize is the maximum number of items returned in a single page.
+	maxPageSize = 100
+
+	// maxProfileBatch is the maximum number of actors getProfiles accepts.
+	maxProfileBatch = 25
+)
+
+// Account is a user seeded into the fake server.
+type Account struct {
+	Handle       string   // Handle of the user, used to log in and look up
+	DID          string   // DID of the user, used to log in and look up
+	Password     string   // Master password, issuing full access sessions
+	AppPasswords []string // App passwords, issuing restricted sessions
+	Name         string   // Display name of the user, empty if unset
+	Bio          string   // Profile description of the user, empty if unset
+	Avatar       []byte   // Encoded profile picture served via a CDN URL, nil if unset
+	Banner       []byte   // Encoded banner picture served via a CDN URL, nil if unset
+	Posts        int      // Number of posts to report on the profile
+}
+
+// Fault is an injected failure returned instead of serving a request.
+type Fault struct {
+	Status  int           // HTTP status code to respond with
+	Error   string        // XRPC error name to respond with (e.g. RateLimitExceeded)
+	Message string        // Human readable error message, optional
+	Header  http.Header   // Extra response headers (e.g. Retry-After), optional
+	Delay   time.Duration // Time to stall before responding, optional
+	Times   int           // Number of requests to fail, 0 to fail until cleared
+}
+
+// Server is a fake Bluesky PDS serving XRPC requests from seeded fixtures.
+type Server struct {
+	*httptest.Server
+
+	AccessTTL  time.Duration // Lifetime of the issued access tokens
+	RefreshTTL time.Duration // Lifetime of the issued refresh tokens
+
+	secret []byte // Key to sign the issued JWT tokens with
+
+	lock      sync.Mutex            // Lock protecting the fixtures and counters below
+	accounts  map[string]*Account   // Seeded accounts, indexed by both handle and DID
+	follows   map[string][]string   // Followees of users, in follow order
+	followers map[string][]string   // Followers of users, in follow order
+	faults    map[string][]*Fault   // Injected faults by XRPC method ("" for all)
+	calls     map[string]int        // Number of requests served by XRPC method
+	revoked   map[string]struct{}   // Already used refresh token identifiers
+	handlers  map[string]xrpcMethod // Implemented XRPC methods
+
+	repos map[string]map[string]map[string]*Record // Repository records by DID, collection and key
+	mutes map[string]map[string]bool               // Muted users by the DID of the muter
+	rkeys int                                      // Counter to generate record keys from
+	blobs map[string]*Blob                         // Uploaded blobs by content hash
+}
+
+// xrpcMethod is an XRPC method handler. The session is the verified caller, or
+// nil if the request was unauthenticated.
+type xrpcMethod func(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error
+
+// xrpcError is an error to be returned from an XRPC method with a given status.
+type xrpcError struct {
+	status  int
+	name    string
+	message string
+}
+
+// Error implements the error interface.
+func (e *xrpcError) Error() string {
+	return fmt.Sprintf("%s: %s", e.name, e.message)
+}
+
+// sessionClaims are the JWT claims of the issued tokens.
+type sessionClaims struct {
+	Scope string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+// NewServer starts a fake PDS with no accounts. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	s := &Server{
+		AccessTTL:  defaultAccessTTL,
+		RefreshTTL: defaultRefreshTTL,
+		secret:     secret,
+		accounts:   make(map[string]*Account),
+		follows:    make(map[string][]string),
+		followers:  make(map[string][]string),
+		faults:     make(map[string][]*Fault),
+		calls:      make(map[string]int),
+		revoked:    make(map[string]struct{}),
+		repos:      make(map[string]map[string]map[string]*Record),
+		mutes:      make(map[string]map[string]bool),
+		blobs:      make(map[string]*Blob),
+	}
+	s.handlers = map[string]xrpcMethod{
+		"com.atproto.server.describeServer":  s.describeServer,
+		"com.atproto.server.createSession":   s.createSession,
+		"com.atproto.server.refreshSession":  s.refreshSession,
+		"com.atproto.server.getSession":      s.authenticated(s.getSession),
+		"app.bsky.actor.getProfile":          s.authenticated(s.getProfile),
+		"app.bsky.actor.getProfiles":         s.authenticated(s.getProfiles),
+		"app.bsky.graph.getFollowers":        s.authenticated(s.getFollowers),
+		"app.bsky.graph.getFollows":          s.authenticated(s.getFollows),
+		"app.bsky.graph.muteActor":           s.authenticated(s.muteActor),
+		"app.bsky.graph.unmuteActor":         s.authenticated(s.unmuteActor),
+		"com.atproto.identity.resolveHandle": s.resolveHandle,
+		"com.atproto.repo.getRecord":         s.getRecord,
+		"com.atproto.repo.listRecords":       s.listRecords,
+		"com.atproto.repo.putRecord":         s.authenticated(s.putRecord),
+		"com.atproto.repo.createRecord":      s.authenticated(s.createRecord),
+		"com.atproto.repo.deleteRecord":      s.authenticated(s.deleteRecord),
+		"com.atproto.repo.applyWrites":       s.authenticated(s.applyWrites),
+		"com.atproto.repo.uploadBlob":        s.authenticated(s.uploadBlob),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddAccount seeds a new user into the server.
+func (s *Server) AddAccount(account *Account) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.accounts[account.Handle] = account
+	s.accounts[account.DID] = account
+}
+
+// AddFollow seeds a follow relationship between two users, identified by handle
+// or DID. Both users need to be already added.
+func (s *Server) AddFollow(follower string, followee string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	from, to := s.accounts[follower], s.accounts[followee]
+	if from == nil || to == nil {
+		panic(fmt.Sprintf("unknown account in follow %s -> %s", follower, followee))
+	}
+	s.follows[from.DID] = append(s.follows[from.DID], to.DID)
+	s.followers[to.DID] = append(s.followers[to.DID], from.DID)
+}
+
+// InjectFault makes the server fail requests to an XRPC method (or to all of
+// them if the method is empty). Multiple faults on the same method are served
+// in the order they were injected.
+func (s *Server) InjectFault(method string, fault *Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults[method] = append(s.faults[method], fault)
+}
+
+// ClearFaults removes all the injected faults.
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.faults = make(map[string][]*Fault)
+}
+
+// Calls returns the number of requests made to an XRPC method, including the
+// ones failed via injected faults.
+func (s *Server) Calls(method string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.calls[method]
+}
+
+// IssueSession mints a new pair of access and refresh tokens for a user with
+// the requested scope and lifetimes, bypassing the login.
+func (s *Server) IssueSession(did string, scope string, accessTTL time.Duration, refreshTTL time.Duration) (string, string, error) {
+	now := time.Now()
+
+	access, err := s.sign(did, scope, now, accessTTL)
+	if err != nil {
+		return "", "", err
+	}
+	refresh, err := s.sign(did, ScopeRefresh, now, refreshTTL)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// sign mints a single JWT token.
+func (s *Server) sign(did string, scope string, now time.Time, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	claims := &sessionClaims{
+		Scope: scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        fmt.Sprintf("%x", id),
+			Subject:   did,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+}
+
+// verify checks the signature and expiration of a token from a request, and
+// that its scope is one of the allowed ones.
+func (s *Server) verify(r *http.Request, scopes ...string) (*sessionClaims, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, &xrpcError{http.StatusUnauthorized, "AuthenticationRequired", "Authentication Required"}
+	}
+	claims := new(sessionClaims)
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, func(*jwt.Token) (any, error) {
+		return s.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, &xrpcError{http.StatusBadRequest, "ExpiredToken", "Token has expired"}
+		}
+		return nil, &xrpcError{http.StatusBadRequest, "InvalidToken", "Token could not be verified"}
+	}
+	for _, scope := range scopes {
+		if claims.Scope == scope {
+			return claims, nil
+		}
+	}
+	return nil, &xrpcError{http.StatusBadRequest, "InvalidToken", "Bad token scope"}
+}
+
+// authenticated wraps an XRPC method, rejecting requests without a valid access
+// token.
+func (s *Server) authenticated(method xrpcMethod) xrpcMethod {
+	return func(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+		claims, err := s.verify(r, ScopeAccess, ScopeAppPass)
+		if err != nil {
+			return err
+		}
+		return method(w, r, &claims.RegisteredClaims)
+	}
+}
+
+// serve dispatches an HTTP request either to an XRPC method or the image CDN.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/img/") {
+		s.serveImage(w, r)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, "/xrpc/")
+	if method == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	// Track the call and fail it if a fault was injected
+	s.lock.Lock()
+	s.calls[method]++
+
+	fault := s.nextFault(method)
+	if fault == nil {
+		fault = s.nextFault("")
+	}
+	handler := s.handlers[method]
+	s.lock.Unlock()
+
+	if fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		for key, vals := range fault.Header {
+			w.Header()[key] = vals
+		}
+		writeError(w, &xrpcError{fault.Status, fault.Error, fault.Message})
+		return
+	}
+	if handler == nil {
+		writeError(w, &xrpcError{http.StatusNotImplemented, "MethodNotImplemented", "Method Not Implemented"})
+		return
+	}
+	if err := handler(w, r, nil); err != nil {
+		writeError(w, err)
+	}
+}
+
+// nextFault retrieves the next injected fault for a method, consuming it if it
+// was limited to a number of requests. The lock is assumed held.
+func (s *Server) nextFault(method string) *Fault {
+	faults := s.faults[method]
+	if len(faults) == 0 {
+		return nil
+	}
+	fault := faults[0]
+	if fault.Times > 0 {
+		if fault.Times--; fault.Times == 0 {
+			s.faults[method] = faults[1:]
+		}
+	}
+	return fault
+}
+
+// serveImage serves the profile pictures of the seeded accounts at the URLs
+// advertised in the profiles.
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/img/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	s.lock.Lock()
+	account := s.accounts[parts[1]]
+	s.lock.Unlock()
+
+	var data []byte
+	if account != nil {
+		switch parts[0] {
+		case "avatar":
+			data = account.Avatar
+		case "banner":
+			data = account.Banner
+		}
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// describeServer implements com.atproto.server.describeServer.
+func (s *Server) describeServer(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	required := false
+	return writeJSON(w, &atproto.ServerDescribeServer_Output{
+		AvailableUserDomains: []string{".test"},
+		InviteCodeRequired:   &required,
+	})
+}
+
+// createSession implements com.atproto.server.createSession.
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	var input atproto.ServerCreateSession_Input
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", err.Error()}
+	}
+	s.lock.Lock()
+	account := s.accounts[strings.ToLower(input.Identifier)]
+	s.lock.Unlock()
+
+	if account == nil {
+		return &xrpcError{http.StatusUnauthorized, "AuthenticationRequired", "Invalid identifier or password"}
+	}
+	scope := ""
+	if input.Password == account.Password && account.Password != "" {
+		scope = ScopeAccess
+	}
+	for _, appkey := range account.AppPasswords {
+		if input.Password == appkey {
+			scope = ScopeAppPass
+		}
+	}
+	if scope == "" {
+		return &xrpcError{http.StatusUnauthorized, "AuthenticationRequired", "Invalid identifier or password"}
+	}
+	access, refresh, err := s.IssueSession(account.DID, scope, s.AccessTTL, s.RefreshTTL)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &atproto.ServerCreateSession_Output{
+		AccessJwt:  access,
+		RefreshJwt: refresh,
+		Handle:     account.Handle,
+		Did:        account.DID,
+	})
+}
+
+// refreshSession implements com.atproto.server.refreshSession. Refresh tokens
+// are single use, rotated on every refresh like on the live server.
+func (s *Server) refreshSession(w http.ResponseWriter, r *http.Request, _ *jwt.RegisteredClaims) error {
+	claims, err := s.verify(r, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	account := s.accounts[claims.Subject]
+	_, revoked := s.revoked[claims.ID]
+	s.revoked[claims.ID] = struct{}{}
+	s.lock.Unlock()
+
+	if revoked {
+		return &xrpcError{http.StatusBadRequest, "ExpiredToken", "Token has been revoked"}
+	}
+	if account == nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidToken", "Account not found"}
+	}
+	// The live server keeps the original session scope, but doesn't embed it in
+	// the refresh token, so default to the restricted one
+	access, refresh, err := s.IssueSession(account.DID, ScopeAppPass, s.AccessTTL, s.RefreshTTL)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &atproto.ServerRefreshSession_Output{
+		AccessJwt:  access,
+		RefreshJwt: refresh,
+		Handle:     account.Handle,
+		Did:        account.DID,
+	})
+}
+
+// getSession implements com.atproto.server.getSession.
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	account := s.accounts[session.Subject]
+	s.lock.Unlock()
+
+	if account == nil {
+		return &xrpcError{http.StatusBadRequest, "InvalidToken", "Account not found"}
+	}
+	return writeJSON(w, &atproto.ServerGetSession_Output{
+		Did:    account.DID,
+		Handle: account.Handle,
+	})
+}
+
+// getProfile implements app.bsky.actor.getProfile.
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, err := s.lookup(r.URL.Query().Get("actor"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, s.profileViewDetailed(account, session.Subject))
+}
+
+// getProfiles implements app.bsky.actor.getProfiles. Like the real server, actors
+// that cannot be found are silently omitted from the response. Actors are
+// accepted both as repeated and as comma separated parameters.
+func (s *Server) getProfiles(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var actors []string
+	for _, param := range r.URL.Query()["actors"] {
+		for _, actor := range strings.Split(param, ",") {
+			if actor != "" {
+				actors = append(actors, actor)
+			}
+		}
+	}
+	if len(actors) == 0 {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Error: Params must have the property \"actors\""}
+	}
+	if len(actors) > maxProfileBatch {
+		return &xrpcError{http.StatusBadRequest, "InvalidRequest", "Error: actors must not have more than 25 elements"}
+	}
+	views := make([]*profileViewDetailed, 0, len(actors))
+	for _, actor := range actors {
+		if account, err := s.lookup(actor); err == nil {
+			views = append(views, s.profileViewDetailed(account, session.Subject))
+		}
+	}
+	return writeJSON(w, map[string]any{"profiles": views})
+}
+
+// getFollowers implements app.bsky.graph.getFollowers.
+func (s *Server) getFollowers(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, err := s.lookup(r.URL.Query().Get("actor"))
+	if err != nil {
+		return err
+	}
+	page, cursor, err := s.paginate(r, s.followers[account.DID])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &bsky.GraphGetFollowers_Output{
+		Subject:   s.profileView(account),
+		Followers: page,
+		Cursor:    cursor,
+	})
+}
+
+// getFollows implements app.bsky.graph.getFollows.
+func (s *Server) getFollows(w http.ResponseWriter, r *http.Request, session *jwt.RegisteredClaims) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, err := s.lookup(r.URL.Query().Get("actor"))
+	if err != nil {
+		return err
+	}
+	page, cursor, err := s.paginate(r, s.follows[account.DID])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &bsky.GraphGetFollows_Output{
+		Subject: s.profileView(account),
+		Follows: page,
+		Cursor:  cursor,
+	})
+}
+
+// lookup finds a seeded account by handle or DID. The lock is assumed held.
+func (s *Server) lookup(actor string) (*Account, error) {
+	if actor == "" {
+		return nil, &xrpcError{http.StatusBadRequest, "InvalidRequest", "Error: Params must have the property \"actor\""}
+	}
+	account := s.accounts[strings.ToLower(actor)]
+	if account == nil {
+		account = s.accounts[actor]
+	}
+	if account == nil {
+		return nil, &xrpcError{http.StatusBadRequest, "InvalidRequest", "Profile not found"}
+	}
+	return account, nil
+}
+
+// paginate slices a page of users out of a list based on the cursor and limit
+// parameters of a request. The cursor is the index of the first item. The lock
+// is assumed held.
+func (s *Server) paginate(r *http.Request, dids []string) ([]*bsky.ActorDefs_ProfileView, *string, error) {
+	limit := 50
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > maxPageSize {
+			return nil, nil, &xrpcError{http.StatusBadRequest, "InvalidRequest", "Error: limit must be between 1 and 100"}
+		}
+	}
+	var start int
+	if param := r.URL.Query().Get("cursor"); param != "" {
+		var err error
+		if start, err = strconv.Atoi(param); err != nil || start < 0 || start > len(dids) {
+			return nil, nil, &xrpcError{http.StatusBadRequest, "InvalidRequest", "Malformed cursor"}
+		}
+	}
+	end := start + limit
+	if end > len(dids) {
+		end = len(dids)
+	}
+	page := make([]*bsky.ActorDefs_ProfileView, 0, end-start)
+	for _, did := range dids[start:end] {
+		page = append(page, s.profileView(s.accounts[did]))
+	}
+	if end == len(dids) {
+		return page, nil, nil
+	}
+	cursor := strconv.Itoa(end)
+	return page, &cursor, nil
+}
+
+// profileView converts a seeded account into a profile view. The lock is
+// assumed held.
+func (s *Server) profileView(account *Account) *bsky.ActorDefs_ProfileView {
+	view := &bsky.ActorDefs_ProfileView{
+		Did:    account.DID,
+		Handle: account.Handle,
+	}
+	view.DisplayName, view.Description, view.Avatar = s.profileFields(account)
+	return view
+}
+
+// profileViewDetailed is a detailed profile view, extended with the viewer state
+// fields missing from the generated atproto type.
+type profileViewDetailed struct {
+	*bsky.ActorDefs_ProfileViewDetailed
+	Viewer *viewerState `json:"viewer,omitempty"`
+}
+
+// viewerState is the relationship of the requesting user to a viewed profile.
+type viewerState struct {
+	Muted     bool   `json:"muted"`
+	Following string `json:"following,omitempty"` // URI of the viewer's follow record, if any
+	Blocking  string `json:"blocking,omitempty"`  // URI of the viewer's block record, if any
+}
+
+// profileViewDetailed converts a seeded account into a detailed profile view,
+// including the social graph counters and the relationship of the viewer to it,
+// as stored in the viewer's repository. The lock is assumed held.
+func (s *Server) profileViewDetailed(account *Account, viewer string) *profileViewDetailed {
+	var (
+		followers = int64(len(s.followers[account.DID]))
+		follows   = int64(len(s.follows[account.DID]))
+		posts     = int64(account.Posts)
+	)
+	view := &bsky.ActorDefs_ProfileViewDetailed{
+		Did:            account.DID,
+		Handle:         account.Handle,
+		FollowersCount: &followers,
+		FollowsCount:   &follows,
+		PostsCount:     &posts,
+	}
+	view.DisplayName, view.Description, view.Avatar = s.profileFields(account)
+	if account.Banner != nil {
+		banner := s.URL + "/img/banner/" + account.DID
+		view.Banner = &banner
+	}
+	return &profileViewDetailed{
+		ActorDefs_ProfileViewDetailed: view,
+		Viewer: &viewerState{
+			Muted:     s.mutes[viewer][account.DID],
+			Following: s.graphRecord(viewer, "app.bsky.graph.follow", account.DID),
+			Blocking:  s.graphRecord(viewer, "app.bsky.graph.block", account.DID),
+		},
+	}
+}
+
+// profileFields converts the optional profile fields of an account into their
+// API representation.
+func (s *Server) profileFields(account *Account) (name *string, bio *string, avatar *string) {
+	if account.Name != "" {
+		name = &account.Name
+	}
+	if account.Bio != "" {
+		bio = &account.Bio
+	}
+	if account.Avatar != nil {
+		url := s.URL + "/img/avatar/" + account.DID
+		avatar = &url
+	}
+	return name, bio, avatar
+}
+
+// writeJSON writes a successful XRPC response.
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes a failed XRPC response.
+func writeError(w http.ResponseWriter, err error) {
+	var xerr *xrpcError
+	if !errors.As(err, &xerr) {
+		xerr = &xrpcError{http.StatusInternalServerError, "InternalServerError", err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(xerr.status)
+
+	body := map[string]string{"error": xerr.name}
+	if xerr.message != "" {
+		body["message"] = xerr.message
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clienttest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// makeTestServer starts a fake server with a single account.
+func makeTestServer(t *testing.T) (*Server, *xrpc.Client) {
+	srv := NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.AddAccount(&Account{
+		Handle:       "alice.test",
+		DID:          "did:plc:alice",
+		Password:     "hunter2",
+		AppPasswords: []string{"app-pass"},
+		Name:         "Alice",
+	})
+	return srv, &xrpc.Client{Client: srv.Client(), Host: srv.URL}
+}
+
+// Tests that sessions are scoped by the type of password used and that their
+// lifetime is configurable.
+func TestCreateSession(t *testing.T) {
+	srv, client := makeTestServer(t)
+	srv.AccessTTL = time.Minute
+
+	for _, tt := range []struct {
+		password string
+		scope    string
+	}{
+		{password: "hunter2", scope: ScopeAccess},
+		{password: "app-pass", scope: ScopeAppPass},
+		{password: "wrong"},
+	} {
+		sess, err := atproto.ServerCreateSession(context.Background(), client, &atproto.ServerCreateSession_Input{
+			Identifier: "alice.test",
+			Password:   tt.password,
+		})
+		if tt.scope == "" {
+			if err == nil {
+				t.Errorf("%s: login succeeded with invalid password", tt.password)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to login: %v", tt.password, err)
+			continue
+		}
+		claims := new(sessionClaims)
+		if _, _, err := jwt.NewParser().ParseUnverified(sess.AccessJwt, claims); err != nil {
+			t.Errorf("%s: failed to parse access token: %v", tt.password, err)
+			continue
+		}
+		if claims.Scope != tt.scope {
+			t.Errorf("%s: scope mismatch: have %s, want %s", tt.password, claims.Scope, tt.scope)
+		}
+		if ttl := time.Until(claims.ExpiresAt.Time); ttl > time.Minute || ttl < 50*time.Second {
+			t.Errorf("%s: access token lifetime mismatch: have %v, want %v", tt.password, ttl, time.Minute)
+		}
+	}
+}
+
+// Tests that refresh tokens are rotated and cannot be reused, and that expired
+// tokens are rejected.
+func TestRefreshSession(t *testing.T) {
+	srv, client := makeTestServer(t)
+
+	access, refresh, err := srv.IssueSession("did:plc:alice", ScopeAppPass, -time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue session: %v", err)
+	}
+	client.Auth = &xrpc.AuthInfo{AccessJwt: access, RefreshJwt: refresh}
+	if _, err := bsky.ActorGetProfile(context.Background(), client, "alice.test"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expired token error mismatch: have %v, want 400", err)
+	}
+	// Refresh the session and ensure the old refresh token is revoked
+	client.Auth.AccessJwt = refresh
+	if _, err := atproto.ServerRefreshSession(context.Background(), client); err != nil {
+		t.Fatalf("failed to refresh session: %v", err)
+	}
+	if _, err := atproto.ServerRefreshSession(context.Background(), client); err == nil {
+		t.Errorf("refresh token reuse succeeded")
+	}
+	// Access tokens should not be usable for refreshing
+	access, _, _ = srv.IssueSession("did:plc:alice", ScopeAppPass, time.Hour, time.Hour)
+	client.Auth.AccessJwt = access
+	if _, err := atproto.ServerRefreshSession(context.Background(), client); err == nil {
+		t.Errorf("refresh with access token succeeded")
+	}
+	if _, err := bsky.ActorGetProfile(context.Background(), client, "alice.test"); err != nil {
+		t.Errorf("failed to use fresh access token: %v", err)
+	}
+}
+
+// Tests that injected faults are served the requested number of times.
+func TestInjectFault(t *testing.T) {
+	srv, client := makeTestServer(t)
+	srv.InjectFault("com.atproto.server.describeServer", &Fault{
+		Status: http.StatusTooManyRequests,
+		Error:  "RateLimitExceeded",
+		Times:  2,
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := atproto.ServerDescribeServer(context.Background(), client); err == nil || !strings.Contains(err.Error(), "429") {
+			t.Errorf("call %d: fault mismatch: have %v, want 429", i, err)
+		}
+	}
+	if _, err := atproto.ServerDescribeServer(context.Background(), client); err != nil {
+		t.Errorf("call after faults failed: %v", err)
+	}
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 3 {
+		t.Errorf("call count mismatch: have %d, want %d", calls, 3)
+	}
+	// Persistent faults on all methods should fail until cleared
+	srv.InjectFault("", &Fault{Status: http.StatusInternalServerError, Error: "InternalServerError"})
+	for i := 0; i < 3; i++ {
+		if _, err := atproto.ServerDescribeServer(context.Background(), client); err == nil {
+			t.Errorf("call %d: persistent fault not served", i)
+		}
+	}
+	srv.ClearFaults()
+	if _, err := atproto.ServerDescribeServer(context.Background(), client); err != nil {
+		t.Errorf("call after clearing faults failed: %v", err)
+	}
+}
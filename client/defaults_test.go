@@ -6,6 +6,8 @@ package client
 
 var (
 	testHandleTester = "go-bluesky-tester.bsky.social"
+	testPasswdTester = "master-password"
+	testAppkeyTester = "abcd-efgh-ijkl-mnop"
 	testDIDTester    = "did:plc:wflozfzpewefv46qof26vbzm"
 	testDIDPeter     = "did:plc:if2tug5buc5a3crz2d2i24i3"
 	testDIDJeromy    = "did:plc:vpkhqolt662uhesyj6nxm7ys"
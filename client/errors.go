@@ -0,0 +1,196 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrorBodyBytes is the maximum number of bytes to read from a failed XRPC
+// response when trying to decode the error details.
+const maxErrorBodyBytes = 64 * 1024
+
+var (
+	// ErrInvalidRequest is returned from any API call if the server rejected the
+	// request as malformed or referencing something invalid.
+	ErrInvalidRequest = errors.New("invalid request")
+
+	// ErrProfileNotFound is returned from any API call if the user referenced
+	// does not exist (or was deleted).
+	ErrProfileNotFound = errors.New("profile not found")
+
+	// ErrRateLimited is returned from any API call if the server refused it due
+	// to the client exceeding its rate limits.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrAuthRequired is returned from any API call if the server rejected the
+	// credentials of the client (missing, invalid or expired access token).
+	ErrAuthRequired = errors.New("authentication required")
+
+	// ErrAccountTakedown is returned from any API call if the account involved
+	// was taken down by the server's moderators.
+	ErrAccountTakedown = errors.New("account taken down")
+
+	// ErrInvalidSwap is returned from a repository write if the record was
+	// concurrently modified and the compare-and-swap guard failed.
+	ErrInvalidSwap = errors.New("invalid swap")
+
+	// ErrServerFailure is returned from any API call if the server failed to
+	// process it due to an internal error or being unavailable.
+	ErrServerFailure = errors.New("server failure")
+
+	// errRecordNotFound is returned from a record retrieval if the requested
+	// record does not exist (or was deleted).
+	errRecordNotFound = errors.New("record not found")
+)
+
+// APIError is a failure response from a Bluesky server to an XRPC call. It can
+// be retrieved from any error returned by the client via errors.As, and it can
+// be matched against the error sentinels of this package via errors.Is.
+type APIError struct {
+	Method  string // XRPC method (NSID) that failed
+	Status  int    // HTTP status code of the response
+	Name    string // XRPC error name (e.g. InvalidRequest, RateLimitExceeded)
+	Message string // Human readable error message, optional
+
+	RateLimit  *RateLimit    // Rate limit state reported by the server, nil if not reported
+	RetryAfter time.Duration // Delay requested by the server before retrying, 0 if not requested
+}
+
+// RateLimit is the rate limit state reported by a server via the ratelimit-*
+// response headers.
+type RateLimit struct {
+	Limit     int       // Number of requests allowed within the window
+	Remaining int       // Number of requests remaining within the window
+	Reset     time.Time // Time when the window resets
+	Policy    string    // Raw policy description, e.g. "3000;w=300"
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	name := e.Name
+	if name == "" {
+		name = http.StatusText(e.Status)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("%s: %s (%d)", e.Method, name, e.Status)
+	}
+	return fmt.Sprintf("%s: %s (%d): %s", e.Method, name, e.Status, maybeEscape(e.Message))
+}
+
+// Is maps the API error onto the error sentinels of this package.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidRequest:
+		return e.Name == "InvalidRequest"
+	case ErrProfileNotFound:
+		return e.isProfileNotFound()
+	case ErrRateLimited:
+		return e.Status == http.StatusTooManyRequests || e.Name == "RateLimitExceeded"
+	case ErrAuthRequired:
+		return e.Status == http.StatusUnauthorized || e.Name == "AuthenticationRequired" ||
+			e.Name == "InvalidToken" || e.Name == "ExpiredToken"
+	case ErrSessionExpired:
+		return e.Method == "com.atproto.server.refreshSession" && (e.Name == "ExpiredToken" || e.Name == "InvalidToken")
+	case ErrAccountTakedown:
+		return e.Name == "AccountTakedown"
+	case ErrInvalidSwap:
+		return e.Name == "InvalidSwap"
+	case ErrServerFailure:
+		return e.Status >= http.StatusInternalServerError
+	case errRecordNotFound:
+		return e.Name == "RecordNotFound" ||
+			(e.Name == "InvalidRequest" && strings.Contains(strings.ToLower(e.Message), "could not locate record"))
+	}
+	return false
+}
+
+// isProfileNotFound checks whether the error signals a missing user. The server
+// reports these as generic invalid requests, so the message needs to be checked.
+func (e *APIError) isProfileNotFound() bool {
+	switch e.Name {
+	case "ProfileNotFound", "ActorNotFound", "RepoNotFound":
+		return true
+	case "InvalidRequest":
+		msg := strings.ToLower(e.Message)
+		return strings.Contains(msg, "profile not found") || strings.Contains(msg, "actor not found") ||
+			strings.Contains(msg, "could not find repo") || strings.Contains(msg, "unable to resolve handle")
+	}
+	return false
+}
+
+// errorTransport is an HTTP transport converting failed XRPC responses into
+// typed API errors. Since the XRPC library discards the response body of
+// failures, the conversion needs to happen before the response reaches it.
+type errorTransport struct {
+	base http.RoundTripper // Transport to execute the requests with
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil || res.StatusCode == http.StatusOK || !strings.HasPrefix(req.URL.Path, "/xrpc/") {
+		return res, err
+	}
+	defer res.Body.Close()
+	return nil, newAPIError(strings.TrimPrefix(req.URL.Path, "/xrpc/"), res)
+}
+
+// newAPIError parses a failed XRPC response into an API error.
+func newAPIError(method string, res *http.Response) *APIError {
+	apiErr := &APIError{
+		Method: method,
+		Status: res.StatusCode,
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxErrorBodyBytes)).Decode(&body); err == nil {
+		apiErr.Name, apiErr.Message = body.Error, body.Message
+	}
+	// Parse the rate limit details if the server reported them
+	if limit, err := strconv.Atoi(res.Header.Get("ratelimit-limit")); err == nil {
+		apiErr.RateLimit = &RateLimit{
+			Limit:  limit,
+			Policy: res.Header.Get("ratelimit-policy"),
+		}
+		apiErr.RateLimit.Remaining, _ = strconv.Atoi(res.Header.Get("ratelimit-remaining"))
+		if reset, err := strconv.ParseInt(res.Header.Get("ratelimit-reset"), 10, 64); err == nil {
+			apiErr.RateLimit.Reset = time.Unix(reset, 0)
+		}
+	}
+	apiErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	return apiErr
+}
+
+// parseRetryAfter parses a Retry-After header, which may be either a number of
+// seconds or an HTTP date, into a delay relative to now.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
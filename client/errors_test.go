@@ -0,0 +1,165 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+)
+
+// Tests that API errors match the correct sentinels.
+func TestAPIErrorSentinels(t *testing.T) {
+	tests := []struct {
+		err  *APIError
+		is   []error
+		isnt []error
+	}{
+		{
+			err:  &APIError{Method: "app.bsky.actor.getProfile", Status: 400, Name: "InvalidRequest", Message: "Profile not found"},
+			is:   []error{ErrInvalidRequest, ErrProfileNotFound},
+			isnt: []error{ErrRateLimited, ErrServerFailure, ErrAuthRequired},
+		},
+		{
+			err:  &APIError{Method: "app.bsky.actor.getProfile", Status: 400, Name: "InvalidRequest", Message: "Error: limit too high"},
+			is:   []error{ErrInvalidRequest},
+			isnt: []error{ErrProfileNotFound},
+		},
+		{
+			err:  &APIError{Method: "app.bsky.graph.getFollowers", Status: 429, Name: "RateLimitExceeded"},
+			is:   []error{ErrRateLimited},
+			isnt: []error{ErrInvalidRequest, ErrServerFailure},
+		},
+		{
+			err:  &APIError{Method: "app.bsky.feed.getTimeline", Status: 400, Name: "ExpiredToken"},
+			is:   []error{ErrAuthRequired},
+			isnt: []error{ErrSessionExpired},
+		},
+		{
+			err: &APIError{Method: "com.atproto.server.refreshSession", Status: 400, Name: "ExpiredToken"},
+			is:  []error{ErrAuthRequired, ErrSessionExpired},
+		},
+		{
+			err: &APIError{Method: "com.atproto.server.createSession", Status: 400, Name: "AccountTakedown"},
+			is:  []error{ErrAccountTakedown},
+		},
+		{
+			err: &APIError{Method: "com.atproto.repo.putRecord", Status: 400, Name: "InvalidSwap"},
+			is:  []error{ErrInvalidSwap},
+		},
+		{
+			err:  &APIError{Method: "com.atproto.repo.getRecord", Status: 400, Name: "InvalidRequest", Message: "Could not locate record: at://did:plc:test/app.bsky.actor.profile/self"},
+			is:   []error{ErrInvalidRequest, errRecordNotFound},
+			isnt: []error{ErrProfileNotFound},
+		},
+		{
+			err:  &APIError{Method: "app.bsky.actor.getProfile", Status: 502},
+			is:   []error{ErrServerFailure},
+			isnt: []error{ErrRateLimited},
+		},
+	}
+	for i, tt := range tests {
+		wrapped := fmt.Errorf("wrapped: %w", tt.err) // Ensure matching works through wrapping
+		for _, target := range tt.is {
+			if !errors.Is(wrapped, target) {
+				t.Errorf("test %d: %v not matched as %v", i, tt.err, target)
+			}
+		}
+		for _, target := range tt.isnt {
+			if errors.Is(wrapped, target) {
+				t.Errorf("test %d: %v wrongly matched as %v", i, tt.err, target)
+			}
+		}
+	}
+}
+
+// Tests that Retry-After headers are parsed in both of their formats.
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		delay  time.Duration
+	}{
+		{header: "", delay: 0},
+		{header: "30", delay: 30 * time.Second},
+		{header: "-5", delay: 0},
+		{header: now.Add(time.Minute).Format(http.TimeFormat), delay: time.Minute},
+		{header: now.Add(-time.Minute).Format(http.TimeFormat), delay: 0},
+		{header: "soon", delay: 0},
+	}
+	for _, tt := range tests {
+		if delay := parseRetryAfter(tt.header, now); delay != tt.delay {
+			t.Errorf("%q: delay mismatch: have %v, want %v", tt.header, delay, tt.delay)
+		}
+	}
+}
+
+// Tests that fetching a non-existent profile returns a typed error.
+func TestFetchProfileNotFound(t *testing.T) {
+	client := makeTestClientWithLogin(t)
+
+	_, err := client.FetchProfile(context.Background(), "nobody.test")
+	if !errors.Is(err, ErrProfileNotFound) {
+		t.Fatalf("missing profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("missing profile error not an API error: %T", err)
+	}
+	if apiErr.Status != http.StatusBadRequest || apiErr.Name != "InvalidRequest" || apiErr.Method != "app.bsky.actor.getProfile" {
+		t.Errorf("missing profile error details mismatch: have %+v", apiErr)
+	}
+}
+
+// Tests that rate limited calls return a typed error with the limit details.
+func TestRateLimitedError(t *testing.T) {
+	srv := makeTestServer(t)
+
+	// Disable retries to surface the rate limit instead of waiting it out
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client(), WithRetryPolicy(nil))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	reset := time.Now().Add(time.Minute).Truncate(time.Second)
+	srv.InjectFault("com.atproto.server.createSession", &clienttest.Fault{
+		Status:  http.StatusTooManyRequests,
+		Error:   "RateLimitExceeded",
+		Message: "Rate Limit Exceeded",
+		Header: http.Header{
+			"Ratelimit-Limit":     {"30"},
+			"Ratelimit-Remaining": {"0"},
+			"Ratelimit-Reset":     {strconv.FormatInt(reset.Unix(), 10)},
+			"Ratelimit-Policy":    {"30;w=300"},
+			"Retry-After":         {"60"},
+		},
+	})
+	err = client.Login(context.Background(), testHandleTester, testAppkeyTester)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("rate limited error mismatch: have %v, want %v", err, ErrRateLimited)
+	}
+	if errors.Is(err, ErrLoginUnauthorized) {
+		t.Errorf("rate limited login reported as unauthorized: %v", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("rate limited error not an API error: %T", err)
+	}
+	if apiErr.RetryAfter != time.Minute {
+		t.Errorf("retry after mismatch: have %v, want %v", apiErr.RetryAfter, time.Minute)
+	}
+	limit := apiErr.RateLimit
+	if limit == nil || limit.Limit != 30 || limit.Remaining != 0 || !limit.Reset.Equal(reset) || limit.Policy != "30;w=300" {
+		t.Errorf("rate limit mismatch: have %+v", limit)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// feedPageFetcher retrieves a single page of a feed starting at a cursor.
+type feedPageFetcher func(ctx context.Context, cursor string) ([]*feedItem, *string, error)
+
+// feedItem is a post view from a feed, along with the hashtags of its facets.
+//
+// The pinned lexicon predates app.bsky.richtext.facet#tag and silently drops the
+// feature when decoding, so the tags are dug out of the raw JSON separately,
+// indexed by facet and feature position.
+type feedItem struct {
+	*bsky.FeedDefs_FeedViewPost
+	tags map[[2]int]string
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding both the generated post
+// view and the hashtags from the raw facet features.
+func (item *feedItem) UnmarshalJSON(blob []byte) error {
+	view := new(bsky.FeedDefs_FeedViewPost)
+	if err := json.Unmarshal(blob, view); err != nil {
+		return err
+	}
+	var raw struct {
+		Post struct {
+			Record struct {
+				Facets []struct {
+					Features []struct {
+						Type string `json:"$type"`
+						Tag  string `json:"tag"`
+					} `json:"features"`
+				} `json:"facets"`
+			} `json:"record"`
+		} `json:"post"`
+	}
+	if err := json.Unmarshal(blob, &raw); err != nil {
+		return err
+	}
+	item.FeedDefs_FeedViewPost, item.tags = view, nil
+	for i, facet := range raw.Post.Record.Facets {
+		for j, feature := range facet.Features {
+			if feature.Type != "app.bsky.richtext.facet#tag" || feature.Tag == "" {
+				continue
+			}
+			if item.tags == nil {
+				item.tags = make(map[[2]int]string)
+			}
+			item.tags[[2]int{i, j}] = feature.Tag
+		}
+	}
+	return nil
+}
+
+// tag returns the hashtag of a facet feature, or empty if it's not a tag.
+func (item *feedItem) tag(facet int, feature int) string {
+	return item.tags[[2]int{facet, feature}]
+}
+
+// feedPage is a single page of a feed, as returned by the feed endpoints.
+type feedPage struct {
+	Cursor *string     `json:"cursor,omitempty"`
+	Feed   []*feedItem `json:"feed"`
+}
+
+// fetchFeedPage retrieves a single page of a feed from the given endpoint.
+func (c *Client) fetchFeedPage(ctx context.Context, method string, params map[string]any) ([]*feedItem, *string, error) {
+	var res feedPage
+	if err := c.client.Do(ctx, xrpc.Query, "", method, params, nil, &res); err != nil {
+		return nil, nil, err
+	}
+	return res.Feed, res.Cursor, nil
+}
+
+// StreamPosts gradually resolves the posts (and reposts) authored by a profile,
+// newest first, feeding them async into a result channel, closing the channel
+// when there are no more posts left. An error channel is also returned and will
+// receive (optionally, only ever one) error in case of a failure.
+//
+// The stream starts at the given cursor, or at the newest post if empty. Every
+// delivered post carries the cursor from which the stream can be resumed after
+// a restart. Resuming redelivers the post (and the ones after it on the same
+// page), so consumers should be prepared to see some duplicates.
+func (p *Profile) StreamPosts(ctx context.Context, cursor string) (<-chan *Post, <-chan error) {
+	return p.client.streamFeed(ctx, cursor, func(ctx context.Context, cursor string) ([]*feedItem, *string, error) {
+		return p.client.fetchFeedPage(ctx, "app.bsky.feed.getAuthorFeed", map[string]any{
+			"actor":  p.DID,
+			"cursor": cursor,
+			"limit":  100,
+		})
+	})
+}
+
+// StreamTimeline gradually resolves the home timeline of the logged in user,
+// newest first, feeding the posts async into a result channel, closing the
+// channel when there are no more posts left. An error channel is also returned
+// and will receive (optionally, only ever one) error in case of a failure.
+//
+// The stream starts at the given cursor, or at the newest post if empty. Every
+// delivered post carries the cursor from which the stream can be resumed after
+// a restart. Resuming redelivers the post (and the ones after it on the same
+// page), so consumers should be prepared to see some duplicates.
+func (c *Client) StreamTimeline(ctx context.Context, cursor string) (<-chan *Post, <-chan error) {
+	return c.streamFeed(ctx, cursor, func(ctx context.Context, cursor string) ([]*feedItem, *string, error) {
+		return c.fetchFeedPage(ctx, "app.bsky.feed.getTimeline", map[string]any{
+			"algorithm": "reverse-chronological",
+			"cursor":    cursor,
+			"limit":     100,
+		})
+	})
+}
+
+// streamFeed iterates over the pages of a feed via the given page fetcher and
+// streams the posts into a result channel.
+func (c *Client) streamFeed(ctx context.Context, cursor string, fetch feedPageFetcher) (<-chan *Post, <-chan error) {
+	var (
+		posts    = make(chan *Post, 100) // Ensure all results fit to unblock a second call
+		errc     = make(chan error, 1)   // Ensure the failure fits to unblock termination
+		failures int                     // Consecutive failed page retrievals
+	)
+	go func() {
+		// No matter what happens, close both channels
+		defer func() {
+			close(posts)
+			close(errc)
+		}()
+		for {
+			// Resolve the next page of the feed from the Bluesky server
+			feed, next, err := fetch(ctx, cursor)
+			if err != nil {
+				// If rate limited, wait it out and retry from the same cursor
+				failures++
+				if err = c.waitPage(ctx, err, failures); err != nil {
+					errc <- err
+					return
+				}
+				continue
+			}
+			failures = 0
+			// Parse the posts and feed them one by one to the sink channel
+			for _, item := range feed {
+				post := newFeedPost(c, item)
+				post.Cursor = cursor
+
+				select {
+				case <-ctx.Done():
+					// Request is being torn down, abort
+					errc <- ctx.Err()
+					return
+				case posts <- post:
+					// Post read, get the next one
+				}
+			}
+			// If there are further posts to parse, repeat
+			if next == nil || *next == "" || len(feed) == 0 {
+				break
+			}
+			cursor = *next
+		}
+	}()
+	return posts, errc
+}
+
+// newFeedPost converts a post view from a feed into the library's post type.
+func newFeedPost(c *Client, item *feedItem) *Post {
+	view := item.Post
+
+	post := &Post{
+		URI:    view.Uri,
+		CID:    view.Cid,
+		Author: newBasicUser(c, view.Author),
+	}
+	post.IndexedAt, _ = time.Parse(time.RFC3339, view.IndexedAt)
+
+	if view.LikeCount != nil {
+		post.LikeCount = uint(*view.LikeCount)
+	}
+	if view.RepostCount != nil {
+		post.RepostCount = uint(*view.RepostCount)
+	}
+	if view.ReplyCount != nil {
+		post.ReplyCount = uint(*view.ReplyCount)
+	}
+	// Dig out the user content from the post record
+	if view.Record != nil {
+		if record, ok := view.Record.Val.(*bsky.FeedPost); ok {
+			post.Text = record.Text
+			post.CreatedAt, _ = time.Parse(time.RFC3339, record.CreatedAt)
+
+			for i, facet := range record.Facets {
+				if facet.Index == nil {
+					continue
+				}
+				for j, feature := range facet.Features {
+					f := &Facet{
+						ByteStart: int(facet.Index.ByteStart),
+						ByteEnd:   int(facet.Index.ByteEnd),
+					}
+					switch {
+					case feature.RichtextFacet_Mention != nil:
+						f.Mention = feature.RichtextFacet_Mention.Did
+					case feature.RichtextFacet_Link != nil:
+						f.Link = feature.RichtextFacet_Link.Uri
+					case item.tag(i, j) != "":
+						f.Tag = item.tag(i, j)
+					default:
+						continue // Unknown facet type
+					}
+					post.Facets = append(post.Facets, f)
+				}
+			}
+			if record.Reply != nil {
+				if record.Reply.Root != nil {
+					post.ReplyRoot = &PostRef{URI: record.Reply.Root.Uri, CID: record.Reply.Root.Cid}
+				}
+				if record.Reply.Parent != nil {
+					post.ReplyParent = &PostRef{URI: record.Reply.Parent.Uri, CID: record.Reply.Parent.Cid}
+				}
+			}
+		}
+	}
+	// Resolve the reply and repost context from the feed
+	if item.Reply != nil && item.Reply.Parent != nil {
+		post.ReplyTo = newBasicUser(c, item.Reply.Parent.Author)
+	}
+	if item.Reason != nil && item.Reason.FeedDefs_ReasonRepost != nil {
+		post.RepostedBy = newBasicUser(c, item.Reason.FeedDefs_ReasonRepost.By)
+	}
+	// Resolve the embedded media and quotes
+	if view.Embed != nil {
+		var (
+			images   *bsky.EmbedImages_View
+			external *bsky.EmbedExternal_View
+			quote    *bsky.EmbedRecord_View
+		)
+		switch {
+		case view.Embed.EmbedImages_View != nil:
+			images = view.Embed.EmbedImages_View
+		case view.Embed.EmbedExternal_View != nil:
+			external = view.Embed.EmbedExternal_View
+		case view.Embed.EmbedRecord_View != nil:
+			quote = view.Embed.EmbedRecord_View
+		case view.Embed.EmbedRecordWithMedia_View != nil:
+			quote = view.Embed.EmbedRecordWithMedia_View.Record
+			if media := view.Embed.EmbedRecordWithMedia_View.Media; media != nil {
+				images, external = media.EmbedImages_View, media.EmbedExternal_View
+			}
+		}
+		if images != nil {
+			for _, img := range images.Images {
+				post.Images = append(post.Images, &PostImage{
+					Alt:         img.Alt,
+					ThumbURL:    img.Thumb,
+					FullsizeURL: img.Fullsize,
+				})
+			}
+		}
+		if external != nil && external.External != nil {
+			post.Link = &PostLink{
+				URI:         external.External.Uri,
+				Title:       external.External.Title,
+				Description: external.External.Description,
+			}
+			if external.External.Thumb != nil {
+				post.Link.ThumbURL = *external.External.Thumb
+			}
+		}
+		if quote != nil && quote.Record != nil && quote.Record.EmbedRecord_ViewRecord != nil {
+			post.Quote = &PostRef{
+				URI: quote.Record.EmbedRecord_ViewRecord.Uri,
+				CID: quote.Record.EmbedRecord_ViewRecord.Cid,
+			}
+		}
+	}
+	return post
+}
+
+// newBasicUser converts a basic profile view into the library's user type.
+func newBasicUser(c *Client, view *bsky.ActorDefs_ProfileViewBasic) *User {
+	if view == nil {
+		return nil
+	}
+	user := &User{
+		client: c,
+		Handle: view.Handle,
+		DID:    view.Did,
+	}
+	if view.DisplayName != nil {
+		user.Name = *view.DisplayName
+	}
+	if view.Avatar != nil {
+		user.AvatarURL = *view.Avatar
+	}
+	return user
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// makeTestFeed creates a feed page fetcher serving the given number of posts in
+// pages of the given size. The cursors are the page indices.
+func makeTestFeed(posts int, page int) feedPageFetcher {
+	return func(ctx context.Context, cursor string) ([]*feedItem, *string, error) {
+		var start int
+		if cursor != "" {
+			fmt.Sscanf(cursor, "%d", &start)
+		}
+		var feed []*feedItem
+		for i := start; i < start+page && i < posts; i++ {
+			feed = append(feed, &feedItem{FeedDefs_FeedViewPost: &bsky.FeedDefs_FeedViewPost{
+				Post: &bsky.FeedDefs_PostView{
+					Uri:    fmt.Sprintf("at://%s/app.bsky.feed.post/%d", testDIDTester, i),
+					Author: &bsky.ActorDefs_ProfileViewBasic{Did: testDIDTester, Handle: testHandleTester},
+				},
+			}})
+		}
+		if start+page >= posts {
+			return feed, nil, nil
+		}
+		next := fmt.Sprintf("%d", start+page)
+		return feed, &next, nil
+	}
+}
+
+// Tests that feeds are streamed across pages and that each post carries the
+// cursor of its page, so the stream can be resumed from it.
+func TestStreamFeed(t *testing.T) {
+	client := new(Client)
+
+	postc, errc := client.streamFeed(context.Background(), "", makeTestFeed(250, 100))
+
+	var posts []*Post
+	for post := range postc {
+		posts = append(posts, post)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to stream feed: %v", err)
+	}
+	if len(posts) != 250 {
+		t.Fatalf("post count mismatch: have %d, want %d", len(posts), 250)
+	}
+	for i, post := range posts {
+		if want := fmt.Sprintf("at://%s/app.bsky.feed.post/%d", testDIDTester, i); post.URI != want {
+			t.Errorf("post %d: uri mismatch: have %s, want %s", i, post.URI, want)
+		}
+		want := ""
+		if i >= 100 {
+			want = fmt.Sprintf("%d", i/100*100)
+		}
+		if post.Cursor != want {
+			t.Errorf("post %d: cursor mismatch: have %q, want %q", i, post.Cursor, want)
+		}
+	}
+	// Resume the stream from the last page's cursor and ensure it continues there
+	postc, errc = client.streamFeed(context.Background(), posts[len(posts)-1].Cursor, makeTestFeed(250, 100))
+
+	var resumed int
+	for post := range postc {
+		if post.URI != posts[200+resumed].URI {
+			t.Errorf("resumed post %d: uri mismatch: have %s, want %s", resumed, post.URI, posts[200+resumed].URI)
+		}
+		resumed++
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to resume feed: %v", err)
+	}
+	if resumed != 50 {
+		t.Errorf("resumed post count mismatch: have %d, want %d", resumed, 50)
+	}
+}
+
+// Tests that a cancelled context will stop streaming a feed.
+func TestStreamFeedWithCancellation(t *testing.T) {
+	client := new(Client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	postc, errc := client.streamFeed(ctx, "", makeTestFeed(1000, 100))
+
+	<-postc
+	retrieved := 1
+
+	cancel()
+	for range postc {
+		retrieved++
+	}
+	if retrieved >= 1000 {
+		t.Errorf("interrupted stream retrieved all posts: have %d, want < %d", retrieved, 1000)
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("interrupt error mismatch: have %v, want %v", err, context.Canceled)
+	}
+}
+
+// Tests that feed items are converted into posts with all their context.
+func TestNewFeedPost(t *testing.T) {
+	var (
+		likes   = int64(3)
+		reposts = int64(2)
+		name    = "go-bluesky tester"
+	)
+	item := &bsky.FeedDefs_FeedViewPost{
+		Post: &bsky.FeedDefs_PostView{
+			Uri:       "at://did:plc:author/app.bsky.feed.post/1",
+			Cid:       "bafyreipost",
+			IndexedAt: "2023-05-06T07:08:09.000Z",
+			Author:    &bsky.ActorDefs_ProfileViewBasic{Did: "did:plc:author", Handle: "author.bsky.social"},
+			LikeCount: &likes, RepostCount: &reposts,
+			Record: &util.LexiconTypeDecoder{Val: &bsky.FeedPost{
+				Text:      "hello @tester",
+				CreatedAt: "2023-05-06T07:08:00.000Z",
+				Facets: []*bsky.RichtextFacet{{
+					Index:    &bsky.RichtextFacet_ByteSlice{ByteStart: 6, ByteEnd: 13},
+					Features: []*bsky.RichtextFacet_Features_Elem{{RichtextFacet_Mention: &bsky.RichtextFacet_Mention{Did: testDIDTester}}},
+				}},
+				Reply: &bsky.FeedPost_ReplyRef{
+					Root:   &atproto.RepoStrongRef{Uri: "at://did:plc:root/app.bsky.feed.post/0", Cid: "bafyreiroot"},
+					Parent: &atproto.RepoStrongRef{Uri: "at://did:plc:parent/app.bsky.feed.post/0", Cid: "bafyreiparent"},
+				},
+			}},
+			Embed: &bsky.FeedDefs_PostView_Embed{EmbedImages_View: &bsky.EmbedImages_View{
+				Images: []*bsky.EmbedImages_ViewImage{{Alt: "a gopher", Thumb: "https://cdn/thumb", Fullsize: "https://cdn/full"}},
+			}},
+		},
+		Reply: &bsky.FeedDefs_ReplyRef{
+			Parent: &bsky.FeedDefs_PostView{Author: &bsky.ActorDefs_ProfileViewBasic{Did: "did:plc:parent", Handle: "parent.bsky.social"}},
+		},
+		Reason: &bsky.FeedDefs_FeedViewPost_Reason{FeedDefs_ReasonRepost: &bsky.FeedDefs_ReasonRepost{
+			By: &bsky.ActorDefs_ProfileViewBasic{Did: testDIDTester, Handle: testHandleTester, DisplayName: &name},
+		}},
+	}
+	post := newFeedPost(nil, &feedItem{FeedDefs_FeedViewPost: item})
+
+	if post.URI != item.Post.Uri || post.CID != item.Post.Cid {
+		t.Errorf("post ref mismatch: have %s/%s, want %s/%s", post.URI, post.CID, item.Post.Uri, item.Post.Cid)
+	}
+	if post.Text != "hello @tester" || post.CreatedAt.IsZero() || post.IndexedAt.IsZero() {
+		t.Errorf("post content mismatch: have %q at %v/%v", post.Text, post.CreatedAt, post.IndexedAt)
+	}
+	if post.LikeCount != 3 || post.RepostCount != 2 || post.ReplyCount != 0 {
+		t.Errorf("post counts mismatch: have %d/%d/%d, want 3/2/0", post.LikeCount, post.RepostCount, post.ReplyCount)
+	}
+	if len(post.Facets) != 1 || post.Facets[0].Mention != testDIDTester || post.Facets[0].ByteStart != 6 {
+		t.Errorf("post facets mismatch: have %+v", post.Facets)
+	}
+	if post.Author.DID != "did:plc:author" || post.ReplyTo.DID != "did:plc:parent" || post.RepostedBy.Name != name {
+		t.Errorf("post users mismatch: author %v, reply to %v, reposted by %v", post.Author, post.ReplyTo, post.RepostedBy)
+	}
+	if post.ReplyRoot.URI != "at://did:plc:root/app.bsky.feed.post/0" || post.ReplyParent.CID != "bafyreiparent" {
+		t.Errorf("post reply refs mismatch: root %+v, parent %+v", post.ReplyRoot, post.ReplyParent)
+	}
+	if len(post.Images) != 1 || post.Images[0].Alt != "a gopher" || post.Images[0].FullsizeURL != "https://cdn/full" {
+		t.Errorf("post images mismatch: have %+v", post.Images)
+	}
+}
+
+// Tests that hashtag facets, unknown to the pinned lexicon, survive decoding a
+// feed page and are converted alongside the mentions and links.
+func TestNewFeedPostTags(t *testing.T) {
+	blob := []byte(`{"cursor": "next", "feed": [{"post": {
+		"uri": "at://did:plc:author/app.bsky.feed.post/1",
+		"cid": "bafyreipost",
+		"indexedAt": "2023-05-06T07:08:09.000Z",
+		"author": {"did": "did:plc:author", "handle": "author.bsky.social"},
+		"record": {
+			"$type": "app.bsky.feed.post",
+			"text": "#golang meetup with @tester #gophercon",
+			"createdAt": "2023-05-06T07:08:00.000Z",
+			"facets": [
+				{"index": {"byteStart": 0, "byteEnd": 7}, "features": [{"$type": "app.bsky.richtext.facet#tag", "tag": "golang"}]},
+				{"index": {"byteStart": 20, "byteEnd": 27}, "features": [{"$type": "app.bsky.richtext.facet#mention", "did": "` + testDIDTester + `"}]},
+				{"index": {"byteStart": 28, "byteEnd": 38}, "features": [{"$type": "app.bsky.richtext.facet#unknown"}, {"$type": "app.bsky.richtext.facet#tag", "tag": "gophercon"}]}
+			]
+		}
+	}}]}`)
+	var page feedPage
+	if err := json.Unmarshal(blob, &page); err != nil {
+		t.Fatalf("failed to decode feed page: %v", err)
+	}
+	if page.Cursor == nil || *page.Cursor != "next" || len(page.Feed) != 1 {
+		t.Fatalf("feed page mismatch: have cursor %v, %d items", page.Cursor, len(page.Feed))
+	}
+	post := newFeedPost(nil, page.Feed[0])
+
+	want := []Facet{
+		{ByteStart: 0, ByteEnd: 7, Tag: "golang"},
+		{ByteStart: 20, ByteEnd: 27, Mention: testDIDTester},
+		{ByteStart: 28, ByteEnd: 38, Tag: "gophercon"},
+	}
+	if len(post.Facets) != len(want) {
+		t.Fatalf("facet count mismatch: have %d, want %d: %+v", len(post.Facets), len(want), post.Facets)
+	}
+	for i, facet := range post.Facets {
+		if *facet != want[i] {
+			t.Errorf("facet %d mismatch: have %+v, want %+v", i, *facet, want[i])
+		}
+	}
+}
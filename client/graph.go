@@ -0,0 +1,394 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+const (
+	// followCollection is the NSID of the repository collection holding follows.
+	followCollection = "app.bsky.graph.follow"
+
+	// blockCollection is the NSID of the repository collection holding blocks.
+	blockCollection = "app.bsky.graph.block"
+
+	// maxApplyWrites is the maximum number of writes the server accepts within a
+	// single batch.
+	maxApplyWrites = 200
+)
+
+// GraphOp is a type of social graph mutation.
+type GraphOp int
+
+const (
+	GraphFollow   GraphOp = iota // Follow a user
+	GraphUnfollow                // Unfollow a user
+	GraphBlock                   // Block a user
+	GraphUnblock                 // Unblock a user
+	GraphMute                    // Mute a user
+	GraphUnmute                  // Unmute a user
+)
+
+// String implements the stringer interface to help debug things.
+func (op GraphOp) String() string {
+	switch op {
+	case GraphFollow:
+		return "follow"
+	case GraphUnfollow:
+		return "unfollow"
+	case GraphBlock:
+		return "block"
+	case GraphUnblock:
+		return "unblock"
+	case GraphMute:
+		return "mute"
+	case GraphUnmute:
+		return "unmute"
+	default:
+		return fmt.Sprintf("GraphOp(%d)", int(op))
+	}
+}
+
+// GraphMutation is a single social graph change to apply in a batch.
+type GraphMutation struct {
+	Op GraphOp // Type of change to apply
+	ID string  // Handle or DID of the user to apply the change to
+}
+
+// subjectRecord is the common shape of the graph records, all of which point to
+// a single user.
+type subjectRecord struct {
+	Type      string `json:"$type"`
+	Subject   string `json:"subject"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Follow makes the logged in user follow another one, identified by a handle or
+// DID. The at:// URI of the follow record is returned.
+//
+// If the user is already followed, the method is a no-op and the URI of the
+// existing follow record is returned.
+//
+// Note, the existing relationship is read from the viewer state of the other
+// user's profile, which may lag slightly behind very recent changes.
+func (c *Client) Follow(ctx context.Context, id string) (string, error) {
+	relation, err := c.fetchRelation(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if relation.Following != "" {
+		return relation.Following, nil
+	}
+	ref, err := c.createRecord(ctx, followCollection, newSubjectRecord(followCollection, relation.DID))
+	if err != nil {
+		return "", err
+	}
+	return ref.URI, nil
+}
+
+// Unfollow makes the logged in user stop following another one, identified by a
+// handle or DID. If the user is not followed, the method is a no-op.
+func (c *Client) Unfollow(ctx context.Context, id string) error {
+	relation, err := c.fetchRelation(ctx, id)
+	if err != nil {
+		return err
+	}
+	if relation.Following == "" {
+		return nil
+	}
+	_, _, rkey, err := parseRecordURI(relation.Following)
+	if err != nil {
+		return err
+	}
+	return c.deleteRecord(ctx, followCollection, rkey)
+}
+
+// Block makes the logged in user block another one, identified by a handle or
+// DID. The at:// URI of the block record is returned.
+//
+// If the user is already blocked, the method is a no-op and the URI of the
+// existing block record is returned.
+//
+// Note, the existing relationship is read from the viewer state of the other
+// user's profile, which may lag slightly behind very recent changes.
+func (c *Client) Block(ctx context.Context, id string) (string, error) {
+	relation, err := c.fetchRelation(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if relation.Blocking != "" {
+		return relation.Blocking, nil
+	}
+	ref, err := c.createRecord(ctx, blockCollection, newSubjectRecord(blockCollection, relation.DID))
+	if err != nil {
+		return "", err
+	}
+	return ref.URI, nil
+}
+
+// Unblock makes the logged in user stop blocking another one, identified by a
+// handle or DID. If the user is not blocked, the method is a no-op.
+func (c *Client) Unblock(ctx context.Context, id string) error {
+	relation, err := c.fetchRelation(ctx, id)
+	if err != nil {
+		return err
+	}
+	if relation.Blocking == "" {
+		return nil
+	}
+	_, _, rkey, err := parseRecordURI(relation.Blocking)
+	if err != nil {
+		return err
+	}
+	return c.deleteRecord(ctx, blockCollection, rkey)
+}
+
+// Mute makes the logged in user mute another one, identified by a handle or DID.
+// Muting an already muted user is a no-op.
+//
+// Note, mutes are private and not stored in the user's repository.
+func (c *Client) Mute(ctx context.Context, id string) error {
+	return bsky.GraphMuteActor(ctx, c.client, &bsky.GraphMuteActor_Input{Actor: trimActorID(id)})
+}
+
+// Unmute makes the logged in user stop muting another one, identified by a
+// handle or DID. Unmuting a not muted user is a no-op.
+func (c *Client) Unmute(ctx context.Context, id string) error {
+	return bsky.GraphUnmuteActor(ctx, c.client, &bsky.GraphUnmuteActor_Input{Actor: trimActorID(id)})
+}
+
+// ApplyGraphMutations applies a batch of social graph changes. Follows, unfollows,
+// blocks and unblocks are collapsed into as few repository writes as possible,
+// which are sent in chunks of 200; mutes and unmutes are applied afterwards one
+// by one, as they are not records.
+//
+// The same idempotency rules apply as for the individual methods: following an
+// already followed user or unblocking a not blocked one is a no-op. Changes that
+// cancel out within the batch (e.g. a follow and an unfollow of the same user)
+// are not sent at all.
+//
+// All the users are resolved and the mutations validated before anything is
+// changed, but the changes themselves are not atomic: each chunk of writes and
+// each mute is a separate request, so a failure midway leaves the earlier ones
+// applied.
+func (c *Client) ApplyGraphMutations(ctx context.Context, mutations []*GraphMutation) error {
+	did, err := c.did()
+	if err != nil {
+		return err
+	}
+	// Resolve all the targets and retrieve the existing relationships if needed
+	var (
+		subjects = make([]string, len(mutations))
+		follows  map[string]string
+		blocks   map[string]string
+	)
+	for i, mutation := range mutations {
+		switch mutation.Op {
+		case GraphFollow, GraphUnfollow, GraphBlock, GraphUnblock, GraphMute, GraphUnmute:
+		default:
+			return fmt.Errorf("unknown graph mutation: %v", mutation.Op)
+		}
+		if subjects[i], err = c.resolveDID(ctx, mutation.ID); err != nil {
+			return err
+		}
+		switch mutation.Op {
+		case GraphFollow, GraphUnfollow:
+			if follows == nil {
+				if follows, err = c.listSubjectRecords(ctx, followCollection); err != nil {
+					return err
+				}
+			}
+		case GraphBlock, GraphUnblock:
+			if blocks == nil {
+				if blocks, err = c.listSubjectRecords(ctx, blockCollection); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// Assemble the repository writes, tracking the relationships as they would be
+	// after each mutation to filter out duplicates, and the pending creates so a
+	// later mutation can cancel them out
+	var (
+		writes  []any
+		creates = map[string]map[string]int{
+			followCollection: make(map[string]int),
+			blockCollection:  make(map[string]int),
+		}
+		mutes []int
+	)
+	for i, mutation := range mutations {
+		var (
+			subject    = subjects[i]
+			existing   map[string]string
+			collection string
+			create     bool
+		)
+		switch mutation.Op {
+		case GraphFollow, GraphUnfollow:
+			existing, collection, create = follows, followCollection, mutation.Op == GraphFollow
+		case GraphBlock, GraphUnblock:
+			existing, collection, create = blocks, blockCollection, mutation.Op == GraphBlock
+		default:
+			mutes = append(mutes, i)
+			continue
+		}
+		uri, ok := existing[subject]
+		switch {
+		case create && !ok:
+			creates[collection][subject] = len(writes)
+			writes = append(writes, map[string]any{
+				"$type":      "com.atproto.repo.applyWrites#create",
+				"collection": collection,
+				"value":      newSubjectRecord(collection, subject),
+			})
+			existing[subject] = ""
+
+		case !create && ok:
+			if uri == "" {
+				// Created within this batch, drop the pending create instead
+				writes[creates[collection][subject]] = nil
+				delete(creates[collection], subject)
+			} else {
+				_, _, rkey, err := parseRecordURI(uri)
+				if err != nil {
+					return err
+				}
+				writes = append(writes, map[string]any{
+					"$type":      "com.atproto.repo.applyWrites#delete",
+					"collection": collection,
+					"rkey":       rkey,
+				})
+			}
+			delete(existing, subject)
+		}
+	}
+	// Push the surviving writes to the server in batches
+	pending := writes[:0]
+	for _, write := range writes {
+		if write != nil {
+			pending = append(pending, write)
+		}
+	}
+	for len(pending) > 0 {
+		batch := pending
+		if len(batch) > maxApplyWrites {
+			batch = batch[:maxApplyWrites]
+		}
+		input := map[string]any{
+			"repo":   did,
+			"writes": batch,
+		}
+		if err := c.client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.applyWrites", nil, input, nil); err != nil {
+			return err
+		}
+		pending = pending[len(batch):]
+	}
+	// Apply the mutes last, in their original order
+	for _, i := range mutes {
+		if mutations[i].Op == GraphMute {
+			err = c.Mute(ctx, subjects[i])
+		} else {
+			err = c.Unmute(ctx, subjects[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveDID converts a handle or DID into a DID, querying the server if the
+// identifier is a handle.
+func (c *Client) resolveDID(ctx context.Context, id string) (string, error) {
+	id = trimActorID(id)
+	if strings.HasPrefix(id, "did:") {
+		return id, nil
+	}
+	res, err := atproto.IdentityResolveHandle(ctx, c.client, id)
+	if err != nil {
+		return "", err
+	}
+	return res.Did, nil
+}
+
+// graphRelation is the relationship of the logged in user to another one.
+type graphRelation struct {
+	DID       string // DID of the other user
+	Following string // URI of the logged in user's follow record, empty if none
+	Blocking  string // URI of the logged in user's block record, empty if none
+}
+
+// fetchRelation looks up the relationship of the logged in user to another one,
+// identified by a handle or DID, from the viewer state of their profile.
+//
+// The profile is retrieved raw, since the generated atproto type lacks the block
+// field of the viewer state.
+func (c *Client) fetchRelation(ctx context.Context, id string) (*graphRelation, error) {
+	var res struct {
+		DID    string `json:"did"`
+		Viewer struct {
+			Following string `json:"following"`
+			Blocking  string `json:"blocking"`
+		} `json:"viewer"`
+	}
+	params := map[string]any{"actor": trimActorID(id)}
+	if err := c.client.Do(ctx, xrpc.Query, "", "app.bsky.actor.getProfile", params, nil, &res); err != nil {
+		return nil, err
+	}
+	return &graphRelation{
+		DID:       res.DID,
+		Following: res.Viewer.Following,
+		Blocking:  res.Viewer.Blocking,
+	}, nil
+}
+
+// listSubjectRecords retrieves all the graph records of the logged in user from
+// a collection, mapping the subject DIDs to the record URIs.
+func (c *Client) listSubjectRecords(ctx context.Context, collection string) (map[string]string, error) {
+	did, err := c.did()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cursor   string
+		subjects = make(map[string]string)
+	)
+	for {
+		records, next, err := c.listRecords(ctx, did, collection, cursor, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			var value subjectRecord
+			if err := json.Unmarshal(record.Value, &value); err != nil {
+				return nil, err
+			}
+			subjects[value.Subject] = record.URI
+		}
+		if next == "" || len(records) == 0 {
+			return subjects, nil
+		}
+		cursor = next
+	}
+}
+
+// newSubjectRecord creates a new graph record pointing to a user.
+func newSubjectRecord(collection string, did string) *subjectRecord {
+	return &subjectRecord{
+		Type:      collection,
+		Subject:   did,
+		CreatedAt: timestamp(time.Now()),
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"gophercon-2023-demo/client/clienttest"
+)
+
+// subjects collects the subject DIDs of the graph records within a collection of
+// the test user's repository.
+func subjects(t *testing.T, srv *clienttest.Server, collection string) []string {
+	t.Helper()
+
+	var dids []string
+	for _, record := range srv.Records(testDIDTester, collection) {
+		var value subjectRecord
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			t.Fatalf("failed to decode graph record: %v", err)
+		}
+		dids = append(dids, value.Subject)
+	}
+	return dids
+}
+
+// Tests that following is idempotent, regardless of the ID format used, and that
+// unfollowing removes the follow record.
+func TestFollowUnfollow(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	uri, err := client.Follow(ctx, testDIDJeromy)
+	if err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	for _, id := range []string{testDIDJeromy, "@why.bsky.team", "at://" + testDIDJeromy} {
+		again, err := client.Follow(ctx, id)
+		if err != nil {
+			t.Fatalf("%s: failed to re-follow: %v", id, err)
+		}
+		if again != uri {
+			t.Errorf("%s: follow uri mismatch: have %v, want %v", id, again, uri)
+		}
+	}
+	if have := subjects(t, srv, followCollection); fmt.Sprint(have) != fmt.Sprint([]string{testDIDJeromy}) {
+		t.Errorf("follows mismatch: have %v, want %v", have, []string{testDIDJeromy})
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Unfollow(ctx, "why.bsky.team"); err != nil {
+			t.Fatalf("unfollow %d failed: %v", i, err)
+		}
+	}
+	if have := subjects(t, srv, followCollection); len(have) != 0 {
+		t.Errorf("follows mismatch after unfollow: have %v, want none", have)
+	}
+	if _, err := client.Follow(ctx, "nobody.test"); err == nil {
+		t.Errorf("following unknown user succeeded")
+	}
+	if calls := srv.Calls("com.atproto.repo.listRecords"); calls != 0 {
+		t.Errorf("follow collection scanned %d times, want direct lookups", calls)
+	}
+}
+
+// Tests that blocking is idempotent and that unblocking removes the block record.
+func TestBlockUnblock(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	uri, err := client.Block(ctx, testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	if again, err := client.Block(ctx, "karalabe.bsky.social"); err != nil || again != uri {
+		t.Errorf("re-block mismatch: have %v/%v, want %v/nil", again, err, uri)
+	}
+	if have := subjects(t, srv, blockCollection); fmt.Sprint(have) != fmt.Sprint([]string{testDIDPeter}) {
+		t.Errorf("blocks mismatch: have %v, want %v", have, []string{testDIDPeter})
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Unblock(ctx, testDIDPeter); err != nil {
+			t.Fatalf("unblock %d failed: %v", i, err)
+		}
+	}
+	if have := subjects(t, srv, blockCollection); len(have) != 0 {
+		t.Errorf("blocks mismatch after unblock: have %v, want none", have)
+	}
+	if calls := srv.Calls("com.atproto.repo.listRecords"); calls != 0 {
+		t.Errorf("block collection scanned %d times, want direct lookups", calls)
+	}
+}
+
+// Tests that muting and unmuting are idempotent.
+func TestMuteUnmute(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	for i := 0; i < 2; i++ {
+		if err := client.Mute(ctx, "@why.bsky.team"); err != nil {
+			t.Fatalf("mute %d failed: %v", i, err)
+		}
+		if !srv.Muted(testDIDTester, testDIDJeromy) {
+			t.Errorf("mute %d: user not muted", i)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Unmute(ctx, testDIDJeromy); err != nil {
+			t.Fatalf("unmute %d failed: %v", i, err)
+		}
+		if srv.Muted(testDIDTester, testDIDJeromy) {
+			t.Errorf("unmute %d: user still muted", i)
+		}
+	}
+}
+
+// Tests that graph mutation batches filter out duplicates and changes that
+// cancel each other out, and that mutes are applied too.
+func TestApplyGraphMutations(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	if _, err := client.Follow(ctx, testDIDPeter); err != nil {
+		t.Fatalf("failed to follow: %v", err)
+	}
+	err := client.ApplyGraphMutations(ctx, []*GraphMutation{
+		{Op: GraphFollow, ID: testDIDPeter},       // already followed, no-op
+		{Op: GraphFollow, ID: testDIDJeromy},      // new follow...
+		{Op: GraphUnfollow, ID: "why.bsky.team"},  // ...cancelled out
+		{Op: GraphBlock, ID: "did:plc:user001"},   // new block...
+		{Op: GraphUnblock, ID: "did:plc:user001"}, // ...cancelled out
+		{Op: GraphBlock, ID: "did:plc:user002"},   // new block
+		{Op: GraphUnfollow, ID: testDIDPeter},     // existing unfollow...
+		{Op: GraphFollow, ID: testDIDPeter},       // ...and a fresh follow
+		{Op: GraphMute, ID: "did:plc:user003"},
+		{Op: GraphMute, ID: "did:plc:user004"},
+		{Op: GraphUnmute, ID: "did:plc:user004"},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply mutations: %v", err)
+	}
+	if have := subjects(t, srv, followCollection); fmt.Sprint(have) != fmt.Sprint([]string{testDIDPeter}) {
+		t.Errorf("follows mismatch: have %v, want %v", have, []string{testDIDPeter})
+	}
+	if have := subjects(t, srv, blockCollection); fmt.Sprint(have) != fmt.Sprint([]string{"did:plc:user002"}) {
+		t.Errorf("blocks mismatch: have %v, want %v", have, []string{"did:plc:user002"})
+	}
+	if !srv.Muted(testDIDTester, "did:plc:user003") || srv.Muted(testDIDTester, "did:plc:user004") {
+		t.Errorf("mutes mismatch: have user003=%v user004=%v, want true/false",
+			srv.Muted(testDIDTester, "did:plc:user003"), srv.Muted(testDIDTester, "did:plc:user004"))
+	}
+	if calls := srv.Calls("com.atproto.repo.applyWrites"); calls != 1 {
+		t.Errorf("write batch count mismatch: have %d, want %d", calls, 1)
+	}
+	// A batch that fully cancels out should not write anything
+	err = client.ApplyGraphMutations(ctx, []*GraphMutation{
+		{Op: GraphFollow, ID: testDIDJeromy},
+		{Op: GraphUnfollow, ID: testDIDJeromy},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply cancelling mutations: %v", err)
+	}
+	if calls := srv.Calls("com.atproto.repo.applyWrites"); calls != 1 {
+		t.Errorf("write batch count mismatch: have %d, want %d", calls, 1)
+	}
+	// An invalid mutation should be rejected before anything is changed
+	err = client.ApplyGraphMutations(ctx, []*GraphMutation{
+		{Op: GraphMute, ID: testDIDJeromy},
+		{Op: GraphUnfollow, ID: testDIDPeter},
+		{Op: GraphOp(42), ID: testDIDJeromy},
+	})
+	if err == nil {
+		t.Fatalf("invalid mutation accepted")
+	}
+	if srv.Muted(testDIDTester, testDIDJeromy) {
+		t.Errorf("mute applied from rejected batch")
+	}
+	if have := subjects(t, srv, followCollection); len(have) != 1 {
+		t.Errorf("follows changed by rejected batch: have %v", have)
+	}
+}
+
+// Tests that large graph mutation batches are split into multiple writes.
+func TestApplyGraphMutationsChunking(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	var mutations []*GraphMutation
+	for i := 0; i < 250; i++ {
+		mutations = append(mutations, &GraphMutation{Op: GraphFollow, ID: fmt.Sprintf("did:plc:user%03d", i)})
+	}
+	if err := client.ApplyGraphMutations(ctx, mutations); err != nil {
+		t.Fatalf("failed to apply mutations: %v", err)
+	}
+	if have := len(srv.Records(testDIDTester, followCollection)); have != 250 {
+		t.Errorf("follow count mismatch: have %d, want %d", have, 250)
+	}
+	if calls := srv.Calls("com.atproto.repo.applyWrites"); calls != 2 {
+		t.Errorf("write batch count mismatch: have %d, want %d", calls, 2)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// imageJPEGQuality is the quality to use when re-encoding JPEG images. It is
+	// slightly lower than what cameras produce, but visually indistinguishable.
+	imageJPEGQuality = 85
+
+	// imageScaleStep is the factor by which to shrink an image on every attempt
+	// to fit it into a size limit.
+	imageScaleStep = 0.75
+
+	// imageMinDimension is the size below which an image is not shrunk any more
+	// when attempting to fit it into a size limit.
+	imageMinDimension = 64
+)
+
+var (
+	// ErrImageFormat is returned if an image is neither a JPEG nor a PNG, or if
+	// it is malformed.
+	ErrImageFormat = errors.New("unsupported image format")
+
+	// ErrImageTooLarge is returned if an image cannot be shrunk below the size
+	// limit (without shrinking it into oblivion).
+	ErrImageTooLarge = errors.New("image too large")
+)
+
+// stripMetadata removes the EXIF and XMP metadata, and any free form text from an
+// encoded JPEG or PNG image. The pixel data is left untouched, so no quality is
+// lost.
+//
+// Note, EXIF orientation is dropped too, so images relying on it being rendered
+// rotated will appear in their raw (sensor) orientation.
+func stripMetadata(data []byte, format string) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		return stripJPEGMetadata(data)
+	case "png":
+		return stripPNGMetadata(data)
+	default:
+		return nil, ErrImageFormat
+	}
+}
+
+// stripJPEGMetadata drops all the APP1 (EXIF and XMP) segments from a JPEG image.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, ErrImageFormat
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+
+	for pos := 2; ; {
+		// Every segment starts with a 0xff marker and a type byte, optionally
+		// preceded by any number of 0xff fill bytes (which are dropped)
+		if pos+2 > len(data) || data[pos] != 0xff {
+			return nil, ErrImageFormat
+		}
+		for pos+2 < len(data) && data[pos+1] == 0xff {
+			pos++
+		}
+		marker := data[pos+1]
+
+		// Once the image scan starts, there are no more segments, copy the rest
+		if marker == 0xda {
+			return append(out, data[pos:]...), nil
+		}
+		// TEM and RSTn markers are standalone, without a length or payload
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out = append(out, data[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+		// Otherwise copy the segment over unless it's an EXIF or XMP block
+		if pos+4 > len(data) {
+			return nil, ErrImageFormat
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return nil, ErrImageFormat
+		}
+		if marker != 0xe1 {
+			out = append(out, data[pos:pos+2+size]...)
+		}
+		pos += 2 + size
+	}
+}
+
+// stripPNGMetadata drops all the eXIf chunks and the tEXt, iTXt and zTXt text
+// chunks (which also carry XMP) from a PNG image.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, ErrImageFormat
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+
+	for pos := len(signature); pos < len(data); {
+		// Every chunk is a length, a type, the data and a checksum
+		if pos+12 > len(data) {
+			return nil, ErrImageFormat
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 0 || pos+12+size > len(data) {
+			return nil, ErrImageFormat
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf", "tEXt", "iTXt", "zTXt":
+		default:
+			out = append(out, data[pos:pos+12+size]...)
+		}
+		pos += 12 + size
+	}
+	return out, nil
+}
+
+// shrinkImage repeatedly downscales and re-encodes an image until it fits into
+// the requested byte limit. The original format is retained.
+func shrinkImage(img image.Image, format string, limit int) ([]byte, image.Image, error) {
+	for {
+		data, err := EncodeImage(img, format)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(data) <= limit {
+			return data, img, nil
+		}
+		bounds := img.Bounds()
+
+		width := int(float64(bounds.Dx()) * imageScaleStep)
+		height := int(float64(bounds.Dy()) * imageScaleStep)
+		if width < imageMinDimension || height < imageMinDimension {
+			return nil, nil, ErrImageTooLarge
+		}
+		img = resizeImage(img, width, height)
+	}
+}
+
+// EncodeImage encodes an image into the requested format, either "jpeg" or "png".
+func EncodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageJPEGQuality}); err != nil {
+			return nil, err
+		}
+	case "png":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrImageFormat
+	}
+	return buf.Bytes(), nil
+}
+
+// Thumbnail downscales an image so that neither of its dimensions exceeds the
+// requested size, retaining its aspect ratio. Images already fitting into the
+// size are returned as is, they are never upscaled.
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	if size <= 0 || (bounds.Dx() <= size && bounds.Dy() <= size) {
+		return img
+	}
+	width, height := size, size
+	if bounds.Dx() > bounds.Dy() {
+		height = bounds.Dy() * size / bounds.Dx()
+	} else {
+		width = bounds.Dx() * size / bounds.Dy()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return resizeImage(img, width, height)
+}
+
+// resizeImage scales an image to the requested dimensions using area averaging,
+// which gives good quality results when downscaling.
+func resizeImage(img image.Image, width int, height int) *image.RGBA {
+	var (
+		src    = toRGBA(img)
+		bounds = src.Bounds()
+		dst    = image.NewRGBA(image.Rect(0, 0, width, height))
+	)
+	for y := 0; y < height; y++ {
+		// Calculate the source rows covered by this destination row
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			// Calculate the source columns covered by this destination column
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			// Average all the source pixels in the covered area
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					px := src.RGBAAt(sx, sy)
+					r, g, b, a = r+uint32(px.R), g+uint32(px.G), b+uint32(px.B), a+uint32(px.A)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// toRGBA converts an arbitrary image into an RGBA one for direct pixel access.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// makeTestImage creates a noisy image of the given size that compresses badly,
+// making it suitable to test size limits.
+func makeTestImage(width int, height int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: 255})
+		}
+	}
+	return img
+}
+
+// Tests that EXIF and XMP segments are stripped from JPEG images, leaving
+// everything else intact.
+func TestStripJPEGMetadata(t *testing.T) {
+	clean, err := EncodeImage(makeTestImage(16, 16), "jpeg")
+	if err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	dirty := append([]byte{}, clean[:2]...)
+	for _, meta := range []string{
+		"Exif\x00\x00GPS secrets",
+		"http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS secrets</x:xmpmeta>",
+	} {
+		segment := []byte{0xff, 0xe1, 0, 0}
+		binary.BigEndian.PutUint16(segment[2:], uint16(len(meta)+2))
+		dirty = append(append(dirty, segment...), meta...)
+	}
+	dirty = append(dirty, clean[2:]...)
+
+	stripped, err := stripMetadata(dirty, "jpeg")
+	if err != nil {
+		t.Fatalf("failed to strip metadata: %v", err)
+	}
+	if !bytes.Equal(stripped, clean) {
+		t.Errorf("stripped image mismatch: have %d bytes, want %d bytes", len(stripped), len(clean))
+	}
+	// Fill bytes before markers should be skipped and standalone markers kept
+	padded := append([]byte{}, clean[:2]...)
+	padded = append(padded, 0xff, 0xff, 0xff, 0x01)
+	padded = append(padded, 0xff, 0xff, 0xe1, 0x00, 0x0b)
+	padded = append(padded, "Exif\x00\x00GPS"...)
+	padded = append(padded, clean[2:]...)
+
+	want := append(append([]byte{}, clean[:2]...), 0xff, 0x01)
+	want = append(want, clean[2:]...)
+
+	if stripped, err = stripMetadata(padded, "jpeg"); err != nil {
+		t.Fatalf("failed to strip padded metadata: %v", err)
+	}
+	if !bytes.Equal(stripped, want) {
+		t.Errorf("stripped padded image mismatch: have %d bytes, want %d bytes", len(stripped), len(want))
+	}
+	if _, err := stripMetadata([]byte("not a jpeg"), "jpeg"); err != ErrImageFormat {
+		t.Errorf("invalid image error mismatch: have %v, want %v", err, ErrImageFormat)
+	}
+}
+
+// Tests that eXIf and text chunks are stripped from PNG images, leaving
+// everything else intact.
+func TestStripPNGMetadata(t *testing.T) {
+	clean, err := EncodeImage(makeTestImage(16, 16), "png")
+	if err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	// Insert the chunks right after the IHDR (8 byte signature + 25 byte header)
+	dirty := append([]byte{}, clean[:33]...)
+	for _, kind := range []string{"eXIf", "tEXt", "iTXt", "zTXt"} {
+		meta := []byte("GPS secrets")
+
+		chunk := make([]byte, 8, 12+len(meta))
+		binary.BigEndian.PutUint32(chunk, uint32(len(meta)))
+		copy(chunk[4:], kind)
+		chunk = append(chunk, meta...)
+		chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+		dirty = append(dirty, chunk...)
+	}
+	dirty = append(dirty, clean[33:]...)
+
+	stripped, err := stripMetadata(dirty, "png")
+	if err != nil {
+		t.Fatalf("failed to strip metadata: %v", err)
+	}
+	if !bytes.Equal(stripped, clean) {
+		t.Errorf("stripped image mismatch: have %d bytes, want %d bytes", len(stripped), len(clean))
+	}
+}
+
+// Tests that oversized images are shrunk until they fit into the size limit and
+// that images which cannot be reasonably shrunk are rejected.
+func TestShrinkImage(t *testing.T) {
+	for _, format := range []string{"jpeg", "png"} {
+		data, img, err := shrinkImage(makeTestImage(512, 256), format, 64*1024)
+		if err != nil {
+			t.Errorf("%s: failed to shrink image: %v", format, err)
+			continue
+		}
+		if len(data) > 64*1024 {
+			t.Errorf("%s: shrunk image too large: have %d bytes, want <= %d", format, len(data), 64*1024)
+		}
+		if bounds := img.Bounds(); bounds.Dx() >= 512 || bounds.Dx() != 2*bounds.Dy() {
+			t.Errorf("%s: shrunk image dimensions mismatch: have %v", format, bounds)
+		}
+		if _, _, err := shrinkImage(makeTestImage(512, 256), format, 100); err != ErrImageTooLarge {
+			t.Errorf("%s: unshrinkable image error mismatch: have %v, want %v", format, err, ErrImageTooLarge)
+		}
+	}
+}
+
+// Tests that resizing averages the source pixels.
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.SetRGBA(0, 0, color.RGBA{R: 200, A: 255})
+	src.SetRGBA(1, 1, color.RGBA{G: 100, A: 255})
+
+	dst := resizeImage(src, 1, 1)
+	if have, want := dst.RGBAAt(0, 0), (color.RGBA{R: 50, G: 25, A: 127}); have != want {
+		t.Errorf("resized pixel mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that thumbnails retain the aspect ratio and never upscale.
+func TestThumbnail(t *testing.T) {
+	tests := []struct {
+		width, height int
+		size          int
+		want          image.Rectangle
+	}{
+		{512, 256, 128, image.Rect(0, 0, 128, 64)},
+		{256, 512, 128, image.Rect(0, 0, 64, 128)},
+		{300, 300, 100, image.Rect(0, 0, 100, 100)},
+		{64, 32, 128, image.Rect(0, 0, 64, 32)},
+		{1000, 1, 10, image.Rect(0, 0, 10, 1)},
+	}
+	for _, tt := range tests {
+		if have := Thumbnail(makeTestImage(tt.width, tt.height), tt.size).Bounds(); have != tt.want {
+			t.Errorf("%dx%d @ %d: thumbnail bounds mismatch: have %v, want %v", tt.width, tt.height, tt.size, have, tt.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Call is the description of a single API call made by a client, handed to the
+// interceptors. The request fields are populated before the call is invoked,
+// the response fields after.
+type Call struct {
+	NSID   string      // XRPC method (e.g. app.bsky.actor.getProfile), empty for non-XRPC requests
+	Method string      // HTTP method, GET for queries and POST for procedures
+	URL    *url.URL    // Full URL of the request, including the parameters
+	Params url.Values  // Parameters of the call (read only)
+	Header http.Header // Headers to send with the request, modifiable by interceptors
+
+	Status   int           // HTTP status code of the response, 0 if none was received
+	Duration time.Duration // Time it took to receive the response, including retries
+	Err      error         // Failure of the call, if any
+}
+
+// Procedure reports whether the call is an XRPC procedure, i.e. a call which
+// might mutate state on the server.
+func (c *Call) Procedure() bool {
+	return c.NSID != "" && c.Method == http.MethodPost
+}
+
+// Name returns a human readable identifier for the call: the XRPC method if the
+// call is an API call, or the host and path otherwise.
+func (c *Call) Name() string {
+	if c.NSID != "" {
+		return c.NSID
+	}
+	return c.URL.Host + c.URL.Path
+}
+
+// Invoker executes an API call, populating the response fields of it.
+type Invoker func(ctx context.Context, call *Call) error
+
+// Interceptor wraps the execution of API calls. It may inspect or modify the call
+// before invoking the next interceptor in the chain (or the actual call, if it is
+// the last), and it may inspect the results after. The interceptor must return
+// the error of the invoker, unless it deliberately wants to alter the outcome.
+//
+// Interceptors are invoked once per logical API call, retries are not visible.
+// Use a Middleware if the individual attempts are of interest.
+type Interceptor func(ctx context.Context, call *Call, invoke Invoker) error
+
+// WithInterceptor adds an interceptor to the chain wrapping every API call of
+// the client. If multiple interceptors are added, the first one will be the
+// outermost.
+func WithInterceptor(interceptor Interceptor) Option {
+	return func(cfg *config) {
+		cfg.interceptors = append(cfg.interceptors, interceptor)
+	}
+}
+
+// interceptTransport is an HTTP transport running every request through a chain
+// of interceptors before executing it.
+type interceptTransport struct {
+	base         http.RoundTripper // Transport to execute the requests with
+	interceptors []Interceptor     // Chain of interceptors, outermost first
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *interceptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := &Call{
+		Method: req.Method,
+		URL:    req.URL,
+		Params: req.URL.Query(),
+		Header: req.Header.Clone(),
+	}
+	if strings.HasPrefix(req.URL.Path, "/xrpc/") {
+		call.NSID = strings.TrimPrefix(req.URL.Path, "/xrpc/")
+	}
+	var res *http.Response
+
+	invoke := func(ctx context.Context, call *Call) error {
+		start := time.Now()
+
+		// Transports must not modify the original request, so use a copy
+		attempt := req.WithContext(ctx)
+		attempt.Header = call.Header
+
+		var err error
+		res, err = t.base.RoundTrip(attempt)
+		call.Duration = time.Since(start)
+
+		if err == nil {
+			call.Status = res.StatusCode
+		} else if apiErr := new(APIError); errors.As(err, &apiErr) {
+			call.Status = apiErr.Status
+		}
+		call.Err = err
+		return err
+	}
+	for i := len(t.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := t.interceptors[i], invoke
+		invoke = func(ctx context.Context, call *Call) error {
+			return interceptor(ctx, call, next)
+		}
+	}
+	if err := invoke(req.Context(), call); err != nil {
+		// Don't leak a response if an interceptor failed a successful call
+		if res != nil {
+			res.Body.Close()
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// LoggingInterceptor creates an interceptor reporting every API call with its
+// parameters, outcome and duration to the given logger.
+func LoggingInterceptor(logger *log.Logger) Interceptor {
+	return func(ctx context.Context, call *Call, invoke Invoker) error {
+		err := invoke(ctx, call)
+		if err != nil {
+			logger.Printf("%s %s %v: failed in %v: %v", call.Method, call.Name(), call.Params, call.Duration, err)
+		} else {
+			logger.Printf("%s %s %v: status %d in %v", call.Method, call.Name(), call.Params, call.Status, call.Duration)
+		}
+		return err
+	}
+}
+
+// ProceduresOnly restricts an interceptor to XRPC procedures, i.e. the calls
+// that might mutate state on the server. It is useful for audit logs.
+func ProceduresOnly(interceptor Interceptor) Interceptor {
+	return func(ctx context.Context, call *Call, invoke Invoker) error {
+		if !call.Procedure() {
+			return invoke(ctx, call)
+		}
+		return interceptor(ctx, call, invoke)
+	}
+}
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram buckets
+// used by the metrics interceptor if none are specified.
+var DefaultLatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Metrics is a collector of API call statistics, grouped by call name.
+type Metrics struct {
+	buckets []time.Duration         // Upper bounds of the latency histogram buckets
+	stats   map[string]*MethodStats // Collected statistics, keyed by call name
+	lock    sync.Mutex              // Lock protecting the stats
+}
+
+// MethodStats are the collected statistics of a single API method.
+type MethodStats struct {
+	Calls    uint64         // Number of calls made
+	Failures uint64         // Number of calls that failed
+	Statuses map[int]uint64 // Number of responses per HTTP status code
+
+	Buckets []time.Duration // Upper bounds of the latency histogram buckets
+	Counts  []uint64        // Number of calls per latency bucket, the last one unbounded
+	Sum     time.Duration   // Total time spent in calls
+}
+
+// NewMetrics creates a metrics collector with the given latency buckets. If no
+// buckets are specified, DefaultLatencyBuckets are used.
+func NewMetrics(buckets ...time.Duration) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]time.Duration{}, buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	return &Metrics{
+		buckets: buckets,
+		stats:   make(map[string]*MethodStats),
+	}
+}
+
+// Interceptor returns an interceptor recording every API call into the metrics.
+func (m *Metrics) Interceptor() Interceptor {
+	return func(ctx context.Context, call *Call, invoke Invoker) error {
+		err := invoke(ctx, call)
+		m.record(call)
+		return err
+	}
+}
+
+// record adds the outcome of a call to the statistics.
+func (m *Metrics) record(call *Call) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stats, ok := m.stats[call.Name()]
+	if !ok {
+		stats = &MethodStats{
+			Statuses: make(map[int]uint64),
+			Buckets:  m.buckets,
+			Counts:   make([]uint64, len(m.buckets)+1),
+		}
+		m.stats[call.Name()] = stats
+	}
+	stats.Calls++
+	if call.Err != nil {
+		stats.Failures++
+	}
+	if call.Status != 0 {
+		stats.Statuses[call.Status]++
+	}
+	stats.Counts[sort.Search(len(m.buckets), func(i int) bool { return call.Duration <= m.buckets[i] })]++
+	stats.Sum += call.Duration
+}
+
+// Snapshot returns a copy of the statistics collected so far, keyed by the XRPC
+// method (or the host and path for non-XRPC requests).
+func (m *Metrics) Snapshot() map[string]*MethodStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snapshot := make(map[string]*MethodStats, len(m.stats))
+	for name, stats := range m.stats {
+		clone := *stats
+		clone.Statuses = make(map[int]uint64, len(stats.Statuses))
+		for status, count := range stats.Statuses {
+			clone.Statuses[status] = count
+		}
+		clone.Counts = append([]uint64{}, stats.Counts...)
+		snapshot[name] = &clone
+	}
+	return snapshot
+}
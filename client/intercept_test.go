@@ -0,0 +1,258 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeTestClientWithOptions creates a client connected to a fake server with
+// the given options and logs into it.
+func makeTestClientWithOptions(t *testing.T, opts ...Option) *Client {
+	t.Helper()
+
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client(), opts...)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	return client
+}
+
+// Tests that interceptors are invoked in order for every API call, and that they
+// see both the call details and the outcome.
+func TestInterceptorChain(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		trace []string
+		calls []Call
+	)
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, call *Call, invoke Invoker) error {
+			lock.Lock()
+			trace = append(trace, name+">")
+			lock.Unlock()
+
+			err := invoke(ctx, call)
+
+			lock.Lock()
+			trace = append(trace, "<"+name)
+			if name == "inner" {
+				calls = append(calls, *call)
+			}
+			lock.Unlock()
+			return err
+		}
+	}
+	client := makeTestClientWithOptions(t, WithInterceptor(record("outer")), WithInterceptor(record("inner")))
+
+	profile, err := client.FetchProfile(context.Background(), testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	if _, err := client.FetchProfile(context.Background(), "nobody.test"); !errors.Is(err, ErrProfileNotFound) {
+		t.Fatalf("missing profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	if err := profile.ResolveFollowers(context.Background()); err != nil {
+		t.Fatalf("failed to resolve followers: %v", err)
+	}
+	if err := profile.ResolveAvatar(context.Background()); err != nil {
+		t.Fatalf("failed to resolve avatar: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	// describeServer, createSession, 2x getProfile, 3x getFollowers, avatar
+	if len(calls) != 8 {
+		t.Fatalf("call count mismatch: have %d, want %d", len(calls), 8)
+	}
+	for i := 0; i < len(trace); i += 4 {
+		if have := strings.Join(trace[i:i+4], " "); have != "outer> inner> <inner <outer" {
+			t.Errorf("call %d: interceptor order mismatch: have %s, want %s", i/4, have, "outer> inner> <inner <outer")
+		}
+	}
+	tests := []struct {
+		nsid   string
+		method string
+		actor  string
+		status int
+		failed bool
+	}{
+		{nsid: "com.atproto.server.describeServer", method: "GET", status: 200},
+		{nsid: "com.atproto.server.createSession", method: "POST", status: 200},
+		{nsid: "app.bsky.actor.getProfile", method: "GET", actor: testDIDPeter, status: 200},
+		{nsid: "app.bsky.actor.getProfile", method: "GET", actor: "nobody.test", status: 400, failed: true},
+		{nsid: "app.bsky.graph.getFollowers", method: "GET", actor: testDIDPeter, status: 200},
+		{nsid: "app.bsky.graph.getFollowers", method: "GET", actor: testDIDPeter, status: 200},
+		{nsid: "app.bsky.graph.getFollowers", method: "GET", actor: testDIDPeter, status: 200},
+		{nsid: "", method: "GET", status: 200},
+	}
+	for i, tt := range tests {
+		call := calls[i]
+		if call.NSID != tt.nsid || call.Method != tt.method || call.Status != tt.status || (call.Err != nil) != tt.failed {
+			t.Errorf("call %d: details mismatch: have %s %s %d %v, want %s %s %d failed=%v",
+				i, call.Method, call.NSID, call.Status, call.Err, tt.method, tt.nsid, tt.status, tt.failed)
+		}
+		if tt.actor != "" && call.Params.Get("actor") != tt.actor {
+			t.Errorf("call %d: actor mismatch: have %q, want %q", i, call.Params.Get("actor"), tt.actor)
+		}
+		if call.Duration <= 0 {
+			t.Errorf("call %d: duration not measured", i)
+		}
+	}
+	if name := calls[7].Name(); !strings.HasSuffix(name, "/img/avatar/"+testDIDPeter) {
+		t.Errorf("image call name mismatch: have %s", name)
+	}
+}
+
+// Tests that the logging interceptor reports calls and that it can be limited
+// to procedures for auditing.
+func TestLoggingInterceptor(t *testing.T) {
+	var (
+		logs  = new(lockedBuffer)
+		audit = new(lockedBuffer)
+	)
+	client := makeTestClientWithOptions(t,
+		WithInterceptor(LoggingInterceptor(log.New(logs, "", 0))),
+		WithInterceptor(ProceduresOnly(LoggingInterceptor(log.New(audit, "", 0)))),
+	)
+	client.FetchProfile(context.Background(), "nobody.test")
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("log line count mismatch: have %d, want %d: %q", len(lines), 3, lines)
+	}
+	if !strings.Contains(lines[1], "POST com.atproto.server.createSession") || !strings.Contains(lines[1], "status 200") {
+		t.Errorf("login log mismatch: have %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "GET app.bsky.actor.getProfile map[actor:[nobody.test]]: failed") {
+		t.Errorf("failure log mismatch: have %q", lines[2])
+	}
+	lines = strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "com.atproto.server.createSession") {
+		t.Errorf("audit log mismatch: have %q", lines)
+	}
+}
+
+// Tests that the metrics interceptor counts calls and failures and records the
+// latencies into a histogram.
+func TestMetricsInterceptor(t *testing.T) {
+	metrics := NewMetrics(time.Hour, time.Nanosecond)
+	client := makeTestClientWithOptions(t, WithInterceptor(metrics.Interceptor()))
+
+	for i := 0; i < 3; i++ {
+		client.FetchProfile(context.Background(), testDIDPeter)
+	}
+	client.FetchProfile(context.Background(), "nobody.test")
+
+	stats := metrics.Snapshot()["app.bsky.actor.getProfile"]
+	if stats == nil {
+		t.Fatalf("profile metrics missing")
+	}
+	if stats.Calls != 4 || stats.Failures != 1 {
+		t.Errorf("call counts mismatch: have %d/%d, want %d/%d", stats.Calls, stats.Failures, 4, 1)
+	}
+	if stats.Statuses[200] != 3 || stats.Statuses[400] != 1 {
+		t.Errorf("status counts mismatch: have %v", stats.Statuses)
+	}
+	if fmt.Sprint(stats.Buckets) != "[1ns 1h0m0s]" || fmt.Sprint(stats.Counts) != "[0 4 0]" {
+		t.Errorf("histogram mismatch: have %v / %v", stats.Buckets, stats.Counts)
+	}
+	if stats.Sum <= 0 {
+		t.Errorf("latency sum not recorded")
+	}
+	// Snapshots should be independent of future calls
+	client.FetchProfile(context.Background(), testDIDPeter)
+	if stats.Calls != 4 {
+		t.Errorf("snapshot modified by later calls")
+	}
+}
+
+// Tests that the tracing interceptor records a span for every call, nesting
+// them into the caller's span and propagating the trace to the server.
+func TestTracingInterceptor(t *testing.T) {
+	var (
+		exporter = NewInMemoryExporter()
+		tracer   = NewTracer(exporter)
+
+		lock    sync.Mutex
+		parents = make(map[string]string)
+	)
+	client := makeTestClientWithOptions(t,
+		WithInterceptor(tracer.Interceptor()),
+		WithMiddleware(func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				lock.Lock()
+				parents[req.URL.Path] = req.Header.Get("traceparent")
+				lock.Unlock()
+				return next.RoundTrip(req)
+			})
+		}),
+	)
+	exporter.Reset() // Drop the dial and login spans
+
+	ctx, root := tracer.Start(context.Background(), "fetch-peter")
+	profile, err := client.FetchProfile(ctx, testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	if err := profile.ResolveAvatar(ctx); err != nil {
+		t.Fatalf("failed to resolve avatar: %v", err)
+	}
+	tracer.End(root, nil)
+
+	spans := exporter.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("span count mismatch: have %d, want %d", len(spans), 3)
+	}
+	if spans[0].Name != "app.bsky.actor.getProfile" || spans[2] != root {
+		t.Errorf("span order mismatch: have %s, %s, %s", spans[0].Name, spans[1].Name, spans[2].Name)
+	}
+	for i, span := range spans[:2] {
+		if span.TraceID != root.TraceID || span.Parent != root.SpanID {
+			t.Errorf("span %d: not nested into root: have %s/%s, want %s/%s", i, span.TraceID, span.Parent, root.TraceID, root.SpanID)
+		}
+		if span.Attributes["http.status_code"] != 200 {
+			t.Errorf("span %d: status mismatch: have %v, want %v", i, span.Attributes["http.status_code"], 200)
+		}
+		if span.End.Before(span.Start) {
+			t.Errorf("span %d: ended before start", i)
+		}
+	}
+	if spans[0].Attributes["rpc.method"] != "app.bsky.actor.getProfile" {
+		t.Errorf("rpc method attribute mismatch: have %v", spans[0].Attributes["rpc.method"])
+	}
+	lock.Lock()
+	traceparent := parents["/xrpc/app.bsky.actor.getProfile"]
+	lock.Unlock()
+
+	want := fmt.Sprintf("00-%s-%s-01", root.TraceID, spans[0].SpanID)
+	if have := traceparent; have != want {
+		t.Errorf("traceparent mismatch: have %q, want %q", have, want)
+	}
+	// Failures should be recorded on the spans too
+	exporter.Reset()
+	if _, err := client.FetchProfile(context.Background(), "nobody.test"); err == nil {
+		t.Fatalf("missing profile fetched")
+	}
+	spans = exporter.Spans()
+	if len(spans) != 1 || !errors.Is(spans[0].Err, ErrProfileNotFound) || spans[0].Parent != (SpanID{}) {
+		t.Errorf("failed root span mismatch: have %+v", spans)
+	}
+}
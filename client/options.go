@@ -0,0 +1,145 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultJWTAsyncRefreshThreshold is the remaining validity time of a JWT
+	// token below which to trigger a session refresh on a background thread (i.e.
+	// the client can still be actively used during).
+	defaultJWTAsyncRefreshThreshold = 5 * time.Minute
+
+	// defaultJWTSyncRefreshThreshold is the remaining validity time of a JWT token
+	// below which to trigger a session refresh on a foreground thread (i.e. the
+	// client blocks new API calls until the refresh finishes).
+	defaultJWTSyncRefreshThreshold = 2 * time.Minute
+)
+
+// Option is a configuration setting for a client, applied when dialing it.
+type Option func(*config)
+
+// config is the collection of settings a client is dialed with.
+type config struct {
+	userAgent    string        // User agent to send with every request, empty for the default
+	timeout      time.Duration // Maximum duration of an API call including retries, 0 for none
+	adminToken   string        // Admin token for administrative calls, empty for none
+	asyncRefresh time.Duration // Remaining JWT validity below which to refresh in the background
+	syncRefresh  time.Duration // Remaining JWT validity below which to refresh blocking
+	logger       *log.Logger   // Logger to report background failures and retries to
+	middlewares  []Middleware  // HTTP middlewares to wrap every request with
+	interceptors []Interceptor // Interceptors to wrap every API call with
+	retryPolicy  *RetryPolicy  // Retry policy for failed calls, nil to disable retries
+	rateLimiter  *RateLimiter  // Rate limiter to pace calls with, nil to disable pacing
+}
+
+// newConfig creates a client config with the default settings, overridden by
+// the user supplied options.
+func newConfig(opts []Option) *config {
+	policy := DefaultRetryPolicy
+	cfg := &config{
+		asyncRefresh: defaultJWTAsyncRefreshThreshold,
+		syncRefresh:  defaultJWTSyncRefreshThreshold,
+		logger:       log.New(io.Discard, "", 0),
+		retryPolicy:  &policy,
+		rateLimiter:  NewRateLimiter(DefaultRateLimits),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Middleware is a wrapper around the HTTP transport of a client, allowing users
+// to inspect or modify every request and response. Middlewares are invoked for
+// every attempt of a call (i.e. retries are visible) and for image retrievals.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is an adapter to allow the use of ordinary functions as HTTP
+// transports, useful when writing middlewares.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper.
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// WithUserAgent sets the user agent to send with every request, overriding the
+// default one of the underlying XRPC library.
+func WithUserAgent(agent string) Option {
+	return func(cfg *config) {
+		cfg.userAgent = agent
+	}
+}
+
+// WithTimeout sets the maximum time an API call may take end to end, including
+// any retries and reading the response. Zero means no timeout.
+//
+// Note, the limit also applies to waiting out rate limits, so a timeout shorter
+// than the rate limit windows of the server will abort such calls.
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = timeout
+	}
+}
+
+// WithAdminToken sets the token to authenticate administrative API calls with.
+// It is only sent with calls that require it (e.g. com.atproto.admin.*).
+func WithAdminToken(token string) Option {
+	return func(cfg *config) {
+		cfg.adminToken = token
+	}
+}
+
+// WithRefreshThresholds overrides the remaining validity times of the access JWT
+// token below which the session is refreshed. Above the sync threshold the refresh
+// runs in the background; below it API calls block until the refresh finishes.
+//
+// The sync threshold must not be larger than the async one.
+func WithRefreshThresholds(async time.Duration, sync time.Duration) Option {
+	return func(cfg *config) {
+		cfg.asyncRefresh, cfg.syncRefresh = async, sync
+	}
+}
+
+// WithLogger sets the logger to report background failures (e.g. session refreshes)
+// and retried calls to. By default nothing is logged.
+func WithLogger(logger *log.Logger) Option {
+	return func(cfg *config) {
+		if logger == nil {
+			logger = log.New(io.Discard, "", 0)
+		}
+		cfg.logger = logger
+	}
+}
+
+// WithMiddleware adds an HTTP middleware around the transport of the client. If
+// multiple middlewares are added, the first one will be the outermost.
+func WithMiddleware(middleware Middleware) Option {
+	return func(cfg *config) {
+		cfg.middlewares = append(cfg.middlewares, middleware)
+	}
+}
+
+// WithRetryPolicy overrides the DefaultRetryPolicy of the client. A nil policy
+// disables retries altogether.
+func WithRetryPolicy(policy *RetryPolicy) Option {
+	return func(cfg *config) {
+		cfg.retryPolicy = policy
+	}
+}
+
+// WithRateLimiter overrides the default rate limiter of the client. A nil limiter
+// disables client side pacing altogether.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(cfg *config) {
+		cfg.rateLimiter = limiter
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// Tests that the user agent is sent with every request and that middlewares are
+// invoked in the configured order.
+func TestDialUserAgentAndMiddleware(t *testing.T) {
+	srv := makeTestServer(t)
+
+	var (
+		lock   sync.Mutex
+		agents []string
+		order  []string
+	)
+	record := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				lock.Lock()
+				order = append(order, name)
+				if name == "inner" {
+					agents = append(agents, req.Header.Get("User-Agent"))
+				}
+				lock.Unlock()
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client(),
+		WithUserAgent("go-bluesky-test/1.0"),
+		WithMiddleware(record("outer")),
+		WithMiddleware(record("inner")),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	profile, err := client.FetchProfile(context.Background(), testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	if err := profile.ResolveAvatar(context.Background()); err != nil {
+		t.Fatalf("failed to resolve avatar: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(agents) != 4 { // describeServer, createSession, getProfile, avatar
+		t.Fatalf("request count mismatch: have %d, want %d", len(agents), 4)
+	}
+	for i, agent := range agents {
+		if agent != "go-bluesky-test/1.0" {
+			t.Errorf("request %d: user agent mismatch: have %q, want %q", i, agent, "go-bluesky-test/1.0")
+		}
+	}
+	for i := 0; i < len(order); i += 2 {
+		if order[i] != "outer" || order[i+1] != "inner" {
+			t.Errorf("request %d: middleware order mismatch: have %v, want [outer inner]", i/2, order[i:i+2])
+		}
+	}
+}
+
+// Tests that calls exceeding the configured timeout are aborted.
+func TestDialTimeout(t *testing.T) {
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client(), WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	srv.InjectFault("com.atproto.server.createSession", &clienttest.Fault{Delay: time.Second, Times: 1})
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err == nil {
+		t.Fatalf("slow login succeeded beyond timeout")
+	}
+}
+
+// Tests that custom refresh thresholds are used for deciding whether to refresh
+// the JWT tokens and that failed background refreshes are logged.
+func TestDialRefreshThresholds(t *testing.T) {
+	srv := makeTestServer(t)
+	srv.AccessTTL = time.Hour
+
+	if _, err := DialWithClient(context.Background(), srv.URL, srv.Client(), WithRefreshThresholds(time.Minute, time.Hour)); err == nil {
+		t.Fatalf("dial succeeded with sync threshold above async one")
+	}
+	logs := new(lockedBuffer)
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client(),
+		WithRefreshThresholds(2*time.Hour, time.Minute),
+		WithLogger(log.New(logs, "", 0)),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	// Inject a refresh failure and ensure a background refresh is attempted on a
+	// token living shorter than the async threshold
+	srv.InjectFault("com.atproto.server.refreshSession", &clienttest.Fault{
+		Status: http.StatusBadRequest,
+		Error:  "InvalidRequest",
+	})
+	refreshed := make(chan bool, 1)
+	client.jwtRefreshHook = func(skip bool, async bool) {
+		select {
+		case refreshed <- async:
+		default:
+		}
+	}
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	select {
+	case async := <-refreshed:
+		if !async {
+			t.Errorf("refresh mode mismatch: have sync, want async")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("refresh not triggered below custom async threshold")
+	}
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if strings.Contains(logs.String(), "Failed to refresh session") {
+			return
+		}
+	}
+	t.Errorf("failed refresh not logged: have %q", logs.String())
+}
+
+// Tests that the admin token is only sent with administrative calls.
+func TestDialAdminToken(t *testing.T) {
+	srv := makeTestServer(t)
+
+	var (
+		lock  sync.Mutex
+		auths = make(map[string]string)
+	)
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client(),
+		WithAdminToken("hunter2"),
+		WithRetryPolicy(nil),
+		WithMiddleware(func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				lock.Lock()
+				auths[strings.TrimPrefix(req.URL.Path, "/xrpc/")] = req.Header.Get("Authorization")
+				lock.Unlock()
+				return next.RoundTrip(req)
+			})
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	client.CustomCall(func(xc *xrpc.Client) error {
+		// The fake server doesn't implement admin calls, only the headers matter
+		xc.Do(context.Background(), xrpc.Query, "", "com.atproto.admin.getRepo", map[string]interface{}{"did": testDIDPeter}, nil, nil)
+		return nil
+	})
+	lock.Lock()
+	defer lock.Unlock()
+
+	if auth := auths["com.atproto.server.describeServer"]; auth != "" {
+		t.Errorf("admin token leaked into regular call: %q", auth)
+	}
+	if auth := auths["com.atproto.server.createSession"]; auth != "" {
+		t.Errorf("admin token leaked into login call: %q", auth)
+	}
+	if auth := auths["com.atproto.admin.getRepo"]; !strings.HasPrefix(auth, "Basic ") {
+		t.Errorf("admin token missing from admin call: have %q", auth)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, needed to capture the
+// logs of the background threads of a client.
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+// Write implements io.Writer.
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.Write(p)
+}
+
+// String returns the contents of the buffer.
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buf.String()
+}
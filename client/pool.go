@@ -0,0 +1,329 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAccountNotFound is returned from a pool if a client is requested for an
+	// account that the pool does not manage.
+	ErrAccountNotFound = errors.New("account not found in pool")
+
+	// ErrPoolClosed is returned from a pool if a client is requested after the
+	// pool was already closed.
+	ErrPoolClosed = errors.New("pool closed")
+)
+
+// Credentials are the login details of a single Bluesky account.
+type Credentials struct {
+	Handle string // Handle (or DID) of the account to log in with
+	Appkey string // Application password to log in with
+}
+
+// CredentialSource is a provider of account credentials for a client pool (e.g.
+// a configuration file, environment variables or a secrets manager).
+type CredentialSource interface {
+	// Credentials retrieves the login details of all the accounts to manage.
+	Credentials(ctx context.Context) ([]*Credentials, error)
+}
+
+// StaticCredentials is a CredentialSource serving a fixed list of credentials.
+type StaticCredentials []*Credentials
+
+// Credentials implements CredentialSource.
+func (s StaticCredentials) Credentials(ctx context.Context) ([]*Credentials, error) {
+	return s, nil
+}
+
+// EnvCredentials is a CredentialSource reading the credentials from the named
+// environment variable, formatted as a comma separated list of handle:appkey
+// pairs (e.g. "alice.bsky.social:abcd-efgh-ijkl-mnop,bob.bsky.social:...").
+type EnvCredentials string
+
+// Credentials implements CredentialSource.
+func (s EnvCredentials) Credentials(ctx context.Context) ([]*Credentials, error) {
+	value, ok := os.LookupEnv(string(s))
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", string(s))
+	}
+	var creds []*Credentials
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		handle, appkey, ok := strings.Cut(pair, ":")
+		if !ok || handle == "" || appkey == "" {
+			return nil, fmt.Errorf("environment variable %s: malformed credentials #%d", string(s), len(creds))
+		}
+		creds = append(creds, &Credentials{Handle: handle, Appkey: appkey})
+	}
+	return creds, nil
+}
+
+// Pool is a collection of logged in clients for many Bluesky accounts, keyed by
+// their DIDs. Instead of every client running its own background refresher, the
+// pool runs a single one for all of them; and since it knows the credentials of
+// the accounts, it also logs back in if a session expires altogether.
+type Pool struct {
+	accounts map[string]*poolAccount // Accounts managed by the pool, keyed by DID
+	lock     sync.RWMutex            // Lock protecting the account metadata
+
+	refresherStop chan chan struct{} // Notification channel to stop the refresher
+	closed        bool               // Flag whether the pool was already closed
+}
+
+// poolAccount is a single account managed by a pool.
+type poolAccount struct {
+	client *Client      // Logged in client of the account
+	creds  *Credentials // Credentials to log back in with if the session expires
+	renew  sync.Mutex   // Lock serializing session checks to avoid concurrent logins
+
+	leases  int       // Number of callers currently using the client
+	checked time.Time // Time of the last session health check
+	failure error     // Failure of the last session health check, if any
+}
+
+// SessionHealth is the state of a single session managed by a pool.
+type SessionHealth struct {
+	DID    string // Machine friendly - stable - identifier of the account
+	Handle string // User-friendly - unstable - identifier of the account
+
+	AccessExpire  time.Time // Expiration time for the access JWT token
+	RefreshExpire time.Time // Expiration time for the refresh JWT token
+	Leases        int       // Number of callers currently using the client
+	Checked       time.Time // Time of the last session health check
+	Err           error     // Failure of the last session health check, nil if passed
+}
+
+// Healthy reports whether the session passed its last health check and it can
+// still be refreshed without a new login.
+func (h *SessionHealth) Healthy() bool {
+	return h.Err == nil && time.Now().Before(h.RefreshExpire)
+}
+
+// NewPool connects to a remote Bluesky server and logs in with every account
+// provided by the credential source. The options are applied to every client.
+func NewPool(ctx context.Context, server string, source CredentialSource, opts ...Option) (*Pool, error) {
+	return NewPoolWithClient(ctx, server, new(http.Client), source, opts...)
+}
+
+// NewPoolWithClient connects to a remote Bluesky server using a user supplied
+// HTTP client and logs in with every account provided by the credential source.
+// The options are applied to every client.
+//
+// If any of the accounts fails to log in, the entire pool creation fails.
+func NewPoolWithClient(ctx context.Context, server string, client *http.Client, source CredentialSource, opts ...Option) (*Pool, error) {
+	creds, err := source.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pool := &Pool{
+		accounts: make(map[string]*poolAccount),
+	}
+	for _, cred := range creds {
+		account, err := newPoolAccount(ctx, server, client, cred, opts)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("account %s: %w", cred.Handle, err)
+		}
+		did, _ := account.client.did()
+		if _, ok := pool.accounts[did]; ok {
+			account.client.Close()
+			continue
+		}
+		pool.accounts[did] = account
+	}
+	pool.refresherStop = make(chan chan struct{})
+	go pool.refresher()
+
+	return pool, nil
+}
+
+// newPoolAccount dials a new client and logs it in without starting a dedicated
+// background refresher.
+func newPoolAccount(ctx context.Context, server string, client *http.Client, creds *Credentials, opts []Option) (*poolAccount, error) {
+	c, err := DialWithClient(ctx, server, client, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.login(ctx, creds.Handle, creds.Appkey); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &poolAccount{client: c, creds: creds, checked: time.Now()}, nil
+}
+
+// Close terminates the pool, shutting down the background refresher and all the
+// clients. Clients that are still leased out should not be used any more.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+
+	if p.refresherStop != nil {
+		stopc := make(chan struct{})
+		p.refresherStop <- stopc
+		<-stopc
+	}
+	for _, account := range p.accounts {
+		account.client.Close()
+	}
+	return nil
+}
+
+// DIDs returns the DIDs of all the accounts managed by the pool, sorted.
+func (p *Pool) DIDs() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	dids := make([]string, 0, len(p.accounts))
+	for did := range p.accounts {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+	return dids
+}
+
+// Lease retrieves the client of an account, identified by its DID or handle,
+// ensuring its session is valid. The returned release function must be called
+// when the caller is done using the client.
+//
+// Note, leases are not exclusive. Clients are safe for concurrent use, so the
+// same client may be leased to multiple callers at the same time.
+func (p *Pool) Lease(ctx context.Context, id string) (*Client, func(), error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, nil, ErrPoolClosed
+	}
+	account := p.find(id)
+	if account == nil {
+		p.lock.Unlock()
+		return nil, nil, fmt.Errorf("%w: %s", ErrAccountNotFound, id)
+	}
+	account.leases++
+	p.lock.Unlock()
+
+	release := func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		account.leases--
+	}
+	// Only serialize on the session check if the session needs renewing, leases
+	// of fresh sessions are the common case and shouldn't contend on the lock
+	if !account.client.jwtFresh() {
+		if err := p.check(ctx, account); err != nil {
+			release()
+			return nil, nil, err
+		}
+	}
+	var once sync.Once
+	return account.client, func() { once.Do(release) }, nil
+}
+
+// Do leases the client of an account, identified by its DID or handle, and runs
+// the given callback with it, releasing the client afterwards.
+func (p *Pool) Do(ctx context.Context, id string, fn func(client *Client) error) error {
+	client, release, err := p.Lease(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return fn(client)
+}
+
+// find looks up an account by DID or by handle. The caller must hold the lock.
+func (p *Pool) find(id string) *poolAccount {
+	id = trimActorID(id)
+	if account, ok := p.accounts[id]; ok {
+		return account
+	}
+	for _, account := range p.accounts {
+		if session := account.client.Session(); session != nil && strings.EqualFold(session.Handle, id) {
+			return account
+		}
+	}
+	return nil
+}
+
+// Health returns the state of all the sessions managed by the pool, sorted by
+// DID.
+func (p *Pool) Health() []*SessionHealth {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	health := make([]*SessionHealth, 0, len(p.accounts))
+	for did, account := range p.accounts {
+		h := &SessionHealth{
+			DID:     did,
+			Leases:  account.leases,
+			Checked: account.checked,
+			Err:     account.failure,
+		}
+		if session := account.client.Session(); session != nil {
+			h.Handle = session.Handle
+			h.AccessExpire = session.AccessExpire
+			h.RefreshExpire = session.RefreshExpire
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].DID < health[j].DID })
+	return health
+}
+
+// check ensures the session of an account is valid, refreshing it if it is close
+// to expiration, or logging back in if it has expired already.
+func (p *Pool) check(ctx context.Context, account *poolAccount) error {
+	account.renew.Lock()
+	defer account.renew.Unlock()
+
+	err := account.client.maybeRefreshJWT()
+	if errors.Is(err, ErrSessionExpired) {
+		account.client.logf("Session of %s expired, logging in again", account.creds.Handle)
+		err = account.client.login(ctx, account.creds.Handle, account.creds.Appkey)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	account.checked, account.failure = time.Now(), err
+	return err
+}
+
+// refresher is an infinite loop that periodically checks the validity of the
+// sessions of all the accounts and refreshes the ones getting close to expiration.
+func (p *Pool) refresher() {
+	for {
+		// Attempt to refresh all the sessions. The accounts are never modified
+		// after the pool is created, so it's safe to iterate them without a lock.
+		for _, account := range p.accounts {
+			if err := p.check(context.Background(), account); err != nil {
+				account.client.logf("Failed to refresh session of %s: %v", account.creds.Handle, err)
+			}
+		}
+		// Wait until some time passes or the pool is closing down
+		select {
+		case <-time.After(time.Minute):
+		case stopc := <-p.refresherStop:
+			stopc <- struct{}{}
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+)
+
+// makeTestPool starts a fake server with an extra bot account and creates a pool
+// managing both the tester and the bot.
+func makeTestPool(t *testing.T) (*clienttest.Server, *Pool) {
+	t.Helper()
+
+	srv := makeTestServer(t)
+	srv.AddAccount(&clienttest.Account{
+		Handle:       "bot.test",
+		DID:          "did:plc:bot",
+		AppPasswords: []string{"bot-appkey"},
+	})
+	pool, err := NewPoolWithClient(context.Background(), srv.URL, srv.Client(), StaticCredentials{
+		{Handle: testHandleTester, Appkey: testAppkeyTester},
+		{Handle: "bot.test", Appkey: "bot-appkey"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	return srv, pool
+}
+
+// Tests that a pool logs in all the accounts and leases out their clients by
+// DID or handle.
+func TestPoolLease(t *testing.T) {
+	_, pool := makeTestPool(t)
+
+	if dids := pool.DIDs(); !reflect.DeepEqual(dids, []string{"did:plc:bot", testDIDTester}) {
+		t.Fatalf("pool accounts mismatch: have %v, want %v", dids, []string{"did:plc:bot", testDIDTester})
+	}
+	for _, id := range []string{"did:plc:bot", "bot.test", "@bot.test"} {
+		client, release, err := pool.Lease(context.Background(), id)
+		if err != nil {
+			t.Fatalf("%s: failed to lease client: %v", id, err)
+		}
+		if did, _ := client.did(); did != "did:plc:bot" {
+			t.Errorf("%s: leased client mismatch: have %s, want %s", id, did, "did:plc:bot")
+		}
+		if leases := pool.Health()[0].Leases; leases != 1 {
+			t.Errorf("%s: lease count mismatch: have %d, want %d", id, leases, 1)
+		}
+		release()
+		release() // Double release should be a no-op
+
+		if leases := pool.Health()[0].Leases; leases != 0 {
+			t.Errorf("%s: lease count mismatch after release: have %d, want %d", id, leases, 0)
+		}
+	}
+	if _, _, err := pool.Lease(context.Background(), "nobody.test"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("unknown account error mismatch: have %v, want %v", err, ErrAccountNotFound)
+	}
+	err := pool.Do(context.Background(), testHandleTester, func(client *Client) error {
+		_, err := client.FetchProfile(context.Background(), testDIDPeter)
+		return err
+	})
+	if err != nil {
+		t.Errorf("failed to run call with pooled client: %v", err)
+	}
+	pool.Close()
+	if _, _, err := pool.Lease(context.Background(), testDIDTester); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("closed pool error mismatch: have %v, want %v", err, ErrPoolClosed)
+	}
+}
+
+// Tests that leasing a client with a fresh session doesn't wait for an ongoing
+// session check, while leasing one needing renewal does.
+func TestPoolLeaseFresh(t *testing.T) {
+	_, pool := makeTestPool(t)
+
+	bot := pool.accounts["did:plc:bot"]
+	bot.renew.Lock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, release, err := pool.Lease(context.Background(), "did:plc:bot")
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to lease fresh client: %v", err)
+		}
+	case <-time.After(time.Second):
+		bot.renew.Unlock()
+		t.Fatalf("fresh lease blocked on session check")
+	}
+	// Expire the session and ensure the lease waits for the check
+	setJWTExpire(bot.client, time.Time{}, time.Time{})
+	go func() {
+		_, release, err := pool.Lease(context.Background(), "did:plc:bot")
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expired lease skipped session check: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	bot.renew.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("failed to lease renewed client: %v", err)
+	}
+	if time.Until(getJWTExpire(bot.client)) < time.Hour {
+		t.Errorf("session not renewed: expires at %v", getJWTExpire(bot.client))
+	}
+}
+
+// Tests that pool creation fails if any of the accounts cannot log in.
+func TestPoolLoginFailure(t *testing.T) {
+	srv := makeTestServer(t)
+
+	_, err := NewPoolWithClient(context.Background(), srv.URL, srv.Client(), StaticCredentials{
+		{Handle: testHandleTester, Appkey: testAppkeyTester},
+		{Handle: testHandleTester, Appkey: "wrong-appkey"},
+	})
+	if !errors.Is(err, ErrLoginUnauthorized) {
+		t.Fatalf("login failure error mismatch: have %v, want %v", err, ErrLoginUnauthorized)
+	}
+}
+
+// Tests that pooled clients don't run their own refreshers and that expired
+// sessions are recovered by logging in again.
+func TestPoolSessionExpiry(t *testing.T) {
+	srv, pool := makeTestPool(t)
+
+	for _, did := range pool.DIDs() {
+		if pool.accounts[did].client.jwtRefresherStop != nil {
+			t.Errorf("%s: pooled client runs dedicated refresher", did)
+		}
+	}
+	// Expire the session of the bot completely and ensure it gets revived
+	bot := pool.accounts["did:plc:bot"]
+	setJWTExpire(bot.client, time.Time{}, time.Time{})
+
+	logins := srv.Calls("com.atproto.server.createSession")
+	client, release, err := pool.Lease(context.Background(), "did:plc:bot")
+	if err != nil {
+		t.Fatalf("failed to lease expired client: %v", err)
+	}
+	defer release()
+
+	if calls := srv.Calls("com.atproto.server.createSession"); calls != logins+1 {
+		t.Errorf("login count mismatch: have %d, want %d", calls, logins+1)
+	}
+	if time.Until(getJWTExpire(client)) < time.Hour {
+		t.Errorf("session not renewed: expires at %v", getJWTExpire(client))
+	}
+	// Break the bot's login and ensure the failure is reported in the health
+	setJWTExpire(bot.client, time.Time{}, time.Time{})
+	srv.InjectFault("com.atproto.server.createSession", &clienttest.Fault{
+		Status: 401,
+		Error:  "AuthenticationRequired",
+	})
+	defer srv.ClearFaults()
+
+	if _, _, err := pool.Lease(context.Background(), "did:plc:bot"); !errors.Is(err, ErrLoginUnauthorized) {
+		t.Errorf("failed relogin error mismatch: have %v, want %v", err, ErrLoginUnauthorized)
+	}
+	health := pool.Health()
+	if len(health) != 2 {
+		t.Fatalf("health report count mismatch: have %d, want %d", len(health), 2)
+	}
+	if health[0].DID != "did:plc:bot" || health[0].Handle != "bot.test" || health[0].Healthy() || !errors.Is(health[0].Err, ErrLoginUnauthorized) {
+		t.Errorf("unhealthy session report mismatch: have %+v", health[0])
+	}
+	if health[1].DID != testDIDTester || !health[1].Healthy() || health[1].Checked.IsZero() {
+		t.Errorf("healthy session report mismatch: have %+v", health[1])
+	}
+}
+
+// Tests that credentials can be loaded from environment variables.
+func TestEnvCredentials(t *testing.T) {
+	t.Setenv("TEST_BLUESKY_ACCOUNTS", "alice.test:aaaa-bbbb, bob.test:cccc-dddd,")
+
+	creds, err := EnvCredentials("TEST_BLUESKY_ACCOUNTS").Credentials(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load credentials: %v", err)
+	}
+	want := []*Credentials{{Handle: "alice.test", Appkey: "aaaa-bbbb"}, {Handle: "bob.test", Appkey: "cccc-dddd"}}
+	if !reflect.DeepEqual(creds, want) {
+		t.Errorf("credentials mismatch: have %v, want %v", creds, want)
+	}
+	t.Setenv("TEST_BLUESKY_ACCOUNTS", "alice.test")
+	if _, err := EnvCredentials("TEST_BLUESKY_ACCOUNTS").Credentials(context.Background()); err == nil {
+		t.Errorf("malformed credentials accepted")
+	}
+	if _, err := EnvCredentials("TEST_BLUESKY_MISSING").Credentials(context.Background()); err == nil {
+		t.Errorf("missing environment variable accepted")
+	}
+}
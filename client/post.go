@@ -0,0 +1,260 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+)
+
+// postCollection is the NSID of the repository collection holding posts.
+const postCollection = "app.bsky.feed.post"
+
+// ErrPostEmpty is returned when attempting to publish a post without content.
+var ErrPostEmpty = errors.New("post empty")
+
+// PostImage is an image embedded into a post.
+type PostImage struct {
+	Blob *Blob  // Uploaded image to embed, see UploadImage
+	Alt  string // Alternative text describing the image for accessibility
+
+	ThumbURL    string // CDN URL to the thumbnail, only set on retrieved posts
+	FullsizeURL string // CDN URL to the full image, only set on retrieved posts
+}
+
+// PostLink is an external link card embedded into a post.
+type PostLink struct {
+	URI         string // Address of the linked resource
+	Title       string // Title of the linked resource
+	Description string // Summary of the linked resource
+	ThumbURL    string // CDN URL to the card thumbnail, empty if unset
+}
+
+// maxPostImages is the maximum number of images that can be embedded into a
+// single post.
+const maxPostImages = 4
+
+// PostRef is a strong reference to a post, identifying both its location and
+// its exact content.
+type PostRef struct {
+	URI string // at:// URI of the post within its author's repository
+	CID string // Content hash of the post
+}
+
+// Post represents a single post (skeet) on a Bluesky server.
+type Post struct {
+	URI string // at:// URI of the post, empty if not yet published
+	CID string // Content hash of the post, empty if not yet published
+
+	Text   string   // Textual content of the post
+	Facets []*Facet // Rich text annotations, auto-detected on publish if nil
+	Langs  []string // BCP-47 language tags of the text, optional
+
+	ReplyRoot   *PostRef     // Root of the thread this post replies into, nil if not a reply
+	ReplyParent *PostRef     // Direct parent this post replies to, nil if not a reply
+	Quote       *PostRef     // Post quoted (embedded) by this one, nil if not a quote
+	Images      []*PostImage // Images embedded into the post, at most 4
+
+	CreatedAt time.Time // Creation timestamp of the post, defaults to publish time
+
+	// Fields below are only populated on posts retrieved from a feed
+	Author     *User     // Author of the post
+	RepostedBy *User     // User who reposted this post into the feed, nil if not a repost
+	ReplyTo    *User     // Author of the parent post, nil if not a reply or not known
+	Link       *PostLink // External link card embedded into the post, nil if none
+	IndexedAt  time.Time // Time when the post was indexed by the server
+
+	LikeCount   uint // Number of likes the post received
+	RepostCount uint // Number of reposts the post received
+	ReplyCount  uint // Number of replies the post received
+
+	Cursor string // Feed cursor from which to resume a stream to (re)deliver this post
+}
+
+// postRecord is the app.bsky.feed.post record as it's stored in a repository.
+//
+// The generated atproto type is not used because it lacks some fields (e.g. the
+// languages) that are needed.
+type postRecord struct {
+	Type      string   `json:"$type"`
+	Text      string   `json:"text"`
+	Facets    []any    `json:"facets,omitempty"`
+	Reply     any      `json:"reply,omitempty"`
+	Embed     any      `json:"embed,omitempty"`
+	Langs     []string `json:"langs,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// CreatePost publishes a new post from the logged in user. The post's URI and
+// CID fields are filled in on success and a reference to it is also returned.
+//
+// If the post does not contain explicit facets, mentions, links and hashtags
+// are detected automatically. Mentions of handles that do not exist are left as
+// plain text.
+//
+// If the post is a reply but only the parent is set, the root of the thread is
+// looked up automatically.
+func (c *Client) CreatePost(ctx context.Context, post *Post) (*PostRef, error) {
+	if post.Text == "" && post.Quote == nil && len(post.Images) == 0 {
+		return nil, ErrPostEmpty
+	}
+	if len(post.Images) > maxPostImages {
+		return nil, fmt.Errorf("too many images: have %d, max %d", len(post.Images), maxPostImages)
+	}
+	for i, img := range post.Images {
+		if img == nil || img.Blob == nil || img.Blob.CID == "" {
+			return nil, fmt.Errorf("image %d not uploaded, see UploadImage", i)
+		}
+	}
+	// Assemble the post record from the user supplied fields
+	record := &postRecord{
+		Type:      postCollection,
+		Text:      post.Text,
+		Langs:     post.Langs,
+		CreatedAt: timestamp(time.Now()),
+	}
+	if !post.CreatedAt.IsZero() {
+		record.CreatedAt = timestamp(post.CreatedAt)
+	}
+	facets := post.Facets
+	if facets == nil {
+		var err error
+		if facets, err = c.resolveFacets(ctx, parseFacets(post.Text)); err != nil {
+			return nil, err
+		}
+	}
+	for _, facet := range facets {
+		record.Facets = append(record.Facets, facet.record())
+	}
+	if post.ReplyParent != nil {
+		root := post.ReplyRoot
+		if root == nil {
+			var err error
+			if root, err = c.threadRoot(ctx, post.ReplyParent); err != nil {
+				return nil, err
+			}
+		}
+		record.Reply = map[string]*recordRef{
+			"root":   {URI: root.URI, CID: root.CID},
+			"parent": {URI: post.ReplyParent.URI, CID: post.ReplyParent.CID},
+		}
+	}
+	record.Embed = postEmbed(post)
+
+	// Publish the post and update the local metadata
+	ref, err := c.createRecord(ctx, postCollection, record)
+	if err != nil {
+		return nil, err
+	}
+	post.URI, post.CID = ref.URI, ref.CID
+	post.Facets = facets
+
+	return &PostRef{URI: ref.URI, CID: ref.CID}, nil
+}
+
+// DeletePost deletes a post of the logged in user, identified by its DID based
+// at:// URI (as returned by CreatePost).
+func (c *Client) DeletePost(ctx context.Context, uri string) error {
+	repo, collection, rkey, err := parseRecordURI(uri)
+	if err != nil {
+		return err
+	}
+	if collection != postCollection {
+		return fmt.Errorf("not a post uri: %s", maybeEscape(uri))
+	}
+	did, err := c.did()
+	if err != nil {
+		return err
+	}
+	if repo != did {
+		return fmt.Errorf("post %s not owned by %s", maybeEscape(uri), did)
+	}
+	return c.deleteRecord(ctx, collection, rkey)
+}
+
+// postEmbed assembles the embed record of a post from the quoted post and the
+// attached images, returning nil if there is nothing to embed.
+func postEmbed(post *Post) any {
+	var quote, images map[string]any
+	if post.Quote != nil {
+		quote = map[string]any{
+			"$type":  "app.bsky.embed.record",
+			"record": &recordRef{URI: post.Quote.URI, CID: post.Quote.CID},
+		}
+	}
+	if len(post.Images) > 0 {
+		embeds := make([]any, 0, len(post.Images))
+		for _, img := range post.Images {
+			embeds = append(embeds, map[string]any{
+				"image": img.Blob.record(),
+				"alt":   img.Alt,
+			})
+		}
+		images = map[string]any{
+			"$type":  "app.bsky.embed.images",
+			"images": embeds,
+		}
+	}
+	switch {
+	case quote != nil && images != nil:
+		return map[string]any{
+			"$type":  "app.bsky.embed.recordWithMedia",
+			"record": quote,
+			"media":  images,
+		}
+	case quote != nil:
+		return quote
+	case images != nil:
+		return images
+	default:
+		return nil
+	}
+}
+
+// resolveFacets converts the handles of detected mentions into DIDs. Handles
+// that do not exist are dropped, all other facets are retained as is. Any other
+// resolution failure aborts, rather than publishing a post with missing mentions.
+func (c *Client) resolveFacets(ctx context.Context, facets []*Facet) ([]*Facet, error) {
+	resolved := make([]*Facet, 0, len(facets))
+	for _, facet := range facets {
+		if facet.handle != "" {
+			res, err := atproto.IdentityResolveHandle(ctx, c.client, facet.handle)
+			if err != nil {
+				if errors.Is(err, ErrProfileNotFound) {
+					continue
+				}
+				return nil, err
+			}
+			facet.Mention = res.Did
+		}
+		resolved = append(resolved, facet)
+	}
+	return resolved, nil
+}
+
+// threadRoot retrieves the root of the thread a post is part of. If the post is
+// not a reply, it is the root itself.
+func (c *Client) threadRoot(ctx context.Context, post *PostRef) (*PostRef, error) {
+	repo, collection, rkey, err := parseRecordURI(post.URI)
+	if err != nil {
+		return nil, err
+	}
+	var parent struct {
+		Reply *struct {
+			Root recordRef `json:"root"`
+		} `json:"reply"`
+	}
+	if _, err := c.getRecord(ctx, repo, collection, rkey, &parent); err != nil {
+		return nil, err
+	}
+	if parent.Reply == nil {
+		return post, nil
+	}
+	return &PostRef{URI: parent.Reply.Root.URI, CID: parent.Reply.Root.CID}, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"gophercon-2023-demo/client/clienttest"
+)
+
+// storedPost is the subset of a post record inspected by the tests.
+type storedPost struct {
+	Type   string `json:"$type"`
+	Text   string `json:"text"`
+	Facets []struct {
+		Index struct {
+			ByteStart int `json:"byteStart"`
+			ByteEnd   int `json:"byteEnd"`
+		} `json:"index"`
+		Features []map[string]string `json:"features"`
+	} `json:"facets"`
+	Reply *struct {
+		Root   recordRef `json:"root"`
+		Parent recordRef `json:"parent"`
+	} `json:"reply"`
+	Langs     []string `json:"langs"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// storedPostAt retrieves a post record of the test user from the server.
+func storedPostAt(t *testing.T, srv *clienttest.Server, uri string) (*clienttest.Record, *storedPost) {
+	t.Helper()
+
+	for _, record := range srv.Records(testDIDTester, postCollection) {
+		if record.URI == uri {
+			post := new(storedPost)
+			if err := json.Unmarshal(record.Value, post); err != nil {
+				t.Fatalf("failed to decode post record: %v", err)
+			}
+			return record, post
+		}
+	}
+	t.Fatalf("post %s not found", uri)
+	return nil, nil
+}
+
+// Tests that posts are published with their facets detected and resolved, and
+// that the returned reference matches the stored record.
+func TestCreatePost(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	post := &Post{
+		Text:  "Hi @why.bsky.team and @nobody.test, see https://example.com #golang",
+		Langs: []string{"en"},
+	}
+	ref, err := client.CreatePost(ctx, post)
+	if err != nil {
+		t.Fatalf("failed to create post: %v", err)
+	}
+	record, stored := storedPostAt(t, srv, ref.URI)
+	if ref.CID != record.CID {
+		t.Errorf("post cid mismatch: have %v, want %v", ref.CID, record.CID)
+	}
+	if post.URI != ref.URI || post.CID != ref.CID {
+		t.Errorf("post metadata mismatch: have %v/%v, want %v/%v", post.URI, post.CID, ref.URI, ref.CID)
+	}
+	if stored.Type != postCollection || stored.Text != post.Text || stored.CreatedAt == "" {
+		t.Errorf("stored post mismatch: have %+v", stored)
+	}
+	if len(stored.Langs) != 1 || stored.Langs[0] != "en" {
+		t.Errorf("stored languages mismatch: have %v, want [en]", stored.Langs)
+	}
+	// The unknown mention should be dropped, everything else retained
+	want := map[string]string{
+		"app.bsky.richtext.facet#mention": testDIDJeromy,
+		"app.bsky.richtext.facet#link":    "https://example.com",
+		"app.bsky.richtext.facet#tag":     "golang",
+	}
+	if len(stored.Facets) != len(want) {
+		t.Fatalf("facet count mismatch: have %d, want %d", len(stored.Facets), len(want))
+	}
+	for _, facet := range stored.Facets {
+		feature := facet.Features[0]
+
+		var value string
+		switch feature["$type"] {
+		case "app.bsky.richtext.facet#mention":
+			value = feature["did"]
+			if text := post.Text[facet.Index.ByteStart:facet.Index.ByteEnd]; text != "@why.bsky.team" {
+				t.Errorf("mention span mismatch: have %q, want %q", text, "@why.bsky.team")
+			}
+		case "app.bsky.richtext.facet#link":
+			value = feature["uri"]
+		case "app.bsky.richtext.facet#tag":
+			value = feature["tag"]
+		}
+		if value != want[feature["$type"]] {
+			t.Errorf("facet %s mismatch: have %v, want %v", feature["$type"], value, want[feature["$type"]])
+		}
+	}
+	if len(post.Facets) != len(want) {
+		t.Errorf("post facet count mismatch: have %d, want %d", len(post.Facets), len(want))
+	}
+	// Empty posts and images without uploaded blobs should be rejected
+	if _, err := client.CreatePost(ctx, &Post{}); err != ErrPostEmpty {
+		t.Errorf("empty post error mismatch: have %v, want %v", err, ErrPostEmpty)
+	}
+	for i, img := range []*PostImage{nil, {Alt: "x"}, {Blob: &Blob{MimeType: "image/png"}, Alt: "x"}} {
+		if _, err := client.CreatePost(ctx, &Post{Text: "pic", Images: []*PostImage{img}}); err == nil {
+			t.Errorf("image %d: post without uploaded blob accepted", i)
+		}
+	}
+	if records := srv.Records(testDIDTester, postCollection); len(records) != 1 {
+		t.Errorf("post count mismatch: have %d, want %d", len(records), 1)
+	}
+}
+
+// Tests that posts are not published with mentions silently dropped if handle
+// resolution fails for any reason other than an unknown handle.
+func TestCreatePostResolveFailure(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	srv.InjectFault("com.atproto.identity.resolveHandle", &clienttest.Fault{
+		Status:  http.StatusBadRequest,
+		Error:   "InvalidRequest",
+		Message: "Error: handle must be a valid handle",
+	})
+	if _, err := client.CreatePost(ctx, &Post{Text: "Hi @why.bsky.team"}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("post error mismatch: have %v, want %v", err, ErrInvalidRequest)
+	}
+	if records := srv.Records(testDIDTester, postCollection); len(records) != 0 {
+		t.Errorf("post published despite failure: have %d records", len(records))
+	}
+}
+
+// Tests that replies reference both their parent and the thread root, looking
+// the root up if only the parent is specified.
+func TestCreatePostReply(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	root, err := client.CreatePost(ctx, &Post{Text: "root"})
+	if err != nil {
+		t.Fatalf("failed to create root post: %v", err)
+	}
+	reply, err := client.CreatePost(ctx, &Post{Text: "reply", ReplyParent: root})
+	if err != nil {
+		t.Fatalf("failed to create reply: %v", err)
+	}
+	nested, err := client.CreatePost(ctx, &Post{Text: "nested", ReplyParent: reply})
+	if err != nil {
+		t.Fatalf("failed to create nested reply: %v", err)
+	}
+	tests := []struct {
+		post   *PostRef
+		parent *PostRef
+	}{
+		{reply, root},
+		{nested, reply},
+	}
+	for _, tt := range tests {
+		_, stored := storedPostAt(t, srv, tt.post.URI)
+		if stored.Reply == nil {
+			t.Errorf("%s: reply refs missing", stored.Text)
+			continue
+		}
+		if stored.Reply.Root.URI != root.URI || stored.Reply.Root.CID != root.CID {
+			t.Errorf("%s: root mismatch: have %v, want %v", stored.Text, stored.Reply.Root, *root)
+		}
+		if stored.Reply.Parent.URI != tt.parent.URI || stored.Reply.Parent.CID != tt.parent.CID {
+			t.Errorf("%s: parent mismatch: have %v, want %v", stored.Text, stored.Reply.Parent, *tt.parent)
+		}
+	}
+	if _, stored := storedPostAt(t, srv, root.URI); stored.Reply != nil {
+		t.Errorf("root post has reply refs: %v", stored.Reply)
+	}
+}
+
+// Tests that posts can be deleted, but only if owned by the logged in user.
+func TestDeletePost(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	ref, err := client.CreatePost(ctx, &Post{Text: "ephemeral"})
+	if err != nil {
+		t.Fatalf("failed to create post: %v", err)
+	}
+	for _, uri := range []string{
+		"at://" + testDIDPeter + "/" + postCollection + "/3k00000000001",
+		"at://" + testDIDTester + "/" + followCollection + "/3k00000000001",
+		"https://bsky.app/profile/tester",
+	} {
+		if err := client.DeletePost(ctx, uri); err == nil {
+			t.Errorf("%s: invalid deletion succeeded", uri)
+		}
+	}
+	if err := client.DeletePost(ctx, ref.URI); err != nil {
+		t.Fatalf("failed to delete post: %v", err)
+	}
+	if records := srv.Records(testDIDTester, postCollection); len(records) != 0 {
+		t.Errorf("post count mismatch after delete: have %d, want 0", len(records))
+	}
+}
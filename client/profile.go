@@ -5,7 +5,9 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/jpeg"
@@ -13,11 +15,23 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 )
 
 const (
+	// profileCollection is the NSID of the repository collection holding the
+	// user's profile record.
+	profileCollection = "app.bsky.actor.profile"
+
+	// profileRecordKey is the key of the user's profile record in its collection.
+	profileRecordKey = "self"
+
+	// maxProfileUpdateAttempts is the number of times a profile update is tried
+	// if the record is concurrently modified between reading and writing it.
+	maxProfileUpdateAttempts = 5
+
 	// maxProfileAvatarBytes is the maximum number of bytes a profile avatar might
 	// have before it's rejected by the library.
 	maxProfileAvatarBytes = 8 * 1024 * 1024
@@ -25,6 +39,24 @@ const (
 	// maxProfileBannerBytes is the maximum number of bytes a profile banner might
 	// have before it's rejected by the library.
 	maxProfileBannerBytes = 8 * 1024 * 1024
+
+	// maxProfilesPerBatch is the maximum number of profiles the server returns in
+	// a single bulk retrieval.
+	maxProfilesPerBatch = 25
+
+	// maxProfileFetchers is the maximum number of bulk profile retrievals to run
+	// concurrently.
+	maxProfileFetchers = 4
+)
+
+var (
+	// ErrImageNotSet is returned when retrieving the raw data of a profile
+	// picture that the user did not set.
+	ErrImageNotSet = errors.New("image not set")
+
+	// ErrImageNotFound is returned when retrieving the raw data of a profile
+	// picture that is set, but the CDN does not serve (e.g. it was deleted).
+	ErrImageNotFound = errors.New("image not found")
 )
 
 // Profile represents a user profile on a Bluesky server.
@@ -67,20 +99,90 @@ type User struct {
 //
 // Supported IDs are the Bluesky handles or atproto DIDs.
 func (c *Client) FetchProfile(ctx context.Context, id string) (*Profile, error) {
-	// The API only supports the non-prefixed forms. Seems a bit wonky, but trim
-	// manually for now until it's decided whether this is a feature or a bug.
-	// https://github.com/bluesky-social/atproto/issues/989
-	if strings.HasPrefix(id, "@") {
-		id = id[1:]
-	}
-	if strings.HasPrefix(id, "at://") {
-		id = id[5:]
-	}
 	// Retrieve the remote profile
-	profile, err := bsky.ActorGetProfile(ctx, c.client, id)
+	profile, err := bsky.ActorGetProfile(ctx, c.client, trimActorID(id))
 	if err != nil {
 		return nil, err
 	}
+	return c.newProfile(profile), nil
+}
+
+// FetchProfiles retrieves all the metadata about a batch of users, requesting
+// them from the server in chunks of 25, with a few chunks in flight at once.
+//
+// Supported IDs are the Bluesky handles or atproto DIDs. The returned profiles
+// and errors are index aligned with the requested IDs: each ID either has a
+// profile, or an error explaining why it could not be retrieved. IDs that the
+// server does not know about are reported as ErrProfileNotFound.
+func (c *Client) FetchProfiles(ctx context.Context, ids []string) ([]*Profile, []error) {
+	var (
+		profiles = make([]*Profile, len(ids))
+		errs     = make([]error, len(ids))
+		batches  = make(chan int)
+		pend     sync.WaitGroup
+	)
+	workers := (len(ids) + maxProfilesPerBatch - 1) / maxProfilesPerBatch
+	if workers > maxProfileFetchers {
+		workers = maxProfileFetchers
+	}
+	for i := 0; i < workers; i++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+
+			// Each batch fills a disjoint slice of the results, no locking needed
+			for start := range batches {
+				end := start + maxProfilesPerBatch
+				if end > len(ids) {
+					end = len(ids)
+				}
+				c.fetchProfileBatch(ctx, ids[start:end], profiles[start:end], errs[start:end])
+			}
+		}()
+	}
+	for start := 0; start < len(ids); start += maxProfilesPerBatch {
+		batches <- start
+	}
+	close(batches)
+	pend.Wait()
+
+	return profiles, errs
+}
+
+// fetchProfileBatch retrieves a single chunk of profiles with one server call,
+// filling in the profile or the error for each ID.
+func (c *Client) fetchProfileBatch(ctx context.Context, ids []string, profiles []*Profile, errs []error) {
+	actors := make([]string, len(ids))
+	for i, id := range ids {
+		actors[i] = trimActorID(id)
+	}
+	res, err := bsky.ActorGetProfiles(ctx, c.client, actors)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	// The server omits unknown users and does not retain the request order, so
+	// match the results back by DID or handle
+	found := make(map[string]*Profile, 2*len(res.Profiles))
+	for _, view := range res.Profiles {
+		profile := c.newProfile(view)
+		found[profile.DID] = profile
+		found[strings.ToLower(profile.Handle)] = profile
+	}
+	for i, actor := range actors {
+		if !strings.HasPrefix(actor, "did:") {
+			actor = strings.ToLower(actor)
+		}
+		if profiles[i] = found[actor]; profiles[i] == nil {
+			errs[i] = ErrProfileNotFound
+		}
+	}
+}
+
+// newProfile converts a detailed profile view from the server into a profile.
+func (c *Client) newProfile(profile *bsky.ActorDefs_ProfileViewDetailed) *Profile {
 	// Dig out the relevant fields and drop pointless pointers
 	p := &Profile{
 		client:        c,
@@ -102,7 +204,109 @@ func (c *Client) FetchProfile(ctx context.Context, id string) (*Profile, error)
 	if profile.Banner != nil {
 		p.BannerURL = *profile.Banner
 	}
-	return p, nil
+	return p
+}
+
+// ProfileUpdate is a partial update to the logged in user's profile. Any fields
+// left unset retain their current value.
+type ProfileUpdate struct {
+	Name *string // New display name, nil to leave unchanged
+	Bio  *string // New profile description, nil to leave unchanged
+
+	Avatar      image.Image // New profile picture, nil to leave unchanged
+	ClearAvatar bool        // Whether to remove the current profile picture
+
+	Banner      image.Image // New banner picture, nil to leave unchanged
+	ClearBanner bool        // Whether to remove the current banner picture
+}
+
+// UpdateProfile applies a partial update to the logged in user's profile.
+//
+// The update is a read-modify-write of the profile record, guarded by the
+// record's content hash. If the profile is concurrently modified by someone
+// else between the read and the write, the server rejects the write and the
+// update is reapplied on top of the fresh record, up to maxProfileUpdateAttempts
+// times. If the record keeps changing, ErrInvalidSwap is returned instead of
+// silently overwriting the other changes.
+func (c *Client) UpdateProfile(ctx context.Context, update *ProfileUpdate) error {
+	did, err := c.did()
+	if err != nil {
+		return err
+	}
+	// Upload any new pictures first, they don't need to be part of the swap
+	var avatar, banner *Blob
+	if update.Avatar != nil {
+		if avatar, err = c.uploadImage(ctx, update.Avatar); err != nil {
+			return err
+		}
+	}
+	if update.Banner != nil {
+		if banner, err = c.uploadImage(ctx, update.Banner); err != nil {
+			return err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.swapProfile(ctx, did, update, avatar, banner)
+		if !errors.Is(err, ErrInvalidSwap) || attempt == maxProfileUpdateAttempts {
+			return err
+		}
+	}
+}
+
+// swapProfile does a single read-modify-write attempt of a profile update, with
+// any new pictures already uploaded.
+func (c *Client) swapProfile(ctx context.Context, did string, update *ProfileUpdate, avatar *Blob, banner *Blob) error {
+	// Retrieve the current profile record, if any. The record is kept raw, so
+	// fields unknown to this library are retained as they are.
+	var (
+		record = map[string]any{"$type": profileCollection}
+		swap   *string
+	)
+	cid, err := c.getRecord(ctx, did, profileCollection, profileRecordKey, &record)
+	switch {
+	case err == nil:
+		swap = &cid
+	case errors.Is(err, errRecordNotFound):
+		// No profile yet, create it from scratch
+	default:
+		return err
+	}
+	// Apply the requested modifications and push the record back
+	if update.Name != nil {
+		record["displayName"] = *update.Name
+	}
+	if update.Bio != nil {
+		record["description"] = *update.Bio
+	}
+	if update.ClearAvatar {
+		delete(record, "avatar")
+	}
+	if avatar != nil {
+		record["avatar"] = avatar.record()
+	}
+	if update.ClearBanner {
+		delete(record, "banner")
+	}
+	if banner != nil {
+		record["banner"] = banner.record()
+	}
+	_, err = c.putRecord(ctx, profileCollection, profileRecordKey, record, swap)
+	return err
+}
+
+// trimActorID converts a user supplied handle or DID into the non-prefixed form
+// accepted by the API.
+func trimActorID(id string) string {
+	// The API only supports the non-prefixed forms. Seems a bit wonky, but trim
+	// manually for now until it's decided whether this is a feature or a bug.
+	// https://github.com/bluesky-social/atproto/issues/989
+	if strings.HasPrefix(id, "@") {
+		id = id[1:]
+	}
+	if strings.HasPrefix(id, "at://") {
+		id = id[5:]
+	}
+	return id
 }
 
 // String implements the stringer interface to help debug things.
@@ -167,6 +371,26 @@ func (p *Profile) ResolveBannerWithLimit(ctx context.Context, bytes uint64) erro
 	return nil
 }
 
+// FetchAvatarData retrieves the encoded profile picture from the server URL as is,
+// without decoding it, along with its content type. If the avatar is unset, the
+// method returns ErrImageNotSet.
+func (p *Profile) FetchAvatarData(ctx context.Context) ([]byte, string, error) {
+	if p.AvatarURL == "" {
+		return nil, "", ErrImageNotSet
+	}
+	return fetchImageData(ctx, p.client, p.AvatarURL, maxProfileAvatarBytes)
+}
+
+// FetchBannerData retrieves the encoded banner picture from the server URL as is,
+// without decoding it, along with its content type. If the banner is unset, the
+// method returns ErrImageNotSet.
+func (p *Profile) FetchBannerData(ctx context.Context) ([]byte, string, error) {
+	if p.BannerURL == "" {
+		return nil, "", ErrImageNotSet
+	}
+	return fetchImageData(ctx, p.client, p.BannerURL, maxProfileBannerBytes)
+}
+
 // ResolveFollowers resolves the full list of followers of a profile and injects
 // it into the profile itself.
 //
@@ -196,57 +420,7 @@ func (p *Profile) ResolveFollowers(ctx context.Context) error {
 // Note, this method is meant to process the follower list as a stream, and will
 // thus not populate the profile's followers field.
 func (p *Profile) StreamFollowers(ctx context.Context) (<-chan *User, <-chan error) {
-	var (
-		cursor    string
-		followers = make(chan *User, 100) // Ensure all results fit to unblock a second call
-		errc      = make(chan error, 1)   // Ensure the failure fits to unblock termination
-	)
-	go func() {
-		// No matter what happens, close both channels
-		defer func() {
-			close(followers)
-			close(errc)
-		}()
-		for {
-			// Resolve the followers from the Bluesky server
-			res, err := bsky.GraphGetFollowers(ctx, p.client.client, p.DID, cursor, 100)
-			if err != nil {
-				errc <- err
-				return
-			}
-			// Parse the followers and feed them one by one to the sink channel
-			for _, follower := range res.Followers {
-				f := &User{
-					client: p.client,
-					Handle: follower.Handle,
-					DID:    follower.Did,
-				}
-				if follower.DisplayName != nil {
-					f.Name = *follower.DisplayName
-				}
-				if follower.Description != nil {
-					f.Bio = *follower.Description
-				}
-				if follower.Avatar != nil {
-					f.AvatarURL = *follower.Avatar
-				}
-				select {
-				case <-ctx.Done():
-					// Request is being torn down, abort
-					errc <- ctx.Err()
-					return
-				case followers <- f:
-					// Follower read, get the next one
-				}
-			}
-			// If there are further followers to parse, repeat
-			if res.Cursor == nil {
-				break
-			}
-			cursor = *res.Cursor
-		}
-	}()
-	return followers, errc
+	return p.client.streamUsers(ctx, p.DID, p.client.FetchFollowers)
 }
 
 // ResolveFollowing resolves the full list of followees of a profile and injects
@@ -278,57 +452,129 @@ func (p *Profile) ResolveFollowing(ctx context.Context) error {
 // Note, this method is meant to process the followeer list as a stream, and will
 // thus not populate the profile's followees field.
 func (p *Profile) StreamFollowing(ctx context.Context) (<-chan *User, <-chan error) {
+	return p.client.streamUsers(ctx, p.DID, p.client.FetchFollowing)
+}
+
+// maxUsersPerPage is the maximum number of users the server returns in a single
+// page of a follower or followee listing.
+const maxUsersPerPage = 100
+
+// FetchFollowers retrieves a single page of followers of a user, starting at the
+// given cursor (empty for the first page). The returned cursor can be used to
+// fetch the next page, and is empty if there are no more followers left.
+//
+// The limit is capped at 100 by the server; set it to 0 to use the maximum.
+func (c *Client) FetchFollowers(ctx context.Context, id string, cursor string, limit int) ([]*User, string, error) {
+	if limit <= 0 || limit > maxUsersPerPage {
+		limit = maxUsersPerPage
+	}
+	res, err := bsky.GraphGetFollowers(ctx, c.client, trimActorID(id), cursor, int64(limit))
+	if err != nil {
+		return nil, "", err
+	}
+	return c.newUsers(res.Followers), derefCursor(res.Cursor), nil
+}
+
+// FetchFollowing retrieves a single page of followees of a user, starting at the
+// given cursor (empty for the first page). The returned cursor can be used to
+// fetch the next page, and is empty if there are no more followees left.
+//
+// The limit is capped at 100 by the server; set it to 0 to use the maximum.
+func (c *Client) FetchFollowing(ctx context.Context, id string, cursor string, limit int) ([]*User, string, error) {
+	if limit <= 0 || limit > maxUsersPerPage {
+		limit = maxUsersPerPage
+	}
+	res, err := bsky.GraphGetFollows(ctx, c.client, trimActorID(id), cursor, int64(limit))
+	if err != nil {
+		return nil, "", err
+	}
+	return c.newUsers(res.Follows), derefCursor(res.Cursor), nil
+}
+
+// derefCursor converts an optional pagination cursor into a string, empty if
+// there are no more pages.
+func derefCursor(cursor *string) string {
+	if cursor == nil {
+		return ""
+	}
+	return *cursor
+}
+
+// newUsers converts a list of profile views returned by the server into users.
+func (c *Client) newUsers(views []*bsky.ActorDefs_ProfileView) []*User {
+	users := make([]*User, 0, len(views))
+	for _, view := range views {
+		u := &User{
+			client: c,
+			Handle: view.Handle,
+			DID:    view.Did,
+		}
+		if view.DisplayName != nil {
+			u.Name = *view.DisplayName
+		}
+		if view.Description != nil {
+			u.Bio = *view.Description
+		}
+		if view.Avatar != nil {
+			u.AvatarURL = *view.Avatar
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
+// userPager is a method fetching a single page of a user listing.
+type userPager func(ctx context.Context, id string, cursor string, limit int) ([]*User, string, error)
+
+// streamUsers is the cursor loop behind the follower and followee streams. It
+// gradually resolves all the pages of a listing, feeding the users async into a
+// result channel, waiting out and retrying rate limited pages from the same
+// cursor.
+func (c *Client) streamUsers(ctx context.Context, id string, fetch userPager) (<-chan *User, <-chan error) {
 	var (
-		cursor    string
-		followees = make(chan *User, 100) // Ensure all results fit to unblock a second call
-		errc      = make(chan error, 1)   // Ensure the failure fits to unblock termination
+		cursor   string
+		failures int
+		users    = make(chan *User, maxUsersPerPage) // Ensure all results fit to unblock a second call
+		errc     = make(chan error, 1)               // Ensure the failure fits to unblock termination
 	)
 	go func() {
 		// No matter what happens, close both channels
 		defer func() {
-			close(followees)
+			close(users)
 			close(errc)
 		}()
 		for {
-			// Resolve the followees from the Bluesky server
-			res, err := bsky.GraphGetFollows(ctx, p.client.client, p.DID, cursor, 100)
+			// Resolve the next page of users from the Bluesky server
+			page, next, err := fetch(ctx, id, cursor, maxUsersPerPage)
 			if err != nil {
-				errc <- err
-				return
-			}
-			// Parse the followers and feed them one by one to the sink channel
-			for _, followee := range res.Follows {
-				f := &User{
-					client: p.client,
-					Handle: followee.Handle,
-					DID:    followee.Did,
-				}
-				if followee.DisplayName != nil {
-					f.Name = *followee.DisplayName
-				}
-				if followee.Description != nil {
-					f.Bio = *followee.Description
-				}
-				if followee.Avatar != nil {
-					f.AvatarURL = *followee.Avatar
+				// If rate limited, wait it out and retry from the same cursor
+				failures++
+				if err = c.waitPage(ctx, err, failures); err != nil {
+					errc <- err
+					return
 				}
+				continue
+			}
+			failures = 0
+			// Feed the users one by one to the sink channel
+			for _, user := range page {
 				select {
 				case <-ctx.Done():
 					// Request is being torn down, abort
 					errc <- ctx.Err()
 					return
-				case followees <- f:
-					// Followee read, get the next one
+				case users <- user:
+					// User read, get the next one
 				}
 			}
-			// If there are further followees to parse, repeat
-			if res.Cursor == nil {
+			// If there are further users to parse, repeat
+			if next == "" {
 				break
 			}
-			cursor = *res.Cursor
+			cursor = next
 		}
 	}()
-	return followees, errc
+	return users, errc
 }
 
 // String implements the stringer interface to help debug things.
@@ -339,6 +585,13 @@ func (u *User) String() string {
 	return fmt.Sprintf("%s (%s/%s)", maybeEscape(u.Name), u.Handle, u.DID)
 }
 
+// Upgrade retrieves the full profile of the user, including the fields that are
+// not part of follower and followee listings (e.g. banner and counters). The
+// user is looked up by DID, so a handle change in between does not matter.
+func (u *User) Upgrade(ctx context.Context) (*Profile, error) {
+	return u.client.FetchProfile(ctx, u.DID)
+}
+
 // ResolveAvatar resolves the user avatar from the server URL and injects it into
 // the user itself. If the avatar (URL) is unset, the method will return success
 // and leave the image in the user nil.
@@ -367,23 +620,58 @@ func (u *User) ResolveAvatarWithLimit(ctx context.Context, bytes uint64) error {
 }
 
 // fetchImage resolves a remote image via a URL and a set byte cap.
-func fetchImage(ctx context.Context, client *Client, url string, bytes uint64) (image.Image, error) {
+func fetchImage(ctx context.Context, client *Client, url string, limit uint64) (image.Image, error) {
+	data, _, err := fetchImageData(ctx, client, url, limit)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// fetchImageData retrieves a remote image via a URL and a set byte cap, without
+// decoding it. The content type reported by the server is returned, or sniffed
+// from the data if the server did not report any.
+func fetchImageData(ctx context.Context, client *Client, url string, limit uint64) ([]byte, string, error) {
 	// Initiate the remote image retrieval
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if client.client.UserAgent != nil {
+		req.Header.Set("User-Agent", *client.client.UserAgent)
 	}
 	res, err := client.client.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer res.Body.Close()
 
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return nil, "", fmt.Errorf("%w: %s", ErrImageNotFound, res.Status)
+	case res.StatusCode >= http.StatusInternalServerError:
+		return nil, "", fmt.Errorf("%w: image retrieval failed: %s", ErrServerFailure, res.Status)
+	case res.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("image retrieval failed: %s", res.Status)
+	}
 	// Read the image with a cap on the max data size if requested
 	in := io.Reader(res.Body)
-	if bytes != 0 {
-		in = io.LimitReader(res.Body, int64(bytes))
+	if limit != 0 {
+		in = io.LimitReader(res.Body, int64(limit)+1)
 	}
-	img, _, err := image.Decode(in)
-	return img, err
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, "", err
+	}
+	if limit != 0 && uint64(len(data)) > limit {
+		// The data was cut short, so report it as such too, same as a decoder
+		// choking on the truncated image would
+		return nil, "", fmt.Errorf("%w: %w", ErrImageTooLarge, io.ErrUnexpectedEOF)
+	}
+	ctype := res.Header.Get("Content-Type")
+	if ctype == "" || ctype == "application/octet-stream" {
+		ctype = http.DetectContentType(data)
+	}
+	return data, ctype, nil
 }
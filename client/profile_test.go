@@ -6,9 +6,17 @@ package client
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+
+	"gophercon-2023-demo/client/clienttest"
 )
 
 // Tests that the library can be used to fetch a user's profile from a Bluesky
@@ -118,6 +126,47 @@ func TestResolveProfileImages(t *testing.T) {
 	}
 }
 
+// Tests that images missing from the CDN are reported as not found, and only
+// server errors as server failures.
+func TestResolveProfileImageFailures(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer cdn.Close()
+
+	client := makeTestClientWithLogin(t)
+	profile, err := client.FetchProfile(context.Background(), testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	tests := []struct {
+		status int
+		want   error
+		notErr error
+	}{
+		{http.StatusNotFound, ErrImageNotFound, ErrServerFailure},
+		{http.StatusGone, ErrImageNotFound, ErrServerFailure},
+		{http.StatusBadGateway, ErrServerFailure, ErrImageNotFound},
+		{http.StatusForbidden, nil, ErrServerFailure},
+	}
+	for _, tt := range tests {
+		profile.AvatarURL = fmt.Sprintf("%s/%d", cdn.URL, tt.status)
+
+		err := profile.ResolveAvatar(context.Background())
+		if err == nil {
+			t.Errorf("status %d: avatar resolution succeeded", tt.status)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("status %d: error mismatch: have %v, want %v", tt.status, err, tt.want)
+		}
+		if errors.Is(err, tt.notErr) {
+			t.Errorf("status %d: error %v unexpectedly matches %v", tt.status, err, tt.notErr)
+		}
+	}
+}
+
 // Tests that the library can crawl the follower list and retrieve all of them.
 func TestResolveProfileFollowers(t *testing.T) {
 	var (
@@ -212,7 +261,7 @@ func TestResolveProfileFollowees(t *testing.T) {
 		t.Fatalf("failed to fetch author profile: %v", err)
 	}
 	// Resolve all the followees directly into the profile struct
-	if err := profile.ResolveFollowees(ctx); err != nil {
+	if err := profile.ResolveFollowing(ctx); err != nil {
 		t.Fatalf("failed to fetch author followees: %v", err)
 	}
 	if profile.Followees == nil {
@@ -237,7 +286,7 @@ func TestResolveProfileFolloweesWithCancellation(t *testing.T) {
 	// Resolve the followees indirectly via channels, cancelling after the first
 	// read, ensuring that the full list does not get crawled
 	cctx, cancel := context.WithCancel(ctx)
-	followeec, errc := profile.StreamFollowees(cctx)
+	followeec, errc := profile.StreamFollowing(cctx)
 
 	<-followeec
 	retrieved := 1
@@ -265,7 +314,7 @@ func TestResolveProfileFolloweeAvatar(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to fetch author profile: %v", err)
 	}
-	if err := profile.ResolveFollowees(ctx); err != nil {
+	if err := profile.ResolveFollowing(ctx); err != nil {
 		t.Fatalf("failed to fetch author followers: %v", err)
 	}
 	// Find Jeromy and hope he has a profile picture set, resolve it
@@ -281,3 +330,259 @@ func TestResolveProfileFolloweeAvatar(t *testing.T) {
 		}
 	}
 }
+
+// Tests that followers and followees can be paged through manually, with the
+// pages adding up to the full lists.
+func TestFetchFollowPages(t *testing.T) {
+	var (
+		client = makeTestClientWithLogin(t)
+		ctx    = context.Background()
+	)
+	tests := []struct {
+		name  string
+		id    string
+		fetch func(ctx context.Context, id string, cursor string, limit int) ([]*User, string, error)
+		want  int
+	}{
+		{"followers", testDIDPeter, client.FetchFollowers, 252},
+		{"following", testDIDJeromy, client.FetchFollowing, 251},
+	}
+	for _, tt := range tests {
+		var (
+			cursor string
+			pages  int
+			seen   = make(map[string]bool)
+		)
+		for {
+			users, next, err := tt.fetch(ctx, tt.id, cursor, 64)
+			if err != nil {
+				t.Fatalf("%s: failed to fetch page %d: %v", tt.name, pages, err)
+			}
+			if len(users) > 64 {
+				t.Errorf("%s: page %d size mismatch: have %d, want <= %d", tt.name, pages, len(users), 64)
+			}
+			for _, user := range users {
+				if seen[user.DID] {
+					t.Errorf("%s: duplicate user %s", tt.name, user.DID)
+				}
+				seen[user.DID] = true
+			}
+			pages++
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if len(seen) != tt.want {
+			t.Errorf("%s: user count mismatch: have %d, want %d", tt.name, len(seen), tt.want)
+		}
+		if pages != (tt.want+63)/64 {
+			t.Errorf("%s: page count mismatch: have %d, want %d", tt.name, pages, (tt.want+63)/64)
+		}
+	}
+}
+
+// Tests that profiles can be retrieved in bulk, chunked into batches, retaining
+// the requested order and reporting unknown users individually.
+func TestFetchProfiles(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	// Request a mix of handles, DIDs and unknown users, in reverse seeding order
+	var ids, want []string
+	for i := 119; i >= 0; i-- {
+		switch {
+		case i%10 == 0:
+			ids = append(ids, fmt.Sprintf("nobody%03d.test", i))
+			want = append(want, "")
+		case i%2 == 0:
+			ids = append(ids, fmt.Sprintf("@User%03d.test", i))
+			want = append(want, fmt.Sprintf("did:plc:user%03d", i))
+		default:
+			ids = append(ids, fmt.Sprintf("did:plc:user%03d", i))
+			want = append(want, fmt.Sprintf("did:plc:user%03d", i))
+		}
+	}
+	ids = append(ids, testDIDPeter, testDIDPeter)
+	want = append(want, testDIDPeter, testDIDPeter)
+
+	profiles, errs := client.FetchProfiles(ctx, ids)
+	if len(profiles) != len(ids) || len(errs) != len(ids) {
+		t.Fatalf("result count mismatch: have %d/%d, want %d", len(profiles), len(errs), len(ids))
+	}
+	for i, id := range ids {
+		if want[i] == "" {
+			if !errors.Is(errs[i], ErrProfileNotFound) {
+				t.Errorf("%s: error mismatch: have %v, want %v", id, errs[i], ErrProfileNotFound)
+			}
+			if profiles[i] != nil {
+				t.Errorf("%s: unexpected profile: %v", id, profiles[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("%s: failed to fetch profile: %v", id, errs[i])
+			continue
+		}
+		if profiles[i].DID != want[i] {
+			t.Errorf("%s: did mismatch: have %v, want %v", id, profiles[i].DID, want[i])
+		}
+	}
+	if have := profiles[len(ids)-1].FollowerCount; have != 252 {
+		t.Errorf("follower count mismatch: have %v, want %v", have, 252)
+	}
+	if calls := srv.Calls("app.bsky.actor.getProfiles"); calls != (len(ids)+24)/25 {
+		t.Errorf("batch count mismatch: have %d, want %d", calls, (len(ids)+24)/25)
+	}
+	// Failed batches should be reported on all their users, but not on others
+	srv.InjectFault("app.bsky.actor.getProfiles", &clienttest.Fault{Status: http.StatusBadRequest, Error: "InvalidRequest", Times: 1})
+
+	profiles, errs = client.FetchProfiles(ctx, ids[:30])
+	var failed int
+	for i := range errs {
+		switch {
+		case errors.Is(errs[i], ErrInvalidRequest):
+			failed++
+		case want[i] == "" && !errors.Is(errs[i], ErrProfileNotFound):
+			t.Errorf("%s: error mismatch: have %v, want %v", ids[i], errs[i], ErrProfileNotFound)
+		case want[i] != "" && (errs[i] != nil || profiles[i] == nil):
+			t.Errorf("%s: failed to fetch profile: %v", ids[i], errs[i])
+		}
+	}
+	if failed != 25 && failed != 5 {
+		t.Errorf("failed user count mismatch: have %d, want 25 or 5", failed)
+	}
+}
+
+// Tests that a user from a follower listing can be upgraded to a full profile.
+func TestUpgradeUser(t *testing.T) {
+	var (
+		client = makeTestClientWithLogin(t)
+		ctx    = context.Background()
+	)
+	profile, err := client.FetchProfile(ctx, testDIDTester)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	if err := profile.ResolveFollowing(ctx); err != nil {
+		t.Fatalf("failed to resolve followees: %v", err)
+	}
+	if len(profile.Followees) != 1 {
+		t.Fatalf("followee count mismatch: have %d, want %d", len(profile.Followees), 1)
+	}
+	upgraded, err := profile.Followees[0].Upgrade(ctx)
+	if err != nil {
+		t.Fatalf("failed to upgrade user: %v", err)
+	}
+	if upgraded.DID != testDIDPeter {
+		t.Errorf("did mismatch: have %v, want %v", upgraded.DID, testDIDPeter)
+	}
+	if upgraded.BannerURL == "" {
+		t.Errorf("banner URL missing from upgraded profile")
+	}
+	if upgraded.FollowerCount != 252 {
+		t.Errorf("follower count mismatch: have %v, want %v", upgraded.FollowerCount, 252)
+	}
+}
+
+// profileRecord retrieves the raw profile record of the test user from the server.
+func profileRecord(t *testing.T, srv *clienttest.Server) map[string]any {
+	t.Helper()
+
+	records := srv.Records(testDIDTester, profileCollection)
+	if len(records) != 1 {
+		t.Fatalf("profile record count mismatch: have %d, want %d", len(records), 1)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(records[0].Value, &record); err != nil {
+		t.Fatalf("failed to decode profile record: %v", err)
+	}
+	return record
+}
+
+// Tests that profile updates only modify the requested fields, retaining any
+// other field set by other clients, and that a missing profile is created.
+func TestUpdateProfile(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+		name, bio   = "Tester", "Testing things"
+	)
+	if err := client.UpdateProfile(ctx, &ProfileUpdate{Name: &name}); err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+	if record := profileRecord(t, srv); record["displayName"] != name || record["description"] != nil {
+		t.Errorf("created profile mismatch: have %v, want displayName %q only", record, name)
+	}
+	// Simulate an edit from another client and ensure it's merged
+	srv.PutRecord(testDIDTester, profileCollection, profileRecordKey, map[string]any{
+		"$type":       profileCollection,
+		"displayName": "Renamed",
+		"pronouns":    "they/them",
+	})
+	if err := client.UpdateProfile(ctx, &ProfileUpdate{Bio: &bio}); err != nil {
+		t.Fatalf("failed to update profile: %v", err)
+	}
+	record := profileRecord(t, srv)
+	if record["displayName"] != "Renamed" {
+		t.Errorf("name mismatch: have %v, want %v", record["displayName"], "Renamed")
+	}
+	if record["description"] != bio {
+		t.Errorf("bio mismatch: have %v, want %v", record["description"], bio)
+	}
+	if record["pronouns"] != "they/them" {
+		t.Errorf("unknown field mismatch: have %v, want %v", record["pronouns"], "they/them")
+	}
+}
+
+// Tests that profile updates racing each other are all retained, instead of the
+// later ones overwriting the earlier ones.
+func TestUpdateProfileConcurrently(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+	)
+	for i := 0; i < 10; i++ {
+		var (
+			name = fmt.Sprintf("Tester #%d", i)
+			bio  = fmt.Sprintf("Testing things #%d", i)
+			errc = make(chan error, 2)
+		)
+		go func() { errc <- client.UpdateProfile(ctx, &ProfileUpdate{Name: &name}) }()
+		go func() { errc <- client.UpdateProfile(ctx, &ProfileUpdate{Bio: &bio}) }()
+
+		for j := 0; j < 2; j++ {
+			if err := <-errc; err != nil {
+				t.Fatalf("round %d: failed to update profile: %v", i, err)
+			}
+		}
+		if record := profileRecord(t, srv); record["displayName"] != name || record["description"] != bio {
+			t.Errorf("round %d: profile mismatch: have %v/%v, want %v/%v", i, record["displayName"], record["description"], name, bio)
+		}
+	}
+}
+
+// Tests that profile updates are retried if the record was concurrently modified,
+// but only a limited number of times.
+func TestUpdateProfileSwapRetries(t *testing.T) {
+	var (
+		client, srv = makeTestClientWithServer(t)
+		ctx         = context.Background()
+		name        = "Tester"
+	)
+	srv.InjectFault("com.atproto.repo.putRecord", &clienttest.Fault{Status: http.StatusBadRequest, Error: "InvalidSwap", Times: maxProfileUpdateAttempts - 1})
+	if err := client.UpdateProfile(ctx, &ProfileUpdate{Name: &name}); err != nil {
+		t.Fatalf("failed to update profile: %v", err)
+	}
+	if calls := srv.Calls("com.atproto.repo.getRecord"); calls != maxProfileUpdateAttempts {
+		t.Errorf("profile read count mismatch: have %d, want %d", calls, maxProfileUpdateAttempts)
+	}
+	srv.InjectFault("com.atproto.repo.putRecord", &clienttest.Fault{Status: http.StatusBadRequest, Error: "InvalidSwap"})
+	if err := client.UpdateProfile(ctx, &ProfileUpdate{Name: &name}); !errors.Is(err, ErrInvalidSwap) {
+		t.Errorf("update error mismatch: have %v, want %v", err, ErrInvalidSwap)
+	}
+	if calls := srv.Calls("com.atproto.repo.putRecord"); calls != 2*maxProfileUpdateAttempts {
+		t.Errorf("profile write count mismatch: have %d, want %d", calls, 2*maxProfileUpdateAttempts)
+	}
+}
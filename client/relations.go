@@ -0,0 +1,200 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSnapshotMismatch is returned when diffing two snapshots that were not
+	// taken of the same user.
+	ErrSnapshotMismatch = errors.New("snapshots of different users")
+)
+
+// Relations is the social graph around a user, split by the direction of the
+// follows. Users are matched by DID, since handles might change.
+type Relations struct {
+	Mutuals       []*User // Users who follow and are followed back by the user
+	FollowersOnly []*User // Users who follow the user, but are not followed back
+	FollowingOnly []*User // Users who are followed by the user, but don't follow back
+}
+
+// FetchRelations resolves the full lists of followers and followees of a profile
+// concurrently and splits them into mutuals, followers-only and following-only
+// users. Users within each set retain the order they were streamed in.
+//
+// Note, this method needs to retrieve both lists in full, so it might take a
+// while to complete on larger accounts.
+func (p *Profile) FetchRelations(ctx context.Context) (*Relations, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		followers []*User
+		followees []*User
+		errs      [2]error
+		pend      sync.WaitGroup
+	)
+	// drain consumes a user stream, aborting the other one on failure
+	drain := func(userc <-chan *User, errc <-chan error, users *[]*User, err *error) {
+		defer pend.Done()
+
+		for user := range userc {
+			*users = append(*users, user)
+		}
+		if *err = <-errc; *err != nil {
+			cancel()
+		}
+	}
+	pend.Add(2)
+	followerc, followerErrc := p.StreamFollowers(ctx)
+	go drain(followerc, followerErrc, &followers, &errs[0])
+
+	followeec, followeeErrc := p.StreamFollowing(ctx)
+	go drain(followeec, followeeErrc, &followees, &errs[1])
+
+	pend.Wait()
+
+	// If either stream failed, report the original failure, not the cancellation
+	// it caused on the other one
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return splitRelations(followers, followees), nil
+}
+
+// FetchMutuals resolves the users who follow and are followed back by a profile.
+func (p *Profile) FetchMutuals(ctx context.Context) ([]*User, error) {
+	relations, err := p.FetchRelations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return relations.Mutuals, nil
+}
+
+// FetchFollowersOnly resolves the users who follow a profile, but are not
+// followed back.
+func (p *Profile) FetchFollowersOnly(ctx context.Context) ([]*User, error) {
+	relations, err := p.FetchRelations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return relations.FollowersOnly, nil
+}
+
+// FetchFollowingOnly resolves the users who are followed by a profile, but don't
+// follow back.
+func (p *Profile) FetchFollowingOnly(ctx context.Context) ([]*User, error) {
+	relations, err := p.FetchRelations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return relations.FollowingOnly, nil
+}
+
+// splitRelations splits a follower and a followee list by DID into mutuals,
+// followers-only and following-only sets.
+func splitRelations(followers []*User, followees []*User) *Relations {
+	following := make(map[string]bool, len(followees))
+	for _, followee := range followees {
+		following[followee.DID] = true
+	}
+	followed := make(map[string]bool, len(followers))
+
+	relations := new(Relations)
+	for _, follower := range followers {
+		followed[follower.DID] = true
+		if following[follower.DID] {
+			relations.Mutuals = append(relations.Mutuals, follower)
+		} else {
+			relations.FollowersOnly = append(relations.FollowersOnly, follower)
+		}
+	}
+	for _, followee := range followees {
+		if !followed[followee.DID] {
+			relations.FollowingOnly = append(relations.FollowingOnly, followee)
+		}
+	}
+	return relations
+}
+
+// Snapshot is a point in time capture of the followers of a user, which can be
+// saved and later diffed against a newer one to find out who followed or
+// unfollowed in between.
+type Snapshot struct {
+	DID   string          `json:"did"`   // Machine friendly - stable - identifier of the user
+	Taken time.Time       `json:"taken"` // Time when the snapshot was taken
+	Users []*SnapshotUser `json:"users"` // Followers of the user at the time
+}
+
+// SnapshotUser is a single follower captured within a snapshot.
+type SnapshotUser struct {
+	DID    string `json:"did"`    // Machine friendly - stable - identifier of the follower
+	Handle string `json:"handle"` // User-friendly - unstable - identifier of the follower
+}
+
+// SnapshotDiff is the difference between two follower snapshots of a user.
+type SnapshotDiff struct {
+	Added   []*SnapshotUser // Followers in the newer snapshot only, with their new handles
+	Removed []*SnapshotUser // Followers in the older snapshot only, with their old handles
+}
+
+// SnapshotFollowers resolves the full list of followers of a profile and captures
+// it into a snapshot.
+func (p *Profile) SnapshotFollowers(ctx context.Context) (*Snapshot, error) {
+	followerc, errc := p.StreamFollowers(ctx)
+
+	snapshot := &Snapshot{
+		DID:   p.DID,
+		Taken: time.Now(),
+		Users: make([]*SnapshotUser, 0, p.FollowerCount),
+	}
+	for follower := range followerc {
+		snapshot.Users = append(snapshot.Users, &SnapshotUser{DID: follower.DID, Handle: follower.Handle})
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// DiffSnapshots compares two follower snapshots of the same user by DID, so that
+// followers who merely changed their handles are not reported.
+func DiffSnapshots(older *Snapshot, newer *Snapshot) (*SnapshotDiff, error) {
+	if older.DID != newer.DID {
+		return nil, ErrSnapshotMismatch
+	}
+	var (
+		olds = make(map[string]bool, len(older.Users))
+		news = make(map[string]bool, len(newer.Users))
+		diff = new(SnapshotDiff)
+	)
+	for _, user := range older.Users {
+		olds[user.DID] = true
+	}
+	for _, user := range newer.Users {
+		news[user.DID] = true
+		if !olds[user.DID] {
+			diff.Added = append(diff.Added, user)
+		}
+	}
+	for _, user := range older.Users {
+		if !news[user.DID] {
+			diff.Removed = append(diff.Removed, user)
+		}
+	}
+	return diff, nil
+}
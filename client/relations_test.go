@@ -0,0 +1,131 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"testing"
+)
+
+// Tests that the relations of a user are split correctly into mutuals,
+// followers-only and following-only sets.
+func TestFetchRelations(t *testing.T) {
+	var (
+		client = makeTestClientWithLogin(t)
+		ctx    = context.Background()
+	)
+	tests := []struct {
+		id            string
+		mutuals       []string
+		followersOnly int
+		followingOnly int
+	}{
+		{testDIDPeter, []string{testDIDJeromy}, 251, 0},
+		{testDIDJeromy, []string{testDIDPeter}, 0, 250},
+		{testDIDTester, nil, 40, 1},
+	}
+	for _, tt := range tests {
+		profile, err := client.FetchProfile(ctx, tt.id)
+		if err != nil {
+			t.Fatalf("%s: failed to fetch profile: %v", tt.id, err)
+		}
+		relations, err := profile.FetchRelations(ctx)
+		if err != nil {
+			t.Fatalf("%s: failed to fetch relations: %v", tt.id, err)
+		}
+		if len(relations.Mutuals) != len(tt.mutuals) {
+			t.Errorf("%s: mutuals count mismatch: have %d, want %d", tt.id, len(relations.Mutuals), len(tt.mutuals))
+		} else {
+			for i, mutual := range relations.Mutuals {
+				if mutual.DID != tt.mutuals[i] {
+					t.Errorf("%s: mutual %d mismatch: have %v, want %v", tt.id, i, mutual.DID, tt.mutuals[i])
+				}
+			}
+		}
+		if len(relations.FollowersOnly) != tt.followersOnly {
+			t.Errorf("%s: followers-only count mismatch: have %d, want %d", tt.id, len(relations.FollowersOnly), tt.followersOnly)
+		}
+		if len(relations.FollowingOnly) != tt.followingOnly {
+			t.Errorf("%s: following-only count mismatch: have %d, want %d", tt.id, len(relations.FollowingOnly), tt.followingOnly)
+		}
+	}
+}
+
+// Tests that relation resolution is aborted if the context is cancelled.
+func TestFetchRelationsWithCancellation(t *testing.T) {
+	client := makeTestClientWithLogin(t)
+
+	profile, err := client.FetchProfile(context.Background(), testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := profile.FetchRelations(ctx); err == nil {
+		t.Errorf("cancelled relation resolution succeeded")
+	}
+}
+
+// Tests that snapshots are diffed by DID, ignoring handle changes.
+func TestDiffSnapshots(t *testing.T) {
+	older := &Snapshot{DID: testDIDPeter, Users: []*SnapshotUser{
+		{DID: "did:plc:alice", Handle: "alice.test"},
+		{DID: "did:plc:bob", Handle: "bob.test"},
+		{DID: "did:plc:carol", Handle: "carol.test"},
+	}}
+	newer := &Snapshot{DID: testDIDPeter, Users: []*SnapshotUser{
+		{DID: "did:plc:carol", Handle: "carol.example.com"},
+		{DID: "did:plc:dave", Handle: "dave.test"},
+		{DID: "did:plc:alice", Handle: "alice.test"},
+	}}
+	diff, err := DiffSnapshots(older, newer)
+	if err != nil {
+		t.Fatalf("failed to diff snapshots: %v", err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].DID != "did:plc:dave" {
+		t.Errorf("added followers mismatch: have %v, want [did:plc:dave]", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].DID != "did:plc:bob" {
+		t.Errorf("removed followers mismatch: have %v, want [did:plc:bob]", diff.Removed)
+	}
+	if _, err := DiffSnapshots(older, &Snapshot{DID: testDIDJeromy}); err != ErrSnapshotMismatch {
+		t.Errorf("foreign snapshot error mismatch: have %v, want %v", err, ErrSnapshotMismatch)
+	}
+}
+
+// Tests that a snapshot taken from the server can be diffed against an older one.
+func TestSnapshotFollowers(t *testing.T) {
+	var (
+		client = makeTestClientWithLogin(t)
+		ctx    = context.Background()
+	)
+	profile, err := client.FetchProfile(ctx, testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	snapshot, err := profile.SnapshotFollowers(ctx)
+	if err != nil {
+		t.Fatalf("failed to snapshot followers: %v", err)
+	}
+	if len(snapshot.Users) != 252 {
+		t.Errorf("snapshot size mismatch: have %d, want %d", len(snapshot.Users), 252)
+	}
+	// Pretend the first 10 followers are new and that someone has since left
+	older := &Snapshot{DID: snapshot.DID}
+	older.Users = append(older.Users, snapshot.Users[10:]...)
+	older.Users = append(older.Users, &SnapshotUser{DID: "did:plc:gone", Handle: "gone.test"})
+
+	diff, err := DiffSnapshots(older, snapshot)
+	if err != nil {
+		t.Fatalf("failed to diff snapshots: %v", err)
+	}
+	if len(diff.Added) != 10 {
+		t.Errorf("added followers mismatch: have %d, want %d", len(diff.Added), 10)
+	}
+	if len(diff.Removed) != 1 {
+		t.Errorf("removed followers mismatch: have %d, want %d", len(diff.Removed), 1)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// timestampLayout is the datetime format used by atproto records. The format is
+// RFC3339 with fixed millisecond precision, which is what the official clients
+// emit too.
+const timestampLayout = "2006-01-02T15:04:05.000Z"
+
+// rawRecord is a record retrieved from a repository, with its value left in
+// the raw JSON form for the caller to interpret.
+type rawRecord struct {
+	URI   string          `json:"uri"`
+	CID   string          `json:"cid"`
+	Value json.RawMessage `json:"value"`
+}
+
+// recordRef is a strong reference to a record in a user's repository, consisting
+// of its at:// URI and its content hash.
+type recordRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+// did returns the DID of the logged in user, or ErrNotLoggedIn if the client is
+// not authenticated.
+func (c *Client) did() (string, error) {
+	c.jwtLock.RLock()
+	defer c.jwtLock.RUnlock()
+
+	if c.client.Auth == nil {
+		return "", ErrNotLoggedIn
+	}
+	return c.client.Auth.Did, nil
+}
+
+// createRecord creates a new record in the logged in user's repository, letting
+// the server pick the record key.
+//
+// The record is shipped as plain JSON so that types not (yet) generated by the
+// atproto library can be used too. It needs to contain its own $type field.
+func (c *Client) createRecord(ctx context.Context, collection string, record any) (*recordRef, error) {
+	did, err := c.did()
+	if err != nil {
+		return nil, err
+	}
+	input := struct {
+		Repo       string `json:"repo"`
+		Collection string `json:"collection"`
+		Record     any    `json:"record"`
+	}{did, collection, record}
+
+	ref := new(recordRef)
+	if err := c.client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.createRecord", nil, input, ref); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// deleteRecord deletes a record from the logged in user's repository.
+func (c *Client) deleteRecord(ctx context.Context, collection string, rkey string) error {
+	did, err := c.did()
+	if err != nil {
+		return err
+	}
+	input := struct {
+		Repo       string `json:"repo"`
+		Collection string `json:"collection"`
+		Rkey       string `json:"rkey"`
+	}{did, collection, rkey}
+
+	return c.client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.deleteRecord", nil, input, nil)
+}
+
+// getRecord retrieves a record from an arbitrary repository, decoding its value
+// into the provided output object and returning its content hash.
+func (c *Client) getRecord(ctx context.Context, repo string, collection string, rkey string, value any) (string, error) {
+	params := map[string]any{
+		"repo":       repo,
+		"collection": collection,
+		"rkey":       rkey,
+	}
+	var res struct {
+		URI   string          `json:"uri"`
+		CID   string          `json:"cid"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := c.client.Do(ctx, xrpc.Query, "", "com.atproto.repo.getRecord", params, nil, &res); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(res.Value, value); err != nil {
+		return "", err
+	}
+	return res.CID, nil
+}
+
+// listRecords retrieves a batch of records from a collection within an arbitrary
+// repository, also returning the cursor to retrieve the next batch with (empty
+// if there are no more records).
+func (c *Client) listRecords(ctx context.Context, repo string, collection string, cursor string, limit int) ([]*rawRecord, string, error) {
+	params := map[string]any{
+		"repo":       repo,
+		"collection": collection,
+		"limit":      limit,
+	}
+	if cursor != "" {
+		params["cursor"] = cursor
+	}
+	var res struct {
+		Cursor  string       `json:"cursor"`
+		Records []*rawRecord `json:"records"`
+	}
+	if err := c.client.Do(ctx, xrpc.Query, "", "com.atproto.repo.listRecords", params, nil, &res); err != nil {
+		return nil, "", err
+	}
+	return res.Records, res.Cursor, nil
+}
+
+// putRecord creates or overwrites a record with a specific key in the logged in
+// user's repository. The write is only accepted if the current content hash of
+// the record matches the swap CID, or if swap is nil and the record does not yet
+// exist.
+func (c *Client) putRecord(ctx context.Context, collection string, rkey string, record any, swap *string) (*recordRef, error) {
+	did, err := c.did()
+	if err != nil {
+		return nil, err
+	}
+	input := struct {
+		Repo       string  `json:"repo"`
+		Collection string  `json:"collection"`
+		Rkey       string  `json:"rkey"`
+		Record     any     `json:"record"`
+		SwapRecord *string `json:"swapRecord"`
+	}{did, collection, rkey, record, swap}
+
+	ref := new(recordRef)
+	if err := c.client.Do(ctx, xrpc.Procedure, "application/json", "com.atproto.repo.putRecord", nil, input, ref); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// parseRecordURI splits an at:// record URI into its repository, collection and
+// record key components.
+func parseRecordURI(uri string) (repo string, collection string, rkey string, err error) {
+	parts := strings.Split(strings.TrimPrefix(uri, "at://"), "/")
+	if !strings.HasPrefix(uri, "at://") || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid record uri: %s", maybeEscape(uri))
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// timestamp formats a time in the atproto record datetime format.
+func timestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
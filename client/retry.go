@@ -0,0 +1,364 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy configures how failed XRPC calls are retried.
+//
+// Only failures that are safe to retry are retried: rate limited calls, since
+// the server did not process them; and server failures or transport errors of
+// queries and idempotent procedures, since repeating them has no side effects.
+type RetryPolicy struct {
+	MaxAttempts   int           // Total number of attempts per call, including the first
+	MinBackoff    time.Duration // Delay before the first retry, doubled on every failure
+	MaxBackoff    time.Duration // Maximum delay between retries
+	MaxRetryAfter time.Duration // Maximum server requested delay to wait out, fail if longer
+}
+
+// DefaultRetryPolicy is the retry policy used by newly dialed clients.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   4,
+	MinBackoff:    500 * time.Millisecond,
+	MaxBackoff:    30 * time.Second,
+	MaxRetryAfter: 5 * time.Minute,
+}
+
+// EndpointClass is a group of XRPC methods sharing the same server rate limits.
+type EndpointClass int
+
+const (
+	EndpointRead  EndpointClass = iota // Queries (e.g. getProfile, getFollowers)
+	EndpointWrite                      // Procedures (e.g. createRecord, uploadBlob)
+	EndpointAuth                       // Session management (createSession, refreshSession)
+)
+
+// BucketLimit is the configuration of a token bucket: it refills at a constant
+// rate up to a maximum capacity, allowing short bursts above the rate.
+type BucketLimit struct {
+	Rate  float64 // Number of calls allowed per second on average (0 = unlimited)
+	Burst int     // Number of calls allowed back to back
+}
+
+// DefaultRateLimits are the client side rate limits used by newly dialed clients,
+// set slightly below the limits published by Bluesky for its own servers.
+var DefaultRateLimits = map[EndpointClass]BucketLimit{
+	EndpointRead:  {Rate: 9, Burst: 50},   // 3000 requests per 5 minutes
+	EndpointWrite: {Rate: 1.2, Burst: 25}, // 5000 write points per hour
+	EndpointAuth:  {Rate: 0.09, Burst: 5}, // 30 logins per 5 minutes
+}
+
+// RateLimiter paces XRPC calls client side via a token bucket per endpoint
+// class. It also honors the ratelimit-* headers of the server, pausing a class
+// until the reset time if the server reports its limit as exhausted.
+//
+// A rate limiter may be shared between multiple clients, e.g. if they connect
+// from the same IP address and thus share the same server side limits.
+type RateLimiter struct {
+	lock    sync.Mutex                     // Lock protecting the buckets
+	buckets map[EndpointClass]*tokenBucket // Token buckets of the endpoint classes
+}
+
+// tokenBucket is the live state of a token bucket.
+type tokenBucket struct {
+	limit  BucketLimit // Refill rate and capacity of the bucket
+	tokens float64     // Number of tokens currently available
+	update time.Time   // Time of the last refill
+	paused time.Time   // Time until which the server requested a pause
+}
+
+// NewRateLimiter creates a rate limiter with the given limits. Endpoint classes
+// missing from the limits are not paced, but still honor the server headers.
+func NewRateLimiter(limits map[EndpointClass]BucketLimit) *RateLimiter {
+	now := time.Now()
+
+	buckets := make(map[EndpointClass]*tokenBucket)
+	for class, limit := range limits {
+		buckets[class] = &tokenBucket{limit: limit, tokens: float64(limit.Burst), update: now}
+	}
+	return &RateLimiter{buckets: buckets}
+}
+
+// Wait blocks until a call of the given endpoint class is allowed, or until the
+// context is cancelled.
+func (l *RateLimiter) Wait(ctx context.Context, class EndpointClass) error {
+	for {
+		delay := l.reserve(class, time.Now())
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve attempts to take a token from the bucket of an endpoint class. If it
+// succeeds, 0 is returned, otherwise the time to wait before trying again.
+func (l *RateLimiter) reserve(class EndpointClass, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket, ok := l.buckets[class]
+	if !ok {
+		return 0
+	}
+	if now.Before(bucket.paused) {
+		return bucket.paused.Sub(now)
+	}
+	if bucket.limit.Rate <= 0 {
+		return 0
+	}
+	// Refill the bucket with the tokens accrued since the last call
+	bucket.tokens += now.Sub(bucket.update).Seconds() * bucket.limit.Rate
+	if capacity := float64(bucket.limit.Burst); bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+	bucket.update = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.limit.Rate * float64(time.Second))
+}
+
+// observe inspects the rate limit headers of a server response, pausing the
+// endpoint class until the reset time if the limit was exhausted.
+func (l *RateLimiter) observe(class EndpointClass, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("ratelimit-remaining"))
+	if err != nil || remaining > 0 {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("ratelimit-reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	l.pause(class, time.Unix(reset, 0))
+}
+
+// pause blocks an endpoint class until the given time, as requested by the
+// server.
+func (l *RateLimiter) pause(class EndpointClass, until time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	bucket, ok := l.buckets[class]
+	if !ok {
+		bucket = &tokenBucket{update: time.Now()}
+		l.buckets[class] = bucket
+	}
+	if until.After(bucket.paused) {
+		bucket.paused = until
+	}
+}
+
+// idempotentProcedures are the XRPC procedures that can be safely repeated if
+// it's unknown whether a previous attempt was processed by the server.
+var idempotentProcedures = map[string]bool{
+	"com.atproto.server.createSession": true, // Creates an independent new session
+	"com.atproto.repo.putRecord":       true, // Overwrites the same record
+	"com.atproto.repo.deleteRecord":    true, // Deleting a missing record is a no-op
+	"com.atproto.repo.uploadBlob":      true, // Content addressed
+	"app.bsky.graph.muteActor":         true, // Muting twice is a no-op
+	"app.bsky.graph.unmuteActor":       true, // Unmuting twice is a no-op
+}
+
+// endpointClass categorizes an XRPC method for rate limiting purposes.
+func endpointClass(method string, httpMethod string) EndpointClass {
+	switch {
+	case method == "com.atproto.server.createSession" || method == "com.atproto.server.refreshSession":
+		return EndpointAuth
+	case httpMethod == http.MethodGet:
+		return EndpointRead
+	default:
+		return EndpointWrite
+	}
+}
+
+// retryTransport is an HTTP transport pacing XRPC calls via a rate limiter and
+// retrying the failed ones according to a retry policy. It needs to wrap the
+// errorTransport to be able to interpret the failures.
+type retryTransport struct {
+	base http.RoundTripper // Transport to execute the requests with
+
+	lock    sync.RWMutex // Lock protecting the configs below
+	policy  *RetryPolicy // Retry policy to apply, nil to disable retries
+	limiter *RateLimiter // Rate limiter to pace calls with, nil to disable pacing
+	logger  *log.Logger  // Logger to report retried calls to, nil to stay silent
+}
+
+// config retrieves the current retry policy and rate limiter.
+func (t *retryTransport) config() (*RetryPolicy, *RateLimiter) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.policy, t.limiter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/xrpc/") {
+		return t.base.RoundTrip(req)
+	}
+	var (
+		method          = strings.TrimPrefix(req.URL.Path, "/xrpc/")
+		class           = endpointClass(method, req.Method)
+		idempotent      = req.Method == http.MethodGet || idempotentProcedures[method]
+		policy, limiter = t.config()
+	)
+	for attempt := 1; ; attempt++ {
+		if limiter != nil {
+			if err := limiter.Wait(req.Context(), class); err != nil {
+				return nil, err
+			}
+		}
+		// Rewind the request body for retries (non-rewindable ones are not retried)
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		res, err := t.base.RoundTrip(req)
+		if err == nil {
+			if limiter != nil {
+				limiter.observe(class, res.Header)
+			}
+			return res, nil
+		}
+		// Call failed, check whether it can and should be retried
+		var apiErr *APIError
+		if limiter != nil && errors.As(err, &apiErr) && apiErr.RateLimit != nil && apiErr.RateLimit.Remaining == 0 {
+			limiter.pause(class, apiErr.RateLimit.Reset)
+		}
+		if policy == nil || attempt >= policy.MaxAttempts || !retriable(err, idempotent) ||
+			(req.Body != nil && req.GetBody == nil) || req.Context().Err() != nil {
+			return nil, err
+		}
+		delay := policy.delay(err, attempt, time.Now())
+		if delay > policy.MaxRetryAfter && policy.MaxRetryAfter > 0 {
+			return nil, err
+		}
+		if t.logger != nil {
+			t.logger.Printf("Retrying %s in %v (attempt %d/%d): %v", method, delay, attempt, policy.MaxAttempts, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// retriable checks whether a failed call is safe to retry.
+func retriable(err error, idempotent bool) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		// Transport failure, the request might or might not have been processed
+		return idempotent
+	}
+	switch {
+	case errors.Is(apiErr, ErrRateLimited):
+		return true
+	case apiErr.Status == http.StatusBadGateway || apiErr.Status == http.StatusServiceUnavailable || apiErr.Status == http.StatusGatewayTimeout:
+		return idempotent
+	case errors.Is(apiErr, ErrServerFailure):
+		return idempotent && apiErr.Status != http.StatusNotImplemented
+	default:
+		return false
+	}
+}
+
+// delay calculates the time to wait before retrying a failed call. Delays the
+// server requested are honored, otherwise the backoff grows exponentially with
+// some jitter added.
+func (p *RetryPolicy) delay(err error, attempt int, now time.Time) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.RetryAfter > 0 {
+			return apiErr.RetryAfter
+		}
+		if limit := apiErr.RateLimit; limit != nil && limit.Remaining == 0 && limit.Reset.After(now) {
+			return limit.Reset.Sub(now)
+		}
+	}
+	backoff := p.MinBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// SetRetryPolicy replaces the retry policy of the client. A nil policy disables
+// retries altogether.
+func (c *Client) SetRetryPolicy(policy *RetryPolicy) {
+	c.transport.lock.Lock()
+	defer c.transport.lock.Unlock()
+
+	c.transport.policy = policy
+}
+
+// SetRateLimiter replaces the rate limiter of the client. A nil limiter disables
+// client side pacing altogether.
+func (c *Client) SetRateLimiter(limiter *RateLimiter) {
+	c.transport.lock.Lock()
+	defer c.transport.lock.Unlock()
+
+	c.transport.limiter = limiter
+}
+
+// waitPage is used by streams when retrieving a page failed due to rate limits
+// even after the retries of the transport. Instead of failing the entire stream,
+// it waits for the limits to reset, so the same page can be retried from the
+// same cursor. The failures are the number of consecutive failed attempts.
+//
+// The method returns a non-nil error if the stream should be aborted instead.
+func (c *Client) waitPage(ctx context.Context, err error, failures int) error {
+	if !errors.Is(err, ErrRateLimited) || c.transport == nil {
+		return err
+	}
+	policy, _ := c.transport.config()
+	if policy == nil || failures >= policy.MaxAttempts {
+		return err
+	}
+	delay := policy.delay(err, failures, time.Now())
+	if policy.MaxRetryAfter > 0 && delay > policy.MaxRetryAfter {
+		return err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+)
+
+// Tests that the rate limiter allows bursts, paces calls afterwards and pauses
+// endpoint classes when the server reports its limits exhausted.
+func TestRateLimiterPacing(t *testing.T) {
+	limiter := NewRateLimiter(map[EndpointClass]BucketLimit{
+		EndpointRead: {Rate: 2, Burst: 3},
+	})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if delay := limiter.reserve(EndpointRead, now); delay != 0 {
+			t.Errorf("burst call %d: delay mismatch: have %v, want %v", i, delay, 0)
+		}
+	}
+	if delay := limiter.reserve(EndpointRead, now); delay != 500*time.Millisecond {
+		t.Errorf("paced call delay mismatch: have %v, want %v", delay, 500*time.Millisecond)
+	}
+	if delay := limiter.reserve(EndpointRead, now.Add(500*time.Millisecond)); delay != 0 {
+		t.Errorf("refilled call delay mismatch: have %v, want %v", delay, 0)
+	}
+	// Classes without configured limits should not be paced
+	for i := 0; i < 100; i++ {
+		if delay := limiter.reserve(EndpointWrite, now); delay != 0 {
+			t.Fatalf("unlimited call %d: delay mismatch: have %v, want %v", i, delay, 0)
+		}
+	}
+	// Exhausted server side limits should pause the class until the reset
+	reset := now.Add(time.Hour).Truncate(time.Second)
+	limiter.observe(EndpointWrite, http.Header{
+		"Ratelimit-Remaining": {"0"},
+		"Ratelimit-Reset":     {fmt.Sprint(reset.Unix())},
+	})
+	if delay := limiter.reserve(EndpointWrite, now); delay != reset.Sub(now) {
+		t.Errorf("paused call delay mismatch: have %v, want %v", delay, reset.Sub(now))
+	}
+	if delay := limiter.reserve(EndpointWrite, reset); delay != 0 {
+		t.Errorf("resumed call delay mismatch: have %v, want %v", delay, 0)
+	}
+}
+
+// Tests that only failures safe to repeat are retried.
+func TestRetriable(t *testing.T) {
+	tests := []struct {
+		err        error
+		idempotent bool
+		retry      bool
+	}{
+		{err: &APIError{Status: 429, Name: "RateLimitExceeded"}, idempotent: false, retry: true},
+		{err: &APIError{Status: 503}, idempotent: true, retry: true},
+		{err: &APIError{Status: 503}, idempotent: false, retry: false},
+		{err: &APIError{Status: 500, Name: "InternalServerError"}, idempotent: true, retry: true},
+		{err: &APIError{Status: 501}, idempotent: true, retry: false},
+		{err: &APIError{Status: 400, Name: "InvalidRequest"}, idempotent: true, retry: false},
+		{err: &APIError{Status: 401, Name: "AuthenticationRequired"}, idempotent: true, retry: false},
+		{err: errors.New("connection reset"), idempotent: true, retry: true},
+		{err: errors.New("connection reset"), idempotent: false, retry: false},
+	}
+	for i, tt := range tests {
+		if retry := retriable(fmt.Errorf("wrapped: %w", tt.err), tt.idempotent); retry != tt.retry {
+			t.Errorf("test %d: retry mismatch for %v (idempotent %v): have %v, want %v", i, tt.err, tt.idempotent, retry, tt.retry)
+		}
+	}
+}
+
+// Tests that retry delays honor the server's requests and otherwise back off
+// exponentially within the configured bounds.
+func TestRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	now := time.Now()
+
+	if delay := policy.delay(&APIError{Status: 429, RetryAfter: time.Minute}, 1, now); delay != time.Minute {
+		t.Errorf("retry after delay mismatch: have %v, want %v", delay, time.Minute)
+	}
+	reset := &APIError{Status: 429, RateLimit: &RateLimit{Remaining: 0, Reset: now.Add(30 * time.Second)}}
+	if delay := policy.delay(reset, 1, now); delay != 30*time.Second {
+		t.Errorf("rate limit reset delay mismatch: have %v, want %v", delay, 30*time.Second)
+	}
+	for attempt, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		for i := 0; i < 100; i++ {
+			if delay := policy.delay(errors.New("failure"), attempt+1, now); delay < limit/2 || delay > limit {
+				t.Fatalf("attempt %d: backoff out of bounds: have %v, want [%v, %v]", attempt+1, delay, limit/2, limit)
+			}
+		}
+	}
+}
+
+// Tests that transient failures are retried transparently, but only as long as
+// the retry policy permits it.
+func TestRetryTransientFailure(t *testing.T) {
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	client.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	srv.InjectFault("app.bsky.actor.getProfile", &clienttest.Fault{Status: http.StatusBadGateway, Times: 2})
+	if _, err := client.FetchProfile(context.Background(), testDIDPeter); err != nil {
+		t.Fatalf("failed to fetch profile through transient failures: %v", err)
+	}
+	if calls := srv.Calls("app.bsky.actor.getProfile"); calls != 3 {
+		t.Errorf("call count mismatch: have %d, want %d", calls, 3)
+	}
+	srv.InjectFault("app.bsky.actor.getProfile", &clienttest.Fault{Status: http.StatusBadGateway, Times: 3})
+	if _, err := client.FetchProfile(context.Background(), testDIDPeter); !errors.Is(err, ErrServerFailure) {
+		t.Fatalf("persistent failure error mismatch: have %v, want %v", err, ErrServerFailure)
+	}
+	if calls := srv.Calls("app.bsky.actor.getProfile"); calls != 6 {
+		t.Errorf("call count mismatch: have %d, want %d", calls, 6)
+	}
+}
+
+// Tests that streaming followers survives more rate limit failures than the
+// transport retries, resuming from the current cursor instead of aborting.
+func TestStreamFollowersRateLimited(t *testing.T) {
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	client.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if err := client.Login(context.Background(), testHandleTester, testAppkeyTester); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	profile, err := client.FetchProfile(context.Background(), testDIDPeter)
+	if err != nil {
+		t.Fatalf("failed to fetch profile: %v", err)
+	}
+	srv.InjectFault("app.bsky.graph.getFollowers", &clienttest.Fault{
+		Status: http.StatusTooManyRequests,
+		Error:  "RateLimitExceeded",
+		Header: http.Header{"Retry-After": {"0"}},
+		Times:  3,
+	})
+	followerc, errc := profile.StreamFollowers(context.Background())
+
+	seen := make(map[string]bool)
+	for follower := range followerc {
+		if seen[follower.DID] {
+			t.Errorf("duplicate follower delivered: %v", follower)
+		}
+		seen[follower.DID] = true
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to stream followers: %v", err)
+	}
+	if len(seen) != int(profile.FollowerCount) {
+		t.Errorf("follower count mismatch: have %d, want %d", len(seen), profile.FollowerCount)
+	}
+	// Make sure the stream aborts if the server keeps rejecting it
+	srv.InjectFault("app.bsky.graph.getFollowers", &clienttest.Fault{
+		Status: http.StatusTooManyRequests,
+		Error:  "RateLimitExceeded",
+	})
+	if err := profile.ResolveFollowers(context.Background()); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("persistent rate limit error mismatch: have %v, want %v", err, ErrRateLimited)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxHashtagRunes is the maximum length of a hashtag (without the leading #)
+	// that is still accepted by the Bluesky apps.
+	maxHashtagRunes = 64
+)
+
+var (
+	// mentionRegexp matches @handle mentions preceded by whitespace, an opening
+	// parenthesis or the start of the text.
+	mentionRegexp = regexp.MustCompile(`(?:^|\s|\()(@[a-zA-Z0-9.-]+)\b`)
+
+	// handleRegexp validates that a mention is a syntactically correct handle, i.e.
+	// a domain name with at least two labels and an alphabetic top level label.
+	handleRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	// linkRegexp matches explicit http(s) links preceded by whitespace, an opening
+	// parenthesis or the start of the text.
+	linkRegexp = regexp.MustCompile(`(?:^|\s|\()(https?://\S+)`)
+
+	// tagRegexp matches #hashtags preceded by whitespace or the start of the text.
+	tagRegexp = regexp.MustCompile(`(?:^|\s)(#[^\s#]+)`)
+)
+
+// Facet is an annotation of a byte range within a post's text, marking it as a
+// mention, a link or a hashtag. Exactly one of the feature fields is set.
+//
+// Note, the offsets are in UTF-8 bytes (which coincides with Go's native string
+// indexing), not in characters.
+type Facet struct {
+	ByteStart int // Inclusive start offset of the annotated text
+	ByteEnd   int // Exclusive end offset of the annotated text
+
+	Mention string // DID of the mentioned user, empty if not a mention
+	Link    string // URI of the linked resource, empty if not a link
+	Tag     string // Hashtag without the leading #, empty if not a tag
+
+	handle string // Handle of the mentioned user, pending DID resolution
+}
+
+// parseFacets detects the mentions, links and hashtags within a text. Mentions
+// are returned with their handles only, the DIDs need to be resolved afterwards.
+func parseFacets(text string) []*Facet {
+	var facets []*Facet
+
+	for _, match := range mentionRegexp.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2], match[3]
+
+		handle := strings.TrimSuffix(text[start+1:end], ".")
+		if !handleRegexp.MatchString(handle) {
+			continue
+		}
+		facets = append(facets, &Facet{
+			ByteStart: start,
+			ByteEnd:   start + 1 + len(handle),
+			handle:    strings.ToLower(handle),
+		})
+	}
+	for _, match := range linkRegexp.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2], match[3]
+
+		link := trimLinkSuffix(text[start:end])
+		facets = append(facets, &Facet{
+			ByteStart: start,
+			ByteEnd:   start + len(link),
+			Link:      link,
+		})
+	}
+	for _, match := range tagRegexp.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2], match[3]
+
+		tag := strings.TrimRight(text[start+1:end], ".,;:!?'\")]}")
+		if tag == "" || utf8.RuneCountInString(tag) > maxHashtagRunes || strings.Trim(tag, "0123456789") == "" {
+			continue
+		}
+		facets = append(facets, &Facet{
+			ByteStart: start,
+			ByteEnd:   start + 1 + len(tag),
+			Tag:       tag,
+		})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		return facets[i].ByteStart < facets[j].ByteStart
+	})
+	return facets
+}
+
+// trimLinkSuffix strips the trailing punctuation from a link that is most likely
+// part of the surrounding sentence, not of the link itself. Closing parentheses
+// are only stripped if they are unbalanced within the link (i.e. Wikipedia links
+// remain intact).
+func trimLinkSuffix(link string) string {
+	for {
+		trimmed := strings.TrimRight(link, ".,;:!?'\"")
+		if strings.HasSuffix(trimmed, ")") && strings.Count(trimmed, "(") < strings.Count(trimmed, ")") {
+			trimmed = trimmed[:len(trimmed)-1]
+		}
+		if trimmed == link {
+			return link
+		}
+		link = trimmed
+	}
+}
+
+// record converts the facet into its app.bsky.richtext.facet record form.
+func (f *Facet) record() any {
+	var feature any
+	switch {
+	case f.Mention != "":
+		feature = struct {
+			Type string `json:"$type"`
+			DID  string `json:"did"`
+		}{"app.bsky.richtext.facet#mention", f.Mention}
+
+	case f.Link != "":
+		feature = struct {
+			Type string `json:"$type"`
+			URI  string `json:"uri"`
+		}{"app.bsky.richtext.facet#link", f.Link}
+
+	default:
+		feature = struct {
+			Type string `json:"$type"`
+			Tag  string `json:"tag"`
+		}{"app.bsky.richtext.facet#tag", f.Tag}
+	}
+	return map[string]any{
+		"index": map[string]int{
+			"byteStart": f.ByteStart,
+			"byteEnd":   f.ByteEnd,
+		},
+		"features": []any{feature},
+	}
+}
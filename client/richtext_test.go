@@ -0,0 +1,68 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests that mentions, links and hashtags are detected within post texts and
+// that their offsets are correctly reported in UTF-8 bytes.
+func TestParseFacets(t *testing.T) {
+	tests := []struct {
+		text   string
+		facets []*Facet
+	}{
+		// Plain text should not contain any facets
+		{text: "hello world", facets: nil},
+
+		// Mentions should be detected, but not email addresses or invalid handles
+		{
+			text:   "hi @karalabe.bsky.social!",
+			facets: []*Facet{{ByteStart: 3, ByteEnd: 24, handle: "karalabe.bsky.social"}},
+		},
+		{text: "mail me at foo@bar.com", facets: nil},
+		{text: "hi @nodomain", facets: nil},
+		{
+			text:   "(@Alice.Example.com.)",
+			facets: []*Facet{{ByteStart: 1, ByteEnd: 19, handle: "alice.example.com"}},
+		},
+		// Links should be detected, dropping the trailing punctuation
+		{
+			text:   "see https://go.dev/doc.",
+			facets: []*Facet{{ByteStart: 4, ByteEnd: 22, Link: "https://go.dev/doc"}},
+		},
+		{
+			text:   "(https://en.wikipedia.org/wiki/Go_(language))",
+			facets: []*Facet{{ByteStart: 1, ByteEnd: 44, Link: "https://en.wikipedia.org/wiki/Go_(language)"}},
+		},
+		// Hashtags should be detected, skipping purely numeric ones
+		{
+			text:   "#golang rocks, #1 and #gophercon!",
+			facets: []*Facet{{ByteStart: 0, ByteEnd: 7, Tag: "golang"}, {ByteStart: 22, ByteEnd: 32, Tag: "gophercon"}},
+		},
+		// Offsets should be in bytes, not in characters, and facets ordered by them
+		{
+			text: "안녕 @golangkorea.bsky.social 🦋 #고퍼콘 https://bsky.app",
+			facets: []*Facet{
+				{ByteStart: 7, ByteEnd: 31, handle: "golangkorea.bsky.social"},
+				{ByteStart: 37, ByteEnd: 47, Tag: "고퍼콘"},
+				{ByteStart: 48, ByteEnd: 64, Link: "https://bsky.app"},
+			},
+		},
+	}
+	for i, tt := range tests {
+		if have := parseFacets(tt.text); !reflect.DeepEqual(have, tt.facets) {
+			t.Errorf("test %d: facet mismatch:", i)
+			for _, facet := range have {
+				t.Errorf("  have %+v: %q", facet, tt.text[facet.ByteStart:facet.ByteEnd])
+			}
+			for _, facet := range tt.facets {
+				t.Errorf("  want %+v", facet)
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// ErrSessionNotFound is returned from a session store if no session was saved
+// under the requested key.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a snapshot of an authenticated client session that can be saved
+// and later resumed, avoiding a fresh login (and the associated rate limits).
+//
+// Note, the session contains live credentials. Treat it like a password.
+type Session struct {
+	Handle string `json:"handle"` // User-friendly - unstable - identifier of the logged in user
+	DID    string `json:"did"`    // Machine friendly - stable - identifier of the logged in user
+
+	AccessJWT     string    `json:"accessJwt"`     // JWT token to authenticate API calls with
+	AccessExpire  time.Time `json:"accessExpire"`  // Expiration time for the access JWT token
+	RefreshJWT    string    `json:"refreshJwt"`    // JWT token to refresh the session with
+	RefreshExpire time.Time `json:"refreshExpire"` // Expiration time for the refresh JWT token
+}
+
+// Session exports the current authenticated session of the client, or nil if
+// the client is not logged in.
+func (c *Client) Session() *Session {
+	c.jwtLock.RLock()
+	defer c.jwtLock.RUnlock()
+
+	return c.session()
+}
+
+// session is the lockless version of Session, requiring the caller to hold the
+// JWT lock.
+func (c *Client) session() *Session {
+	if c.client.Auth == nil {
+		return nil
+	}
+	return &Session{
+		Handle:        c.client.Auth.Handle,
+		DID:           c.client.Auth.Did,
+		AccessJWT:     c.client.Auth.AccessJwt,
+		AccessExpire:  c.jwtCurrentExpire,
+		RefreshJWT:    c.client.Auth.RefreshJwt,
+		RefreshExpire: c.jwtRefreshExpire,
+	}
+}
+
+// Resume authenticates the client with a previously exported session instead of
+// logging in from scratch. If the access token is close to (or past) expiration,
+// the session will be refreshed as part of resuming it.
+//
+// If even the refresh token has expired, ErrSessionExpired is returned and a new
+// login is required.
+//
+// If the client is already authenticated, its current session is replaced. If
+// resuming fails, the previous session is retained.
+func (c *Client) Resume(ctx context.Context, session *Session) error {
+	if time.Until(session.RefreshExpire) < 0 {
+		return fmt.Errorf("%w: refresh token was valid until %v", ErrSessionExpired, session.RefreshExpire)
+	}
+	// Tear down any refresher of a previous session, it would otherwise leak and
+	// race the new one on the swapped credentials
+	restart := c.jwtRefresherStop != nil
+	c.stopRefresher()
+
+	c.jwtLock.Lock()
+	var (
+		prevAuth    = c.client.Auth
+		prevCurrent = c.jwtCurrentExpire
+		prevRefresh = c.jwtRefreshExpire
+	)
+	if prevAuth != nil {
+		prevAuth = new(xrpc.AuthInfo)
+		*prevAuth = *c.client.Auth
+	}
+	c.client.Auth = &xrpc.AuthInfo{
+		AccessJwt:  session.AccessJWT,
+		RefreshJwt: session.RefreshJWT,
+		Handle:     session.Handle,
+		Did:        session.DID,
+	}
+	c.jwtCurrentExpire = session.AccessExpire
+	c.jwtRefreshExpire = session.RefreshExpire
+	if c.jwtAsyncRefresh == nil {
+		c.jwtAsyncRefresh = make(chan struct{}, 1) // 1 async refresher allowed concurrently
+	}
+	c.jwtLock.Unlock()
+
+	// Run the standard refresh logic before handing the client back. If the access
+	// token is stale, this will block until a new one is retrieved.
+	if err := c.maybeRefreshJWT(); err != nil {
+		// Resuming failed, roll back to the previous session (if any)
+		c.jwtLock.Lock()
+		c.client.Auth = prevAuth
+		c.jwtCurrentExpire = prevCurrent
+		c.jwtRefreshExpire = prevRefresh
+		c.jwtLock.Unlock()
+
+		if restart {
+			c.jwtRefresherStop = make(chan chan struct{})
+			go c.refresher()
+		}
+		return err
+	}
+	c.jwtRefresherStop = make(chan chan struct{})
+	go c.refresher()
+
+	return nil
+}
+
+// SessionStore is a persistence layer for authenticated sessions, keyed by some
+// user chosen identifier (e.g. handle or DID).
+type SessionStore interface {
+	// Load retrieves a previously saved session, or ErrSessionNotFound if there
+	// is nothing stored under the requested key.
+	Load(ctx context.Context, key string) (*Session, error)
+
+	// Save persists a session, overwriting anything previously stored under the
+	// same key.
+	Save(ctx context.Context, key string, session *Session) error
+
+	// Delete removes a session from the store. Deleting a missing session is not
+	// an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// MemorySessionStore is a SessionStore keeping everything in memory. It is meant
+// for tests and for sharing sessions between clients within the same process.
+type MemorySessionStore struct {
+	sessions map[string]Session
+	lock     sync.RWMutex
+}
+
+// NewMemorySessionStore creates an empty in-memory session store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]Session),
+	}
+}
+
+// Load implements SessionStore, retrieving a copy of a stored session.
+func (s *MemorySessionStore) Load(ctx context.Context, key string) (*Session, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	session, ok := s.sessions[key]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+// Save implements SessionStore, storing a copy of the session.
+func (s *MemorySessionStore) Save(ctx context.Context, key string, session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions[key] = *session
+	return nil
+}
+
+// Delete implements SessionStore, dropping a stored session.
+func (s *MemorySessionStore) Delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, key)
+	return nil
+}
+
+// FileSessionStore is a SessionStore keeping each session as a JSON file within
+// a directory on the local filesystem.
+type FileSessionStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// NewFileSessionStore creates a session store backed by the given directory. The
+// directory is created on the first save if it does not exist.
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{dir: dir}
+}
+
+// Load implements SessionStore, reading a session from its JSON file.
+func (s *FileSessionStore) Load(ctx context.Context, key string) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	blob, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := new(Session)
+	if err := json.Unmarshal(blob, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Save implements SessionStore, writing a session into its JSON file. The file
+// is written to a temporary location first and moved into place afterwards to
+// avoid leaving a corrupt session behind on a crash.
+func (s *FileSessionStore) Save(ctx context.Context, key string, session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	blob, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	path := s.path(key)
+	if err := os.WriteFile(path+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Delete implements SessionStore, removing a session's JSON file.
+func (s *FileSessionStore) Delete(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path returns the filesystem location of a session. The key is sanitized so
+// that handles and DIDs (which contain dots and colons) map to a single file.
+func (s *FileSessionStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(filepath.Clean("/"+key))+".json")
+}
+
+// LoginWithStore authenticates to the Bluesky server, preferring to resume a
+// session saved in the store under the handle, and only doing a full login if
+// there is no stored session or it can't be resumed. The resulting session is
+// saved back into the store, and kept up to date on every subsequent refresh.
+func (c *Client) LoginWithStore(ctx context.Context, store SessionStore, handle string, appkey string) error {
+	// Refresh tokens are single use, so the store needs to track every refresh,
+	// otherwise the saved session becomes unusable after the first one
+	c.jwtLock.Lock()
+	c.sessionStore, c.sessionKey = store, handle
+	c.jwtLock.Unlock()
+
+	if session, err := store.Load(ctx, handle); err == nil {
+		if err := c.Resume(ctx, session); err == nil {
+			return store.Save(ctx, handle, c.Session())
+		}
+	} else if !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+	if err := c.Login(ctx, handle, appkey); err != nil {
+		return err
+	}
+	return store.Save(ctx, handle, c.Session())
+}
@@ -0,0 +1,217 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// makeTestSession creates a fake session that expires at the given times.
+func makeTestSession(current time.Duration, refresh time.Duration) *Session {
+	return &Session{
+		Handle:        testHandleTester,
+		DID:           testDIDTester,
+		AccessJWT:     "access-jwt",
+		AccessExpire:  time.Now().Add(current).Round(0).UTC(),
+		RefreshJWT:    "refresh-jwt",
+		RefreshExpire: time.Now().Add(refresh).Round(0).UTC(),
+	}
+}
+
+// Tests that a still valid session can be resumed without touching the network
+// and that it can be exported back out unchanged.
+func TestResumeSession(t *testing.T) {
+	client := &Client{client: &xrpc.Client{Host: "http://invalid"}}
+	defer client.Close()
+
+	session := makeTestSession(time.Hour, 24*time.Hour)
+	if err := client.Resume(context.Background(), session); err != nil {
+		t.Fatalf("failed to resume session: %v", err)
+	}
+	if have := client.Session(); !reflect.DeepEqual(have, session) {
+		t.Errorf("exported session mismatch: have %+v, want %+v", have, session)
+	}
+}
+
+// Tests that a session with an expired refresh token cannot be resumed.
+func TestResumeExpiredSession(t *testing.T) {
+	client := &Client{client: &xrpc.Client{Host: "http://invalid"}}
+	defer client.Close()
+
+	session := makeTestSession(-time.Hour, -time.Minute)
+	if err := client.Resume(context.Background(), session); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expired session error mismatch: have %v, want %v", err, ErrSessionExpired)
+	}
+}
+
+// Tests that resuming a session with an expired access token refreshes it before
+// handing the client back.
+func TestResumeStaleSession(t *testing.T) {
+	srv := makeTestServer(t)
+
+	client, err := DialWithClient(context.Background(), srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	access, refresh, err := srv.IssueSession(testDIDTester, clienttest.ScopeAppPass, -time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue session: %v", err)
+	}
+	session := &Session{
+		Handle:        testHandleTester,
+		DID:           testDIDTester,
+		AccessJWT:     access,
+		AccessExpire:  time.Now().Add(-time.Minute),
+		RefreshJWT:    refresh,
+		RefreshExpire: time.Now().Add(time.Hour),
+	}
+	if err := client.Resume(context.Background(), session); err != nil {
+		t.Fatalf("failed to resume session: %v", err)
+	}
+	if calls := srv.Calls("com.atproto.server.refreshSession"); calls != 1 {
+		t.Errorf("refresh count mismatch: have %d, want %d", calls, 1)
+	}
+	resumed := client.Session()
+	if resumed.AccessJWT == access || resumed.RefreshJWT == refresh {
+		t.Errorf("resumed session not refreshed")
+	}
+	if !resumed.AccessExpire.After(time.Now()) {
+		t.Errorf("refreshed access token already expired at %v", resumed.AccessExpire)
+	}
+	if _, err := client.FetchProfile(context.Background(), testDIDPeter); err != nil {
+		t.Errorf("failed to use resumed session: %v", err)
+	}
+}
+
+// Tests that resuming a session on an already authenticated client replaces the
+// old session and tears down its background refresher.
+func TestResumeOverLogin(t *testing.T) {
+	client, srv := makeTestClientWithServer(t)
+
+	access, refresh, err := srv.IssueSession(testDIDTester, clienttest.ScopeAppPass, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue session: %v", err)
+	}
+	session := &Session{
+		Handle:        testHandleTester,
+		DID:           testDIDTester,
+		AccessJWT:     access,
+		AccessExpire:  time.Now().Add(time.Hour).Round(0).UTC(),
+		RefreshJWT:    refresh,
+		RefreshExpire: time.Now().Add(24 * time.Hour).Round(0).UTC(),
+	}
+	stale := client.jwtRefresherStop
+	if err := client.Resume(context.Background(), session); err != nil {
+		t.Fatalf("failed to resume session: %v", err)
+	}
+	if have := client.Session(); !reflect.DeepEqual(have, session) {
+		t.Errorf("exported session mismatch: have %+v, want %+v", have, session)
+	}
+	if client.jwtRefresherStop == stale {
+		t.Fatalf("refresher not replaced")
+	}
+	select {
+	case stale <- make(chan struct{}, 1):
+		t.Errorf("previous refresher still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Tests that a failed resume on an already authenticated client retains the old
+// session, along with its background refresher.
+func TestResumeFailureRollback(t *testing.T) {
+	client, srv := makeTestClientWithServer(t)
+	previous := client.Session()
+
+	access, refresh, err := srv.IssueSession(testDIDTester, clienttest.ScopeAppPass, -time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue session: %v", err)
+	}
+	session := &Session{
+		Handle:        testHandleTester,
+		DID:           testDIDTester,
+		AccessJWT:     access,
+		AccessExpire:  time.Now().Add(-time.Minute),
+		RefreshJWT:    refresh,
+		RefreshExpire: time.Now().Add(time.Hour),
+	}
+	srv.InjectFault("com.atproto.server.refreshSession", &clienttest.Fault{Status: http.StatusBadRequest, Error: "InvalidRequest", Times: 1})
+	if err := client.Resume(context.Background(), session); err == nil {
+		t.Fatalf("resume with failing refresh succeeded")
+	}
+	if have := client.Session(); !reflect.DeepEqual(have, previous) {
+		t.Errorf("session after failed resume mismatch: have %+v, want %+v", have, previous)
+	}
+	if client.jwtRefresherStop == nil {
+		t.Errorf("refresher not restarted after failed resume")
+	}
+	if _, err := client.FetchProfile(context.Background(), testDIDPeter); err != nil {
+		t.Errorf("failed to use previous session: %v", err)
+	}
+	// A fresh client should be left unauthenticated
+	fresh, err := DialWithClient(context.Background(), srv.URL, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer fresh.Close()
+
+	srv.InjectFault("com.atproto.server.refreshSession", &clienttest.Fault{Status: http.StatusBadRequest, Error: "InvalidRequest", Times: 1})
+	if err := fresh.Resume(context.Background(), session); err == nil {
+		t.Fatalf("resume with failing refresh succeeded")
+	}
+	if have := fresh.Session(); have != nil {
+		t.Errorf("session after failed resume mismatch: have %+v, want nil", have)
+	}
+	if fresh.jwtRefresherStop != nil {
+		t.Errorf("refresher started after failed resume")
+	}
+}
+
+// Tests that the session stores can save, load and delete sessions.
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+}
+func TestFileSessionStore(t *testing.T) {
+	testSessionStore(t, NewFileSessionStore(t.TempDir()))
+}
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	ctx := context.Background()
+
+	if _, err := store.Load(ctx, testHandleTester); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("missing session error mismatch: have %v, want %v", err, ErrSessionNotFound)
+	}
+	session := makeTestSession(time.Hour, 24*time.Hour)
+	if err := store.Save(ctx, testHandleTester, session); err != nil {
+		t.Fatalf("failed to save session: %v", err)
+	}
+	loaded, err := store.Load(ctx, testHandleTester)
+	if err != nil {
+		t.Fatalf("failed to load session: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, session) {
+		t.Errorf("loaded session mismatch: have %+v, want %+v", loaded, session)
+	}
+	if err := store.Delete(ctx, testHandleTester); err != nil {
+		t.Fatalf("failed to delete session: %v", err)
+	}
+	if _, err := store.Load(ctx, testHandleTester); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("deleted session error mismatch: have %v, want %v", err, ErrSessionNotFound)
+	}
+	if err := store.Delete(ctx, testHandleTester); err != nil {
+		t.Fatalf("failed to delete missing session: %v", err)
+	}
+}
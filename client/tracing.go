@@ -0,0 +1,157 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TraceID is the identifier of a trace, shared by all its spans.
+type TraceID [16]byte
+
+// String implements the stringer interface, returning the W3C hex format.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID is the identifier of a single span within a trace.
+type SpanID [8]byte
+
+// String implements the stringer interface, returning the W3C hex format.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Span is a timed operation within a trace. The tracing interceptor records a
+// span for every API call, modelled after OpenTelemetry client spans.
+type Span struct {
+	TraceID TraceID // Identifier of the trace the span belongs to
+	SpanID  SpanID  // Identifier of the span itself
+	Parent  SpanID  // Identifier of the parent span, zero for root spans
+
+	Name       string                 // Operation name, the XRPC method for API calls
+	Start      time.Time              // Time when the operation started
+	End        time.Time              // Time when the operation ended
+	Attributes map[string]interface{} // Key-value metadata of the operation
+	Err        error                  // Failure of the operation, if any
+}
+
+// SpanExporter is a sink for finished spans (e.g. an adapter to a tracing
+// backend). Exporting happens synchronously on the thread ending the span, so
+// implementations should not block.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer creates spans and exports them when they end.
+type Tracer struct {
+	exporter SpanExporter // Sink to export the finished spans to
+}
+
+// NewTracer creates a tracer exporting its spans into the given exporter.
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// spanContextKey is the context key under which the active span is stored.
+type spanContextKey struct{}
+
+// SpanFromContext retrieves the active span from a context, or nil if there is
+// none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Start creates a new span as a child of the active one in the context (or as
+// a new root span if there is none), returning a context with the new span set
+// as the active one. The span must be finished via End.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID, span.Parent = parent.TraceID, parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// End finishes a span, recording the failure of the operation (if any) and
+// exporting it.
+func (t *Tracer) End(span *Span, err error) {
+	span.End = time.Now()
+	span.Err = err
+	t.exporter.ExportSpan(span)
+}
+
+// Interceptor returns an interceptor recording a span for every API call and
+// propagating the trace to the server via the W3C traceparent header.
+func (t *Tracer) Interceptor() Interceptor {
+	return func(ctx context.Context, call *Call, invoke Invoker) error {
+		ctx, span := t.Start(ctx, call.Name())
+
+		span.Attributes["http.method"] = call.Method
+		span.Attributes["http.url"] = call.URL.String()
+		if call.NSID != "" {
+			span.Attributes["rpc.system"] = "xrpc"
+			span.Attributes["rpc.method"] = call.NSID
+		}
+		call.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", span.TraceID, span.SpanID))
+
+		err := invoke(ctx, call)
+		if call.Status != 0 {
+			span.Attributes["http.status_code"] = call.Status
+		}
+		t.End(span, err)
+		return err
+	}
+}
+
+// InMemoryExporter is a SpanExporter collecting the spans in memory. It is meant
+// for tests and debugging.
+type InMemoryExporter struct {
+	spans []*Span
+	lock  sync.Mutex
+}
+
+// NewInMemoryExporter creates an empty in-memory span exporter.
+func NewInMemoryExporter() *InMemoryExporter {
+	return new(InMemoryExporter)
+}
+
+// ExportSpan implements SpanExporter.
+func (e *InMemoryExporter) ExportSpan(span *Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (e *InMemoryExporter) Spans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return append([]*Span{}, e.spans...)
+}
+
+// Reset drops all the spans exported so far.
+func (e *InMemoryExporter) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.spans = nil
+}
@@ -0,0 +1,320 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package firehose
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+const (
+	postCollection    = "app.bsky.feed.post"
+	likeCollection    = "app.bsky.feed.like"
+	followCollection  = "app.bsky.graph.follow"
+	profileCollection = "app.bsky.actor.profile"
+)
+
+// Event is a single decoded change from the repository event stream.
+type Event interface {
+	// Meta returns the stream metadata common to all events.
+	Meta() *EventMeta
+}
+
+// EventMeta is the stream metadata common to all events.
+type EventMeta struct {
+	Seq  int64     // Sequence number of the frame, usable as a resume cursor
+	Time time.Time // Time when the event was emitted by the server
+	Repo string    // DID of the repository (user) the event belongs to
+}
+
+// Meta implements the Event interface.
+func (m *EventMeta) Meta() *EventMeta { return m }
+
+// PostCreated is emitted when a user publishes a new post.
+type PostCreated struct {
+	EventMeta
+
+	URI         string    // at:// URI of the post record
+	CID         string    // Content hash of the post record
+	Text        string    // User text content of the post
+	ReplyRoot   string    // at:// URI of the thread root if the post is a reply
+	ReplyParent string    // at:// URI of the parent post if the post is a reply
+	CreatedAt   time.Time // Creation time of the post as claimed by the client
+}
+
+// LikeCreated is emitted when a user likes a post.
+type LikeCreated struct {
+	EventMeta
+
+	URI       string    // at:// URI of the like record
+	CID       string    // Content hash of the like record
+	Subject   string    // at:// URI of the liked post
+	CreatedAt time.Time // Creation time of the like as claimed by the client
+}
+
+// FollowCreated is emitted when a user follows another one.
+type FollowCreated struct {
+	EventMeta
+
+	URI       string    // at:// URI of the follow record
+	CID       string    // Content hash of the follow record
+	Subject   string    // DID of the followed user
+	CreatedAt time.Time // Creation time of the follow as claimed by the client
+}
+
+// ProfileUpdated is emitted when a user creates or modifies their profile.
+type ProfileUpdated struct {
+	EventMeta
+
+	CID  string // Content hash of the new profile record
+	Name string // Display name of the user, empty if unset
+	Bio  string // Profile description of the user, empty if unset
+}
+
+// RecordDeleted is emitted when a user deletes a record (post, like, follow, etc).
+type RecordDeleted struct {
+	EventMeta
+
+	URI        string // at:// URI of the deleted record
+	Collection string // NSID of the collection the record was deleted from
+}
+
+// HandleChanged is emitted when a user switches to a new handle.
+type HandleChanged struct {
+	EventMeta
+
+	Handle string // New handle of the user
+}
+
+// Tombstone is emitted when a repository (user) is deleted from the server.
+type Tombstone struct {
+	EventMeta
+}
+
+// frameHeader is the header preceding every message in the event stream.
+type frameHeader struct {
+	Op   int64  // 1 for regular messages, -1 for errors
+	Type string // Message type for regular messages (e.g. #commit)
+}
+
+// decodeFrame parses a binary websocket message from the event stream into its
+// typed events, also returning the sequence number of the frame (0 if the frame
+// is not sequenced).
+func decodeFrame(msg []byte) (int64, []Event, error) {
+	r := bytes.NewReader(msg)
+
+	var header frameHeader
+	err := readMap(r, func(key string) error {
+		switch key {
+		case "op":
+			var op cbg.CborInt
+			if err := op.UnmarshalCBOR(r); err != nil {
+				return err
+			}
+			header.Op = int64(op)
+			return nil
+		case "t":
+			var err error
+			header.Type, err = cbg.ReadString(r)
+			return err
+		default:
+			return new(cbg.Deferred).UnmarshalCBOR(r)
+		}
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid frame header: %w", err)
+	}
+	switch header.Op {
+	case -1:
+		frame := new(ErrorFrame)
+		err := readMap(r, func(key string) error {
+			var err error
+			switch key {
+			case "error":
+				frame.Name, err = cbg.ReadString(r)
+			case "message":
+				frame.Message, err = cbg.ReadString(r)
+			default:
+				err = new(cbg.Deferred).UnmarshalCBOR(r)
+			}
+			return err
+		})
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid error frame: %w", err)
+		}
+		return 0, nil, frame
+
+	case 1:
+		// Regular message, decode below
+
+	default:
+		return 0, nil, fmt.Errorf("unknown frame op: %d", header.Op)
+	}
+	switch header.Type {
+	case "#commit":
+		commit := new(atproto.SyncSubscribeRepos_Commit)
+		if err := commit.UnmarshalCBOR(r); err != nil {
+			return 0, nil, fmt.Errorf("invalid commit: %w", err)
+		}
+		events, err := decodeCommit(commit)
+		return commit.Seq, events, err
+
+	case "#handle":
+		handle := new(atproto.SyncSubscribeRepos_Handle)
+		if err := handle.UnmarshalCBOR(r); err != nil {
+			return 0, nil, fmt.Errorf("invalid handle change: %w", err)
+		}
+		return handle.Seq, []Event{&HandleChanged{
+			EventMeta: newEventMeta(handle.Seq, handle.Time, handle.Did),
+			Handle:    handle.Handle,
+		}}, nil
+
+	case "#tombstone":
+		tomb := new(atproto.SyncSubscribeRepos_Tombstone)
+		if err := tomb.UnmarshalCBOR(r); err != nil {
+			return 0, nil, fmt.Errorf("invalid tombstone: %w", err)
+		}
+		return tomb.Seq, []Event{&Tombstone{
+			EventMeta: newEventMeta(tomb.Seq, tomb.Time, tomb.Did),
+		}}, nil
+
+	default:
+		// Informational or not yet supported message, skip it. Migrations would
+		// carry a sequence number, but they are too rare to be worth decoding
+		// just to advance the cursor.
+		return 0, nil, nil
+	}
+}
+
+// decodeCommit converts the operations within a repository commit into typed
+// events, decoding the created records from the attached CAR blocks.
+//
+// Note, operations on collections without a typed event, records missing from
+// the CAR (e.g. commits flagged as too big) and records failing to decode are
+// silently skipped.
+func decodeCommit(commit *atproto.SyncSubscribeRepos_Commit) ([]Event, error) {
+	blocks := make(map[string][]byte)
+	if len(commit.Blocks) > 0 {
+		br, err := car.NewBlockReader(bytes.NewReader(commit.Blocks))
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit blocks: %w", err)
+		}
+		for {
+			block, err := br.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid commit blocks: %w", err)
+			}
+			blocks[block.Cid().String()] = block.RawData()
+		}
+	}
+	meta := newEventMeta(commit.Seq, commit.Time, commit.Repo)
+
+	var events []Event
+	for _, op := range commit.Ops {
+		var (
+			collection = strings.SplitN(op.Path, "/", 2)[0]
+			uri        = "at://" + commit.Repo + "/" + op.Path
+		)
+		if op.Action == "delete" {
+			events = append(events, &RecordDeleted{EventMeta: meta, URI: uri, Collection: collection})
+			continue
+		}
+		if op.Cid == nil {
+			continue
+		}
+		hash := cid.Cid(*op.Cid).String()
+
+		data, ok := blocks[hash]
+		if !ok {
+			continue
+		}
+		record, err := lexutil.CborDecodeValue(data)
+		if err != nil {
+			continue
+		}
+		switch record := record.(type) {
+		case *bsky.FeedPost:
+			if op.Action != "create" {
+				continue
+			}
+			ev := &PostCreated{EventMeta: meta, URI: uri, CID: hash, Text: record.Text}
+			ev.CreatedAt, _ = time.Parse(time.RFC3339, record.CreatedAt)
+			if record.Reply != nil && record.Reply.Root != nil && record.Reply.Parent != nil {
+				ev.ReplyRoot, ev.ReplyParent = record.Reply.Root.Uri, record.Reply.Parent.Uri
+			}
+			events = append(events, ev)
+
+		case *bsky.FeedLike:
+			if op.Action != "create" || record.Subject == nil {
+				continue
+			}
+			ev := &LikeCreated{EventMeta: meta, URI: uri, CID: hash, Subject: record.Subject.Uri}
+			ev.CreatedAt, _ = time.Parse(time.RFC3339, record.CreatedAt)
+			events = append(events, ev)
+
+		case *bsky.GraphFollow:
+			if op.Action != "create" {
+				continue
+			}
+			ev := &FollowCreated{EventMeta: meta, URI: uri, CID: hash, Subject: record.Subject}
+			ev.CreatedAt, _ = time.Parse(time.RFC3339, record.CreatedAt)
+			events = append(events, ev)
+
+		case *bsky.ActorProfile:
+			ev := &ProfileUpdated{EventMeta: meta, CID: hash}
+			if record.DisplayName != nil {
+				ev.Name = *record.DisplayName
+			}
+			if record.Description != nil {
+				ev.Bio = *record.Description
+			}
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+// readMap iterates over the entries of a CBOR map, invoking the callback with
+// each key to consume the associated value from the reader.
+func readMap(r io.Reader, field func(key string) error) error {
+	maj, n, err := cbg.CborReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("expected cbor map, got major type %d", maj)
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := cbg.ReadString(r)
+		if err != nil {
+			return err
+		}
+		if err := field(key); err != nil {
+			return fmt.Errorf("field %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// newEventMeta assembles the common event metadata from the raw stream fields.
+func newEventMeta(seq int64, timestamp string, repo string) EventMeta {
+	meta := EventMeta{Seq: seq, Repo: repo}
+	meta.Time, _ = time.Parse(time.RFC3339, timestamp)
+	return meta
+}
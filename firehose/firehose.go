@@ -0,0 +1,235 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package firehose implements a consumer for the Bluesky repository event stream
+// (com.atproto.sync.subscribeRepos), decoding the raw commits into typed events.
+package firehose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// subscribeReposPath is the XRPC endpoint serving the repository event stream.
+	subscribeReposPath = "/xrpc/com.atproto.sync.subscribeRepos"
+
+	// defaultMinBackoff is the initial delay between reconnection attempts.
+	defaultMinBackoff = time.Second
+
+	// defaultMaxBackoff is the maximum delay between reconnection attempts.
+	defaultMaxBackoff = time.Minute
+
+	// defaultReadTimeout is the time after which a silent connection is deemed
+	// dead and is reestablished.
+	defaultReadTimeout = time.Minute
+)
+
+var (
+	// ErrFutureCursor is returned from a stream if the requested cursor is ahead
+	// of the server's latest event. Reconnecting will not help, so the stream is
+	// ended.
+	ErrFutureCursor = errors.New("cursor in the future")
+
+	// ErrMalformedFrame is returned from a stream if a message could not be
+	// decoded. Reconnecting would replay the same message, so the stream is ended.
+	ErrMalformedFrame = errors.New("malformed frame")
+)
+
+// ErrorFrame is an error message sent by the server before closing the stream.
+type ErrorFrame struct {
+	Name    string // Machine readable error type (e.g. ConsumerTooSlow)
+	Message string // Human readable error message, optional
+}
+
+// Error implements the error interface.
+func (e *ErrorFrame) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("stream error: %s", e.Name)
+	}
+	return fmt.Sprintf("stream error: %s: %s", e.Name, e.Message)
+}
+
+// Unwrap maps the known fatal error frames onto their sentinel errors.
+func (e *ErrorFrame) Unwrap() error {
+	if e.Name == "FutureCursor" {
+		return ErrFutureCursor
+	}
+	return nil
+}
+
+// Subscriber is a consumer of a server's repository event stream.
+type Subscriber struct {
+	host string // Websocket URL of the server to subscribe to
+
+	Dialer      *websocket.Dialer // Dialer to establish the websocket connections with
+	MinBackoff  time.Duration     // Initial delay between reconnection attempts
+	MaxBackoff  time.Duration     // Maximum delay between reconnection attempts
+	MaxRetries  int               // Consecutive failed connections before giving up (0 = never)
+	ReadTimeout time.Duration     // Silence after which a connection is reestablished
+}
+
+// NewSubscriber creates a consumer for the repository event stream of a server.
+// The host might be given as a http(s):// or ws(s):// URL, the former converted
+// to the latter.
+func NewSubscriber(host string) *Subscriber {
+	host = strings.TrimSuffix(host, "/")
+	switch {
+	case strings.HasPrefix(host, "https://"):
+		host = "wss://" + strings.TrimPrefix(host, "https://")
+	case strings.HasPrefix(host, "http://"):
+		host = "ws://" + strings.TrimPrefix(host, "http://")
+	}
+	return &Subscriber{
+		host:        host,
+		Dialer:      websocket.DefaultDialer,
+		MinBackoff:  defaultMinBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+		ReadTimeout: defaultReadTimeout,
+	}
+}
+
+// Stream subscribes to the repository event stream, feeding the decoded events
+// async into a result channel, closing the channel when the stream terminates.
+// An error channel is also returned and will receive (optionally, only ever one)
+// error in case of a failure.
+//
+// The stream starts after the given cursor, or at the live tail of the network
+// if the cursor is 0. Every event carries the sequence number of the frame it was
+// decoded from, which can be used as the cursor to resume the stream after a
+// restart. Events decoded from the same commit share the same sequence number.
+//
+// Dropped connections are reestablished with an exponential backoff, resuming
+// after the last fully delivered frame, so no events are lost. Delivery is only
+// at-least-once per frame though: if the connection drops or the context is
+// cancelled midway through the events of a frame, the already delivered ones are
+// delivered again after resuming from the same cursor.
+//
+// Error frames sent by the server (e.g. ConsumerTooSlow) and frames that cannot
+// be decoded end the stream, returning an *ErrorFrame or ErrMalformedFrame. The
+// stream can be restarted from the sequence number of the last processed event.
+func (s *Subscriber) Stream(ctx context.Context, cursor int64) (<-chan Event, <-chan error) {
+	var (
+		events = make(chan Event, 100) // Ensure many results fit to smooth out bursts
+		errc   = make(chan error, 1)   // Ensure the failure fits to unblock termination
+	)
+	go func() {
+		// No matter what happens, close both channels
+		defer func() {
+			close(events)
+			close(errc)
+		}()
+		var failures int
+		for {
+			progressed, err := s.consume(ctx, &cursor, events)
+			if ctx.Err() != nil {
+				errc <- ctx.Err()
+				return
+			}
+			var frame *ErrorFrame
+			if errors.As(err, &frame) || errors.Is(err, ErrMalformedFrame) {
+				errc <- err
+				return
+			}
+			// Connection dropped, reset the failure counter if it was a healthy
+			// one, or abort if we've been failing for too long
+			if progressed {
+				failures = 0
+			}
+			failures++
+			if s.MaxRetries > 0 && failures > s.MaxRetries {
+				errc <- err
+				return
+			}
+			select {
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			case <-time.After(s.backoff(failures)):
+				// Reconnect after the delay
+			}
+		}
+	}()
+	return events, errc
+}
+
+// consume connects to the event stream and delivers events until the connection
+// fails or the context is cancelled. The cursor is updated after every delivered
+// frame. Whether any frames were successfully delivered is also returned.
+func (s *Subscriber) consume(ctx context.Context, cursor *int64, sink chan<- Event) (bool, error) {
+	endpoint := s.host + subscribeReposPath
+	if *cursor > 0 {
+		endpoint += "?" + url.Values{"cursor": {fmt.Sprint(*cursor)}}.Encode()
+	}
+	conn, _, err := s.Dialer.DialContext(ctx, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Tear the connection down if the context is cancelled to abort any reads
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	var progressed bool
+	for {
+		if s.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return progressed, err
+		}
+		seq, evs, err := decodeFrame(msg)
+		if err != nil {
+			var frame *ErrorFrame
+			if errors.As(err, &frame) {
+				return progressed, err
+			}
+			return progressed, fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+		}
+		for _, ev := range evs {
+			select {
+			case <-ctx.Done():
+				return progressed, ctx.Err()
+			case sink <- ev:
+				// Event delivered, get the next one
+			}
+		}
+		if seq > 0 {
+			*cursor = seq
+		}
+		progressed = true
+	}
+}
+
+// backoff calculates the delay before the given reconnection attempt, doubling
+// it on every failure up until the cap and adding some jitter on top.
+func (s *Subscriber) backoff(attempt int) time.Duration {
+	delay := s.MinBackoff
+	for i := 1; i < attempt && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff {
+		delay = s.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,461 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+const (
+	testDIDAlice = "did:plc:alice"
+	testDIDBob   = "did:plc:bob"
+)
+
+// testFrame is a recorded message of the event stream along with its sequence
+// number to allow resuming from arbitrary cursors.
+type testFrame struct {
+	seq  int64
+	data []byte
+}
+
+// testServer is a local stand-in for a server's event stream, replaying a set of
+// recorded frames to every subscriber.
+type testServer struct {
+	*httptest.Server
+
+	frames  []*testFrame // Recorded frames to replay
+	dropAt  int          // Number of frames after which to drop the first connection
+	refuse  bool         // Whether to refuse all websocket upgrades
+	lock    sync.Mutex   // Lock protecting the connection tracking below
+	cursors []string     // Cursors requested by the subscribers, in order
+}
+
+// newTestServer creates an event stream stand-in replaying the given frames.
+func newTestServer(t *testing.T, frames []*testFrame) *testServer {
+	srv := &testServer{frames: frames}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serve))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serve upgrades a subscription request and replays the frames after the cursor,
+// then idles until the subscriber goes away.
+func (srv *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != subscribeReposPath {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	srv.lock.Lock()
+	srv.cursors = append(srv.cursors, r.URL.Query().Get("cursor"))
+	first := len(srv.cursors) == 1
+	srv.lock.Unlock()
+
+	if srv.refuse {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := new(websocket.Upgrader).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	cursor, _ := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+
+	var sent int
+	for _, frame := range srv.frames {
+		if frame.seq != 0 && frame.seq <= cursor {
+			continue
+		}
+		if first && srv.dropAt > 0 && sent == srv.dropAt {
+			return
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame.data); err != nil {
+			return
+		}
+		sent++
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// requestedCursors returns the cursors the subscribers connected with.
+func (srv *testServer) requestedCursors() []string {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	return append([]string{}, srv.cursors...)
+}
+
+// encodeFrame assembles a stream message from a header and a CBOR body.
+func encodeFrame(t *testing.T, op int64, typ string, body cbg.CBORMarshaler) []byte {
+	buf := new(bytes.Buffer)
+
+	fields := 1
+	if typ != "" {
+		fields++
+	}
+	cbg.WriteMajorTypeHeader(buf, cbg.MajMap, uint64(fields))
+	writeString(buf, "op")
+	cbg.CborInt(op).MarshalCBOR(buf)
+	if typ != "" {
+		writeString(buf, "t")
+		writeString(buf, typ)
+	}
+	if err := body.MarshalCBOR(buf); err != nil {
+		t.Fatalf("failed to encode frame body: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// writeString writes a CBOR text string.
+func writeString(buf *bytes.Buffer, s string) {
+	cbg.WriteMajorTypeHeader(buf, cbg.MajTextString, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// errorBody is a CBOR encoder for the body of error frames.
+type errorBody struct {
+	name    string
+	message string
+}
+
+// MarshalCBOR implements cbg.CBORMarshaler.
+func (e *errorBody) MarshalCBOR(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	cbg.WriteMajorTypeHeader(buf, cbg.MajMap, 2)
+	writeString(buf, "error")
+	writeString(buf, e.name)
+	writeString(buf, "message")
+	writeString(buf, e.message)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// makeCommit assembles a commit frame creating the given records at the given
+// paths, bundling them into a CAR file. A nil record denotes a deletion.
+func makeCommit(t *testing.T, seq int64, repo string, paths []string, records []cbg.CBORMarshaler) *testFrame {
+	var (
+		ops    []*atproto.SyncSubscribeRepos_RepoOp
+		blocks [][]byte
+		cids   []cid.Cid
+	)
+	for i, path := range paths {
+		if records[i] == nil {
+			ops = append(ops, &atproto.SyncSubscribeRepos_RepoOp{Action: "delete", Path: path})
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if err := records[i].MarshalCBOR(buf); err != nil {
+			t.Fatalf("failed to encode record: %v", err)
+		}
+		hash, err := cid.NewPrefixV1(cid.DagCBOR, multihash.SHA2_256).Sum(buf.Bytes())
+		if err != nil {
+			t.Fatalf("failed to hash record: %v", err)
+		}
+		link := lexutil.LexLink(hash)
+		ops = append(ops, &atproto.SyncSubscribeRepos_RepoOp{Action: "create", Path: path, Cid: &link})
+		blocks, cids = append(blocks, buf.Bytes()), append(cids, hash)
+	}
+	// Assemble the CARv1 file with the records as blocks
+	car := new(bytes.Buffer)
+	if len(cids) > 0 {
+		header := new(bytes.Buffer)
+		cbg.WriteMajorTypeHeader(header, cbg.MajMap, 2)
+		writeString(header, "roots")
+		cbg.WriteMajorTypeHeader(header, cbg.MajArray, 1)
+		cbg.WriteCid(header, cids[0])
+		writeString(header, "version")
+		cbg.CborInt(1).MarshalCBOR(header)
+
+		car.Write(binary.AppendUvarint(nil, uint64(header.Len())))
+		car.Write(header.Bytes())
+		for i, block := range blocks {
+			car.Write(binary.AppendUvarint(nil, uint64(cids[i].ByteLen()+len(block))))
+			car.Write(cids[i].Bytes())
+			car.Write(block)
+		}
+	}
+	root := cid.NewCidV1(cid.DagCBOR, mustSum(t, []byte{0xa0}))
+	commit := &atproto.SyncSubscribeRepos_Commit{
+		Blobs:  []lexutil.LexLink{},
+		Blocks: car.Bytes(),
+		Commit: lexutil.LexLink(root),
+		Ops:    ops,
+		Repo:   repo,
+		Seq:    seq,
+		Time:   "2023-05-06T07:08:09.000Z",
+	}
+	return &testFrame{seq: seq, data: encodeFrame(t, 1, "#commit", commit)}
+}
+
+// mustSum hashes some data into a multihash.
+func mustSum(t *testing.T, data []byte) multihash.Multihash {
+	hash, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("failed to hash data: %v", err)
+	}
+	return hash
+}
+
+// makeTestFrames creates a recorded stream with one of every supported event.
+func makeTestFrames(t *testing.T) []*testFrame {
+	var (
+		name = "Alice"
+		bio  = "Gopher"
+	)
+	return []*testFrame{
+		makeCommit(t, 1, testDIDAlice, []string{"app.bsky.feed.post/1", "app.bsky.feed.like/1"}, []cbg.CBORMarshaler{
+			&bsky.FeedPost{LexiconTypeID: postCollection, Text: "hello world", CreatedAt: "2023-05-06T07:08:00.000Z"},
+			&bsky.FeedLike{LexiconTypeID: likeCollection, CreatedAt: "2023-05-06T07:08:01.000Z", Subject: &atproto.RepoStrongRef{
+				Uri: "at://did:plc:bob/app.bsky.feed.post/1", Cid: "bafyreipost",
+			}},
+		}),
+		makeCommit(t, 2, testDIDBob, []string{"app.bsky.graph.follow/1"}, []cbg.CBORMarshaler{
+			&bsky.GraphFollow{LexiconTypeID: followCollection, Subject: testDIDAlice, CreatedAt: "2023-05-06T07:08:02.000Z"},
+		}),
+		makeCommit(t, 3, testDIDAlice, []string{"app.bsky.actor.profile/self", "app.bsky.feed.post/1"}, []cbg.CBORMarshaler{
+			&bsky.ActorProfile{LexiconTypeID: profileCollection, DisplayName: &name, Description: &bio},
+			nil,
+		}),
+		{data: encodeFrame(t, 1, "#info", &atproto.SyncSubscribeRepos_Info{Name: "OutdatedCursor"})},
+		{seq: 4, data: encodeFrame(t, 1, "#handle", &atproto.SyncSubscribeRepos_Handle{
+			Did: testDIDAlice, Handle: "alice.example.com", Seq: 4, Time: "2023-05-06T07:08:09.000Z",
+		})},
+		{seq: 5, data: encodeFrame(t, 1, "#tombstone", &atproto.SyncSubscribeRepos_Tombstone{
+			Did: testDIDBob, Seq: 5, Time: "2023-05-06T07:08:09.000Z",
+		})},
+	}
+}
+
+// collectEvents reads a number of events from a stream, failing if the stream
+// ends or stalls prematurely.
+func collectEvents(t *testing.T, events <-chan Event, errc <-chan error, count int) []Event {
+	var collected []Event
+	for len(collected) < count {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("stream ended after %d events: %v", len(collected), <-errc)
+			}
+			collected = append(collected, ev)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stream stalled after %d events", len(collected))
+		}
+	}
+	return collected
+}
+
+// Tests that the recorded commits are decoded into their typed events.
+func TestStreamEvents(t *testing.T) {
+	srv := newTestServer(t, makeTestFrames(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, errc := NewSubscriber(srv.URL).Stream(ctx, 0)
+	collected := collectEvents(t, events, errc, 7)
+
+	post, ok := collected[0].(*PostCreated)
+	if !ok || post.Text != "hello world" || post.URI != "at://did:plc:alice/app.bsky.feed.post/1" || post.Repo != testDIDAlice || post.CreatedAt.IsZero() {
+		t.Errorf("post event mismatch: have %+v", collected[0])
+	}
+	like, ok := collected[1].(*LikeCreated)
+	if !ok || like.Subject != "at://did:plc:bob/app.bsky.feed.post/1" || like.Seq != 1 {
+		t.Errorf("like event mismatch: have %+v", collected[1])
+	}
+	follow, ok := collected[2].(*FollowCreated)
+	if !ok || follow.Subject != testDIDAlice || follow.Repo != testDIDBob || follow.Seq != 2 {
+		t.Errorf("follow event mismatch: have %+v", collected[2])
+	}
+	profile, ok := collected[3].(*ProfileUpdated)
+	if !ok || profile.Name != "Alice" || profile.Bio != "Gopher" || profile.CID == "" {
+		t.Errorf("profile event mismatch: have %+v", collected[3])
+	}
+	deleted, ok := collected[4].(*RecordDeleted)
+	if !ok || deleted.URI != "at://did:plc:alice/app.bsky.feed.post/1" || deleted.Collection != postCollection {
+		t.Errorf("delete event mismatch: have %+v", collected[4])
+	}
+	handle, ok := collected[5].(*HandleChanged)
+	if !ok || handle.Handle != "alice.example.com" || handle.Repo != testDIDAlice || handle.Time.IsZero() {
+		t.Errorf("handle event mismatch: have %+v", collected[5])
+	}
+	tomb, ok := collected[6].(*Tombstone)
+	if !ok || tomb.Repo != testDIDBob || tomb.Meta().Seq != 5 {
+		t.Errorf("tombstone event mismatch: have %+v", collected[6])
+	}
+	cancel()
+	for range events {
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("interrupt error mismatch: have %v, want %v", err, context.Canceled)
+	}
+}
+
+// Tests that a stream started from a cursor only delivers the later events.
+func TestStreamFromCursor(t *testing.T) {
+	srv := newTestServer(t, makeTestFrames(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, errc := NewSubscriber(srv.URL).Stream(ctx, 3)
+	collected := collectEvents(t, events, errc, 2)
+
+	if _, ok := collected[0].(*HandleChanged); !ok {
+		t.Errorf("first resumed event mismatch: have %T, want %T", collected[0], new(HandleChanged))
+	}
+	if have := srv.requestedCursors(); len(have) != 1 || have[0] != "3" {
+		t.Errorf("requested cursors mismatch: have %v, want [3]", have)
+	}
+}
+
+// Tests that a dropped connection is reestablished, resuming after the last
+// delivered frame without losing or duplicating events.
+func TestStreamReconnect(t *testing.T) {
+	srv := newTestServer(t, makeTestFrames(t))
+	srv.dropAt = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := NewSubscriber(srv.URL)
+	sub.MinBackoff = time.Millisecond
+
+	events, errc := sub.Stream(ctx, 0)
+	collected := collectEvents(t, events, errc, 7)
+
+	for i, want := range []int64{1, 1, 2, 3, 3, 4, 5} {
+		if have := collected[i].Meta().Seq; have != want {
+			t.Errorf("event %d: sequence mismatch: have %d, want %d", i, have, want)
+		}
+	}
+	if have := srv.requestedCursors(); len(have) != 2 || have[0] != "" || have[1] != "2" {
+		t.Errorf("requested cursors mismatch: have %v, want [ 2]", have)
+	}
+}
+
+// Tests that the stream gives up after the configured number of failed attempts.
+func TestStreamMaxRetries(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.refuse = true
+
+	sub := NewSubscriber(srv.URL)
+	sub.MinBackoff, sub.MaxRetries = time.Millisecond, 3
+
+	events, errc := sub.Stream(context.Background(), 0)
+	for range events {
+		t.Errorf("unexpected event from refused stream")
+	}
+	if err := <-errc; !errors.Is(err, websocket.ErrBadHandshake) {
+		t.Errorf("refused stream error mismatch: have %v, want %v", err, websocket.ErrBadHandshake)
+	}
+	if have := len(srv.requestedCursors()); have != 4 {
+		t.Errorf("connection attempts mismatch: have %d, want %d", have, 4)
+	}
+}
+
+// Tests that fatal error frames terminate the stream instead of reconnecting.
+func TestStreamFutureCursor(t *testing.T) {
+	srv := newTestServer(t, []*testFrame{
+		{data: encodeFrame(t, -1, "", &errorBody{name: "FutureCursor", message: "cursor in the future"})},
+	})
+	events, errc := NewSubscriber(srv.URL).Stream(context.Background(), 1000)
+	for range events {
+		t.Errorf("unexpected event from failed stream")
+	}
+	err := <-errc
+	if !errors.Is(err, ErrFutureCursor) {
+		t.Errorf("stream error mismatch: have %v, want %v", err, ErrFutureCursor)
+	}
+	var frame *ErrorFrame
+	if !errors.As(err, &frame) || frame.Message != "cursor in the future" {
+		t.Errorf("error frame mismatch: have %+v", frame)
+	}
+}
+
+// Tests that the reconnection backoff grows exponentially up to the cap.
+func TestBackoff(t *testing.T) {
+	sub := &Subscriber{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	caps := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, limit := range caps {
+		if delay := sub.backoff(i + 1); delay < limit/2 || delay > limit {
+			t.Errorf("attempt %d: delay mismatch: have %v, want [%v, %v]", i+1, delay, limit/2, limit)
+		}
+	}
+}
+
+// Tests that an undecodable frame ends the stream instead of reconnecting to the
+// same cursor forever.
+func TestStreamMalformedFrame(t *testing.T) {
+	frames := makeTestFrames(t)[:1]
+	frames = append(frames, &testFrame{seq: 2, data: []byte{0xa2, 0x62, 'o', 'p', 0x01, 0x61, 't', 0xff}})
+
+	srv := newTestServer(t, frames)
+
+	sub := NewSubscriber(srv.URL)
+	sub.MinBackoff = time.Millisecond
+
+	events, errc := sub.Stream(context.Background(), 0)
+
+	var collected int
+	for range events {
+		collected++
+	}
+	if err := <-errc; !errors.Is(err, ErrMalformedFrame) {
+		t.Errorf("stream error mismatch: have %v, want %v", err, ErrMalformedFrame)
+	}
+	if collected != 2 {
+		t.Errorf("event count mismatch: have %d, want %d", collected, 2)
+	}
+	if have := srv.requestedCursors(); len(have) != 1 {
+		t.Errorf("connection attempts mismatch: have %v, want 1", have)
+	}
+}
+
+// Tests that error frames sent by the server end the stream, surfacing the error.
+func TestStreamErrorFrame(t *testing.T) {
+	frames := makeTestFrames(t)[:1]
+	frames = append(frames, &testFrame{data: encodeFrame(t, -1, "", &errorBody{name: "ConsumerTooSlow", message: "Stream consumer too slow"})})
+
+	srv := newTestServer(t, frames)
+
+	sub := NewSubscriber(srv.URL)
+	sub.MinBackoff = time.Millisecond
+
+	events, errc := sub.Stream(context.Background(), 0)
+	for range events {
+	}
+	var frame *ErrorFrame
+	if err := <-errc; !errors.As(err, &frame) || frame.Name != "ConsumerTooSlow" {
+		t.Errorf("stream error mismatch: have %v, want ConsumerTooSlow frame", err)
+	}
+	if have := srv.requestedCursors(); len(have) != 1 {
+		t.Errorf("connection attempts mismatch: have %v, want 1", have)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxDocumentBytes is the maximum size of a DID document to accept from remote
+// servers, protecting against malicious endpoints streaming garbage forever.
+const maxDocumentBytes = 64 * 1024
+
+// DIDDocument is the subset of a W3C DID document that atproto makes use of.
+type DIDDocument struct {
+	ID                 string                `json:"id"`
+	AlsoKnownAs        []string              `json:"alsoKnownAs,omitempty"`
+	VerificationMethod []*VerificationMethod `json:"verificationMethod,omitempty"`
+	Service            []*Service            `json:"service,omitempty"`
+}
+
+// VerificationMethod is a public key listed in a DID document.
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase,omitempty"`
+}
+
+// Service is a network endpoint listed in a DID document.
+type Service struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// Handle returns the handle claimed by the DID document, or an empty string if
+// none is claimed.
+//
+// Note, the claim alone is not proof of ownership, the handle needs to resolve
+// back to the same DID to be trusted.
+func (doc *DIDDocument) Handle() string {
+	for _, aka := range doc.AlsoKnownAs {
+		if strings.HasPrefix(aka, "at://") {
+			return normalizeHandle(strings.TrimPrefix(aka, "at://"))
+		}
+	}
+	return ""
+}
+
+// PDSEndpoint returns the URL of the personal data server hosting the user's
+// repository, or an empty string if none is listed.
+func (doc *DIDDocument) PDSEndpoint() string {
+	for _, service := range doc.Service {
+		if doc.isLocalID(service.ID, "atproto_pds") && service.Type == "AtprotoPersonalDataServer" {
+			return strings.TrimSuffix(service.ServiceEndpoint, "/")
+		}
+	}
+	return ""
+}
+
+// SigningKey returns the multibase encoded public key used to sign the user's
+// repository commits, or an empty string if none is listed.
+func (doc *DIDDocument) SigningKey() string {
+	for _, method := range doc.VerificationMethod {
+		if doc.isLocalID(method.ID, "atproto") {
+			return method.PublicKeyMultibase
+		}
+	}
+	return ""
+}
+
+// isLocalID checks whether an identifier within the document references the
+// given fragment, either in relative or in absolute form.
+func (doc *DIDDocument) isLocalID(id string, fragment string) bool {
+	return id == "#"+fragment || id == doc.ID+"#"+fragment
+}
+
+// resolveDID retrieves the DID document of a did:plc or did:web identifier from
+// the network, bypassing the cache.
+func (r *Resolver) resolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	var endpoint string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		endpoint = strings.TrimSuffix(r.plcDirectory(), "/") + "/" + did
+
+	case strings.HasPrefix(did, "did:web:"):
+		var err error
+		if endpoint, err = didWebURL(did); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDID, did)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%w: %s", ErrDIDNotFound, did)
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status resolving %s: %s", did, res.Status)
+	}
+	doc := new(DIDDocument)
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxDocumentBytes)).Decode(doc); err != nil {
+		return nil, fmt.Errorf("invalid did document for %s: %w", did, err)
+	}
+	if doc.ID != did {
+		return nil, fmt.Errorf("did document mismatch: have %s, want %s", doc.ID, did)
+	}
+	return doc, nil
+}
+
+// didWebURL converts a did:web identifier into the URL of its DID document.
+// Colons separate path segments and a percent encoded colon denotes a port.
+func didWebURL(did string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(did, "did:web:"), ":")
+
+	host, err := url.PathUnescape(parts[0])
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return "", fmt.Errorf("invalid did:web host: %s", did)
+	}
+	path := "/.well-known"
+	if len(parts) > 1 {
+		path = ""
+		for _, part := range parts[1:] {
+			if part == "" {
+				return "", fmt.Errorf("invalid did:web path: %s", did)
+			}
+			path += "/" + url.PathEscape(part)
+		}
+	}
+	return "https://" + host + path + "/did.json", nil
+}
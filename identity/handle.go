@@ -0,0 +1,96 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// resolveHandle looks up the DID a handle points to from the network, bypassing
+// the cache. The DNS TXT record is tried first, falling back to the well-known
+// HTTPS endpoint if there is none.
+func (r *Resolver) resolveHandle(ctx context.Context, handle string) (string, error) {
+	did, dnsErr := r.resolveHandleDNS(ctx, handle)
+	if dnsErr == nil {
+		return did, nil
+	}
+	did, httpErr := r.resolveHandleHTTPS(ctx, handle)
+	if httpErr == nil {
+		return did, nil
+	}
+	// Both lookups failed, report not-found only if neither was a hard error
+	if errors.Is(dnsErr, ErrHandleNotFound) && errors.Is(httpErr, ErrHandleNotFound) {
+		return "", fmt.Errorf("%w: %s", ErrHandleNotFound, handle)
+	}
+	if !errors.Is(httpErr, ErrHandleNotFound) {
+		return "", httpErr
+	}
+	return "", dnsErr
+}
+
+// resolveHandleDNS looks up the DID of a handle from the _atproto DNS TXT record.
+func (r *Resolver) resolveHandleDNS(ctx context.Context, handle string) (string, error) {
+	records, err := r.lookupTXT(ctx, "_atproto."+handle)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", ErrHandleNotFound
+		}
+		return "", err
+	}
+	var found string
+	for _, record := range records {
+		if did := strings.TrimPrefix(record, "did="); did != record {
+			if found != "" && found != did {
+				return "", fmt.Errorf("ambiguous dns records for %s", handle)
+			}
+			found = did
+		}
+	}
+	if found == "" || !strings.HasPrefix(found, "did:") {
+		return "", ErrHandleNotFound
+	}
+	return found, nil
+}
+
+// resolveHandleHTTPS looks up the DID of a handle from the well-known HTTPS
+// endpoint hosted on the handle's domain.
+func (r *Resolver) resolveHandleHTTPS(ctx context.Context, handle string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+handle+"/.well-known/atproto-did", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := r.httpClient().Do(req)
+	if err != nil {
+		// Nothing listening at the domain is the common case for handles using
+		// DNS records, so treat all connection failures as not found
+		return "", ErrHandleNotFound
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", ErrHandleNotFound
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 2048))
+	if err != nil {
+		return "", err
+	}
+	did := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(did, "did:") || strings.ContainsAny(did, " \n\t") {
+		return "", ErrHandleNotFound
+	}
+	return did, nil
+}
+
+// normalizeHandle converts a user supplied handle into its canonical form.
+func normalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(handle, "@"), "."))
+}
@@ -0,0 +1,244 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package identity resolves atproto handles and DIDs into verified identities,
+// without relying on any particular server or third party index.
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPLCDirectory is the public directory serving did:plc documents.
+	DefaultPLCDirectory = "https://plc.directory"
+
+	// defaultCacheTTL is the time for which successful resolutions are cached.
+	defaultCacheTTL = 10 * time.Minute
+
+	// defaultTimeout is the HTTP timeout of the default resolver client.
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	// ErrHandleNotFound is returned if a handle does not point to any DID via
+	// either DNS or HTTPS.
+	ErrHandleNotFound = errors.New("handle not found")
+
+	// ErrDIDNotFound is returned if a DID document does not exist.
+	ErrDIDNotFound = errors.New("did not found")
+
+	// ErrUnsupportedDID is returned if a DID uses a method other than did:plc or
+	// did:web.
+	ErrUnsupportedDID = errors.New("unsupported did method")
+
+	// ErrHandleMismatch is returned if a handle points to a DID whose document
+	// does not claim the handle back.
+	ErrHandleMismatch = errors.New("handle not claimed by did")
+
+	// ErrNoPDS is returned if a DID document does not list a personal data server.
+	ErrNoPDS = errors.New("no pds endpoint")
+)
+
+// Identity is a resolved and verified atproto identity.
+type Identity struct {
+	DID        string       // Permanent identifier of the user
+	Handle     string       // Handle of the user, empty if it fails verification
+	PDS        string       // URL of the personal data server hosting the user
+	SigningKey string       // Multibase encoded repository signing key
+	Document   *DIDDocument // Full DID document the identity was derived from
+}
+
+// Resolver is a caching handle and DID resolver. The zero value is usable, but
+// does not cache; use NewResolver for sane defaults.
+type Resolver struct {
+	PLCDirectory string        // Base URL of the did:plc directory to query (empty = public one)
+	HTTPClient   *http.Client  // Client to make the HTTPS requests with (nil = http.DefaultClient)
+	TTL          time.Duration // Time for which resolutions are cached (0 = no cache)
+
+	// LookupTXT is the DNS TXT record resolver. It defaults to the system one.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	lock    sync.Mutex             // Lock protecting the caches below
+	handles map[string]*cacheEntry // Cached handle to DID resolutions
+	docs    map[string]*cacheEntry // Cached DID to document resolutions
+}
+
+// cacheEntry is a cached resolution along with its expiration time.
+type cacheEntry struct {
+	value  any
+	expire time.Time
+}
+
+// NewResolver creates a resolver using the public PLC directory, the system DNS
+// resolver and caching the results for a few minutes.
+func NewResolver() *Resolver {
+	return &Resolver{
+		PLCDirectory: DefaultPLCDirectory,
+		HTTPClient:   &http.Client{Timeout: defaultTimeout},
+		TTL:          defaultCacheTTL,
+		LookupTXT:    net.DefaultResolver.LookupTXT,
+	}
+}
+
+// plcDirectory returns the configured did:plc directory, or the public one if
+// none was set.
+func (r *Resolver) plcDirectory() string {
+	if r.PLCDirectory == "" {
+		return DefaultPLCDirectory
+	}
+	return r.PLCDirectory
+}
+
+// httpClient returns the configured HTTP client, or the default one if none was
+// set.
+func (r *Resolver) httpClient() *http.Client {
+	if r.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return r.HTTPClient
+}
+
+// lookupTXT resolves the DNS TXT records of a name via the configured resolver,
+// or the system one if none was set.
+func (r *Resolver) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.LookupTXT == nil {
+		return net.DefaultResolver.LookupTXT(ctx, name)
+	}
+	return r.LookupTXT(ctx, name)
+}
+
+// ResolveHandle looks up the DID a handle points to, without verifying that the
+// DID claims the handle back. Use Lookup for a verified resolution.
+func (r *Resolver) ResolveHandle(ctx context.Context, handle string) (string, error) {
+	handle = normalizeHandle(handle)
+	if handle == "" || strings.ContainsAny(handle, "/:?#@ ") {
+		return "", fmt.Errorf("invalid handle: %q", handle)
+	}
+	if did, ok := r.cached(&r.handles, handle); ok {
+		return did.(string), nil
+	}
+	did, err := r.resolveHandle(ctx, handle)
+	if err != nil {
+		return "", err
+	}
+	r.cache(&r.handles, handle, did)
+	return did, nil
+}
+
+// ResolveDID retrieves the DID document of a did:plc or did:web identifier.
+func (r *Resolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	if doc, ok := r.cached(&r.docs, did); ok {
+		return doc.(*DIDDocument), nil
+	}
+	doc, err := r.resolveDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	r.cache(&r.docs, did, doc)
+	return doc, nil
+}
+
+// Lookup resolves a handle or a DID into a full identity, verifying the handle
+// in both directions: the handle needs to point to the DID and the DID document
+// needs to claim the handle.
+//
+// If the lookup starts from a handle, a failed verification is an error. If it
+// starts from a DID, the identity is returned with an empty handle instead, as
+// the DID itself is still valid.
+func (r *Resolver) Lookup(ctx context.Context, id string) (*Identity, error) {
+	id = strings.TrimPrefix(id, "@")
+	if strings.HasPrefix(id, "did:") {
+		doc, err := r.ResolveDID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		ident := newIdentity(doc)
+		if handle := doc.Handle(); handle != "" {
+			if did, err := r.ResolveHandle(ctx, handle); err == nil && did == doc.ID {
+				ident.Handle = handle
+			}
+		}
+		return ident, nil
+	}
+	handle := normalizeHandle(id)
+
+	did, err := r.ResolveHandle(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := r.ResolveDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Handle() != handle {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrHandleMismatch, handle, did)
+	}
+	ident := newIdentity(doc)
+	ident.Handle = handle
+	return ident, nil
+}
+
+// Purge drops any cached resolutions of a handle or DID, forcing the next call
+// to hit the network.
+func (r *Resolver) Purge(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.handles, normalizeHandle(id))
+	delete(r.docs, id)
+}
+
+// cached retrieves a non-expired entry from one of the caches.
+func (r *Resolver) cached(cache *map[string]*cacheEntry, key string) (any, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry, ok := (*cache)[key]
+	if !ok || time.Now().After(entry.expire) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// cache inserts an entry into one of the caches, creating it if needed.
+func (r *Resolver) cache(cache *map[string]*cacheEntry, key string, value any) {
+	if r.TTL <= 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if *cache == nil {
+		*cache = make(map[string]*cacheEntry)
+	}
+	// Drop expired entries every now and again to avoid leaking memory
+	now := time.Now()
+	if len(*cache) > 0 && len(*cache)%1024 == 0 {
+		for k, entry := range *cache {
+			if now.After(entry.expire) {
+				delete(*cache, k)
+			}
+		}
+	}
+	(*cache)[key] = &cacheEntry{value: value, expire: now.Add(r.TTL)}
+}
+
+// newIdentity extracts the identity fields from a DID document, leaving the
+// handle empty until verified.
+func newIdentity(doc *DIDDocument) *Identity {
+	return &Identity{
+		DID:        doc.ID,
+		PDS:        doc.PDSEndpoint(),
+		SigningKey: doc.SigningKey(),
+		Document:   doc,
+	}
+}
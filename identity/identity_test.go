@@ -0,0 +1,303 @@
+// Copyright 2023 go-bluesky authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNetwork is a local stand-in for the PLC directory, the DNS and the handle
+// domains, counting the lookups to verify caching.
+type testNetwork struct {
+	docs      map[string]*DIDDocument // DID documents served by the directory and did:web hosts
+	txt       map[string][]string     // DNS TXT records by name
+	wellKnown map[string]string       // Well-known DIDs served by handle domains
+
+	requests atomic.Int32 // Number of HTTP requests served
+	lookups  atomic.Int32 // Number of DNS lookups served
+}
+
+// newTestResolver creates a resolver wired to a local test network.
+func newTestResolver(t *testing.T, network *testNetwork) *Resolver {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		network.requests.Add(1)
+
+		switch {
+		case r.URL.Path == "/.well-known/atproto-did":
+			did, ok := network.wellKnown[r.Host]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(did + "\n"))
+
+		case strings.HasSuffix(r.URL.Path, "/did.json"):
+			did := "did:web:" + r.Host
+			if path := strings.TrimSuffix(r.URL.Path, "/did.json"); path != "/.well-known" {
+				did += strings.ReplaceAll(path, "/", ":")
+			}
+			doc, ok := network.docs[did]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(doc)
+
+		default:
+			doc, ok := network.docs[strings.TrimPrefix(r.URL.Path, "/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(doc)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	// Route every domain to the test server, so handles and did:web hosts can
+	// be arbitrary names
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	return &Resolver{
+		PLCDirectory: srv.URL,
+		HTTPClient:   &http.Client{Transport: transport},
+		TTL:          time.Minute,
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			network.lookups.Add(1)
+			records, ok := network.txt[name]
+			if !ok {
+				return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+			}
+			return records, nil
+		},
+	}
+}
+
+// makeTestDocument creates a DID document claiming a handle and hosted on a PDS.
+func makeTestDocument(did string, handle string) *DIDDocument {
+	return &DIDDocument{
+		ID:          did,
+		AlsoKnownAs: []string{"at://" + handle},
+		VerificationMethod: []*VerificationMethod{{
+			ID: did + "#atproto", Type: "Multikey", Controller: did, PublicKeyMultibase: "zQ3shtestkey",
+		}},
+		Service: []*Service{{
+			ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: "https://pds.example.com/",
+		}},
+	}
+}
+
+// Tests that handles resolve via DNS first, falling back to HTTPS.
+func TestResolveHandle(t *testing.T) {
+	network := &testNetwork{
+		txt: map[string][]string{
+			"_atproto.alice.example.com": {"some unrelated record", "did=did:plc:alice"},
+		},
+		wellKnown: map[string]string{
+			"bob.example.com": "did:plc:bob",
+		},
+	}
+	resolver := newTestResolver(t, network)
+
+	tests := []struct {
+		handle string
+		did    string
+		err    error
+	}{
+		{handle: "alice.example.com", did: "did:plc:alice"},
+		{handle: "@Alice.Example.com", did: "did:plc:alice"},
+		{handle: "bob.example.com", did: "did:plc:bob"},
+		{handle: "carol.example.com", err: ErrHandleNotFound},
+	}
+	for _, tt := range tests {
+		did, err := resolver.ResolveHandle(context.Background(), tt.handle)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error mismatch: have %v, want %v", tt.handle, err, tt.err)
+			continue
+		}
+		if did != tt.did {
+			t.Errorf("%s: did mismatch: have %s, want %s", tt.handle, did, tt.did)
+		}
+	}
+}
+
+// Tests that did:plc and did:web documents are resolved and their atproto
+// specific fields extracted.
+func TestResolveDID(t *testing.T) {
+	network := &testNetwork{docs: map[string]*DIDDocument{
+		"did:plc:alice":                  makeTestDocument("did:plc:alice", "alice.example.com"),
+		"did:web:bob.example.com":        makeTestDocument("did:web:bob.example.com", "bob.example.com"),
+		"did:web:example.com:user:carol": makeTestDocument("did:web:example.com:user:carol", "carol.example.com"),
+	}}
+	resolver := newTestResolver(t, network)
+
+	for did, want := range network.docs {
+		doc, err := resolver.ResolveDID(context.Background(), did)
+		if err != nil {
+			t.Errorf("%s: failed to resolve: %v", did, err)
+			continue
+		}
+		if doc.ID != did || doc.Handle() != want.Handle() {
+			t.Errorf("%s: document mismatch: have %s/%s, want %s/%s", did, doc.ID, doc.Handle(), did, want.Handle())
+		}
+		if pds := doc.PDSEndpoint(); pds != "https://pds.example.com" {
+			t.Errorf("%s: pds mismatch: have %s, want %s", did, pds, "https://pds.example.com")
+		}
+		if key := doc.SigningKey(); key != "zQ3shtestkey" {
+			t.Errorf("%s: signing key mismatch: have %s, want %s", did, key, "zQ3shtestkey")
+		}
+	}
+	if _, err := resolver.ResolveDID(context.Background(), "did:plc:missing"); !errors.Is(err, ErrDIDNotFound) {
+		t.Errorf("missing did error mismatch: have %v, want %v", err, ErrDIDNotFound)
+	}
+	if _, err := resolver.ResolveDID(context.Background(), "did:key:z6Mk"); !errors.Is(err, ErrUnsupportedDID) {
+		t.Errorf("unsupported did error mismatch: have %v, want %v", err, ErrUnsupportedDID)
+	}
+}
+
+// Tests that did:web identifiers are converted into the correct document URLs.
+func TestDIDWebURL(t *testing.T) {
+	tests := []struct {
+		did string
+		url string
+	}{
+		{did: "did:web:example.com", url: "https://example.com/.well-known/did.json"},
+		{did: "did:web:localhost%3A8080", url: "https://localhost:8080/.well-known/did.json"},
+		{did: "did:web:example.com:user:alice", url: "https://example.com/user/alice/did.json"},
+		{did: "did:web:", url: ""},
+		{did: "did:web:evil.com%2Fpath", url: ""},
+	}
+	for _, tt := range tests {
+		url, err := didWebURL(tt.did)
+		if tt.url == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got url %s", tt.did, url)
+			}
+			continue
+		}
+		if err != nil || url != tt.url {
+			t.Errorf("%s: url mismatch: have %s (%v), want %s", tt.did, url, err, tt.url)
+		}
+	}
+}
+
+// Tests that lookups verify handles in both directions.
+func TestLookup(t *testing.T) {
+	network := &testNetwork{
+		docs: map[string]*DIDDocument{
+			"did:plc:alice": makeTestDocument("did:plc:alice", "alice.example.com"),
+			"did:plc:bob":   makeTestDocument("did:plc:bob", "bob.example.com"),
+		},
+		txt: map[string][]string{
+			"_atproto.alice.example.com":    {"did=did:plc:alice"},
+			"_atproto.imposter.example.com": {"did=did:plc:alice"}, // Points to alice, not claimed back
+			"_atproto.bob.example.com":      {"did=did:plc:alice"}, // Bob's handle hijacked to alice
+		},
+	}
+	resolver := newTestResolver(t, network)
+
+	// Lookups from a valid handle should yield the full identity
+	ident, err := resolver.Lookup(context.Background(), "alice.example.com")
+	if err != nil {
+		t.Fatalf("failed to look up alice: %v", err)
+	}
+	if ident.DID != "did:plc:alice" || ident.Handle != "alice.example.com" || ident.PDS != "https://pds.example.com" || ident.SigningKey == "" {
+		t.Errorf("alice identity mismatch: have %+v", ident)
+	}
+	// Lookups from a handle not claimed back by the DID should fail
+	if _, err := resolver.Lookup(context.Background(), "imposter.example.com"); !errors.Is(err, ErrHandleMismatch) {
+		t.Errorf("imposter error mismatch: have %v, want %v", err, ErrHandleMismatch)
+	}
+	// Lookups from a DID should verify the claimed handle, dropping it if invalid
+	if ident, err = resolver.Lookup(context.Background(), "did:plc:alice"); err != nil || ident.Handle != "alice.example.com" {
+		t.Errorf("alice did lookup mismatch: have %+v (%v), want handle %s", ident, err, "alice.example.com")
+	}
+	if ident, err = resolver.Lookup(context.Background(), "did:plc:bob"); err != nil || ident.Handle != "" || ident.DID != "did:plc:bob" {
+		t.Errorf("bob did lookup mismatch: have %+v (%v), want no handle", ident, err)
+	}
+}
+
+// Tests that resolutions are cached for the configured time only.
+func TestResolverCache(t *testing.T) {
+	network := &testNetwork{
+		docs: map[string]*DIDDocument{"did:plc:alice": makeTestDocument("did:plc:alice", "alice.example.com")},
+		txt:  map[string][]string{"_atproto.alice.example.com": {"did=did:plc:alice"}},
+	}
+	resolver := newTestResolver(t, network)
+
+	for i := 0; i < 3; i++ {
+		if _, err := resolver.Lookup(context.Background(), "alice.example.com"); err != nil {
+			t.Fatalf("lookup %d: failed: %v", i, err)
+		}
+	}
+	if lookups, requests := network.lookups.Load(), network.requests.Load(); lookups != 1 || requests != 1 {
+		t.Errorf("cached network access mismatch: have %d/%d, want 1/1", lookups, requests)
+	}
+	// Purging the cache should hit the network again
+	resolver.Purge("alice.example.com")
+	resolver.Purge("did:plc:alice")
+
+	if _, err := resolver.Lookup(context.Background(), "alice.example.com"); err != nil {
+		t.Fatalf("lookup after purge failed: %v", err)
+	}
+	if lookups, requests := network.lookups.Load(), network.requests.Load(); lookups != 2 || requests != 2 {
+		t.Errorf("purged network access mismatch: have %d/%d, want 2/2", lookups, requests)
+	}
+	// Disabling the cache should hit the network every time
+	resolver.TTL = 0
+	resolver.Purge("alice.example.com")
+	resolver.Purge("did:plc:alice")
+
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.Lookup(context.Background(), "alice.example.com"); err != nil {
+			t.Fatalf("uncached lookup %d: failed: %v", i, err)
+		}
+	}
+	if lookups, requests := network.lookups.Load(), network.requests.Load(); lookups != 4 || requests != 4 {
+		t.Errorf("uncached network access mismatch: have %d/%d, want 4/4", lookups, requests)
+	}
+}
+
+// Tests that a zero value resolver falls back to the default network settings
+// instead of crashing.
+func TestZeroResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(makeTestDocument("did:plc:alice", "alice.example.com"))
+	}))
+	defer srv.Close()
+
+	doc, err := (&Resolver{PLCDirectory: srv.URL}).ResolveDID(context.Background(), "did:plc:alice")
+	if err != nil {
+		t.Fatalf("failed to resolve did: %v", err)
+	}
+	if doc.ID != "did:plc:alice" {
+		t.Errorf("did document mismatch: have %v, want %v", doc.ID, "did:plc:alice")
+	}
+	// Hitting the real network is not an option, but the lookups should fail
+	// gracefully on a cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := new(Resolver).ResolveHandle(ctx, "alice.example.com"); err == nil {
+		t.Errorf("cancelled handle resolution succeeded")
+	}
+	if _, err := new(Resolver).ResolveDID(ctx, "did:plc:alice"); err == nil {
+		t.Errorf("cancelled did resolution succeeded")
+	}
+}
@@ -0,0 +1,295 @@
+package lambda
+
+import (
+	"context"
+	"gophercon-2023-demo/client"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Request is a transport neutral API request. The front-ends (API Gateway and the
+// standalone HTTP server) convert their native requests into this, so routing,
+// authentication and error mapping are shared between them.
+type Request struct {
+	Method string            // HTTP method of the request
+	Path   string            // URL path of the request, without the query
+	Header http.Header       // Request headers, canonicalized
+	Query  url.Values        // Query string parameters
+	Params map[string]string // Typed path parameters, filled in by the router
+	Body   []byte            // Request body, nil if none was sent
+	ID     string            // Unique identifier of the request, for tracing failures
+}
+
+// Response is a transport neutral API response.
+type Response struct {
+	StatusCode int         // HTTP status code of the response
+	Header     http.Header // Response headers, may be nil
+	Body       []byte      // Response body, may be nil
+}
+
+// API is the REST API of the demo. It holds onto the authenticated Bluesky client
+// between requests, so that neither a warm Lambda container, nor a long running
+// server needs to dial and log in again for every request.
+type API struct {
+	server     string         // Bluesky server to connect to
+	httpClient *http.Client   // HTTP client to connect with
+	handle     string         // Bluesky handle to log in with
+	appkey     string         // Bluesky app password to log in with
+	auth       *Authenticator // Authenticator verifying the API clients
+
+	pool *client.Pool // Pool holding the logged in client, nil until first used
+	lock sync.Mutex   // Lock protecting the pool's lifecycle
+}
+
+// NewAPI creates the API from the configuration. The Bluesky client is only
+// created on the first request, so a temporarily unreachable server does not
+// crash the process.
+func NewAPI(config *Config, httpClient *http.Client) (*API, error) {
+	auth, err := NewAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+	return &API{
+		server:     config.BlueskyServer,
+		httpClient: httpClient,
+		handle:     config.BlueskyHandle,
+		appkey:     config.BlueskyAppkey,
+		auth:       auth,
+	}, nil
+}
+
+// lease retrieves the shared client, dialing and logging in if this is the first
+// request. The pool takes care of refreshing the session, or logging in again if
+// it expired while the process was frozen. The returned release function must be
+// called when the request is done with the client.
+func (a *API) lease(ctx context.Context) (*client.Client, func(), error) {
+	a.lock.Lock()
+	if a.pool == nil {
+		log.Printf("Logging in with handle: %s\n", a.handle)
+
+		pool, err := client.NewPoolWithClient(ctx, a.server, a.httpClient, client.StaticCredentials{
+			{Handle: a.handle, Appkey: a.appkey},
+		})
+		if err != nil {
+			a.lock.Unlock()
+			return nil, nil, err
+		}
+		a.pool = pool
+	}
+	pool := a.pool
+	a.lock.Unlock()
+
+	return pool.Lease(ctx, a.handle)
+}
+
+// Close tears down the shared client, if any. A later request would create a new
+// one.
+func (a *API) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.pool == nil {
+		return nil
+	}
+	err := a.pool.Close()
+	a.pool = nil
+	return err
+}
+
+// routes is the declarative table of endpoints served by the API. It is assembled
+// in init, since the route listing endpoint refers back to the table itself.
+var routes *Router
+
+func init() {
+	routes = newRouter([]Route{
+		{
+			Method:  http.MethodGet,
+			Pattern: "/profile/{actor:actor}",
+			Summary: "Profile of a user",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetProfile(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/avatar/{actor:actor}",
+			Summary: "Avatar image of a user",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetAvatar(ctx, client, req.Params["actor"], req.Query)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/banner/{actor:actor}",
+			Summary: "Banner image of a user",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetBanner(ctx, client, req.Params["actor"], req.Query)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/followers/{actor:actor}",
+			Summary: "Page of followers of a user, selected by ?limit= and ?cursor=",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowers(ctx, client, req.Params["actor"], req.Query)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/following/{actor:actor}",
+			Summary: "Page of users followed by a user, selected by ?limit= and ?cursor=",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowing(ctx, client, req.Params["actor"], req.Query)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/followers/full/{actor:actor}",
+			Summary: "All followers of a user, with names, bios and avatars",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowersFull(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/following/full/{actor:actor}",
+			Summary: "All users followed by a user, with names, bios and avatars",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowingFull(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/followers/mutuals/{actor:actor}",
+			Summary: "Users who follow a user and are followed back",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetMutuals(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/followers/unreciprocated/{actor:actor}",
+			Summary: "Users who follow a user, but are not followed back",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowersOnly(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/following/unreciprocated/{actor:actor}",
+			Summary: "Users followed by a user, who don't follow back",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowingOnly(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/followers/snapshot/{actor:actor}",
+			Summary: "Snapshot of the followers of a user, to be diffed later",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowersSnapshot(ctx, client, req.Params["actor"])
+			},
+		},
+		{
+			Method:  http.MethodPost,
+			Pattern: "/followers/diff/{actor:actor}",
+			Summary: "Followers gained and lost since the snapshot in the request body",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return DiffFollowers(ctx, client, req.Params["actor"], req.Body)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/followers/short/{actor:actor}",
+			Summary: "Handles, DIDs and names of all followers of a user",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowersShort(ctx, client, req.Params["actor"], req.Query)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/following/short/{actor:actor}",
+			Summary: "Handles, DIDs and names of all users followed by a user",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetFollowingShort(ctx, client, req.Params["actor"], req.Query)
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/blob/{did:did}/{cid:cid}",
+			Summary: "Blob stored in a user's repository",
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetBlob(ctx, client, req.Params["did"], req.Params["cid"])
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/routes",
+			Summary: "Listing of all the API routes",
+			Offline: true,
+			Handler: func(ctx context.Context, client *client.Client, req *Request) (*Response, error) {
+				return GetRoutes(routes)
+			},
+		},
+	})
+}
+
+// Serve authenticates a request, routes it to the matching handler and maps any
+// failure onto an HTTP response. It is the single entrypoint shared by all the
+// front-ends.
+func (a *API) Serve(ctx context.Context, req *Request) *Response {
+	return finishResponse(req, a.serve(ctx, req))
+}
+
+// finishResponse adds the headers common to all responses, defaulting the content
+// type if the handler did not set one.
+func finishResponse(req *Request, res *Response) *Response {
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	if res.Header.Get("Content-Type") == "" && len(res.Body) > 0 {
+		res.Header.Set("Content-Type", contentTypeText)
+	}
+	if req.ID != "" {
+		res.Header.Set("X-Request-Id", req.ID)
+	}
+	res.Header.Set("X-Api-Version", APIVersion)
+	return res
+}
+
+// serve is the implementation of Serve, without the response post-processing.
+func (a *API) serve(ctx context.Context, req *Request) *Response {
+	if err := a.auth.Authenticate(req.Header.Get("Authorization")); err != nil {
+		log.Printf("Rejected request: %v", err)
+		return authResponse(req, err)
+	}
+	route, params, err := routes.match(req.Method, req.Path)
+	if err != nil {
+		return routingResponse(req, err)
+	}
+	if len(req.Body) > maxRequestBodyBytes {
+		return envelopeResponse(req, http.StatusRequestEntityTooLarge, codePayloadTooLarge, "request body too large")
+	}
+	req.Params = params
+
+	if route.Offline {
+		res, err := route.Handler(ctx, nil, req)
+		if err != nil {
+			return errorResponse(req, err)
+		}
+		return res
+	}
+	client, release, err := a.lease(ctx)
+	if err != nil {
+		return leaseResponse(req, err)
+	}
+	defer release()
+
+	res, err := route.Handler(ctx, client, req)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return res
+}
@@ -0,0 +1,212 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	testHandle = "bot.test"
+	testAppkey = "abcd-efgh-ijkl-mnop"
+	testAPIKey = "test-api-key"
+)
+
+// makeTestAPI starts a fake Bluesky server with a single account and creates the
+// API pointing to it.
+func makeTestAPI(t *testing.T) (*clienttest.Server, *API) {
+	t.Helper()
+
+	srv := clienttest.NewServer()
+	t.Cleanup(srv.Close)
+
+	srv.AddAccount(&clienttest.Account{
+		Handle:       testHandle,
+		DID:          "did:plc:bot",
+		Password:     "master-password",
+		AppPasswords: []string{testAppkey},
+		Name:         "Bot",
+	})
+	api, err := NewAPI(&Config{
+		BlueskyServer: srv.URL,
+		BlueskyHandle: testHandle,
+		BlueskyAppkey: testAppkey,
+		APIKeyHashes:  []string{HashAPIKey(testAPIKey)},
+	}, srv.Client())
+	if err != nil {
+		t.Fatalf("failed to create API: %v", err)
+	}
+	t.Cleanup(func() { api.Close() })
+
+	return srv, api
+}
+
+// invoke runs a single authenticated profile request through the handler.
+func invoke(t *testing.T, api *API) events.APIGatewayProxyResponse {
+	t.Helper()
+
+	res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+		Path:           "/profile/" + testHandle,
+		Headers:        map[string]string{"Authorization": "Bearer " + testAPIKey},
+		PathParameters: map[string]string{"handle": testHandle},
+	})
+	if err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	return res
+}
+
+// Tests that a warm container reuses the same logged in client across many
+// invocations instead of logging in every time.
+func TestHandlerReusesClient(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	for i := 0; i < 10; i++ {
+		if res := invoke(t, api); res.StatusCode != http.StatusOK {
+			t.Fatalf("invocation %d: status mismatch: have %d, want %d", i, res.StatusCode, http.StatusOK)
+		}
+	}
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 1 {
+		t.Errorf("dial count mismatch: have %d, want %d", calls, 1)
+	}
+	if calls := srv.Calls("com.atproto.server.createSession"); calls != 1 {
+		t.Errorf("login count mismatch: have %d, want %d", calls, 1)
+	}
+	if calls := srv.Calls("app.bsky.actor.getProfile"); calls != 10 {
+		t.Errorf("profile call count mismatch: have %d, want %d", calls, 10)
+	}
+}
+
+// Tests that unauthorized requests are rejected without touching Bluesky, and
+// that the Bluesky app password is not accepted as an API credential.
+func TestHandlerUnauthorized(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{testAPIKey, http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusForbidden},
+		{"Bearer " + testAppkey, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			Path:    "/profile/" + testHandle,
+			Headers: map[string]string{"Authorization": tt.header},
+		})
+		if err != nil {
+			t.Fatalf("%q: handler failed: %v", tt.header, err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%q: status mismatch: have %d, want %d", tt.header, res.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && res.Headers["Www-Authenticate"] == "" {
+			t.Errorf("%q: missing authentication challenge", tt.header)
+		}
+	}
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 0 {
+		t.Errorf("server contacted for unauthorized request: %d dials", calls)
+	}
+}
+
+// Tests that neither the API credentials, nor the Bluesky ones end up in the logs.
+func TestHandlerRedactsSecrets(t *testing.T) {
+	_, api := makeTestAPI(t)
+
+	logs := new(bytes.Buffer)
+	log.SetOutput(NewRedactingWriter(logs, testAppkey))
+	defer log.SetOutput(os.Stderr)
+
+	res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+		Path:           "/profile/" + testHandle,
+		Headers:        map[string]string{"authorization": "Bearer " + testAPIKey},
+		PathParameters: map[string]string{"handle": testHandle},
+	})
+	if err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status mismatch: have %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	log.Printf("Leaked appkey: %s", testAppkey)
+
+	if out := logs.String(); strings.Contains(out, testAPIKey) || strings.Contains(out, testAppkey) {
+		t.Errorf("secrets leaked into logs: %s", out)
+	}
+	if !strings.Contains(logs.String(), testHandle) {
+		t.Errorf("request not logged: %s", logs.String())
+	}
+}
+
+// Tests that if the session expires while the container is frozen, the next
+// invocation logs in again instead of failing.
+func TestHandlerSessionExpiry(t *testing.T) {
+	srv, api := makeTestAPI(t)
+	srv.AccessTTL = 2 * time.Second
+	srv.RefreshTTL = 2 * time.Second
+
+	if res := invoke(t, api); res.StatusCode != http.StatusOK {
+		t.Fatalf("status mismatch: have %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	time.Sleep(2500 * time.Millisecond)
+
+	if res := invoke(t, api); res.StatusCode != http.StatusOK {
+		t.Fatalf("status mismatch after expiry: have %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if calls := srv.Calls("com.atproto.server.createSession"); calls != 2 {
+		t.Errorf("login count mismatch: have %d, want %d", calls, 2)
+	}
+}
+
+// Tests that failing to log in doesn't poison the container and that a later
+// invocation can recover once the server does.
+func TestHandlerLoginFailure(t *testing.T) {
+	srv, api := makeTestAPI(t)
+	srv.InjectFault("com.atproto.server.createSession", &clienttest.Fault{
+		Status: http.StatusBadRequest,
+		Error:  "InvalidRequest",
+		Times:  1,
+	})
+	if res := invoke(t, api); res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status mismatch: have %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+	if res := invoke(t, api); res.StatusCode != http.StatusOK {
+		t.Fatalf("status mismatch after recovery: have %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+// Tests that closing the API tears down all background goroutines.
+func TestHandlerClose(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		invoke(t, api)
+	}
+	if err := api.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := api.Close(); err != nil {
+		t.Fatalf("failed to close twice: %v", err)
+	}
+	// Idle HTTP connections might take a moment to wind down
+	srv.Client().CloseIdleConnections()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if runtime.NumGoroutine() <= before {
+			return
+		}
+	}
+	t.Errorf("goroutines leaked: have %d, want at most %d", runtime.NumGoroutine(), before)
+}
@@ -0,0 +1,128 @@
+package lambda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMissingCredentials is returned if a request does not carry any bearer
+	// token to authorize it with.
+	ErrMissingCredentials = errors.New("missing credentials")
+
+	// ErrInvalidCredentials is returned if a request's bearer token is neither a
+	// known API key, nor a valid signed token.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrExpiredCredentials is returned if a request's signed token is authentic,
+	// but it has already expired.
+	ErrExpiredCredentials = errors.New("expired credentials")
+)
+
+// Authenticator verifies the bearer tokens of API requests. A token is accepted
+// if it is either an API key whose SHA-256 hash is known, or an unexpired token
+// signed with the shared HMAC secret.
+//
+// The API keys themselves are never stored, and all comparisons are done in
+// constant time so the response timing does not leak anything about them.
+type Authenticator struct {
+	hashes [][]byte // SHA-256 hashes of the accepted API keys
+	secret []byte   // HMAC secret for signed tokens, nil if disabled
+
+	now func() time.Time // Clock to check token expirations against
+}
+
+// NewAuthenticator creates an authenticator from the API credentials within the
+// configuration.
+func NewAuthenticator(config *Config) (*Authenticator, error) {
+	auth := &Authenticator{now: time.Now}
+	for i, hash := range config.APIKeyHashes {
+		blob, err := hex.DecodeString(strings.TrimPrefix(hash, "0x"))
+		if err != nil || len(blob) != sha256.Size {
+			return nil, fmt.Errorf("malformed API key hash #%d", i)
+		}
+		auth.hashes = append(auth.hashes, blob)
+	}
+	if config.APITokenSecret != "" {
+		auth.secret = []byte(config.APITokenSecret)
+	}
+	return auth, nil
+}
+
+// HashAPIKey returns the hex SHA-256 hash of an API key, in the format expected
+// by the configuration.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// SignToken creates a token for the given subject, valid until the expiration
+// time, signed with the HMAC secret. The format of the token is
+// "subject.expiry.signature", where expiry is a unix timestamp and signature is
+// the unpadded base64url HMAC-SHA256 of the first two fields.
+func SignToken(secret string, subject string, expiry time.Time) string {
+	payload := subject + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signToken([]byte(secret), payload))
+}
+
+// signToken calculates the HMAC signature of a token payload.
+func signToken(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Authenticate verifies the value of an Authorization header, returning nil if
+// the request is authorized.
+func (a *Authenticator) Authenticate(header string) error {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return ErrMissingCredentials
+	}
+	// Check the token against all the API keys, without bailing out early on a
+	// match to avoid leaking which one it was.
+	hash := sha256.Sum256([]byte(token))
+
+	match := 0
+	for _, known := range a.hashes {
+		match |= subtle.ConstantTimeCompare(hash[:], known)
+	}
+	if match == 1 {
+		return nil
+	}
+	// Not a known API key, try to interpret it as a signed token
+	if a.secret == nil {
+		return ErrInvalidCredentials
+	}
+	split := strings.LastIndexByte(token, '.')
+	if split < 0 {
+		return ErrInvalidCredentials
+	}
+	payload, signature := token[:split], token[split+1:]
+
+	have, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(have, signToken(a.secret, payload)) {
+		return ErrInvalidCredentials
+	}
+	// Token authentic, make sure it has not expired yet
+	split = strings.LastIndexByte(payload, '.')
+	if split < 0 {
+		return ErrInvalidCredentials
+	}
+	expiry, err := strconv.ParseInt(payload[split+1:], 10, 64)
+	if err != nil {
+		return ErrInvalidCredentials
+	}
+	if !a.now().Before(time.Unix(expiry, 0)) {
+		return ErrExpiredCredentials
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package lambda
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Tests that API keys are accepted by their hashes and that anything else is
+// rejected with the appropriate error.
+func TestAuthenticateAPIKey(t *testing.T) {
+	auth, err := NewAuthenticator(&Config{
+		APIKeyHashes: []string{HashAPIKey("first-key"), HashAPIKey("second-key")},
+	})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	tests := []struct {
+		header string
+		err    error
+	}{
+		{"Bearer first-key", nil},
+		{"bearer second-key", nil},
+		{"Bearer third-key", ErrInvalidCredentials},
+		{"Bearer first-key ", ErrInvalidCredentials},
+		{"Basic first-key", ErrMissingCredentials},
+		{"first-key", ErrMissingCredentials},
+		{"Bearer ", ErrMissingCredentials},
+		{"", ErrMissingCredentials},
+	}
+	for _, tt := range tests {
+		if err := auth.Authenticate(tt.header); !errors.Is(err, tt.err) {
+			t.Errorf("%q: error mismatch: have %v, want %v", tt.header, err, tt.err)
+		}
+	}
+	if _, err := NewAuthenticator(&Config{APIKeyHashes: []string{"not-a-hash"}}); err == nil {
+		t.Errorf("malformed API key hash accepted")
+	}
+}
+
+// Tests that HMAC signed tokens are accepted until they expire and that tampered
+// ones are rejected.
+func TestAuthenticateSignedToken(t *testing.T) {
+	auth, err := NewAuthenticator(&Config{APITokenSecret: "shared-secret"})
+	if err != nil {
+		t.Fatalf("failed to create authenticator: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	auth.now = func() time.Time { return now }
+
+	valid := SignToken("shared-secret", "partner.app", now.Add(time.Hour))
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{valid, nil},
+		{SignToken("shared-secret", "partner.app", now), ErrExpiredCredentials},
+		{SignToken("other-secret", "partner.app", now.Add(time.Hour)), ErrInvalidCredentials},
+		{"intruder" + valid[len("partner.app"):], ErrInvalidCredentials},
+		{valid[:len(valid)-1], ErrInvalidCredentials},
+		{"no-separators", ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		if err := auth.Authenticate("Bearer " + tt.token); !errors.Is(err, tt.err) {
+			t.Errorf("%q: error mismatch: have %v, want %v", tt.token, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package lambda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gophercon-2023-demo/client"
+	"os"
+	"strings"
+)
+
+// Environment variables the configuration is loaded from.
+const (
+	EnvSecretsFile    = "SECRETS_FILE"     // Path to a JSON file holding the configuration
+	EnvBlueskyServer  = "BLUESKY_SERVER"   // Bluesky server to connect to
+	EnvBlueskyHandle  = "BLUESKY_HANDLE"   // Bluesky handle to log in with
+	EnvBlueskyAppkey  = "BLUESKY_APPKEY"   // Bluesky app password to log in with
+	EnvAPIKeyHashes   = "API_KEY_HASHES"   // Comma separated hex SHA-256 hashes of the accepted API keys
+	EnvAPITokenSecret = "API_TOKEN_SECRET" // Secret to verify HMAC signed API tokens with
+)
+
+// Config is the configuration of the REST API. It keeps the credentials of the
+// API's own clients and those of the Bluesky account the API runs as separate,
+// so that no Bluesky secret ever needs to be handed out to API users.
+type Config struct {
+	BlueskyServer string `json:"blueskyServer"` // Bluesky server to connect to
+	BlueskyHandle string `json:"blueskyHandle"` // Bluesky handle to log in with
+	BlueskyAppkey string `json:"blueskyAppkey"` // Bluesky app password to log in with
+
+	APIKeyHashes   []string `json:"apiKeyHashes"`   // Hex SHA-256 hashes of the accepted API keys
+	APITokenSecret string   `json:"apiTokenSecret"` // Secret to verify HMAC signed API tokens with
+}
+
+// LoadConfig loads the configuration from the secrets file named by the
+// SECRETS_FILE environment variable (if set), overriding the individual fields
+// with any of the other environment variables set.
+func LoadConfig() (*Config, error) {
+	config := &Config{BlueskyServer: client.ServerBskySocial}
+
+	if path := os.Getenv(EnvSecretsFile); path != "" {
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secrets file: %w", err)
+		}
+		if err := json.Unmarshal(blob, config); err != nil {
+			return nil, fmt.Errorf("failed to parse secrets file: %w", err)
+		}
+	}
+	if value := os.Getenv(EnvBlueskyServer); value != "" {
+		config.BlueskyServer = value
+	}
+	if value := os.Getenv(EnvBlueskyHandle); value != "" {
+		config.BlueskyHandle = value
+	}
+	if value := os.Getenv(EnvBlueskyAppkey); value != "" {
+		config.BlueskyAppkey = value
+	}
+	if value := os.Getenv(EnvAPIKeyHashes); value != "" {
+		config.APIKeyHashes = nil
+		for _, hash := range strings.Split(value, ",") {
+			if hash = strings.TrimSpace(hash); hash != "" {
+				config.APIKeyHashes = append(config.APIKeyHashes, hash)
+			}
+		}
+	}
+	if value := os.Getenv(EnvAPITokenSecret); value != "" {
+		config.APITokenSecret = value
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate checks that the configuration is complete enough to run the API.
+func (c *Config) validate() error {
+	if c.BlueskyHandle == "" || c.BlueskyAppkey == "" {
+		return errors.New("missing Bluesky credentials")
+	}
+	if len(c.APIKeyHashes) == 0 && c.APITokenSecret == "" {
+		return errors.New("missing API credentials, no requests could be authorized")
+	}
+	return nil
+}
+
+// Secrets returns all the secret values within the configuration, which should
+// never appear in any log output.
+func (c *Config) Secrets() []string {
+	var secrets []string
+	if c.BlueskyAppkey != "" {
+		secrets = append(secrets, c.BlueskyAppkey)
+	}
+	if c.APITokenSecret != "" {
+		secrets = append(secrets, c.APITokenSecret)
+	}
+	return secrets
+}
@@ -0,0 +1,56 @@
+package lambda
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that the configuration is loaded from the secrets file and that the
+// environment variables override it.
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(path, []byte(`{
+		"blueskyHandle": "file.test",
+		"blueskyAppkey": "file-appkey",
+		"apiKeyHashes": ["aa"]
+	}`), 0600); err != nil {
+		t.Fatalf("failed to write secrets file: %v", err)
+	}
+	t.Setenv(EnvSecretsFile, path)
+	t.Setenv(EnvBlueskyServer, "")
+	t.Setenv(EnvBlueskyHandle, "")
+	t.Setenv(EnvBlueskyAppkey, "env-appkey")
+	t.Setenv(EnvAPIKeyHashes, "bb, cc,")
+	t.Setenv(EnvAPITokenSecret, "")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	want := &Config{
+		BlueskyServer: "https://bsky.social",
+		BlueskyHandle: "file.test",
+		BlueskyAppkey: "env-appkey",
+		APIKeyHashes:  []string{"bb", "cc"},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("config mismatch: have %+v, want %+v", config, want)
+	}
+	if secrets := config.Secrets(); !reflect.DeepEqual(secrets, []string{"env-appkey"}) {
+		t.Errorf("secrets mismatch: have %v, want %v", secrets, []string{"env-appkey"})
+	}
+	// Ensure incomplete configurations are rejected
+	t.Setenv(EnvAPIKeyHashes, "")
+	if err := os.WriteFile(path, []byte(`{"blueskyHandle": "file.test"}`), 0600); err != nil {
+		t.Fatalf("failed to write secrets file: %v", err)
+	}
+	if _, err := LoadConfig(); err == nil {
+		t.Errorf("config without API credentials accepted")
+	}
+	t.Setenv(EnvSecretsFile, filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := LoadConfig(); err == nil {
+		t.Errorf("missing secrets file accepted")
+	}
+}
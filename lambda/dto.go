@@ -0,0 +1,196 @@
+package lambda
+
+import (
+	"encoding/json"
+	"fmt"
+	"gophercon-2023-demo/client"
+	"time"
+)
+
+// APIVersion is the version of the JSON representations served by the API. It is
+// reported in the X-Api-Version header of every response and must be bumped on
+// any incompatible change to the DTOs below.
+const APIVersion = "1"
+
+// ProfileV1 is the JSON representation of a user's profile.
+//
+// Textual fields that the user did not set are omitted, whereas counters are
+// always present, since zero is a meaningful value for them.
+type ProfileV1 struct {
+	Handle      string `json:"handle"`                // User-friendly - unstable - identifier of the user
+	DID         string `json:"did"`                   // Machine friendly - stable - identifier of the user
+	DisplayName string `json:"displayName,omitempty"` // Display name of the user, omitted if unset
+	Description string `json:"description,omitempty"` // Profile description of the user, omitted if unset
+	AvatarURL   string `json:"avatarUrl,omitempty"`   // CDN URL of the profile picture, omitted if unset
+	BannerURL   string `json:"bannerUrl,omitempty"`   // CDN URL of the banner picture, omitted if unset
+
+	FollowersCount uint `json:"followersCount"` // Number of users following this user
+	FollowingCount uint `json:"followingCount"` // Number of users this user follows
+	PostsCount     uint `json:"postsCount"`     // Number of posts this user made
+}
+
+// UserV1 is the JSON representation of a user within a listing (e.g. followers).
+type UserV1 struct {
+	Handle      string `json:"handle"`                // User-friendly - unstable - identifier of the user
+	DID         string `json:"did"`                   // Machine friendly - stable - identifier of the user
+	DisplayName string `json:"displayName,omitempty"` // Display name of the user, omitted if unset
+	Description string `json:"description,omitempty"` // Profile description of the user, omitted if unset
+	AvatarURL   string `json:"avatarUrl,omitempty"`   // CDN URL of the profile picture, omitted if unset
+}
+
+// UsersPageV1 is the JSON representation of a single page of a paginated user
+// listing.
+type UsersPageV1 struct {
+	Items  []*UserV1 `json:"items"`            // Users within the page, never null
+	Cursor string    `json:"cursor,omitempty"` // Cursor to fetch the next page with, omitted on the last page
+}
+
+// SnapshotV1 is the JSON representation of a point in time capture of a user's
+// followers. API clients are expected to store it as is and send it back later
+// to find out who followed or unfollowed in between.
+type SnapshotV1 struct {
+	DID   string            `json:"did"`   // Machine friendly - stable - identifier of the user
+	Taken time.Time         `json:"taken"` // Time when the snapshot was taken
+	Users []*SnapshotUserV1 `json:"users"` // Followers of the user at the time, never null
+}
+
+// SnapshotUserV1 is the JSON representation of a follower within a snapshot.
+type SnapshotUserV1 struct {
+	DID    string `json:"did"`    // Machine friendly - stable - identifier of the follower
+	Handle string `json:"handle"` // User-friendly - unstable - identifier of the follower
+}
+
+// SnapshotDiffV1 is the JSON representation of the changes in a user's followers
+// between two snapshots.
+type SnapshotDiffV1 struct {
+	Since   time.Time         `json:"since"`   // Time when the older snapshot was taken
+	Until   time.Time         `json:"until"`   // Time when the newer snapshot was taken
+	Added   []*SnapshotUserV1 `json:"added"`   // New followers, never null
+	Removed []*SnapshotUserV1 `json:"removed"` // Lost followers, never null
+}
+
+// userFieldsV1 are the fields of a user that the short listings can be
+// projected onto, in their default order.
+var userFieldsV1 = []string{"handle", "did", "displayName"}
+
+// isUserFieldV1 reports whether a field is a valid short listing projection.
+func isUserFieldV1(field string) bool {
+	for _, known := range userFieldsV1 {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// newProfileV1 converts a client profile into its JSON representation.
+func newProfileV1(profile *client.Profile) *ProfileV1 {
+	return &ProfileV1{
+		Handle:         profile.Handle,
+		DID:            profile.DID,
+		DisplayName:    profile.Name,
+		Description:    profile.Bio,
+		AvatarURL:      profile.AvatarURL,
+		BannerURL:      profile.BannerURL,
+		FollowersCount: profile.FollowerCount,
+		FollowingCount: profile.FolloweeCount,
+		PostsCount:     profile.PostCount,
+	}
+}
+
+// newUserV1 converts a client user into its JSON representation.
+func newUserV1(user *client.User) *UserV1 {
+	return &UserV1{
+		Handle:      user.Handle,
+		DID:         user.DID,
+		DisplayName: user.Name,
+		Description: user.Bio,
+		AvatarURL:   user.AvatarURL,
+	}
+}
+
+// newUsersV1 converts a list of client users into their JSON representations.
+// The result is never nil, so an empty list is encoded as [] instead of null.
+func newUsersV1(users []*client.User) []*UserV1 {
+	dtos := make([]*UserV1, 0, len(users))
+	for _, user := range users {
+		dtos = append(dtos, newUserV1(user))
+	}
+	return dtos
+}
+
+// newUserFieldsV1 converts a client user into its short JSON representation,
+// projected onto the requested fields. Requested fields are always present, even
+// if empty, so that users without a display name remain distinguishable.
+func newUserFieldsV1(user *client.User, fields []string) map[string]string {
+	dto := make(map[string]string, len(fields))
+	for _, field := range fields {
+		switch field {
+		case "handle":
+			dto[field] = user.Handle
+		case "did":
+			dto[field] = user.DID
+		case "displayName":
+			dto[field] = user.Name
+		}
+	}
+	return dto
+}
+
+// newSnapshotV1 converts a client snapshot into its JSON representation.
+func newSnapshotV1(snapshot *client.Snapshot) *SnapshotV1 {
+	return &SnapshotV1{
+		DID:   snapshot.DID,
+		Taken: snapshot.Taken,
+		Users: newSnapshotUsersV1(snapshot.Users),
+	}
+}
+
+// newSnapshotDiffV1 diffs two client snapshots and converts the result into its
+// JSON representation.
+func newSnapshotDiffV1(older *client.Snapshot, newer *client.Snapshot) (*SnapshotDiffV1, error) {
+	diff, err := client.DiffSnapshots(older, newer)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotDiffV1{
+		Since:   older.Taken,
+		Until:   newer.Taken,
+		Added:   newSnapshotUsersV1(diff.Added),
+		Removed: newSnapshotUsersV1(diff.Removed),
+	}, nil
+}
+
+// newSnapshotUsersV1 converts a list of snapshot users into their JSON
+// representations. The result is never nil.
+func newSnapshotUsersV1(users []*client.SnapshotUser) []*SnapshotUserV1 {
+	dtos := make([]*SnapshotUserV1, 0, len(users))
+	for _, user := range users {
+		dtos = append(dtos, &SnapshotUserV1{DID: user.DID, Handle: user.Handle})
+	}
+	return dtos
+}
+
+// parseSnapshotV1 parses a JSON snapshot sent back by an API client into a client
+// snapshot.
+func parseSnapshotV1(body []byte) (*client.Snapshot, error) {
+	var dto SnapshotV1
+	if err := json.Unmarshal(body, &dto); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidBody, err)
+	}
+	if dto.DID == "" {
+		return nil, fmt.Errorf("%w: snapshot did missing", errInvalidBody)
+	}
+	snapshot := &client.Snapshot{
+		DID:   dto.DID,
+		Taken: dto.Taken,
+		Users: make([]*client.SnapshotUser, 0, len(dto.Users)),
+	}
+	for _, user := range dto.Users {
+		if user == nil || user.DID == "" {
+			return nil, fmt.Errorf("%w: snapshot user did missing", errInvalidBody)
+		}
+		snapshot.Users = append(snapshot.Users, &client.SnapshotUser{DID: user.DID, Handle: user.Handle})
+	}
+	return snapshot, nil
+}
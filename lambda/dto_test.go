@@ -0,0 +1,138 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gophercon-2023-demo/client"
+	"gophercon-2023-demo/client/clienttest"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// update regenerates the golden files instead of checking against them.
+var update = flag.Bool("update", false, "update the golden files")
+
+// checkGolden compares a JSON blob against the named golden file, or overwrites
+// the file with it if the -update flag is set.
+func checkGolden(t *testing.T, name string, have []byte) {
+	t.Helper()
+
+	indented := new(bytes.Buffer)
+	if err := json.Indent(indented, have, "", "  "); err != nil {
+		t.Fatalf("%s: invalid JSON: %v", name, err)
+	}
+	indented.WriteByte('\n')
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, indented.Bytes(), 0644); err != nil {
+			t.Fatalf("%s: failed to update golden file: %v", name, err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: failed to read golden file: %v", name, err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("%s: JSON mismatch:\nhave:\n%s\nwant:\n%s", name, indented, want)
+	}
+}
+
+// Tests that the JSON representation of profiles matches the contract.
+func TestProfileV1Golden(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *client.Profile
+	}{
+		{"profile_v1_full.json", &client.Profile{
+			Handle:        "alice.test",
+			DID:           "did:plc:alice",
+			Name:          "Alice",
+			Bio:           "Gopher at heart",
+			AvatarURL:     "https://cdn.bsky.app/img/avatar/plain/did:plc:alice/avatar@jpeg",
+			BannerURL:     "https://cdn.bsky.app/img/banner/plain/did:plc:alice/banner@jpeg",
+			FollowerCount: 42,
+			Followers:     []*client.User{{Handle: "bob.test", DID: "did:plc:bob"}},
+			FolloweeCount: 7,
+			PostCount:     1024,
+		}},
+		{"profile_v1_minimal.json", &client.Profile{
+			Handle: "bob.test",
+			DID:    "did:plc:bob",
+		}},
+	}
+	for _, tt := range tests {
+		blob, err := json.Marshal(newProfileV1(tt.profile))
+		if err != nil {
+			t.Fatalf("%s: failed to marshal profile: %v", tt.name, err)
+		}
+		checkGolden(t, tt.name, blob)
+	}
+}
+
+// Tests that the JSON representation of user listings matches the contract.
+func TestUsersV1Golden(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []*client.User
+	}{
+		{"users_v1.json", []*client.User{
+			{Handle: "alice.test", DID: "did:plc:alice", Name: "Alice", Bio: "Gopher at heart", AvatarURL: "https://cdn.bsky.app/img/avatar/plain/did:plc:alice/avatar@jpeg"},
+			{Handle: "bob.test", DID: "did:plc:bob"},
+		}},
+		{"users_v1_empty.json", nil},
+	}
+	for _, tt := range tests {
+		blob, err := json.Marshal(newUsersV1(tt.users))
+		if err != nil {
+			t.Fatalf("%s: failed to marshal users: %v", tt.name, err)
+		}
+		checkGolden(t, tt.name, blob)
+	}
+}
+
+// Tests that the profile and follower endpoints serve the versioned DTOs.
+func TestEndpointsV1Golden(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	srv.AddAccount(&clienttest.Account{Handle: "alice.test", DID: "did:plc:alice", Name: "Alice", Bio: "Gopher at heart", Posts: 3})
+	srv.AddAccount(&clienttest.Account{Handle: "carol.test", DID: "did:plc:carol"})
+	srv.AddFollow("did:plc:bot", "did:plc:alice")
+	srv.AddFollow("did:plc:carol", "did:plc:alice")
+
+	tests := []struct {
+		path   string
+		golden string
+	}{
+		{"/profile/alice.test", "endpoint_profile_v1.json"},
+		{"/followers/full/alice.test", "endpoint_followers_v1.json"},
+		{"/following/full/bot.test", "endpoint_following_v1.json"},
+		{"/followers/alice.test", "endpoint_followers_page_v1.json"},
+		{"/followers/short/alice.test", "endpoint_followers_short_v1.json"},
+	}
+	for _, tt := range tests {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: http.MethodGet,
+			Path:       tt.path,
+			Headers:    map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%s: handler failed: %v", tt.path, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status mismatch: have %d, want %d", tt.path, res.StatusCode, http.StatusOK)
+		}
+		if version := res.Headers["X-Api-Version"]; version != APIVersion {
+			t.Errorf("%s: version mismatch: have %s, want %s", tt.path, version, APIVersion)
+		}
+		checkGolden(t, tt.golden, []byte(res.Body))
+	}
+}
@@ -0,0 +1,228 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gophercon-2023-demo/blob"
+	"gophercon-2023-demo/client"
+	"gophercon-2023-demo/identity"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types of the API responses.
+const (
+	contentTypeJSON = "application/json; charset=utf-8"
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// maxRequestBodyBytes is the largest request body the API accepts, enough for a
+// follower snapshot of a very large account.
+const maxRequestBodyBytes = 4 * 1024 * 1024
+
+// defaultRetryAfter is the delay suggested to API clients after an upstream rate
+// limit if Bluesky did not report when the limit resets.
+const defaultRetryAfter = time.Minute
+
+// Error codes of the JSON error envelope.
+const (
+	codeBadRequest       = "BadRequest"
+	codeUnauthorized     = "Unauthorized"
+	codeForbidden        = "Forbidden"
+	codeNotFound         = "NotFound"
+	codeMethodNotAllowed = "MethodNotAllowed"
+	codeGone             = "Gone"
+	codePayloadTooLarge  = "PayloadTooLarge"
+	codeRateLimited      = "RateLimited"
+	codeInternalError    = "InternalError"
+	codeUpstreamFailure  = "UpstreamFailure"
+	codeUpstreamTimeout  = "UpstreamTimeout"
+)
+
+var (
+	// errInvalidQuery is returned by handlers if a query parameter is malformed.
+	errInvalidQuery = errors.New("invalid query parameter")
+
+	// errInvalidBody is returned by handlers if the request body is malformed.
+	errInvalidBody = errors.New("invalid request body")
+)
+
+// errorEnvelope is the JSON body of every failed API response.
+type errorEnvelope struct {
+	Error     string `json:"error"`     // Machine readable error code
+	Message   string `json:"message"`   // Human readable error description
+	RequestID string `json:"requestId"` // Identifier of the failed request, for support
+}
+
+// jsonResponse creates a successful response with a JSON encoded body.
+func jsonResponse(status int, v any) (*Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentTypeJSON}},
+		Body:       body,
+	}, nil
+}
+
+// envelopeResponse creates a failed response with a JSON error envelope.
+func envelopeResponse(req *Request, status int, code string, message string) *Response {
+	body, _ := json.Marshal(&errorEnvelope{Error: code, Message: message, RequestID: req.ID})
+	return &Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentTypeJSON}},
+		Body:       body,
+	}
+}
+
+// authResponse maps an authentication failure onto an HTTP response. Missing or
+// expired credentials are challenged, whereas credentials that are present but
+// not accepted are forbidden.
+func authResponse(req *Request, err error) *Response {
+	var res *Response
+	switch {
+	case errors.Is(err, ErrMissingCredentials):
+		res = envelopeResponse(req, http.StatusUnauthorized, codeUnauthorized, "missing bearer token")
+		res.Header.Set("WWW-Authenticate", `Bearer`)
+	case errors.Is(err, ErrExpiredCredentials):
+		res = envelopeResponse(req, http.StatusUnauthorized, codeUnauthorized, "expired bearer token")
+		res.Header.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	default:
+		res = envelopeResponse(req, http.StatusForbidden, codeForbidden, "bearer token not accepted")
+	}
+	return res
+}
+
+// routingResponse maps a routing failure onto an HTTP response.
+func routingResponse(req *Request, err error) *Response {
+	var (
+		merr *methodNotAllowedError
+		perr *paramError
+	)
+	switch {
+	case errors.As(err, &merr):
+		res := envelopeResponse(req, http.StatusMethodNotAllowed, codeMethodNotAllowed, merr.Error())
+		res.Header.Set("Allow", strings.Join(merr.allow, ", "))
+		return res
+	case errors.As(err, &perr):
+		return envelopeResponse(req, http.StatusBadRequest, codeBadRequest, perr.Error())
+	default:
+		return envelopeResponse(req, http.StatusNotFound, codeNotFound, "no route for "+req.Path)
+	}
+}
+
+// errorResponse maps a handler failure onto an HTTP response. Failures caused by
+// the request are reported as client errors, everything else that went wrong
+// talking to Bluesky as a bad gateway or gateway timeout, and anything
+// unexpected as an internal error without leaking its details.
+func errorResponse(req *Request, err error) *Response {
+	switch {
+	case errors.Is(err, client.ErrRateLimited):
+		return rateLimitResponse(req, err)
+	case errors.Is(err, client.ErrProfileNotFound), errors.Is(err, identity.ErrHandleNotFound),
+		errors.Is(err, identity.ErrDIDNotFound):
+		return envelopeResponse(req, http.StatusNotFound, codeNotFound, "profile not found")
+	case errors.Is(err, blob.ErrBlobNotFound):
+		return envelopeResponse(req, http.StatusNotFound, codeNotFound, "blob not found")
+	case errors.Is(err, client.ErrImageNotSet):
+		return envelopeResponse(req, http.StatusNotFound, codeNotFound, "image not set")
+	case errors.Is(err, client.ErrImageNotFound):
+		return envelopeResponse(req, http.StatusNotFound, codeNotFound, "image not found")
+	case errors.Is(err, client.ErrAccountTakedown):
+		return envelopeResponse(req, http.StatusGone, codeGone, "account taken down")
+	case errors.Is(err, errInvalidQuery), errors.Is(err, errInvalidBody), errors.Is(err, client.ErrSnapshotMismatch),
+		errors.Is(err, blob.ErrInvalidCID), errors.Is(err, identity.ErrUnsupportedDID):
+		return envelopeResponse(req, http.StatusBadRequest, codeBadRequest, err.Error())
+	case errors.Is(err, client.ErrInvalidRequest):
+		return envelopeResponse(req, http.StatusBadRequest, codeBadRequest, upstreamMessage(err))
+	case isTimeout(err):
+		log.Printf("Upstream timeout: %v", err)
+		return envelopeResponse(req, http.StatusGatewayTimeout, codeUpstreamTimeout, "Bluesky did not respond in time")
+	case isUpstream(err):
+		log.Printf("Upstream failure: %v", err)
+		return envelopeResponse(req, http.StatusBadGateway, codeUpstreamFailure, "Bluesky request failed")
+	default:
+		log.Printf("Request failed: %v", err)
+		return envelopeResponse(req, http.StatusInternalServerError, codeInternalError, "internal server error")
+	}
+}
+
+// leaseResponse maps a failure to acquire the Bluesky client onto an HTTP
+// response. None of these are caused by the request itself, so apart from rate
+// limits and timeouts, they are all reported as upstream failures.
+func leaseResponse(req *Request, err error) *Response {
+	log.Printf("Failed to acquire Bluesky client: %v", err)
+	switch {
+	case errors.Is(err, client.ErrRateLimited):
+		return rateLimitResponse(req, err)
+	case isTimeout(err):
+		return envelopeResponse(req, http.StatusGatewayTimeout, codeUpstreamTimeout, "Bluesky did not respond in time")
+	default:
+		return envelopeResponse(req, http.StatusBadGateway, codeUpstreamFailure, "Bluesky login failed")
+	}
+}
+
+// rateLimitResponse creates a 429 response for an upstream rate limit, telling
+// the client how long to back off for.
+func rateLimitResponse(req *Request, err error) *Response {
+	delay := defaultRetryAfter
+
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.RetryAfter > 0:
+			delay = apiErr.RetryAfter
+		case apiErr.RateLimit != nil && time.Until(apiErr.RateLimit.Reset) > 0:
+			delay = time.Until(apiErr.RateLimit.Reset)
+		}
+	}
+	res := envelopeResponse(req, http.StatusTooManyRequests, codeRateLimited, "Bluesky rate limit exceeded")
+	res.Header.Set("Retry-After", strconv.Itoa(int((delay+time.Second-1)/time.Second)))
+	return res
+}
+
+// upstreamMessage extracts the message Bluesky gave for a failure, falling back
+// to the full error if there was none.
+func upstreamMessage(err error) string {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.Message != "" {
+		return apiErr.Message
+	}
+	return err.Error()
+}
+
+// isTimeout reports whether a failure was caused by Bluesky not responding in
+// time.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// isUpstream reports whether a failure was caused by Bluesky or a PDS failing to
+// serve a request.
+func isUpstream(err error) bool {
+	var (
+		apiErr *client.APIError
+		nerr   net.Error
+	)
+	switch {
+	case errors.As(err, &apiErr), errors.As(err, &nerr):
+		return true
+	case errors.Is(err, client.ErrServerFailure), errors.Is(err, client.ErrAuthRequired),
+		errors.Is(err, client.ErrSessionExpired), errors.Is(err, blob.ErrPDSFailure),
+		errors.Is(err, identity.ErrNoPDS), errors.Is(err, identity.ErrHandleMismatch),
+		errors.Is(err, client.ErrImageFormat), errors.Is(err, client.ErrImageTooLarge):
+		return true
+	}
+	return false
+}
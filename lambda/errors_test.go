@@ -0,0 +1,114 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/blob"
+	"gophercon-2023-demo/client"
+	"gophercon-2023-demo/identity"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Tests that handler failures are mapped onto the correct statuses and error
+// codes.
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&client.APIError{Status: 400, Name: "InvalidRequest", Message: "Profile not found"}, http.StatusNotFound, codeNotFound},
+		{&client.APIError{Status: 400, Name: "InvalidRequest", Message: "Bad actor"}, http.StatusBadRequest, codeBadRequest},
+		{&client.APIError{Status: 400, Name: "AccountTakedown"}, http.StatusGone, codeGone},
+		{&client.APIError{Status: 429, Name: "RateLimitExceeded"}, http.StatusTooManyRequests, codeRateLimited},
+		{&client.APIError{Status: 503, Name: "ServiceUnavailable"}, http.StatusBadGateway, codeUpstreamFailure},
+		{&client.APIError{Status: 401, Name: "ExpiredToken"}, http.StatusBadGateway, codeUpstreamFailure},
+		{fmt.Errorf("lookup: %w", identity.ErrHandleNotFound), http.StatusNotFound, codeNotFound},
+		{fmt.Errorf("%w: missing", blob.ErrBlobNotFound), http.StatusNotFound, codeNotFound},
+		{fmt.Errorf("%w: bad", blob.ErrInvalidCID), http.StatusBadRequest, codeBadRequest},
+		{fmt.Errorf("%w: 404 Not Found", client.ErrImageNotFound), http.StatusNotFound, codeNotFound},
+		{fmt.Errorf("%w: image retrieval failed: 503", client.ErrServerFailure), http.StatusBadGateway, codeUpstreamFailure},
+		{fmt.Errorf("%w: 500", blob.ErrPDSFailure), http.StatusBadGateway, codeUpstreamFailure},
+		{&url.Error{Op: "Get", URL: "https://bsky.social", Err: errors.New("connection refused")}, http.StatusBadGateway, codeUpstreamFailure},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, codeUpstreamTimeout},
+		{errors.New("boom"), http.StatusInternalServerError, codeInternalError},
+	}
+	req := &Request{Path: "/profile/bot.test", ID: "request-id"}
+	for i, tt := range tests {
+		res := errorResponse(req, tt.err)
+		if res.StatusCode != tt.status {
+			t.Errorf("test %d (%v): status mismatch: have %d, want %d", i, tt.err, res.StatusCode, tt.status)
+		}
+		if ctype := res.Header.Get("Content-Type"); ctype != contentTypeJSON {
+			t.Errorf("test %d (%v): content type mismatch: have %s, want %s", i, tt.err, ctype, contentTypeJSON)
+		}
+		var envelope errorEnvelope
+		if err := json.Unmarshal(res.Body, &envelope); err != nil {
+			t.Fatalf("test %d (%v): failed to parse envelope: %v", i, tt.err, err)
+		}
+		if envelope.Error != tt.code || envelope.RequestID != req.ID || envelope.Message == "" {
+			t.Errorf("test %d (%v): envelope mismatch: have %+v, want code %s", i, tt.err, envelope, tt.code)
+		}
+	}
+	// Internal failures should not leak any details
+	want := `{"error":"InternalError","message":"internal server error","requestId":"request-id"}`
+	if res := errorResponse(req, errors.New("secret internals")); string(res.Body) != want {
+		t.Errorf("internal error envelope mismatch: have %s, want %s", res.Body, want)
+	}
+}
+
+// Tests that upstream rate limits tell the API client when to retry.
+func TestRateLimitResponse(t *testing.T) {
+	req := &Request{ID: "request-id"}
+
+	tests := []struct {
+		err   error
+		delay string
+	}{
+		{&client.APIError{Status: 429, RetryAfter: 1500 * time.Millisecond}, "2"},
+		{&client.APIError{Status: 429, RateLimit: &client.RateLimit{Reset: time.Now().Add(30*time.Second - time.Millisecond)}}, "30"},
+		{&client.APIError{Status: 429}, "60"},
+		{fmt.Errorf("stream: %w", client.ErrRateLimited), "60"},
+	}
+	for i, tt := range tests {
+		res := errorResponse(req, tt.err)
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("test %d: status mismatch: have %d, want %d", i, res.StatusCode, http.StatusTooManyRequests)
+		}
+		if delay := res.Header.Get("Retry-After"); delay != tt.delay {
+			t.Errorf("test %d: retry delay mismatch: have %s, want %s", i, delay, tt.delay)
+		}
+	}
+}
+
+// Tests that every response served through the API carries a content type and
+// the request identifier.
+func TestResponseHeaders(t *testing.T) {
+	_, api := makeTestAPI(t)
+
+	for _, path := range []string{"/profile/" + testHandle, "/profile/nobody.test", "/profile/bad_handle", "/nothing"} {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:     http.MethodGet,
+			Path:           path,
+			Headers:        map[string]string{"Authorization": "Bearer " + testAPIKey},
+			RequestContext: events.APIGatewayProxyRequestContext{RequestID: "gateway-id"},
+		})
+		if err != nil {
+			t.Fatalf("%s: handler failed: %v", path, err)
+		}
+		if ctype := res.Headers["Content-Type"]; ctype != contentTypeJSON {
+			t.Errorf("%s: content type mismatch: have %s, want %s", path, ctype, contentTypeJSON)
+		}
+		if id := res.Headers["X-Request-Id"]; id != "gateway-id" {
+			t.Errorf("%s: request id mismatch: have %s, want %s", path, id, "gateway-id")
+		}
+	}
+}
@@ -1,184 +1,373 @@
 package lambda
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-lambda-go/events"
 	"gophercon-2023-demo/blob"
 	"gophercon-2023-demo/client"
+	"image"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
-func GetProfile(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
+func GetProfile(ctx context.Context, client *client.Client, handle string) (*Response, error) {
 	log.Printf("Fetching profile for handle: %s\n", handle)
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	profileJson, err := json.Marshal(profile)
+	return jsonResponse(http.StatusOK, newProfileV1(profile))
+}
+
+// maxThumbnailSize is the largest thumbnail dimension the image endpoints accept.
+const maxThumbnailSize = 2048
+
+func GetAvatar(ctx context.Context, client *client.Client, handle string, query url.Values) (*Response, error) {
+	size, format, err := parseImageQuery(query)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
+	}
+	profile, err := client.FetchProfile(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ctype, err := profile.FetchAvatarData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageResponse(data, ctype, size, format)
+}
+
+func GetBanner(ctx context.Context, client *client.Client, handle string, query url.Values) (*Response, error) {
+	size, format, err := parseImageQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := client.FetchProfile(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ctype, err := profile.FetchBannerData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return imageResponse(data, ctype, size, format)
+}
+
+// parseImageQuery parses the optional ?size= and ?format= query parameters of the
+// image endpoints. Zero and empty mean the image is to be served as is.
+func parseImageQuery(query url.Values) (int, string, error) {
+	var size int
+	if value := query.Get("size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxThumbnailSize {
+			return 0, "", fmt.Errorf("%w: size must be between 1 and %d", errInvalidQuery, maxThumbnailSize)
+		}
+		size = n
+	}
+	format := strings.ToLower(query.Get("format"))
+	switch format {
+	case "", "png", "jpeg":
+	case "jpg":
+		format = "jpeg"
+	default:
+		return 0, "", fmt.Errorf("%w: format must be png or jpeg", errInvalidQuery)
 	}
+	return size, format, nil
+}
 
-	return events.APIGatewayProxyResponse{
+// imageResponse serves an encoded image, converting it to a thumbnail and/or a
+// different format if requested. If no conversion is needed, the original bytes
+// are served without decoding them.
+func imageResponse(data []byte, ctype string, size int, format string) (*Response, error) {
+	if size == 0 && (format == "" || ctype == "image/"+format) {
+		return &Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {ctype}},
+			Body:       data,
+		}, nil
+	}
+	img, original, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", client.ErrImageFormat, err)
+	}
+	if format == "" {
+		format = original
+		if format != "png" {
+			format = "jpeg"
+		}
+	}
+	data, err = client.EncodeImage(client.Thumbnail(img, size), format)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
 		StatusCode: http.StatusOK,
-		Body:       string(profileJson),
+		Header:     http.Header{"Content-Type": {"image/" + format}},
+		Body:       data,
 	}, nil
 }
 
-func GetAvatar(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
+func GetFollowersFull(ctx context.Context, client *client.Client, handle string) (*Response, error) {
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	err = profile.ResolveAvatar(ctx)
+	err = profile.ResolveFollowers(ctx)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	bounds, err := json.Marshal(profile.Avatar.Bounds())
+	return jsonResponse(http.StatusOK, newUsersV1(profile.Followers))
+}
+
+func GetFollowingFull(ctx context.Context, client *client.Client, handle string) (*Response, error) {
+	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	return events.APIGatewayProxyResponse{Body: string(bounds), StatusCode: http.StatusOK}, nil
+	err = profile.ResolveFollowing(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonResponse(http.StatusOK, newUsersV1(profile.Followees))
 }
 
-func GetBanner(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
-	//handle := request.PathParameters["handle"]
+func GetMutuals(ctx context.Context, client *client.Client, handle string) (*Response, error) {
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	err = profile.ResolveBanner(ctx)
+	mutuals, err := profile.FetchMutuals(ctx)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	response := events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       fmt.Sprintf("%v", profile.Banner.Bounds()),
+	return jsonResponse(http.StatusOK, newUsersV1(mutuals))
+}
+
+func GetFollowersOnly(ctx context.Context, client *client.Client, handle string) (*Response, error) {
+	profile, err := client.FetchProfile(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	followers, err := profile.FetchFollowersOnly(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return response, nil
+	return jsonResponse(http.StatusOK, newUsersV1(followers))
 }
 
-func GetFollowersFull(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
-	//handle, ok := request.PathParameters["handle"]
-	//if !ok {
-	//	return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
-	//}
+func GetFollowingOnly(ctx context.Context, client *client.Client, handle string) (*Response, error) {
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return nil, err
 	}
 
-	err = profile.ResolveFollowers(ctx)
+	followees, err := profile.FetchFollowingOnly(ctx)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return nil, err
 	}
 
-	jsonFollowers, _ := json.Marshal(profile.Followers)
-
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       string(jsonFollowers),
-	}, nil
+	return jsonResponse(http.StatusOK, newUsersV1(followees))
 }
 
-func GetFollowingFull(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
-	//handle, ok := request.PathParameters["handle"]
-	//if !ok {
-	//	return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
-	//}
-
+func GetFollowersSnapshot(ctx context.Context, client *client.Client, handle string) (*Response, error) {
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return nil, err
 	}
 
-	err = profile.ResolveFollowing(ctx)
+	snapshot, err := profile.SnapshotFollowers(ctx)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		return nil, err
 	}
 
-	jsonFollowers, _ := json.Marshal(profile.Followers)
-
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       string(jsonFollowers),
-	}, nil
+	return jsonResponse(http.StatusOK, newSnapshotV1(snapshot))
 }
 
-func GetFollowersShort(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
-	//handle := request.PathParameters["handle"]
+// DiffFollowers compares a previously taken follower snapshot, sent as the request
+// body, against the current followers of a user.
+func DiffFollowers(ctx context.Context, client *client.Client, handle string, body []byte) (*Response, error) {
+	older, err := parseSnapshotV1(body)
+	if err != nil {
+		return nil, err
+	}
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+		return nil, err
+	}
+	if older.DID != profile.DID {
+		return nil, fmt.Errorf("%w: snapshot of %s, not %s", errInvalidBody, older.DID, profile.DID)
 	}
 
-	followerc, errc := profile.StreamFollowers(ctx)
+	newer, err := profile.SnapshotFollowers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := newSnapshotDiffV1(older, newer)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := <-errc; err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+	return jsonResponse(http.StatusOK, diff)
+}
+
+// Page sizes of the paginated listing endpoints.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+	maxCursorLength  = 1024
+)
+
+func GetFollowers(ctx context.Context, client *client.Client, handle string, query url.Values) (*Response, error) {
+	return getUsersPage(ctx, handle, query, client.FetchFollowers)
+}
+
+func GetFollowing(ctx context.Context, client *client.Client, handle string, query url.Values) (*Response, error) {
+	return getUsersPage(ctx, handle, query, client.FetchFollowing)
+}
+
+// getUsersPage serves a single page of a user listing, as selected by the ?limit=
+// and ?cursor= query parameters.
+func getUsersPage(ctx context.Context, handle string, query url.Values, fetch func(ctx context.Context, id string, cursor string, limit int) ([]*client.User, string, error)) (*Response, error) {
+	limit, cursor, err := parsePageQuery(query)
+	if err != nil {
+		return nil, err
 	}
+	users, next, err := fetch(ctx, handle, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResponse(http.StatusOK, &UsersPageV1{Items: newUsersV1(users), Cursor: next})
+}
 
-	var followersName []string
-	for follower := range followerc {
-		followersName = append(followersName, follower.Name)
+// parsePageQuery parses the optional ?limit= and ?cursor= query parameters of the
+// paginated endpoints.
+func parsePageQuery(query url.Values) (int, string, error) {
+	limit := defaultPageLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			return 0, "", fmt.Errorf("%w: limit must be between 1 and %d", errInvalidQuery, maxPageLimit)
+		}
+		limit = n
 	}
+	cursor := query.Get("cursor")
+	if len(cursor) > maxCursorLength {
+		return 0, "", fmt.Errorf("%w: cursor too long", errInvalidQuery)
+	}
+	return limit, cursor, nil
+}
 
-	response, err := json.Marshal(followersName)
+func GetFollowersShort(ctx context.Context, client *client.Client, handle string, query url.Values) (*Response, error) {
+	fields, err := parseFieldsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error marshalling response"}, nil
+		return nil, err
 	}
 
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(response)}, nil
+	followerc, errc := profile.StreamFollowers(ctx)
+	return shortUsersResponse(followerc, errc, fields)
 }
 
-func GetFollowingShort(ctx context.Context, client *client.Client, handle string) (events.APIGatewayProxyResponse, error) {
+func GetFollowingShort(ctx context.Context, client *client.Client, handle string, query url.Values) (*Response, error) {
+	fields, err := parseFieldsQuery(query)
+	if err != nil {
+		return nil, err
+	}
 	profile, err := client.FetchProfile(ctx, handle)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+		return nil, err
 	}
 
-	followingFull, errc := profile.StreamFollowing(ctx)
+	followeec, errc := profile.StreamFollowing(ctx)
+	return shortUsersResponse(followeec, errc, fields)
+}
 
+// shortUsersResponse drains a user stream into a projected listing. The stream
+// must be fully consumed before waiting for its error, as the producer blocks
+// once the result channel's buffer fills up.
+func shortUsersResponse(userc <-chan *client.User, errc <-chan error, fields []string) (*Response, error) {
+	users := []map[string]string{}
+	for user := range userc {
+		users = append(users, newUserFieldsV1(user, fields))
+	}
 	if err := <-errc; err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: err.Error()}, nil
+		return nil, err
 	}
+	return jsonResponse(http.StatusOK, users)
+}
 
-	var followingName []string
-	for following := range followingFull {
-		followingName = append(followingName, following.Name)
+// parseFieldsQuery parses the optional ?fields= query parameter of the short
+// listings, a comma separated list of user fields to include. If omitted, all
+// the short fields are included.
+func parseFieldsQuery(query url.Values) ([]string, error) {
+	values, ok := query["fields"]
+	if !ok {
+		return userFieldsV1, nil
 	}
-
-	response, err := json.Marshal(followingName)
-	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "Error marshalling response"}, nil
+	var fields []string
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			if !isUserFieldV1(field) {
+				return nil, fmt.Errorf("%w: unknown field %q, must be one of %s", errInvalidQuery, field, strings.Join(userFieldsV1, ", "))
+			}
+			fields = append(fields, field)
+		}
 	}
-
-	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(response)}, nil
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: fields must not be empty", errInvalidQuery)
+	}
+	return fields, nil
 }
 
-func GetBlob(ctx context.Context, client *client.Client, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	did := request.PathParameters["did"]
-	cid := request.PathParameters["cid"]
+// blobs retrieves the blobs from the PDSes hosting them. It is shared across
+// requests, so that warm containers reuse the resolved DIDs.
+var blobs = blob.NewFetcher(string('.'))
 
-	blobRawResponse, err := blob.RetrieveBlob(string('.'), did, cid)
+func GetBlob(ctx context.Context, client *client.Client, did string, cid string) (*Response, error) {
+	blobRawResponse, err := blobs.RetrieveBlob(ctx, did, cid)
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
+		return nil, err
 	}
 
-	blobJSON, err := json.Marshal(blobRawResponse)
-	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, err
-	}
+	return jsonResponse(http.StatusOK, blobRawResponse)
+}
 
-	return events.APIGatewayProxyResponse{Body: string(blobJSON), StatusCode: http.StatusOK}, nil
+// routeInfo is a single entry of the generated route listing.
+type routeInfo struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Summary string `json:"summary"`
+}
+
+// GetRoutes lists all the routes served by the router.
+func GetRoutes(router *Router) (*Response, error) {
+	var listing []routeInfo
+	for _, route := range router.Routes() {
+		listing = append(listing, routeInfo{Method: route.Method, Path: route.Pattern, Summary: route.Summary})
+	}
+	return jsonResponse(http.StatusOK, listing)
 }
@@ -0,0 +1,440 @@
+package lambda
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gophercon-2023-demo/client/clienttest"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// makeTestJPEG creates a JPEG encoded image of the requested dimensions.
+func makeTestJPEG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Tests that the avatar and banner endpoints serve the actual images, converted
+// if requested, and base64 encoded for API Gateway.
+func TestImageEndpoints(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	avatar := makeTestJPEG(t, 64, 32)
+	srv.AddAccount(&clienttest.Account{Handle: "alice.test", DID: "did:plc:alice", Avatar: avatar})
+
+	tests := []struct {
+		path   string
+		query  map[string]string
+		status int
+		ctype  string
+		bounds image.Rectangle
+	}{
+		{"/avatar/alice.test", nil, http.StatusOK, "image/jpeg", image.Rect(0, 0, 64, 32)},
+		{"/avatar/alice.test", map[string]string{"size": "32"}, http.StatusOK, "image/jpeg", image.Rect(0, 0, 32, 16)},
+		{"/avatar/alice.test", map[string]string{"size": "128"}, http.StatusOK, "image/jpeg", image.Rect(0, 0, 64, 32)},
+		{"/avatar/alice.test", map[string]string{"format": "png"}, http.StatusOK, "image/png", image.Rect(0, 0, 64, 32)},
+		{"/avatar/alice.test", map[string]string{"size": "16", "format": "jpg"}, http.StatusOK, "image/jpeg", image.Rect(0, 0, 16, 8)},
+		{"/avatar/alice.test", map[string]string{"size": "0"}, http.StatusBadRequest, contentTypeJSON, image.Rectangle{}},
+		{"/avatar/alice.test", map[string]string{"size": "huge"}, http.StatusBadRequest, contentTypeJSON, image.Rectangle{}},
+		{"/avatar/alice.test", map[string]string{"format": "gif"}, http.StatusBadRequest, contentTypeJSON, image.Rectangle{}},
+		{"/banner/alice.test", nil, http.StatusNotFound, contentTypeJSON, image.Rectangle{}},
+		{"/avatar/" + testHandle, nil, http.StatusNotFound, contentTypeJSON, image.Rectangle{}},
+	}
+	for _, tt := range tests {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Path:                  tt.path,
+			QueryStringParameters: tt.query,
+			Headers:               map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%s %v: handler failed: %v", tt.path, tt.query, err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %v: status mismatch: have %d, want %d", tt.path, tt.query, res.StatusCode, tt.status)
+			continue
+		}
+		if ctype := res.Headers["Content-Type"]; ctype != tt.ctype {
+			t.Errorf("%s %v: content type mismatch: have %s, want %s", tt.path, tt.query, ctype, tt.ctype)
+		}
+		if tt.status != http.StatusOK {
+			if res.IsBase64Encoded {
+				t.Errorf("%s %v: error envelope base64 encoded", tt.path, tt.query)
+			}
+			continue
+		}
+		if !res.IsBase64Encoded {
+			t.Fatalf("%s %v: image not base64 encoded", tt.path, tt.query)
+		}
+		data, err := base64.StdEncoding.DecodeString(res.Body)
+		if err != nil {
+			t.Fatalf("%s %v: failed to decode base64 body: %v", tt.path, tt.query, err)
+		}
+		if tt.query == nil && !bytes.Equal(data, avatar) {
+			t.Errorf("%s %v: unconverted image modified", tt.path, tt.query)
+		}
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s %v: failed to decode image: %v", tt.path, tt.query, err)
+		}
+		if "image/"+format != tt.ctype {
+			t.Errorf("%s %v: image format mismatch: have %s, want %s", tt.path, tt.query, format, tt.ctype)
+		}
+		if img.Bounds() != tt.bounds {
+			t.Errorf("%s %v: image bounds mismatch: have %v, want %v", tt.path, tt.query, img.Bounds(), tt.bounds)
+		}
+	}
+	// The standalone server should serve the raw bytes without any encoding
+	req := httptest.NewRequest(http.MethodGet, "/avatar/alice.test?format=png", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("server status mismatch: have %d, want %d", rec.Code, http.StatusOK)
+	}
+	if _, err := png.Decode(rec.Body); err != nil {
+		t.Errorf("failed to decode served image: %v", err)
+	}
+}
+
+// Tests that the paginated follow endpoints page through the full lists.
+func TestFollowPageEndpoints(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	srv.AddAccount(&clienttest.Account{Handle: "alice.test", DID: "did:plc:alice"})
+	for i := 0; i < 120; i++ {
+		did := fmt.Sprintf("did:plc:user%03d", i)
+		srv.AddAccount(&clienttest.Account{Handle: fmt.Sprintf("user%03d.test", i), DID: did})
+		srv.AddFollow(did, "did:plc:alice")
+		if i < 7 {
+			srv.AddFollow("did:plc:alice", did)
+		}
+	}
+	tests := []struct {
+		path  string
+		limit string
+		want  int
+		pages int
+	}{
+		{"/followers/alice.test", "50", 120, 3},
+		{"/followers/alice.test", "", 120, 3},
+		{"/followers/alice.test", "100", 120, 2},
+		{"/following/alice.test", "5", 7, 2},
+		{"/following/alice.test", "", 7, 1},
+	}
+	for _, tt := range tests {
+		var (
+			cursor string
+			pages  int
+			seen   = make(map[string]bool)
+		)
+		for {
+			query := map[string]string{"cursor": cursor}
+			if tt.limit != "" {
+				query["limit"] = tt.limit
+			}
+			res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod:            http.MethodGet,
+				Path:                  tt.path,
+				QueryStringParameters: query,
+				Headers:               map[string]string{"Authorization": "Bearer " + testAPIKey},
+			})
+			if err != nil {
+				t.Fatalf("%s: handler failed: %v", tt.path, err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status mismatch: have %d, want %d: %s", tt.path, res.StatusCode, http.StatusOK, res.Body)
+			}
+			var page UsersPageV1
+			if err := json.Unmarshal([]byte(res.Body), &page); err != nil {
+				t.Fatalf("%s: failed to parse page: %v", tt.path, err)
+			}
+			for _, user := range page.Items {
+				if seen[user.DID] {
+					t.Errorf("%s: duplicate user %s", tt.path, user.DID)
+				}
+				seen[user.DID] = true
+			}
+			pages++
+			if page.Cursor == "" {
+				break
+			}
+			cursor = page.Cursor
+		}
+		if len(seen) != tt.want {
+			t.Errorf("%s?limit=%s: user count mismatch: have %d, want %d", tt.path, tt.limit, len(seen), tt.want)
+		}
+		if pages != tt.pages {
+			t.Errorf("%s?limit=%s: page count mismatch: have %d, want %d", tt.path, tt.limit, pages, tt.pages)
+		}
+	}
+	// Malformed paging parameters should be rejected
+	for _, query := range []map[string]string{{"limit": "0"}, {"limit": "101"}, {"limit": "many"}, {"cursor": "bogus"}} {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Path:                  "/followers/alice.test",
+			QueryStringParameters: query,
+			Headers:               map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%v: handler failed: %v", query, err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: status mismatch: have %d, want %d", query, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// Tests that the short listings drain streams larger than a single page, and
+// that they can be projected onto a subset of the fields.
+func TestShortEndpoints(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	srv.AddAccount(&clienttest.Account{Handle: "alice.test", DID: "did:plc:alice"})
+	for i := 0; i < 1200; i++ {
+		did := fmt.Sprintf("did:plc:user%04d", i)
+		srv.AddAccount(&clienttest.Account{Handle: fmt.Sprintf("user%04d.test", i), DID: did})
+		srv.AddFollow(did, "did:plc:alice")
+		if i%2 == 0 {
+			srv.AddFollow("did:plc:alice", did)
+		}
+	}
+	tests := []struct {
+		path   string
+		fields string
+		want   int
+		keys   []string
+	}{
+		{"/followers/short/alice.test", "", 1200, []string{"handle", "did", "displayName"}},
+		{"/following/short/alice.test", "", 600, []string{"handle", "did", "displayName"}},
+		{"/followers/short/alice.test", "did", 1200, []string{"did"}},
+		{"/following/short/alice.test", "handle,displayName", 600, []string{"handle", "displayName"}},
+	}
+	for _, tt := range tests {
+		query := map[string]string{}
+		if tt.fields != "" {
+			query["fields"] = tt.fields
+		}
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Path:                  tt.path,
+			QueryStringParameters: query,
+			Headers:               map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%s?fields=%s: handler failed: %v", tt.path, tt.fields, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s?fields=%s: status mismatch: have %d, want %d: %s", tt.path, tt.fields, res.StatusCode, http.StatusOK, res.Body)
+		}
+		var users []map[string]string
+		if err := json.Unmarshal([]byte(res.Body), &users); err != nil {
+			t.Fatalf("%s?fields=%s: failed to parse listing: %v", tt.path, tt.fields, err)
+		}
+		if len(users) != tt.want {
+			t.Errorf("%s?fields=%s: user count mismatch: have %d, want %d", tt.path, tt.fields, len(users), tt.want)
+		}
+		for _, user := range users {
+			if len(user) != len(tt.keys) {
+				t.Errorf("%s?fields=%s: field count mismatch: have %v, want %v", tt.path, tt.fields, user, tt.keys)
+				break
+			}
+			for _, key := range tt.keys {
+				if _, ok := user[key]; !ok {
+					t.Errorf("%s?fields=%s: field %q missing: %v", tt.path, tt.fields, key, user)
+				}
+			}
+		}
+	}
+	// Unknown or empty projections should be rejected
+	for _, fields := range []string{"avatarUrl", "did,bogus", ","} {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:            http.MethodGet,
+			Path:                  "/followers/short/alice.test",
+			QueryStringParameters: map[string]string{"fields": fields},
+			Headers:               map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%q: handler failed: %v", fields, err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status mismatch: have %d, want %d", fields, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// Tests that the relation endpoints split the social graph correctly.
+func TestRelationEndpoints(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	srv.AddAccount(&clienttest.Account{Handle: "alice.test", DID: "did:plc:alice"})
+	for i := 0; i < 9; i++ {
+		did := fmt.Sprintf("did:plc:user%d", i)
+		srv.AddAccount(&clienttest.Account{Handle: fmt.Sprintf("user%d.test", i), DID: did})
+		if i < 6 {
+			srv.AddFollow(did, "did:plc:alice")
+		}
+		if i >= 3 {
+			srv.AddFollow("did:plc:alice", did)
+		}
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/followers/mutuals/alice.test", []string{"did:plc:user3", "did:plc:user4", "did:plc:user5"}},
+		{"/followers/unreciprocated/alice.test", []string{"did:plc:user0", "did:plc:user1", "did:plc:user2"}},
+		{"/following/unreciprocated/alice.test", []string{"did:plc:user6", "did:plc:user7", "did:plc:user8"}},
+		{"/followers/mutuals/bot.test", []string{}},
+	}
+	for _, tt := range tests {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: http.MethodGet,
+			Path:       tt.path,
+			Headers:    map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%s: handler failed: %v", tt.path, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status mismatch: have %d, want %d: %s", tt.path, res.StatusCode, http.StatusOK, res.Body)
+		}
+		var users []*UserV1
+		if err := json.Unmarshal([]byte(res.Body), &users); err != nil {
+			t.Fatalf("%s: failed to parse listing: %v", tt.path, err)
+		}
+		if users == nil {
+			t.Errorf("%s: listing encoded as null", tt.path)
+		}
+		have := make([]string, 0, len(users))
+		for _, user := range users {
+			have = append(have, user.DID)
+		}
+		if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: users mismatch: have %v, want %v", tt.path, have, tt.want)
+		}
+	}
+}
+
+// Tests that a follower snapshot can be taken, stored by the API client and sent
+// back later to diff against the current followers.
+func TestFollowersDiffEndpoint(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	srv.AddAccount(&clienttest.Account{Handle: "alice.test", DID: "did:plc:alice"})
+	for i := 0; i < 5; i++ {
+		did := fmt.Sprintf("did:plc:user%d", i)
+		srv.AddAccount(&clienttest.Account{Handle: fmt.Sprintf("user%d.test", i), DID: did})
+		srv.AddFollow(did, "did:plc:alice")
+	}
+	call := func(method string, path string, body string, base64ed bool) events.APIGatewayProxyResponse {
+		t.Helper()
+
+		if base64ed {
+			body = base64.StdEncoding.EncodeToString([]byte(body))
+		}
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:      method,
+			Path:            path,
+			Headers:         map[string]string{"Authorization": "Bearer " + testAPIKey},
+			Body:            body,
+			IsBase64Encoded: base64ed,
+		})
+		if err != nil {
+			t.Fatalf("%s %s: handler failed: %v", method, path, err)
+		}
+		return res
+	}
+	res := call(http.MethodGet, "/followers/snapshot/alice.test", "", false)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot status mismatch: have %d, want %d: %s", res.StatusCode, http.StatusOK, res.Body)
+	}
+	var snapshot SnapshotV1
+	if err := json.Unmarshal([]byte(res.Body), &snapshot); err != nil {
+		t.Fatalf("failed to parse snapshot: %v", err)
+	}
+	if snapshot.DID != "did:plc:alice" || len(snapshot.Users) != 5 {
+		t.Fatalf("snapshot mismatch: have %s with %d users, want %s with %d", snapshot.DID, len(snapshot.Users), "did:plc:alice", 5)
+	}
+	// Pretend user0 followed since, user1 renamed and someone since unfollowed
+	snapshot.Users = snapshot.Users[1:]
+	snapshot.Users[0].Handle = "old-user1.test"
+	snapshot.Users = append(snapshot.Users, &SnapshotUserV1{DID: "did:plc:gone", Handle: "gone.test"})
+
+	body, _ := json.Marshal(&snapshot)
+	for _, base64ed := range []bool{false, true} {
+		res = call(http.MethodPost, "/followers/diff/alice.test", string(body), base64ed)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("diff status mismatch: have %d, want %d: %s", res.StatusCode, http.StatusOK, res.Body)
+		}
+		var diff SnapshotDiffV1
+		if err := json.Unmarshal([]byte(res.Body), &diff); err != nil {
+			t.Fatalf("failed to parse diff: %v", err)
+		}
+		if len(diff.Added) != 1 || diff.Added[0].DID != "did:plc:user0" {
+			t.Errorf("added followers mismatch: have %v, want [did:plc:user0]", diff.Added)
+		}
+		if len(diff.Removed) != 1 || diff.Removed[0].DID != "did:plc:gone" {
+			t.Errorf("removed followers mismatch: have %v, want [did:plc:gone]", diff.Removed)
+		}
+		if !diff.Since.Equal(snapshot.Taken) {
+			t.Errorf("diff start mismatch: have %v, want %v", diff.Since, snapshot.Taken)
+		}
+	}
+	// Malformed or foreign snapshots should be rejected
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodPost, "/followers/diff/alice.test", "", http.StatusBadRequest},
+		{http.MethodPost, "/followers/diff/alice.test", "not json", http.StatusBadRequest},
+		{http.MethodPost, "/followers/diff/alice.test", `{"users": []}`, http.StatusBadRequest},
+		{http.MethodPost, "/followers/diff/alice.test", `{"did": "did:plc:alice", "users": [{"handle": "x.test"}]}`, http.StatusBadRequest},
+		{http.MethodPost, "/followers/diff/bot.test", string(body), http.StatusBadRequest},
+		{http.MethodPost, "/followers/diff/alice.test", strings.Repeat(" ", maxRequestBodyBytes+1), http.StatusRequestEntityTooLarge},
+		{http.MethodGet, "/followers/diff/alice.test", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if res := call(tt.method, tt.path, tt.body, false); res.StatusCode != tt.want {
+			t.Errorf("%s %s (%d bytes): status mismatch: have %d, want %d: %s", tt.method, tt.path, len(tt.body), res.StatusCode, tt.want, res.Body)
+		}
+	}
+	// Bodies flagged as base64 but failing to decode should not reach the handler
+	res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod:      http.MethodPost,
+		Path:            "/followers/diff/alice.test",
+		Headers:         map[string]string{"Authorization": "Bearer " + testAPIKey},
+		Body:            "!!!not base64",
+		IsBase64Encoded: true,
+	})
+	if err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad base64 status mismatch: have %d, want %d: %s", res.StatusCode, http.StatusBadRequest, res.Body)
+	}
+	var envelope errorEnvelope
+	if err := json.Unmarshal([]byte(res.Body), &envelope); err != nil || envelope.Error != codeBadRequest || !strings.Contains(envelope.Message, "base64") {
+		t.Errorf("bad base64 envelope mismatch: have %s (%v)", res.Body, err)
+	}
+}
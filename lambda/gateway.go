@@ -0,0 +1,114 @@
+package lambda
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HandleAPIGateway is the AWS Lambda front-end of the API, serving requests that
+// arrive through an API Gateway proxy integration.
+func (a *API) HandleAPIGateway(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Printf("Request: %+v\n", RedactRequest(request))
+
+	req, err := newGatewayRequest(request)
+	if err != nil {
+		log.Printf("Rejected request: %v", err)
+		return newGatewayResponse(finishResponse(req, errorResponse(req, err))), nil
+	}
+	return newGatewayResponse(a.Serve(ctx, req)), nil
+}
+
+// newGatewayRequest converts an API Gateway proxy request into a transport neutral
+// one. API Gateway may deliver headers in any case and in both single and multi
+// value form, so they are merged and canonicalized.
+//
+// If the body cannot be decoded, an error is returned along with the partially
+// converted request, so that the failure can still be answered.
+func newGatewayRequest(request events.APIGatewayProxyRequest) (*Request, error) {
+	req := &Request{
+		Method: request.HTTPMethod,
+		Path:   request.Path,
+		Header: make(http.Header),
+		Query:  make(url.Values),
+		ID:     request.RequestContext.RequestID,
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	for name, values := range request.MultiValueHeaders {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	for name, value := range request.Headers {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+	for name, values := range request.MultiValueQueryStringParameters {
+		req.Query[name] = append(req.Query[name], values...)
+	}
+	for name, value := range request.QueryStringParameters {
+		if !req.Query.Has(name) {
+			req.Query.Set(name, value)
+		}
+	}
+	if request.Body != "" {
+		req.Body = []byte(request.Body)
+		if request.IsBase64Encoded {
+			body, err := base64.StdEncoding.DecodeString(request.Body)
+			if err != nil {
+				return req, fmt.Errorf("%w: bad base64 encoding: %v", errInvalidBody, err)
+			}
+			req.Body = body
+		}
+	}
+	return req, nil
+}
+
+// newGatewayResponse converts a transport neutral response into an API Gateway
+// proxy response.
+func newGatewayResponse(res *Response) events.APIGatewayProxyResponse {
+	out := events.APIGatewayProxyResponse{
+		StatusCode: res.StatusCode,
+		Body:       string(res.Body),
+	}
+	// API Gateway can only carry binary data (e.g. images) base64 encoded
+	if len(res.Body) > 0 && !isTextContent(res.Header.Get("Content-Type")) {
+		out.Body = base64.StdEncoding.EncodeToString(res.Body)
+		out.IsBase64Encoded = true
+	}
+	for name, values := range res.Header {
+		if len(values) == 0 {
+			continue
+		}
+		if out.Headers == nil {
+			out.Headers = make(map[string]string)
+		}
+		out.Headers[name] = values[0]
+		if len(values) > 1 {
+			if out.MultiValueHeaders == nil {
+				out.MultiValueHeaders = make(map[string][]string)
+			}
+			out.MultiValueHeaders[name] = values
+		}
+	}
+	return out
+}
+
+// isTextContent reports whether a content type is textual, and thus can be sent
+// through API Gateway without encoding.
+func isTextContent(ctype string) bool {
+	mediatype, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediatype, "text/") || mediatype == "application/json" || strings.HasSuffix(mediatype, "+json")
+}
@@ -0,0 +1,109 @@
+package lambda
+
+import (
+	"bytes"
+	"github.com/aws/aws-lambda-go/events"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// redacted is the placeholder replacing secrets in log output.
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are the request headers that carry credentials, whose values
+// must never be logged.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "X-Api-Key"}
+
+// RedactRequest returns a copy of an API Gateway request with all the credential
+// carrying headers replaced, suitable for logging.
+func RedactRequest(request events.APIGatewayProxyRequest) events.APIGatewayProxyRequest {
+	request.Headers = redactHeaders(request.Headers)
+	request.MultiValueHeaders = redactMultiHeaders(request.MultiValueHeaders)
+	return request
+}
+
+// redactHeaders returns a copy of a single valued header map with the sensitive
+// headers replaced. Header names are matched case insensitively, since API
+// Gateway may lowercase them.
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	safe := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if isSensitiveHeader(name) {
+			value = redacted
+		}
+		safe[name] = value
+	}
+	return safe
+}
+
+// redactMultiHeaders returns a copy of a multi valued header map with the
+// sensitive headers replaced.
+func redactMultiHeaders(headers map[string][]string) map[string][]string {
+	if headers == nil {
+		return nil
+	}
+	safe := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		if isSensitiveHeader(name) {
+			values = []string{redacted}
+		}
+		safe[name] = values
+	}
+	return safe
+}
+
+// isSensitiveHeader reports whether a header carries credentials.
+func isSensitiveHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, sensitive := range sensitiveHeaders {
+		if name == sensitive {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactingWriter is an io.Writer that replaces a set of known secrets with a
+// placeholder before forwarding the data to an underlying writer. It is meant to
+// wrap the output of a log.Logger as a last line of defense, so that a secret
+// accidentally formatted into a log line never makes it out of the process.
+//
+// The writer assumes that every write is a self contained message (which holds
+// for the standard logger), so secrets split across writes are not caught.
+type RedactingWriter struct {
+	out     io.Writer // Underlying writer to forward the redacted data to
+	secrets [][]byte  // Secrets to replace in the written data
+	lock    sync.Mutex
+}
+
+// NewRedactingWriter creates a writer that redacts the given secrets.
+func NewRedactingWriter(out io.Writer, secrets ...string) *RedactingWriter {
+	w := &RedactingWriter{out: out}
+	for _, secret := range secrets {
+		if secret != "" {
+			w.secrets = append(w.secrets, []byte(secret))
+		}
+	}
+	return w
+}
+
+// Write implements io.Writer, redacting the secrets from the data.
+func (w *RedactingWriter) Write(data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	safe := data
+	for _, secret := range w.secrets {
+		if bytes.Contains(safe, secret) {
+			safe = bytes.ReplaceAll(safe, secret, []byte(redacted))
+		}
+	}
+	if _, err := w.out.Write(safe); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
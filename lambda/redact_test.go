@@ -0,0 +1,50 @@
+package lambda
+
+import (
+	"bytes"
+	"github.com/aws/aws-lambda-go/events"
+	"log"
+	"testing"
+)
+
+// Tests that credential carrying headers are redacted from logged requests
+// without modifying the original request.
+func TestRedactRequest(t *testing.T) {
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{
+			"authorization": "Bearer secret",
+			"Accept":        "application/json",
+		},
+		MultiValueHeaders: map[string][]string{
+			"Authorization": {"Bearer secret"},
+			"X-API-KEY":     {"secret"},
+		},
+	}
+	safe := RedactRequest(request)
+
+	if have := safe.Headers["authorization"]; have != redacted {
+		t.Errorf("authorization header mismatch: have %q, want %q", have, redacted)
+	}
+	if have := safe.Headers["Accept"]; have != "application/json" {
+		t.Errorf("accept header mismatch: have %q, want %q", have, "application/json")
+	}
+	for _, name := range []string{"Authorization", "X-API-KEY"} {
+		if have := safe.MultiValueHeaders[name]; len(have) != 1 || have[0] != redacted {
+			t.Errorf("%s multi header mismatch: have %q, want %q", name, have, redacted)
+		}
+	}
+	if have := request.Headers["authorization"]; have != "Bearer secret" {
+		t.Errorf("original request modified: have %q, want %q", have, "Bearer secret")
+	}
+}
+
+// Tests that the redacting writer strips secrets from log output.
+func TestRedactingWriter(t *testing.T) {
+	out := new(bytes.Buffer)
+	logger := log.New(NewRedactingWriter(out, "hunter2", "", "s3cr3t"), "", 0)
+
+	logger.Printf("Logging in with %s and %s, then %s again", "hunter2", "s3cr3t", "hunter2")
+	if have, want := out.String(), "Logging in with [REDACTED] and [REDACTED], then [REDACTED] again\n"; have != want {
+		t.Errorf("log output mismatch: have %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,227 @@
+package lambda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"gophercon-2023-demo/client"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ParamType is the type of a path parameter, determining which values it accepts
+// and how they are normalized before being handed to a handler.
+type ParamType string
+
+const (
+	ParamString ParamType = "string" // Any non-empty path segment
+	ParamActor  ParamType = "actor"  // Bluesky handle or DID, optionally prefixed with @
+	ParamDID    ParamType = "did"    // Decentralized identifier
+	ParamCID    ParamType = "cid"    // IPFS content identifier
+)
+
+var (
+	// handleRegexp is the syntax of a Bluesky handle: a DNS name with at least
+	// two labels and an alphabetic top level domain.
+	handleRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	// didRegexp is the syntax of a DID: a method name followed by a method
+	// specific identifier.
+	didRegexp = regexp.MustCompile(`^did:[a-z]+:[a-zA-Z0-9._:%-]*[a-zA-Z0-9._-]$`)
+)
+
+// parse validates a raw path parameter value against the type, returning its
+// normalized form.
+func (t ParamType) parse(value string) (string, bool) {
+	switch t {
+	case ParamActor:
+		value = strings.TrimPrefix(value, "@")
+		if didRegexp.MatchString(value) {
+			return value, true
+		}
+		if len(value) <= 253 && handleRegexp.MatchString(value) {
+			return strings.ToLower(value), true
+		}
+		return "", false
+	case ParamDID:
+		return value, didRegexp.MatchString(value)
+	case ParamCID:
+		if _, err := cid.Decode(value); err != nil {
+			return "", false
+		}
+		return value, true
+	default:
+		return value, value != ""
+	}
+}
+
+// HandlerFunc is an API endpoint implementation, invoked with the logged in
+// Bluesky client and the request carrying the typed path parameters.
+type HandlerFunc func(ctx context.Context, client *client.Client, req *Request) (*Response, error)
+
+// Route is a single endpoint of the API. The pattern is a slash separated list
+// of literal segments and typed parameters in the form {name:type}, where the
+// type defaults to string if omitted (e.g. "/blob/{did:did}/{cid:cid}").
+type Route struct {
+	Method  string      // HTTP method the route accepts
+	Pattern string      // Path pattern the route matches
+	Summary string      // Human readable description for the route listing
+	Handler HandlerFunc // Implementation of the endpoint
+	Offline bool        // Whether the endpoint can be served without a Bluesky client
+
+	segments []segment // Parsed path pattern
+}
+
+// segment is a single element of a parsed path pattern, either a literal or a
+// typed parameter.
+type segment struct {
+	literal string    // Literal path segment to match, empty for parameters
+	param   string    // Name of the path parameter, empty for literals
+	typ     ParamType // Type of the path parameter
+}
+
+var (
+	// errRouteNotFound is returned by the router if no route matches the path.
+	errRouteNotFound = errors.New("route not found")
+)
+
+// methodNotAllowedError is returned by the router if some routes match the path,
+// but none of them accepts the request method.
+type methodNotAllowedError struct {
+	allow []string // Methods accepted on the path, sorted
+}
+
+// Error implements the error interface.
+func (e *methodNotAllowedError) Error() string {
+	return fmt.Sprintf("method not allowed, allowed: %s", strings.Join(e.allow, ", "))
+}
+
+// paramError is returned by the router if a route matches the path, but one of
+// the parameters is not a valid value of its type.
+type paramError struct {
+	name  string    // Name of the invalid parameter
+	value string    // Raw value of the invalid parameter
+	typ   ParamType // Type the parameter failed to parse as
+}
+
+// Error implements the error interface.
+func (e *paramError) Error() string {
+	return fmt.Sprintf("invalid %s parameter %q: %q", e.typ, e.name, e.value)
+}
+
+// Router dispatches requests to a declarative table of routes.
+type Router struct {
+	routes []*Route
+}
+
+// newRouter parses the patterns of the routes and creates a router from them.
+// Malformed patterns are programming errors, so they panic.
+func newRouter(routes []Route) *Router {
+	router := new(Router)
+	for i := range routes {
+		route := routes[i]
+		if !strings.HasPrefix(route.Pattern, "/") {
+			panic(fmt.Sprintf("route %s %s: pattern must start with /", route.Method, route.Pattern))
+		}
+		for _, part := range strings.Split(strings.Trim(route.Pattern, "/"), "/") {
+			if !strings.HasPrefix(part, "{") {
+				route.segments = append(route.segments, segment{literal: part})
+				continue
+			}
+			if !strings.HasSuffix(part, "}") {
+				panic(fmt.Sprintf("route %s %s: malformed parameter %s", route.Method, route.Pattern, part))
+			}
+			name, typ, ok := strings.Cut(part[1:len(part)-1], ":")
+			if !ok {
+				typ = string(ParamString)
+			}
+			switch ParamType(typ) {
+			case ParamString, ParamActor, ParamDID, ParamCID:
+			default:
+				panic(fmt.Sprintf("route %s %s: unknown parameter type %s", route.Method, route.Pattern, typ))
+			}
+			route.segments = append(route.segments, segment{param: name, typ: ParamType(typ)})
+		}
+		router.routes = append(router.routes, &route)
+	}
+	return router
+}
+
+// Routes returns the routes served by the router, in declaration order.
+func (r *Router) Routes() []Route {
+	routes := make([]Route, len(r.routes))
+	for i, route := range r.routes {
+		routes[i] = *route
+	}
+	return routes
+}
+
+// match finds the route accepting a request, returning the typed parameters
+// extracted from the path.
+func (r *Router) match(method string, path string) (*Route, map[string]string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	var (
+		allow []string
+		perr  error
+	)
+	for _, route := range r.routes {
+		params, err := route.match(parts)
+		if params == nil && err == nil {
+			continue
+		}
+		if route.Method != method {
+			allow = append(allow, route.Method)
+			continue
+		}
+		if err != nil {
+			perr = err
+			continue
+		}
+		return route, params, nil
+	}
+	switch {
+	case perr != nil:
+		return nil, nil, perr
+	case len(allow) > 0:
+		sort.Strings(allow)
+		return nil, nil, &methodNotAllowedError{allow: allow}
+	default:
+		return nil, nil, errRouteNotFound
+	}
+}
+
+// match checks whether the path segments match the route's pattern, returning
+// the typed parameters if so. If the path matches structurally but some of the
+// parameters are invalid, a paramError is returned.
+func (r *Route) match(parts []string) (map[string]string, error) {
+	if len(parts) != len(r.segments) {
+		return nil, nil
+	}
+	var (
+		params = make(map[string]string)
+		perr   error
+	)
+	for i, seg := range r.segments {
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, nil
+			}
+			continue
+		}
+		value, ok := seg.typ.parse(parts[i])
+		if !ok {
+			if perr == nil {
+				perr = &paramError{name: seg.param, value: parts[i], typ: seg.typ}
+			}
+			continue
+		}
+		params[seg.param] = value
+	}
+	if perr != nil {
+		return nil, perr
+	}
+	return params, nil
+}
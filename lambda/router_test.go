@@ -0,0 +1,122 @@
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Tests that API Gateway requests are routed by exact path and method, with the
+// appropriate failure statuses.
+func TestRouterDispatch(t *testing.T) {
+	_, api := makeTestAPI(t)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, "/profile/" + testHandle, http.StatusOK, ""},
+		{http.MethodGet, "/profile/@" + testHandle + "/", http.StatusOK, ""},
+		{http.MethodGet, "/profile/did:plc:bot", http.StatusOK, ""},
+		{http.MethodGet, "/profile", http.StatusNotFound, ""},
+		{http.MethodGet, "/profile/" + testHandle + "/extra", http.StatusNotFound, ""},
+		{http.MethodGet, "/followers/fullxyz/" + testHandle, http.StatusNotFound, ""},
+		{http.MethodGet, "/profilexyz/" + testHandle, http.StatusNotFound, ""},
+		{http.MethodPost, "/profile/" + testHandle, http.StatusMethodNotAllowed, "GET"},
+		{http.MethodDelete, "/routes", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/profile/not_a_handle", http.StatusBadRequest, ""},
+		{http.MethodGet, "/profile/localhost", http.StatusBadRequest, ""},
+		{http.MethodGet, "/blob/did:plc:bot/not-a-cid", http.StatusBadRequest, ""},
+		{http.MethodGet, "/blob/not-a-did/bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: tt.method,
+			Path:       tt.path,
+			Headers:    map[string]string{"Authorization": "Bearer " + testAPIKey},
+		})
+		if err != nil {
+			t.Fatalf("%s %s: handler failed: %v", tt.method, tt.path, err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %s: status mismatch: have %d, want %d", tt.method, tt.path, res.StatusCode, tt.status)
+		}
+		if allow := res.Headers["Allow"]; allow != tt.allow {
+			t.Errorf("%s %s: allow header mismatch: have %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+}
+
+// Tests that path parameters are extracted and normalized by their types.
+func TestRouterParams(t *testing.T) {
+	tests := []struct {
+		path   string
+		params map[string]string
+	}{
+		{"/profile/Bot.Test", map[string]string{"actor": "bot.test"}},
+		{"/profile/@did:plc:bot", map[string]string{"actor": "did:plc:bot"}},
+		{"/blob/did:web:example.com/bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", map[string]string{
+			"did": "did:web:example.com",
+			"cid": "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku",
+		}},
+	}
+	for _, tt := range tests {
+		_, params, err := routes.match(http.MethodGet, tt.path)
+		if err != nil {
+			t.Fatalf("%s: failed to match route: %v", tt.path, err)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s: params mismatch: have %v, want %v", tt.path, params, tt.params)
+		}
+	}
+}
+
+// Tests that the route listing is generated from the route table.
+func TestRouteListing(t *testing.T) {
+	srv, api := makeTestAPI(t)
+
+	res, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodGet,
+		Path:       "/routes",
+		Headers:    map[string]string{"Authorization": "Bearer " + testAPIKey},
+	})
+	if err != nil {
+		t.Fatalf("handler failed: %v", err)
+	}
+	var listing []routeInfo
+	if err := json.Unmarshal([]byte(res.Body), &listing); err != nil {
+		t.Fatalf("failed to parse listing: %v", err)
+	}
+	if len(listing) != len(routes.Routes()) {
+		t.Fatalf("listing size mismatch: have %d, want %d", len(listing), len(routes.Routes()))
+	}
+	for i, route := range routes.Routes() {
+		want := routeInfo{Method: route.Method, Path: route.Pattern, Summary: route.Summary}
+		if listing[i] != want {
+			t.Errorf("route %d: listing mismatch: have %+v, want %+v", i, listing[i], want)
+		}
+	}
+	if calls := srv.Calls("com.atproto.server.describeServer"); calls != 0 {
+		t.Errorf("server contacted for offline route: %d dials", calls)
+	}
+}
+
+// Tests that malformed route patterns are rejected when building the router.
+func TestRouterMalformedPattern(t *testing.T) {
+	for _, pattern := range []string{"profile/{actor}", "/profile/{actor", "/profile/{actor:unknown}"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: malformed pattern accepted", pattern)
+				}
+			}()
+			newRouter([]Route{{Method: http.MethodGet, Pattern: pattern}})
+		}()
+	}
+}
@@ -0,0 +1,102 @@
+package lambda
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout is the maximum time to wait for in-flight requests to finish
+// when shutting down the standalone HTTP server.
+const shutdownTimeout = 30 * time.Second
+
+// ServeHTTP is the net/http front-end of the API, allowing it to run as a
+// standalone server instead of behind API Gateway.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Request: %s %s\n", r.Method, r.URL.Path)
+
+	// Read one byte past the limit, so that oversized bodies are rejected instead
+	// of silently truncated
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodyBytes+1))
+	if err != nil {
+		log.Printf("Failed to read request body: %v", err)
+	}
+	res := a.Serve(r.Context(), &Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header,
+		Query:  r.URL.Query(),
+		Body:   body,
+		ID:     requestID(r),
+	})
+	for name, values := range res.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if len(res.Body) > 0 {
+		w.Write(res.Body)
+	}
+}
+
+// ListenAndServe runs the API as a standalone HTTP server on the given address
+// until the context is cancelled, at which point the server is gracefully shut
+// down: no new connections are accepted and in-flight requests are given some
+// time to finish.
+func (a *API) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return a.serveListener(ctx, listener)
+}
+
+// serveListener runs the API on an already open listener until the context is
+// cancelled.
+func (a *API) serveListener(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           a,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("Serving API on %s\n", listener.Addr())
+		errc <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down API server\n")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// requestID returns the identifier of an HTTP request, reusing the one set by a
+// fronting proxy if any, or generating a random one otherwise.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
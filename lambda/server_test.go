@@ -0,0 +1,127 @@
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gophercon-2023-demo/client/clienttest"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Tests that the standalone HTTP server and the API Gateway adapter serve the
+// same requests identically.
+func TestServerParity(t *testing.T) {
+	_, api := makeTestAPI(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- api.serveListener(ctx, listener) }()
+	defer func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	}()
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		body   string
+	}{
+		{http.MethodGet, "/profile/" + testHandle, "Bearer " + testAPIKey, ""},
+		{http.MethodGet, "/profile/nobody.test", "Bearer " + testAPIKey, ""},
+		{http.MethodGet, "/profile/" + testHandle, "Bearer wrong", ""},
+		{http.MethodGet, "/unknown/" + testHandle, "Bearer " + testAPIKey, ""},
+		{http.MethodPost, "/followers/diff/" + testHandle, "Bearer " + testAPIKey, `{"did": "did:plc:bot", "users": [{}]}`},
+		{http.MethodPost, "/followers/diff/" + testHandle, "Bearer " + testAPIKey, strings.Repeat(" ", maxRequestBodyBytes+1)},
+	}
+	for i, tt := range tests {
+		id := fmt.Sprintf("request-%d", i)
+		want, err := api.HandleAPIGateway(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod:     tt.method,
+			Path:           tt.path,
+			Headers:        map[string]string{"authorization": tt.auth},
+			Body:           tt.body,
+			RequestContext: events.APIGatewayProxyRequestContext{RequestID: id},
+		})
+		if err != nil {
+			t.Fatalf("%s: gateway handler failed: %v", tt.path, err)
+		}
+		req, _ := http.NewRequest(tt.method, "http://"+listener.Addr().String()+tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", tt.auth)
+		req.Header.Set("X-Request-Id", id)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: server request failed: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != want.StatusCode {
+			t.Errorf("%s: status mismatch: have %d, want %d", tt.path, res.StatusCode, want.StatusCode)
+		}
+		if string(body) != want.Body {
+			t.Errorf("%s: body mismatch: have %s, want %s", tt.path, body, want.Body)
+		}
+		if ctype := res.Header.Get("Content-Type"); ctype != want.Headers["Content-Type"] {
+			t.Errorf("%s: content type mismatch: have %s, want %s", tt.path, ctype, want.Headers["Content-Type"])
+		}
+	}
+}
+
+// Tests that cancelling the context shuts the server down, letting in-flight
+// requests finish.
+func TestServerShutdown(t *testing.T) {
+	srv, api := makeTestAPI(t)
+	srv.InjectFault("app.bsky.actor.getProfile", &clienttest.Fault{
+		Status: http.StatusBadRequest,
+		Error:  "InvalidRequest",
+		Delay:  500 * time.Millisecond,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open listener: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- api.serveListener(ctx, listener) }()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/profile/"+testHandle, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+	resc := make(chan int, 1)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			resc <- 0
+			return
+		}
+		res.Body.Close()
+		resc <- res.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	if err := <-errc; err != nil {
+		t.Fatalf("server shutdown failed: %v", err)
+	}
+	if status := <-resc; status != http.StatusBadRequest {
+		t.Errorf("in-flight request status mismatch: have %d, want %d", status, http.StatusBadRequest)
+	}
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Errorf("request served after shutdown")
+	}
+}
@@ -2,67 +2,45 @@ package main
 
 import (
 	"context"
-	"github.com/aws/aws-lambda-go/events"
+	"flag"
 	"github.com/aws/aws-lambda-go/lambda"
-	"gophercon-2023-demo/client"
 	bskyImpl "gophercon-2023-demo/lambda"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-var (
-	blueskyHandle = "golangkorea.bsky.social"
-	blueskyAppkey = "DEMO"
-)
+var addrFlag = flag.String("addr", ":8080", "Address to serve the API on when not running inside AWS Lambda")
 
 func main() {
-	lambda.Start(handleRequest)
-}
-
-func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	log.Printf("Request: %+v\n", request)
-	authHeader := request.Headers["Authorization"]
-	authParts := strings.Split(authHeader, " ")
+	flag.Parse()
 
-	if len(authParts) != 2 || authParts[0] != "Bearer" || authParts[1] != blueskyAppkey {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusUnauthorized}, nil
-	}
-
-	client, err := client.Dial(ctx, client.ServerBskySocial)
+	config, err := bskyImpl.LoadConfig()
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	log.Printf("Logging in with handle: %s, appkey: %s\n", blueskyHandle, blueskyAppkey)
+	// Make sure none of the configured secrets can ever leak into the logs
+	log.SetOutput(bskyImpl.NewRedactingWriter(os.Stderr, config.Secrets()...))
 
-	err = client.Login(ctx, blueskyHandle, blueskyAppkey)
+	api, err := bskyImpl.NewAPI(config, new(http.Client))
 	if err != nil {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+		log.Fatalf("Failed to create API: %v", err)
 	}
-
-	handle := request.PathParameters["handle"]
-	if handle == "" {
-		handle = request.PathParameters["proxy"]
+	// The Lambda runtime always sets its API endpoint, use that to detect whether
+	// to run as a function or as a standalone server
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		lambda.StartWithOptions(api.HandleAPIGateway, lambda.WithEnableSIGTERM(func() {
+			api.Close()
+		}))
+		return
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	switch {
-	case strings.HasPrefix(request.Path, "/profile"):
-		return bskyImpl.GetProfile(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/avatar"):
-		return bskyImpl.GetAvatar(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/banner"):
-		return bskyImpl.GetBanner(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/followers/full"):
-		return bskyImpl.GetFollowersFull(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/following/full"):
-		return bskyImpl.GetFollowingFull(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/followers/short"):
-		return bskyImpl.GetFollowersShort(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/following/short"):
-		return bskyImpl.GetFollowingShort(ctx, client, handle)
-	case strings.HasPrefix(request.Path, "/blob"):
-		return bskyImpl.GetBlob(ctx, client, request)
-	default:
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound}, nil
+	if err := api.ListenAndServe(ctx, *addrFlag); err != nil {
+		log.Fatalf("Failed to serve API: %v", err)
 	}
+	api.Close()
 }